@@ -1,222 +1,342 @@
-package main
+// Package dht is a Kademlia distributed hash table node. The dht command
+// in cmd/dht runs nodes, and package dhtsim whole networks of them in
+// memory for tests and experiments, see Simulated.
+package dht
 
 import (
 	"crypto/md5"
 	"fmt"
 	"math/big"
-	"math/rand"
 	"sort"
 	"time"
 )
 
 const (
 	BucketSize = 16
+	Alpha      = 3
+	IDBits     = 128
 )
 
 type Peer struct {
-	id      string
-	buckets []Bucket
-	dht     DHT
+	id        string
+	addr      string
+	addrs     []string      // multiaddrs of every endpoint, if it listed them
+	rtt       time.Duration // zero until the peer has answered us
+	rttvar    time.Duration // mean deviation of rtt
+	suspicion float64       // phi accrued since the last answer
+	seen      time.Time     // last exchange in either direction
+	added     time.Time     // first added to the routing table
+
+	deflate bool        // accepts compressed values
+	record  *nodeRecord // signed by the peer, if it sent one
+
+	version  int // negotiated protocol version, zero before the handshake
+	features []string
+	vnodes   int // virtual nodes it claims on the ring, if it said
 }
 
+func (p *Peer) ID() string {
+	return p.id
+}
+
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Addrs returns the multiaddrs of every endpoint the peer listed, if it
+// did.
+func (p *Peer) Addrs() []string {
+	return p.addrs
+}
+
+// Bucket holds up to k contacts, least recently seen first. Peers seen
+// while it is full wait in replacements, most recent last, until a contact
+// is removed, as in section 4.1 of the Kademlia paper.
 type Bucket struct {
-	nodes []*Peer
+	nodes        []*Peer
+	replacements []*Peer
 }
 
+// DHT is a binary trie over ID bits. Leaves are k-buckets; only the leaf on
+// our own ID's path ever splits, so every other leaf holds the peers at one
+// XOR distance bit length, as in the Kademlia paper.
 type DHT struct {
-	buckets []Bucket
+	self       *Peer
+	root       *trieNode
+	size       int
+	bucketSize int
+	banned     map[string]bool
+
+	bucketSubnet, tableSubnet int // contacts per subnet, see diversity.go
+
+	removed func(p *Peer) // told of every contact dropped, if set
 }
 
-func NewDHT() *DHT {
-	return &DHT{buckets: []Bucket{}}
+// trieNode is either a leaf with a bucket or an inner node whose children
+// split on bit depth of the ID.
+type trieNode struct {
+	depth    int
+	children [2]*trieNode
+	bucket   *Bucket
 }
 
-func (d *DHT) setValue(key string, value string) bool {
-	hash := d.hashValue(key)
+func newRoutingTable(self *Peer, bucketSize int) *DHT {
+	return &DHT{self: self, root: &trieNode{bucket: &Bucket{}}, bucketSize: bucketSize}
+}
 
-	if key != hash {
-		return false
-	}
+func (d *DHT) findOwnNode() *Peer {
+	return d.self
+}
 
-	ownNode := d.findOwnNode()
-	if ownNode != nil && ownNode.dht.containsKey(key) {
-		return true
-	}
+func (d *DHT) distance(id1 string, id2 string) *big.Int {
+	num1 := new(big.Int)
+	num1.SetString(id1, 16)
+	num2 := new(big.Int)
+	num2.SetString(id2, 16)
+	return new(big.Int).Xor(num1, num2)
+}
 
-	if ownNode != nil {
-		ownNode.dht.setValue(key, value)
-	}
+// bucketIndex is the bit length of the XOR distance between us and id.
+func (d *DHT) bucketIndex(id string) int {
+	return distanceBits(d.self.id, id)
+}
 
-	nearestNodes := d.findNearestNodes(key)
-	for _, node := range nearestNodes {
-		node.dht.setValue(key, value)
+// distanceBits is the bit length of the XOR distance between a and b.
+func distanceBits(a, b string) int {
+	for i := 0; i < IDBits; i++ {
+		if idBit(a, i) != idBit(b, i) {
+			return IDBits - i
+		}
 	}
-
-	return true
+	return 0
 }
 
-func (d *DHT) getValue(key string) string {
-	ownNode := d.findOwnNode()
-	if ownNode != nil && ownNode.dht.containsKey(key) {
-		return ownNode.dht.getValue(key)
+// leaf returns the trie leaf whose prefix id falls under.
+func (d *DHT) leaf(id string) *trieNode {
+	t := d.root
+	for t.bucket == nil {
+		t = t.children[idBit(id, t.depth)]
 	}
+	return t
+}
 
-	nearestNodes := d.findNearestNodes(key)
-	for _, node := range nearestNodes {
-		value := node.dht.getValue(key)
-		if value != "" {
-			return value
-		}
+// split turns leaf t into an inner node, keeping each bucket in the order
+// its contacts were last seen.
+func (t *trieNode) split() {
+	for i := range t.children {
+		t.children[i] = &trieNode{depth: t.depth + 1, bucket: &Bucket{}}
 	}
-
-	return ""
+	for _, node := range t.bucket.nodes {
+		child := t.children[idBit(node.id, t.depth)].bucket
+		child.nodes = append(child.nodes, node)
+	}
+	for _, node := range t.bucket.replacements {
+		child := t.children[idBit(node.id, t.depth)].bucket
+		child.replacements = append(child.replacements, node)
+	}
+	t.bucket = nil
 }
 
-func (d *DHT) containsKey(key string) bool {
-	for _, bucket := range d.buckets {
-		for _, peer := range bucket.nodes {
-			if peer.id == key {
+// addPeer records p as the most recently seen contact in its bucket. It
+// reports false when p is banned or over its subnet's limit, or when the
+// bucket is already full, in which case p is kept as a replacement.
+func (d *DHT) addPeer(p *Peer) bool {
+	if d.banned[p.id] || p.id == d.self.id {
+		return false
+	}
+	for {
+		t := d.leaf(p.id)
+		bucket := t.bucket
+		for i, node := range bucket.nodes {
+			if node.id == p.id {
+				bucket.nodes = append(bucket.nodes[:i], bucket.nodes[i+1:]...)
+				bucket.nodes = append(bucket.nodes, p)
 				return true
 			}
 		}
+		if !d.diverse(p) {
+			return false
+		}
+		if len(bucket.nodes) < d.bucketSize {
+			bucket.nodes = append(bucket.nodes, p)
+			d.size++
+			return true
+		}
+		if t != d.leaf(d.self.id) || t.depth >= IDBits {
+			bucket.addReplacement(p, d.bucketSize)
+			return false
+		}
+		t.split()
 	}
-
-	return false
 }
 
-func (d *DHT) findOwnNode() *Peer {
-	if len(d.buckets) == 0 || len(d.buckets[0].nodes) == 0 {
-		return nil
+func (b *Bucket) addReplacement(p *Peer, limit int) {
+	b.dropReplacement(p.id)
+	b.replacements = append(b.replacements, p)
+	if len(b.replacements) > limit {
+		b.replacements = b.replacements[1:]
 	}
-	return d.buckets[0].nodes[0] // Assuming the first node in the first bucket is the own node
 }
 
-func (d *DHT) findNearestNodes(key string) []*Peer {
-	ownNode := d.findOwnNode()
-	if ownNode == nil {
-		return []*Peer{}
-	}
-
-	distanceToKey := d.calculateDistance(ownNode.id, key)
-
-	allNodes := make([]*Peer, 0)
-	for _, bucket := range d.buckets {
-		allNodes = append(allNodes, bucket.nodes...)
+func (b *Bucket) dropReplacement(id string) {
+	for i, node := range b.replacements {
+		if node.id == id {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
 	}
+}
 
-	sortedNodes := make([]*Peer, len(allNodes))
-	copy(sortedNodes, allNodes)
-	d.sortPeerSlice(sortedNodes, func(p1, p2 *Peer) bool {
-		distanceA := d.calculateDistance(p1.id, key)
-		distanceB := d.calculateDistance(p2.id, key)
-		if distanceA != distanceB {
-			return distanceA < distanceB
+// removePeer drops id from its bucket and promotes the most recently seen
+// replacement, if any, into the freed slot.
+func (d *DHT) removePeer(id string) bool {
+	bucket := d.leaf(id).bucket
+	bucket.dropReplacement(id)
+	for i, node := range bucket.nodes {
+		if node.id == id {
+			bucket.nodes = append(bucket.nodes[:i], bucket.nodes[i+1:]...)
+			d.size--
+			if d.removed != nil {
+				d.removed(node)
+			}
+			for len(bucket.replacements) > 0 {
+				last := len(bucket.replacements) - 1
+				p := bucket.replacements[last]
+				bucket.replacements = bucket.replacements[:last]
+				if !d.banned[p.id] && d.diverse(p) {
+					bucket.nodes = append(bucket.nodes, p)
+					d.size++
+					break
+				}
+			}
+			return true
 		}
-		return p1.id < p2.id
-	})
+	}
+	return false
+}
 
-	nearestNodes := make([]*Peer, 0)
-	for _, node := range sortedNodes {
-		distance := d.calculateDistance(node.id, key)
-		if distance <= distanceToKey {
-			nearestNodes = append(nearestNodes, node)
+func (d *DHT) findPeer(id string) *Peer {
+	for _, node := range d.leaf(id).bucket.nodes {
+		if node.id == id {
+			return node
 		}
 	}
-
-	return nearestNodes[:min(2, len(nearestNodes))]
+	return nil
 }
 
-func (d *DHT) calculateDistance(id1 string, id2 string) int {
-	num1 := new(big.Int)
-	num1.SetString(id1, 16)
-	num2 := new(big.Int)
-	num2.SetString(id2, 16)
-	distance := new(big.Int).Xor(num1, num2)
-	return int(distance.Int64())
+func (d *DHT) ban(id string) {
+	if d.banned == nil {
+		d.banned = make(map[string]bool)
+	}
+	d.banned[id] = true
+	d.removePeer(id)
 }
 
-func (d *DHT) hashValue(value string) string {
-	hash := md5.Sum([]byte(value))
-	return fmt.Sprintf("%x", hash)
+// closest returns up to count known peers ordered by XOR distance to target,
+// never including the own node. It walks the trie towards target first:
+// everything under the child matching target's next bit is closer than
+// anything under its sibling, so only the leaves visited need sorting.
+func (d *DHT) closest(target string, count int) []*Peer {
+	return d.closestWhere(target, count, nil)
 }
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
-
-	nodes := make([]*Peer, 0)
-	// Initialize buckets for the peer
-	// Initialize 100 nodes
-	for i := 0; i < 100; i++ {
-		peer := &Peer{
-			id:      fmt.Sprintf("%d", i),
-			buckets: make([]Bucket, 0),
-			dht:     *NewDHT(),
+// closestWhere is closest restricted to the peers keep accepts; a nil keep
+// accepts every peer.
+func (d *DHT) closestWhere(target string, count int, keep func(*Peer) bool) []*Peer {
+	nodes := make([]*Peer, 0, min(count, d.size))
+	var walk func(t *trieNode)
+	walk = func(t *trieNode) {
+		if len(nodes) >= count {
+			return
 		}
-
-		for j := 0; j < 160; j += BucketSize {
-			bucket := Bucket{nodes: make([]*Peer, 0)}
-			for k := 0; k < BucketSize; k++ {
-				if i*160+j+k >= 100*160 {
-					continue
-				}
-				neighbor := &Peer{
-					id:      fmt.Sprintf("%d", i*160+j+k),
-					buckets: make([]Bucket, 0),
-					dht:     *NewDHT(),
+		if t.bucket != nil {
+			start := len(nodes)
+			for _, p := range t.bucket.nodes {
+				if keep == nil || keep(p) {
+					nodes = append(nodes, p)
 				}
-				bucket.nodes = append(bucket.nodes, neighbor)
 			}
-			peer.buckets = append(peer.buckets, bucket)
+			d.sortByDistance(nodes[start:], target)
+			nodes = nodes[:min(count, len(nodes))]
+			return
 		}
-		nodes = append(nodes, peer)
+		b := idBit(target, t.depth)
+		walk(t.children[b])
+		walk(t.children[1-b])
 	}
+	walk(d.root)
+	return nodes
+}
 
-	// Generate 200 random keys and values
-	keys := make([]string, 0)
-	for i := 0; i < 200; i++ {
-		key := generateRandomString()
-		value := generateRandomString()
-		keys = append(keys, key)
-		randomNodeIndex := rand.Intn(len(nodes))
-		randomNode := nodes[randomNodeIndex]
-		randomNode.dht.setValue(key, value)
+func (d *DHT) sortByDistance(nodes []*Peer, target string) {
+	d.sortPeerSlice(nodes, func(p1, p2 *Peer) bool {
+		if c := compareDistance(p1.id, p2.id, target); c != 0 {
+			return c < 0
+		}
+		return p1.id < p2.id
+	})
+}
+
+// buckets returns the trie's leaves from the farthest from us to our own.
+func (d *DHT) buckets() []*Bucket {
+	buckets := make([]*Bucket, 0)
+	t := d.root
+	for t.bucket == nil {
+		own := idBit(d.self.id, t.depth)
+		buckets = append(buckets, t.children[1-own].bucket)
+		t = t.children[own]
 	}
+	return append(buckets, t.bucket)
+}
 
-	// Select 100 random keys and perform getValue operation
-	selectedKeys := selectRandomElements(keys, 100)
-	for _, key := range selectedKeys {
-		randomNodeIndex := rand.Intn(len(nodes))
-		randomNode := nodes[randomNodeIndex]
-		value := randomNode.dht.getValue(key)
-		fmt.Printf("Key: %s, Value: %s\n", key, value)
+func (d *DHT) peers() []*Peer {
+	nodes := make([]*Peer, 0, d.size)
+	for _, bucket := range d.buckets() {
+		nodes = append(nodes, bucket.nodes...)
 	}
+	return nodes
 }
 
-func generateRandomString() string {
-	length := getRandomInt(5, 10)
-	result := make([]byte, length)
-	characters := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	for i := 0; i < length; i++ {
-		randomIndex := rand.Intn(len(characters))
-		result[i] = characters[randomIndex]
+// compareDistance compares the XOR distances of a and b to target one hex
+// digit at a time.
+func compareDistance(a, b, target string) int {
+	for i := 0; i < IDBits/4; i++ {
+		t := hexDigit(target, i)
+		x, y := hexDigit(a, i)^t, hexDigit(b, i)^t
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
 	}
-	return string(result)
+	return 0
 }
 
-func getRandomInt(min int, max int) int {
-	return rand.Intn(max-min+1) + min
+func idBit(id string, i int) int {
+	return int(hexDigit(id, i/4)>>(3-i%4)) & 1
 }
 
-func selectRandomElements(arr []string, count int) []string {
-	shuffled := make([]string, len(arr))
-	copy(shuffled, arr)
-	i := len(arr)
-	for i > 0 {
-		randomIndex := rand.Intn(i)
-		i--
-		shuffled[i], shuffled[randomIndex] = shuffled[randomIndex], shuffled[i]
+// hexDigit returns the value of the i-th hex digit of id, treating missing
+// or malformed digits as zero.
+func hexDigit(id string, i int) byte {
+	if i >= len(id) {
+		return 0
 	}
-	return shuffled[:min(count, len(shuffled))]
+	switch c := id[i]; {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+func (d *DHT) hashValue(value string) string {
+	hash := md5.Sum([]byte(value))
+	return fmt.Sprintf("%x", hash)
 }
 
 func (d *DHT) sortPeerSlice(nodes []*Peer, by func(p1, p2 *Peer) bool) {
@@ -244,3 +364,17 @@ func min(x, y int) int {
 	}
 	return y
 }
+
+func min64(x, y time.Duration) time.Duration {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func abs64(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// With adaptive_lookups, how many peers a lookup queries at once and how
+// long it waits for a round follow the network, in the manner of TCP's
+// congestion window. Alpha starts at the configured value and, while
+// rounds come back without losses, grows by one per answer up to the
+// threshold and by one per round after that, to at most twice alpha or k.
+// A round that loses a peer halves it, to no fewer than one, and sets the
+// threshold there. A round waits for its calls, retries and all, for the
+// smoothed round trip time plus four times its variance, between
+// minHopTimeout and the RPC timeout.
+const minHopTimeout = 50 * time.Millisecond
+
+// lookupWindow is the adaptive alpha and the round trip estimate. It is
+// guarded by the node's mutex.
+type lookupWindow struct {
+	size      float64
+	threshold float64
+	srtt      time.Duration
+	rttvar    time.Duration
+}
+
+// alpha is how many peers the next lookup round queries. n.mu must be
+// held.
+func (n *Node) alpha() int {
+	if !n.cfg.AdaptiveLookups || n.window.size == 0 {
+		return n.cfg.Alpha
+	}
+	return int(n.window.size)
+}
+
+func (n *Node) maxAlpha() float64 {
+	return float64(min(2*n.cfg.Alpha, n.cfg.K))
+}
+
+// hopContext bounds one lookup round by the adaptive hop timeout.
+func (n *Node) hopContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if !n.cfg.AdaptiveLookups {
+		return ctx, func() {}
+	}
+	n.mu.Lock()
+	w := n.window
+	n.mu.Unlock()
+	if w.srtt == 0 {
+		return ctx, func() {}
+	}
+	timeout := max(w.srtt+4*w.rttvar, minHopTimeout)
+	if n.cfg.Timeouts.RPC > 0 {
+		timeout = min64(timeout, n.cfg.Timeouts.RPC)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// observeRound adapts the window to the replies of one lookup round.
+// Calls cancelled because another peer had the value count for nothing.
+func (n *Node) observeRound(replies []reply) {
+	if !n.cfg.AdaptiveLookups {
+		return
+	}
+	answered, lost := 0, 0
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	w := &n.window
+	for _, r := range replies {
+		var remote *remoteError
+		switch {
+		case r.err == nil || errors.As(r.err, &remote):
+			answered++
+			if w.srtt == 0 {
+				w.srtt, w.rttvar = r.rtt, r.rtt/2
+			} else {
+				w.rttvar = (3*w.rttvar + (w.srtt - r.rtt).Abs()) / 4
+				w.srtt = (7*w.srtt + r.rtt) / 8
+			}
+		case errors.Is(r.err, context.Canceled):
+		default:
+			lost++
+		}
+	}
+	if w.size == 0 {
+		w.size, w.threshold = float64(n.cfg.Alpha), n.maxAlpha()
+	}
+	switch {
+	case lost > 0:
+		w.threshold = max(w.size/2, 1)
+		w.size = w.threshold
+	case w.size < w.threshold:
+		w.size = math.Min(w.size+float64(answered), w.threshold)
+	default:
+		w.size = math.Min(w.size+1, n.maxAlpha())
+	}
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"strings"
+)
+
+// storeCipher returns the AEAD that seals spilled record files, or nil if
+// encrypt_store is off. The key comes from store_key_file when set, for
+// secrets a KMS agent drops on disk, and otherwise from the identity
+// passphrase. Since the disk tier never outlives the process, a node
+// without either still encrypts, under a random key held only in memory.
+func storeCipher(cfg Config) (cipher.AEAD, error) {
+	if !cfg.EncryptStore {
+		return nil, nil
+	}
+	key, err := storeKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func storeKey(cfg Config) ([]byte, error) {
+	if cfg.StoreKeyFile != "" {
+		secret, err := os.ReadFile(cfg.StoreKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(strings.TrimRight(string(secret), "\r\n")))
+		return sum[:], nil
+	}
+	passphrase, err := identityPassphrase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// A fresh salt every start is fine, nothing sealed before survives.
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	if passphrase == "" {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key, nil
+	}
+	return pbkdf2.Key(sha256.New, passphrase, salt, identityIterations, 32)
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// Every RPC's bytes, as encoded, are counted against the peer at the other
+// end and against its message type: a request we answer as received and
+// our reply as sent, a request we make as sent and its reply as received,
+// against the peer that replied. The counts cover the last
+// bandwidthWindow, kept in bandwidthSlots slots that roll over one at a
+// time. With limits.peer_bandwidth set, requests from a peer whose traffic
+// over the window averages more bytes a second than that are dropped,
+// like those over its request rate, except pings and find_node requests
+// so the peer stays in our routing table.
+const (
+	bandwidthWindow = time.Minute
+	bandwidthSlots  = 6
+	bandwidthSlot   = bandwidthWindow / bandwidthSlots
+)
+
+// trafficTotals are the bytes counted over the last bandwidthWindow.
+type trafficTotals struct {
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+type trafficSlot struct {
+	epoch          int64 // which bandwidthSlot since the Unix epoch
+	sent, received int64
+}
+
+// rollingTraffic is one peer's or message type's traffic.
+type rollingTraffic struct {
+	slots [bandwidthSlots]trafficSlot
+	last  int64 // epoch of the latest slot counted into
+}
+
+func slotEpoch(now time.Time) int64 {
+	return now.UnixNano() / int64(bandwidthSlot)
+}
+
+func (r *rollingTraffic) add(epoch int64, sent, received int) {
+	s := &r.slots[epoch%bandwidthSlots]
+	if s.epoch != epoch {
+		*s = trafficSlot{epoch: epoch}
+	}
+	s.sent += int64(sent)
+	s.received += int64(received)
+	r.last = max(r.last, epoch)
+}
+
+func (r *rollingTraffic) total(epoch int64) trafficTotals {
+	var t trafficTotals
+	for _, s := range r.slots {
+		if s.epoch > epoch-bandwidthSlots && s.epoch <= epoch {
+			t.Sent += s.sent
+			t.Received += s.received
+		}
+	}
+	return t
+}
+
+// bandwidthMeter counts traffic by peer ID and by message type.
+type bandwidthMeter struct {
+	mu    sync.Mutex
+	peers map[string]*rollingTraffic
+	types map[string]*rollingTraffic
+	swept int64
+}
+
+func newBandwidthMeter() *bandwidthMeter {
+	return &bandwidthMeter{peers: make(map[string]*rollingTraffic), types: make(map[string]*rollingTraffic)}
+}
+
+func (b *bandwidthMeter) add(now time.Time, peer, typ string, sent, received int) {
+	epoch := slotEpoch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if epoch-b.swept >= bandwidthSlots {
+		for id, r := range b.peers {
+			if r.last <= epoch-bandwidthSlots {
+				delete(b.peers, id)
+			}
+		}
+		b.swept = epoch
+	}
+	for _, m := range []struct {
+		counts map[string]*rollingTraffic
+		key    string
+	}{{b.peers, peer}, {b.types, typ}} {
+		if m.key == "" {
+			continue
+		}
+		r := m.counts[m.key]
+		if r == nil {
+			r = new(rollingTraffic)
+			m.counts[m.key] = r
+		}
+		r.add(epoch, sent, received)
+	}
+}
+
+// peer returns the traffic with one peer.
+func (b *bandwidthMeter) peer(now time.Time, id string) trafficTotals {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r := b.peers[id]; r != nil {
+		return r.total(slotEpoch(now))
+	}
+	return trafficTotals{}
+}
+
+// totals returns the traffic of every peer and message type seen in the
+// window.
+func (b *bandwidthMeter) totals(now time.Time) (peers, types map[string]trafficTotals) {
+	epoch := slotEpoch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peers = make(map[string]trafficTotals, len(b.peers))
+	for id, r := range b.peers {
+		if t := r.total(epoch); t != (trafficTotals{}) {
+			peers[id] = t
+		}
+	}
+	types = make(map[string]trafficTotals, len(b.types))
+	for typ, r := range b.types {
+		if t := r.total(epoch); t != (trafficTotals{}) {
+			types[typ] = t
+		}
+	}
+	return peers, types
+}
+
+// overBudget reports whether the peer's traffic over the window exceeds
+// budget bytes a second. A zero budget is no limit.
+func (b *bandwidthMeter) overBudget(now time.Time, id string, budget int) bool {
+	if budget <= 0 {
+		return false
+	}
+	t := b.peer(now, id)
+	return t.Sent+t.Received > int64(budget)*int64(bandwidthWindow/time.Second)
+}
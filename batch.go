@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// Writes to one peer are pipelined: the first packet goes out at once and
+// messages queued for the peer while it is being written follow in the
+// same datagram as a JSON array, demultiplexed by RPC ID on the other side
+// like any other message. Nothing waits to be batched, so a lone request
+// costs no extra latency, while concurrent lookups that keep hitting the
+// same peer share syscalls and headers. Only peers that announced
+// featureBatch in their hello are sent arrays; everyone else gets the
+// queued messages one datagram each.
+//
+// Pings and find_node requests and their replies jump the queue: what is
+// waiting of them goes out before any other message, and a writer draining
+// a long queue checks for them between batches. Heavy store and value
+// traffic to a peer then does not hold up the liveness checks and lookups
+// that keep routing tables healthy.
+const (
+	featureBatch     = "batch"
+	maxBatchSize     = 32
+	maxQueuedPerPeer = 256
+)
+
+type peerQueue struct {
+	control [][]byte // sent first, see controlMessage
+	pending [][]byte
+}
+
+// controlMessage reports whether m keeps the routing table healthy and so
+// takes priority over data in the send queue.
+func controlMessage(m *message) bool {
+	return m.Type == msgPing || m.Type == msgFindNode
+}
+
+// decodePacket parses a packet holding either one message or a batch.
+func decodePacket(data []byte) ([]*message, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*message{msg}, nil
+	}
+	if len(data) > maxPacketSize {
+		return nil, errors.New("packet too large")
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 || len(raw) > maxBatchSize {
+		return nil, errors.New("bad batch size")
+	}
+	msgs := make([]*message, 0, len(raw))
+	for _, r := range raw {
+		msg, err := decodeMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// learnBatching remembers the peers that can take batches, from their
+// hello, for as long as they keep sending us anything.
+func (t *udpTransport) learnBatching(from netip.AddrPort, msg *message) {
+	announced := msg.Hello != nil && hasFeature(msg.Hello.Features, featureBatch)
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, known := t.batchers[from]; !known && !announced {
+		return
+	}
+	if now.Sub(t.batchSwept) > peerIdle {
+		for addr, seen := range t.batchers {
+			if now.Sub(seen) > peerIdle {
+				delete(t.batchers, addr)
+			}
+		}
+		t.batchSwept = now
+	}
+	if _, ok := t.batchers[from]; ok || len(t.batchers) < maxPeerAddrs {
+		t.batchers[from] = now
+	}
+}
+
+// write sends one encoded message to addr, or queues it behind the write
+// already in progress to addr and leaves it to that writer. With the queue
+// full it writes the message itself.
+func (t *udpTransport) write(data []byte, addr netip.AddrPort, control bool) error {
+	t.mu.Lock()
+	if q, busy := t.queues[addr]; busy {
+		queued := len(q.control)+len(q.pending) < maxQueuedPerPeer
+		if queued && control {
+			q.control = append(q.control, append([]byte(nil), data...))
+		} else if queued {
+			q.pending = append(q.pending, append([]byte(nil), data...))
+		}
+		t.mu.Unlock()
+		if !queued {
+			_, err := t.writeTo(data, addr)
+			return err
+		}
+		return nil
+	}
+	q := &peerQueue{}
+	t.queues[addr] = q
+	t.mu.Unlock()
+
+	_, err := t.writeTo(data, addr)
+	for {
+		t.mu.Lock()
+		// All control messages waiting, else one batch of data, so any
+		// control message queued meanwhile is next.
+		var pending [][]byte
+		if len(q.control) > 0 {
+			pending, q.control = q.control, nil
+		} else {
+			count := min(len(q.pending), maxBatchSize)
+			pending, q.pending = q.pending[:count:count], q.pending[count:]
+		}
+		if len(pending) == 0 {
+			delete(t.queues, addr)
+			t.mu.Unlock()
+			return err
+		}
+		_, batching := t.batchers[addr]
+		t.mu.Unlock()
+		t.flush(pending, addr, batching)
+	}
+}
+
+// flush writes queued messages, as few batches as fit in a packet each
+// when the peer takes them.
+func (t *udpTransport) flush(pending [][]byte, addr netip.AddrPort, batching bool) {
+	if !batching {
+		for _, data := range pending {
+			t.writeTo(data, addr)
+		}
+		return
+	}
+	buf := packetPool.Get().(*bytes.Buffer)
+	defer releasePacket(buf)
+	for len(pending) > 0 {
+		buf.Reset()
+		buf.WriteByte('[')
+		count := 0
+		for count < len(pending) && count < maxBatchSize {
+			if count > 0 && buf.Len()+len(pending[count])+2 > maxPacketSize {
+				break
+			}
+			if count > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(pending[count])
+			count++
+		}
+		buf.WriteByte(']')
+		t.writeTo(buf.Bytes(), addr)
+		pending = pending[count:]
+	}
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+var benchSizes = []int{1000, 10000, 100000}
+
+func randomIDs(rng *rand.Rand, count int) []string {
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = newNodeID(rng)
+	}
+	return ids
+}
+
+func BenchmarkRoutingTableInsert(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	ids := randomIDs(rng, 4096)
+	self := &Peer{id: newNodeID(rng)}
+	d := newRoutingTable(self, BucketSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := ids[i%len(ids)]
+		d.addPeer(&Peer{id: id})
+		if i%len(ids) == len(ids)-1 {
+			d = newRoutingTable(self, BucketSize)
+		}
+	}
+}
+
+func BenchmarkRoutingTableClosest(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("seen=%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			d := newRoutingTable(&Peer{id: newNodeID(rng)}, BucketSize)
+			for _, id := range randomIDs(rng, size) {
+				d.addPeer(&Peer{id: id})
+			}
+			targets := randomIDs(rng, 256)
+			b.ReportMetric(float64(len(d.peers())), "contacts")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.closest(targets[i%len(targets)], BucketSize)
+			}
+		})
+	}
+}
+
+func BenchmarkSortByDistance(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	d := newRoutingTable(&Peer{id: newNodeID(rng)}, BucketSize)
+	peers := make([]*Peer, 0, 512)
+	for _, id := range randomIDs(rng, 512) {
+		peers = append(peers, &Peer{id: id})
+	}
+	target := newNodeID(rng)
+	scratch := make([]*Peer, len(peers))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(scratch, peers)
+		d.sortByDistance(scratch, target)
+	}
+}
+
+// benchNetwork wires size simulated nodes together directly instead of
+// bootstrapping each one, which would dominate the run at these sizes.
+// Every node learns its neighbours in ID order plus, for each bucket, the
+// node numerically closest to a random ID in that bucket's range, which
+// approximates the table a real join would have built.
+func benchNetwork(size int) *dhtsim.Simulation {
+	newNode := Simulated(DefaultConfig())
+	sim := dhtsim.New(newNode, 1)
+	for i := 0; i < size; i++ {
+		sim.Add(newNode(sim.Network(), sim.Clock(), sim.Rand()))
+	}
+	sorted := simNodes(sim)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID() < sorted[j].ID() })
+	nearest := func(id string) *Node {
+		i := sort.Search(size, func(i int) bool { return sorted[i].ID() >= id })
+		return sorted[min(i, size-1)]
+	}
+	for i, node := range sorted {
+		for j := i - BucketSize/2; j <= i+BucketSize/2; j++ {
+			if j >= 0 && j < size && j != i {
+				node.dht.addPeer(sorted[j].self)
+			}
+		}
+		for bucket := 1; bucket <= IDBits; bucket++ {
+			node.dht.addPeer(nearest(node.randomIDInBucket(bucket)).self)
+		}
+	}
+	return sim
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("nodes=%d", size), func(b *testing.B) {
+			sim := benchNetwork(size)
+			nodes := simNodes(sim)
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				nodes[sim.Rand().Intn(size)].Put(ctx, fmt.Sprintf("key-%d", i), []byte("value"))
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("nodes=%d", size), func(b *testing.B) {
+			sim := benchNetwork(size)
+			nodes := simNodes(sim)
+			ctx := context.Background()
+			keys := make([]string, 64)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", i)
+				nodes[sim.Rand().Intn(size)].Put(ctx, keys[i], []byte("value"))
+			}
+			b.ResetTimer()
+			hops, hits := 0, 0
+			for i := 0; i < b.N; i++ {
+				result, err := nodes[sim.Rand().Intn(size)].get(ctx, keys[i%len(keys)])
+				if err == nil {
+					hits++
+					hops += result.hops
+				}
+			}
+			b.ReportMetric(float64(hops)/float64(max(hits, 1)), "hops/op")
+			b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+		})
+	}
+}
+
+// BenchmarkUDPPing measures a ping round trip between two UDP transports
+// on the loopback interface, allocations included.
+func BenchmarkUDPPing(b *testing.B) {
+	server, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		b.Skip("udp unavailable:", err)
+	}
+	defer server.Close()
+	client, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		b.Skip("udp unavailable:", err)
+	}
+	defer client.Close()
+	sender := newNodeID(rand.New(rand.NewSource(1)))
+	server.Serve(func(from string, req *message) *message {
+		return &message{Type: req.Type, From: contact{ID: sender}}
+	})
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &message{Type: msgPing, From: contact{ID: sender}}
+		if _, err := client.Call(ctx, server.Addr(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
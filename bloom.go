@@ -0,0 +1,52 @@
+package dht
+
+import "hash/fnv"
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+	bloomMinKeys    = 1024
+)
+
+// bloomFilter answers "definitely not present" for keys without touching
+// the store. Sized at ten bits per expected key, its false positive rate
+// stays around 1% until more keys than that have been added.
+type bloomFilter struct {
+	bits     []uint64
+	capacity int
+}
+
+func newBloomFilter(expected int) *bloomFilter {
+	expected = max(expected, bloomMinKeys)
+	return &bloomFilter{
+		bits:     make([]uint64, (expected*bloomBitsPerKey+63)/64),
+		capacity: expected,
+	}
+}
+
+// positions derives every probe from two halves of one 64-bit hash, which
+// is as good as independent hashes for a filter this size.
+func (f *bloomFilter) positions(key string, probe func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	a, b := sum&0xffffffff, sum>>32|1
+	size := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		probe((a + i*b) % size)
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.positions(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	found := true
+	f.positions(key, func(bit uint64) {
+		found = found && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return found
+}
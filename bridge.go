@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A bridge runs on a process that takes part in two overlays, such as a
+// daemon with two configs, and copies the records of some namespaces from
+// one, the source, into the other, every bridge.interval. Keys are the
+// ones the source lists in its prefix index under /<namespace>/ and the
+// ones its node stores itself. Each is read from the source and, when its
+// value has changed since the last pass, put and indexed in the target
+// wrapped in a bridgedValue that says where it came from. The target node
+// then republishes it as its own until the source no longer has the key,
+// when the bridge drops it and the copies expire with the namespace TTL.
+//
+// Values that are already bridged are not copied again, so two bridges
+// running opposite ways do not feed each other.
+const defaultBridgeInterval = 5 * time.Minute
+
+var ErrNotBridged = errors.New("value was not bridged")
+
+// Bridge copies namespaces from one overlay into another.
+type Bridge struct {
+	from, to   *Node
+	namespaces []string
+	interval   time.Duration
+	copied     map[string]uint64 // digest of the value last copied, by key
+}
+
+// bridgedValue is what a bridge stores in the target overlay.
+type bridgedValue struct {
+	Value      []byte      `json:"value"`
+	Provenance *provenance `json:"bridged"`
+}
+
+// provenance says where a bridged value came from.
+type provenance struct {
+	Network   string    `json:"network,omitempty"`   // the source's network_id
+	Publisher string    `json:"publisher,omitempty"` // in the source, if the bridge knew it
+	Version   int64     `json:"version,omitempty"`   // the publisher's, in the source
+	Bridge    string    `json:"bridge"`              // the bridge's source node ID
+	At        time.Time `json:"at"`
+}
+
+// NewBridge returns a bridge copying namespaces from one node's overlay
+// into another's.
+func NewBridge(from, to *Node, namespaces []string, interval time.Duration) *Bridge {
+	if interval <= 0 {
+		interval = defaultBridgeInterval
+	}
+	return &Bridge{from: from, to: to, namespaces: namespaces, interval: interval, copied: make(map[string]uint64)}
+}
+
+// OpenBridged unwraps a value a bridge stored.
+func OpenBridged(value []byte) ([]byte, *provenance, error) {
+	var b bridgedValue
+	if err := json.Unmarshal(value, &b); err != nil || b.Provenance == nil {
+		return nil, nil, ErrNotBridged
+	}
+	return b.Value, b.Provenance, nil
+}
+
+// Run copies the namespaces every interval until ctx is done.
+func (b *Bridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		b.pass(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keys returns the keys of the bridged namespaces the source knows of,
+// and whether every listing succeeded.
+func (b *Bridge) keys(ctx context.Context) ([]string, bool) {
+	found := make(map[string]bool)
+	complete := true
+	for _, ns := range b.namespaces {
+		listed, err := b.from.ListByPrefix(ctx, "/"+ns+"/")
+		if err != nil {
+			b.from.log.Warn("listing bridged namespace failed", "namespace", ns, "err", err)
+			complete = false
+		}
+		for _, key := range listed {
+			found[key] = true
+		}
+	}
+	b.from.mu.Lock()
+	for _, key := range b.from.store.keys() {
+		for _, ns := range b.namespaces {
+			if namespaceOf(key) == ns {
+				found[key] = true
+			}
+		}
+	}
+	b.from.mu.Unlock()
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, complete
+}
+
+// pass copies every changed key once and drops those the source lost,
+// unless it could not list them all.
+func (b *Bridge) pass(ctx context.Context) {
+	keys, complete := b.keys(ctx)
+	present := make(map[string]bool, len(keys))
+	copied := 0
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		result, err := b.from.get(ctx, key)
+		if !errors.Is(err, ErrNotFound) {
+			present[key] = true
+		}
+		if err != nil {
+			continue
+		}
+		if _, _, err := OpenBridged(result.value); err == nil {
+			continue
+		}
+		digest := valueDigest(result.value)
+		if d, ok := b.copied[key]; ok && d == digest {
+			continue
+		}
+		p := &provenance{Network: b.from.cfg.NetworkID, Version: result.version, Bridge: b.from.ID(), At: b.from.clock.Now()}
+		b.from.mu.Lock()
+		if r, ok := b.from.store.peek(key); ok {
+			p.Publisher = r.publisher
+		}
+		b.from.mu.Unlock()
+		value, err := json.Marshal(bridgedValue{Value: result.value, Provenance: p})
+		if err != nil {
+			continue
+		}
+		if err := b.to.PutIndexed(ctx, key, value); err != nil {
+			b.to.log.Warn("bridging record failed", "key", key, "err", err)
+			continue
+		}
+		b.copied[key] = digest
+		copied++
+	}
+	dropped := 0
+	for key := range b.copied {
+		if complete && !present[key] {
+			delete(b.copied, key)
+			b.to.mu.Lock()
+			b.to.store.delete(key)
+			delete(b.to.indexed, key)
+			b.to.mu.Unlock()
+			dropped++
+		}
+	}
+	if copied > 0 || dropped > 0 {
+		b.to.log.Info("bridged records", "namespaces", strings.Join(b.namespaces, ","), "copied", copied, "dropped", dropped)
+	}
+}
@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"sort"
+	"time"
+)
+
+// A node keeps, for every bucket by the bit length of the XOR distance
+// from us, how many contacts it has dropped from it, when the last
+// maxChurnTimes of them went within churnWindow, and Stats reports them
+// with the contact and replacement counts and the mean contact age. A
+// bucket losing contacts far faster than the rest while fresh contacts
+// crowd in is churn or an eclipse attempt on it.
+const (
+	churnWindow   = time.Hour
+	maxChurnTimes = 1024
+)
+
+// bucketChurn counts the contacts dropped from each bucket. Like the
+// routing table, it is guarded by the node's mutex.
+type bucketChurn struct {
+	total  [IDBits + 1]int64
+	recent [IDBits + 1][]time.Time // within churnWindow, oldest first
+}
+
+// bucketStats describes one bucket. Age is the mean time since its
+// contacts were first added.
+type bucketStats struct {
+	Contacts         int     `json:"contacts"`
+	Replacements     int     `json:"replacements"`
+	Evictions        int64   `json:"evictions"`
+	EvictionsPerHour int     `json:"evictions_per_hour"`
+	Age              float64 `json:"mean_age_seconds"`
+}
+
+// noteEviction counts a contact dropped from bucket at now.
+func (c *bucketChurn) noteEviction(bucket int, now time.Time) {
+	c.total[bucket]++
+	times := c.prune(bucket, now)
+	if len(times) >= maxChurnTimes {
+		times = times[1:]
+	}
+	c.recent[bucket] = append(times, now)
+}
+
+// prune forgets the evictions from bucket older than churnWindow.
+func (c *bucketChurn) prune(bucket int, now time.Time) []time.Time {
+	times := c.recent[bucket]
+	i := sort.Search(len(times), func(i int) bool { return now.Sub(times[i]) < churnWindow })
+	c.recent[bucket] = times[i:]
+	return c.recent[bucket]
+}
+
+// bucketStats returns the stats of every bucket that has contacts,
+// replacements or evictions. n.mu must be held.
+func (n *Node) bucketStats(now time.Time) map[int]bucketStats {
+	stats := make(map[int]bucketStats)
+	ages := make(map[int]time.Duration)
+	aged := make(map[int]int)
+	for _, b := range n.dht.buckets() {
+		for _, p := range b.nodes {
+			i := n.dht.bucketIndex(p.id)
+			s := stats[i]
+			s.Contacts++
+			stats[i] = s
+			if !p.added.IsZero() {
+				ages[i] += now.Sub(p.added)
+				aged[i]++
+			}
+		}
+		for _, p := range b.replacements {
+			i := n.dht.bucketIndex(p.id)
+			s := stats[i]
+			s.Replacements++
+			stats[i] = s
+		}
+	}
+	for i := range n.churn.total {
+		if n.churn.total[i] > 0 {
+			s := stats[i]
+			s.Evictions = n.churn.total[i]
+			s.EvictionsPerHour = len(n.churn.prune(i, now))
+			stats[i] = s
+		}
+	}
+	for i, count := range aged {
+		s := stats[i]
+		s.Age = (ages[i] / time.Duration(count)).Seconds()
+		stats[i] = s
+	}
+	return stats
+}
+
+// bucketIndexes returns the buckets in stats, nearest first.
+func bucketIndexes(stats map[int]bucketStats) []int {
+	indexes := make([]int, 0, len(stats))
+	for i := range stats {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
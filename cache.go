@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"container/list"
+	"time"
+)
+
+// valueCache is a bounded LRU of values fetched from the network and of
+// keys the network did not have. Values expire ttl, or the TTL they were
+// put with, after they were fetched, misses after negativeTTL. A zero size
+// disables it. Like store, it is guarded by the node's mutex.
+type valueCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	order       *list.List
+	entries     map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	missing bool
+	fetched time.Time
+	ttl     time.Duration // 0 for the cache's
+}
+
+func newValueCache(size int, ttl, negativeTTL time.Duration) *valueCache {
+	return &valueCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the live entry for key, if any, and marks it as used.
+func (c *valueCache) lookup(key string, now time.Time) *cacheEntry {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	ttl := c.ttl
+	if entry.ttl > 0 {
+		ttl = entry.ttl
+	}
+	if entry.missing {
+		ttl = c.negativeTTL
+	}
+	if now.Sub(entry.fetched) > ttl {
+		c.remove(key)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry
+}
+
+func (c *valueCache) get(key string, now time.Time) ([]byte, bool) {
+	entry := c.lookup(key, now)
+	if entry == nil || entry.missing {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// missing reports whether a recent lookup for key came back empty.
+func (c *valueCache) missing(key string, now time.Time) bool {
+	entry := c.lookup(key, now)
+	return entry != nil && entry.missing
+}
+
+func (c *valueCache) put(key string, value []byte, now time.Time) {
+	c.putFor(key, value, now, 0)
+}
+
+// putFor caches value for ttl, or the cache's TTL if zero.
+func (c *valueCache) putFor(key string, value []byte, now time.Time, ttl time.Duration) {
+	c.add(&cacheEntry{key: key, value: value, fetched: now, ttl: ttl})
+}
+
+// cacheTTL is how long Get caches the value of key. With cache.min_ttl
+// set it follows how often the key is asked for: min_ttl times the Gets
+// for it over about the last rateWindow, see keyRates, up to max_ttl. A
+// value everyone wants then stays cached long, where a stale read is one
+// among many hits, and one asked for once drops out soon. Otherwise it is
+// cache.ttl. n.mu must be held.
+func (n *Node) cacheTTL(key string, now time.Time) time.Duration {
+	c := n.cfg.Cache
+	if c.MinTTL <= 0 {
+		return c.TTL
+	}
+	return min64(time.Duration(float64(c.MinTTL)*max(n.requested.recent(key, now), 1)), c.MaxTTL)
+}
+
+func (c *valueCache) putMissing(key string, now time.Time) {
+	if c.negativeTTL > 0 {
+		c.add(&cacheEntry{key: key, missing: true, fetched: now})
+	}
+}
+
+func (c *valueCache) add(entry *cacheEntry) {
+	if c.size <= 0 {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
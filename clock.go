@@ -0,0 +1,15 @@
+package dht
+
+import "time"
+
+const maintenanceInterval = time.Second
+
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
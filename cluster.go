@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"context"
+	"time"
+)
+
+// Clusters follow Coral: besides the global DHT every node sees a hierarchy
+// of nearby clusters, one per configured RTT limit, tightest first. Our
+// level-i cluster is the set of contacts whose measured round trip time is
+// within Clusters[i]; contacts we have not measured belong to none. Values
+// are looked up in each cluster before the global DHT, and a value found
+// further out is copied to the nearest cluster peers on the way back, so
+// hot keys end up being served close by instead of by the few globally
+// closest nodes.
+
+func (n *Node) withinCluster(limit time.Duration) func(*Peer) bool {
+	return func(p *Peer) bool {
+		known := n.dht.findPeer(p.id)
+		return known != nil && known.rtt > 0 && known.rtt <= limit
+	}
+}
+
+// lookupValue runs find_value through the clusters and then globally,
+// stopping at the first level that has the value. Hops add up across
+// levels.
+func (n *Node) lookupValue(ctx context.Context, key string) *lookupResult {
+	target := n.dht.hashValue(key)
+	hops := 0
+	var traces []lookupTrace
+	missed := make([]*Peer, 0, len(n.cfg.Clusters))
+	tokens := make(map[string]string)
+	for _, limit := range n.cfg.Clusters {
+		result := n.iterateWhere(ctx, msgFindValue, key, target, n.withinCluster(limit))
+		hops += result.hops
+		traces = append(traces, result.traces...)
+		if result.found {
+			result.hops, result.traces = hops, traces
+			n.storeVersionAt(ctx, missed, tokens, key, result.value, result.version)
+			return result
+		}
+		if len(result.closest) > 0 {
+			missed = append(missed, result.closest[0])
+			tokens[result.closest[0].id] = result.tokens[result.closest[0].id]
+		}
+	}
+	result := n.iterate(ctx, msgFindValue, key, target)
+	result.hops += hops
+	result.traces = append(traces, result.traces...)
+	if result.found {
+		n.storeVersionAt(ctx, missed, tokens, key, result.value, result.version)
+	}
+	return result
+}
+
+// storeInClusters stores key at the closest peer of every cluster, on top
+// of the k globally closest peers Put already stored it at.
+func (n *Node) storeInClusters(ctx context.Context, key string, value []byte, version int64) {
+	target := n.dht.hashValue(key)
+	peers := make([]*Peer, 0, len(n.cfg.Clusters))
+	tokens := make(map[string]string)
+	for _, limit := range n.cfg.Clusters {
+		result := n.iterateWhere(ctx, msgFindNode, "", target, n.withinCluster(limit))
+		if len(result.closest) > 0 {
+			closest := result.closest[0]
+			if _, seen := tokens[closest.id]; !seen {
+				peers = append(peers, closest)
+			}
+			tokens[closest.id] = result.tokens[closest.id]
+		}
+	}
+	n.storeVersionAt(ctx, peers, tokens, key, value, version)
+}
+
+// storeAt stores key on peers, presenting the write token each of them
+// gave us during the lookup that found it, and returns their replies.
+func (n *Node) storeAt(ctx context.Context, peers []*Peer, tokens map[string]string, key string, value []byte) []reply {
+	return n.storeVersionAt(ctx, peers, tokens, key, value, 0)
+}
+
+// storeVersionAt is storeAt for a value with a version, which replicas
+// holding a later one refuse.
+func (n *Node) storeVersionAt(ctx context.Context, peers []*Peer, tokens map[string]string, key string, value []byte, version int64) []reply {
+	if len(peers) == 0 {
+		return nil
+	}
+	return n.callAll(ctx, peers, func(p *Peer) *message {
+		return n.storeRequest(p, tokens[p.id], key, value, version)
+	})
+}
+
+func (n *Node) storeRequest(p *Peer, token string, key string, value []byte, version int64) *message {
+	req := n.request(msgStore)
+	req.Key = key
+	req.Token = token
+	req.Version = version
+	n.mu.Lock()
+	if r, ok := n.store.peek(key); ok {
+		req.Replicas = r.replicas
+	}
+	n.mu.Unlock()
+	compressValue(req, value, n.compressionFor(p))
+	return req
+}
+
+// replicaCopies finds the peers that should hold key and asks each of
+// them for its copy, for records whose replicas can disagree. It returns
+// the replicas with their write tokens, the copies found and how many
+// replicas answered at all.
+func (n *Node) replicaCopies(ctx context.Context, key string) (replicas []*Peer, tokens map[string]string, copies [][]byte, answered int) {
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas = n.replicasFor(key, result.closest)
+	replies := n.callAll(ctx, replicas, func(p *Peer) *message {
+		req := n.request(msgFindValue)
+		req.Key = key
+		return req
+	})
+	for _, r := range replies {
+		if r.err != nil {
+			continue
+		}
+		answered++
+		if r.resp.Found {
+			copies = append(copies, r.resp.Value)
+		}
+	}
+	return replicas, result.tokens, copies, answered
+}
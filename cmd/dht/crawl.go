@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	dht "github.com/Redamancylll/2020131047"
+)
+
+// runCrawl starts a throwaway node, crawls the network from the seeds and
+// prints what it found.
+func runCrawl(args []string) error {
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	listen := flags.String("listen", "0.0.0.0:0", "UDP address to listen on")
+	seeds := flags.String("seeds", "", "comma-separated addresses of nodes to start from")
+	limit := flags.Int("limit", 10000, "stop after crawling this many nodes")
+	timeout := flags.Duration("timeout", 10*time.Minute, "give up after this long")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	export := flags.String("export", "", "write the node graph to this file, as DOT if it ends in .dot, else JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *seeds == "" {
+		return errors.New("crawl: -seeds is required")
+	}
+
+	cfg := dht.DefaultConfig()
+	cfg.Listen = []string{*listen}
+	cfg.LogLevel = "error"
+	node, err := dht.StartNode(cfg)
+	if err != nil {
+		return err
+	}
+	defer node.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report := node.Crawl(ctx, strings.Split(*seeds, ","), *limit)
+	if *export != "" {
+		if err := report.Topology().Export(*export); err != nil {
+			return err
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	reached := 0
+	for _, c := range report.Nodes {
+		if !c.Reached {
+			fmt.Printf("%s %s unreached\n", c.ID, c.Addr)
+			continue
+		}
+		reached++
+		fmt.Printf("%s %s version=%d rtt=%v features=%s\n", c.ID, c.Addr, c.Version, c.RTT, strings.Join(c.Features, ","))
+	}
+	fmt.Printf("nodes=%d reached=%d elapsed=%v\n", len(report.Nodes), reached, report.Elapsed.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dht "github.com/Redamancylll/2020131047"
+)
+
+const (
+	bootstrapTimeout     = 30 * time.Second
+	adminShutdownTimeout = 5 * time.Second
+)
+
+// reloadSignals make the daemon reload its config files: SIGHUP where
+// there is one.
+var reloadSignals []os.Signal
+
+// configPaths collects the repeatable -config flag.
+type configPaths []string
+
+func (p *configPaths) String() string { return strings.Join(*p, ",") }
+
+func (p *configPaths) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
+
+// runDaemon starts a node from each config file given, dht.toml if none,
+// and keeps them running until SIGINT or SIGTERM. Nodes share nothing but
+// the process, so one can join a public overlay and another a private
+// one, as long as they listen, store and serve admin requests in
+// different places, and a config's bridge section can copy namespaces
+// from its node's overlay into another's. SIGHUP rereads every node's
+// file, a POST to a node's admin /reload its own, see dht.Node.Reload.
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	var paths configPaths
+	flags.Var(&paths, "config", "path to a node configuration file, repeat for several nodes (default dht.toml)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = configPaths{"dht.toml"}
+	}
+
+	configs := make([]dht.Config, len(paths))
+	for i, path := range paths {
+		cfg, err := dht.LoadConfig(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		configs[i] = cfg
+	}
+	if err := checkInstances(paths, configs); err != nil {
+		return err
+	}
+	nodes := make([]*dht.Node, 0, len(configs))
+	for i, cfg := range configs {
+		node, err := dht.StartNode(cfg)
+		if err != nil {
+			for _, n := range nodes {
+				n.Shutdown()
+			}
+			return fmt.Errorf("%s: %w", paths[i], err)
+		}
+		node.Logger().Info("node started", "id", node.ID(), "listen", cfg.Listen, "config", paths[i])
+		node.SetConfigFile(paths[i])
+		nodes = append(nodes, node)
+	}
+
+	bridges, err := instanceBridges(paths, configs, nodes)
+	if err != nil {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, b := range bridges {
+		go b.Run(ctx)
+	}
+
+	hup := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(hup, reloadSignals...)
+		defer signal.Stop(hup)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				for i, node := range nodes {
+					cfg, err := dht.LoadConfig(paths[i])
+					if err == nil {
+						err = node.Reload(cfg)
+					}
+					if err != nil {
+						node.Logger().Error("reloading configuration failed", "err", err)
+					}
+				}
+			}
+		}
+	}()
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *dht.Node) {
+			defer wg.Done()
+			errs[i] = runInstance(ctx, node, configs[i])
+		}(i, node)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runInstance runs one of the daemon's nodes until ctx is done.
+func runInstance(ctx context.Context, node *dht.Node, cfg dht.Config) error {
+	if cfg.AdminListen != "" {
+		go func() {
+			if err := serveAdmin(ctx, cfg.AdminListen, node.AdminHandler()); err != nil {
+				node.Logger().Error("admin server failed", "err", err)
+			}
+		}()
+	}
+
+	if cfg.MDNS {
+		if err := node.StartMDNS(ctx); err != nil {
+			node.Logger().Warn("mdns discovery disabled", "err", err)
+		}
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	err := node.Join(bootCtx)
+	cancel()
+	if err != nil {
+		node.Logger().Warn("bootstrap failed, waiting for inbound peers", "err", err)
+	}
+
+	node.Run(ctx)
+	node.Logger().Info("shutting down")
+	return node.Shutdown()
+}
+
+// instanceBridges returns the bridges the configs ask for between the
+// daemon's nodes.
+func instanceBridges(paths []string, configs []dht.Config, nodes []*dht.Node) ([]*dht.Bridge, error) {
+	bridges := make([]*dht.Bridge, 0)
+	for i, cfg := range configs {
+		if cfg.Bridge.Target == "" {
+			continue
+		}
+		target := -1
+		for j, path := range paths {
+			if filepath.Clean(path) == filepath.Clean(cfg.Bridge.Target) {
+				target = j
+			}
+		}
+		if target < 0 || target == i {
+			return nil, fmt.Errorf("%s: bridge.target %s is not another -config of this daemon", paths[i], cfg.Bridge.Target)
+		}
+		bridges = append(bridges, dht.NewBridge(nodes[i], nodes[target], cfg.Bridge.Namespaces, cfg.Bridge.Interval))
+	}
+	return bridges, nil
+}
+
+// checkInstances refuses configs that would make the daemon's nodes share
+// a storage directory, and with it an identity and a store, or an
+// address to listen on.
+func checkInstances(paths []string, configs []dht.Config) error {
+	used := make(map[string]string)
+	claim := func(what, value, path string) error {
+		if other, ok := used[what+" "+value]; ok {
+			return fmt.Errorf("%s and %s both use %s %s", other, path, what, value)
+		}
+		used[what+" "+value] = path
+		return nil
+	}
+	for i, cfg := range configs {
+		var err error
+		if cfg.Storage != "" {
+			err = errors.Join(err, claim("storage", filepath.Clean(cfg.Storage), paths[i]))
+		}
+		if cfg.AdminListen != "" {
+			err = errors.Join(err, claim("admin_listen", cfg.AdminListen, paths[i]))
+		}
+		for _, addr := range cfg.Listen {
+			if !strings.HasSuffix(addr, ":0") {
+				err = errors.Join(err, claim("listen", addr, paths[i]))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveAdmin serves handler on addr until ctx is done.
+func serveAdmin(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
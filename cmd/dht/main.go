@@ -0,0 +1,46 @@
+// The dht command runs nodes, a simulated network or a crawl:
+//
+//	dht daemon [-config dht.toml]...   run nodes until SIGINT or SIGTERM
+//	dht shell [-admin addr]            attach to a running daemon
+//	dht sim [flags]                    simulate a network, the default
+//	dht crawl -seeds addr,...          enumerate a network's nodes
+//
+// Built for js/wasm it is instead a light client for web pages, see
+// wasm.go.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// jsMain replaces the command line when built for the browser.
+var jsMain func()
+
+func main() {
+	if jsMain != nil {
+		jsMain()
+		return
+	}
+	var err error
+	if len(os.Args) < 2 {
+		err = runSim(nil)
+	} else {
+		switch os.Args[1] {
+		case "shell":
+			err = runShell(os.Args[2:])
+		case "daemon":
+			err = runDaemon(os.Args[2:])
+		case "sim":
+			err = runSim(os.Args[2:])
+		case "crawl":
+			err = runCrawl(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dht:", err)
+		os.Exit(1)
+	}
+}
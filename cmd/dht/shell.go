@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	dht "github.com/Redamancylll/2020131047"
+)
+
+// shellTimeout bounds a command, which the daemon itself gives up on
+// after half as long.
+const shellTimeout = 20 * time.Second
+
+// maxLine is the longest command line the daemon's /shell reads.
+const maxLine = 1 << 20
+
+// runShell attaches to a running daemon through its admin listener, at
+// -admin or else at the admin_listen of -config, and runs the commands it
+// reads line by line there, each POSTed to the node's /shell. Lines are
+// read as they come; run it under rlwrap for editing and history.
+func runShell(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	admin := flags.String("admin", "", "address of the daemon's admin listener (default admin_listen from -config)")
+	configPath := flags.String("config", "dht.toml", "the daemon's config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	addr := *admin
+	if addr == "" {
+		cfg, err := dht.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if cfg.AdminListen == "" {
+			return fmt.Errorf("%s has no admin_listen, give -admin", *configPath)
+		}
+		addr = cfg.AdminListen
+	}
+	client := &http.Client{Timeout: shellTimeout}
+	url := "http://" + addr + "/shell"
+	// Show which node we are attached to, and fail early if none is there.
+	if err := shellRemote(client, url, "id", os.Stdout); err != nil {
+		return err
+	}
+	return shell(client, url, os.Stdin, os.Stdout)
+}
+
+func shell(client *http.Client, url string, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxLine)
+	for {
+		fmt.Fprint(out, "dht> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return nil
+		}
+		if err := shellRemote(client, url, scanner.Text(), out); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+// shellRemote runs line at the /shell at url and copies its output to
+// out.
+func shellRemote(client *http.Client, url, line string, out io.Writer) error {
+	resp, err := client.Post(url, "text/plain; charset=utf-8", strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShellSendsLines(t *testing.T) {
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		line, _ := io.ReadAll(r.Body)
+		lines = append(lines, string(line))
+		if string(line) == "fail" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintln(w, "error: failed")
+			return
+		}
+		fmt.Fprintln(w, "ran", string(line))
+	}))
+	defer server.Close()
+
+	in := strings.NewReader("get k\n\nfail\nquit\nget j\n")
+	var out bytes.Buffer
+	if err := shell(server.Client(), server.URL, in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, "|"); got != "get k|fail" {
+		t.Errorf("sent %q, want the lines up to quit", got)
+	}
+	for _, want := range []string{"dht> ran get k", "error: failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("shell output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	server.Config.Handler = http.NotFoundHandler()
+	if err := shellRemote(server.Client(), server.URL, "id", &out); err == nil {
+		t.Error("no error from a listener without /shell")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !js
+
+package main
+
+import "syscall"
+
+func init() {
+	reloadSignals = append(reloadSignals, syscall.SIGHUP)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	dht "github.com/Redamancylll/2020131047"
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// The routing and replica levels the sim command takes as reconverged.
+const (
+	partitionRouting  = 0.95
+	partitionReplicas = 0.95
+)
+
+// runSim builds a simulated network and runs one workload over it, printing
+// every read followed by a summary.
+func runSim(args []string) error {
+	flags := flag.NewFlagSet("sim", flag.ContinueOnError)
+	nodes := flags.Int("nodes", 100, "number of simulated nodes")
+	keys := flags.Int("keys", 200, "number of records to write")
+	reads := flags.Int("reads", 100, "number of reads of written records")
+	wait := flags.Duration("wait", 0, "simulated time between writes and reads")
+	seed := flags.Int64("seed", 1, "random seed")
+	quiet := flags.Bool("quiet", false, "only print the summary")
+	export := flags.String("export", "", "write the final routing tables to this file, as DOT if it ends in .dot, else JSON")
+	k := flags.Int("k", dht.BucketSize, "bucket size and replication factor")
+	republish := flags.Duration("republish", time.Hour, "republish interval")
+	ttl := flags.Duration("ttl", 24*time.Hour, "record TTL")
+	duration := flags.Duration("duration", 0, "run a churn scenario for this much simulated time instead")
+	sample := flags.Duration("sample", time.Hour, "churn: time between availability samples")
+	var churn dhtsim.Churn
+	flags.Float64Var(&churn.JoinRate, "join", 0, "churn: nodes joining per hour")
+	flags.Float64Var(&churn.LeaveRate, "leave", 0, "churn: fraction of nodes leaving per hour")
+	flags.Float64Var(&churn.FailureRate, "fail", 0, "churn: fraction of nodes failing per hour")
+	flags.DurationVar(&churn.Downtime, "downtime", 30*time.Minute, "churn: how long a failed node stays down")
+	split := flags.Int("split", 0, "run a partition scenario splitting the network into this many groups instead")
+	splitAt := flags.Duration("split-at", time.Hour, "partition: when the network splits")
+	splitFor := flags.Duration("split-for", time.Hour, "partition: how long it stays split")
+	reconverge := flags.Duration("reconverge", 0, "partition: fail unless routing and replicas recover within this long of healing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg := dht.DefaultConfig()
+	cfg.K = *k
+	cfg.Alpha = min(cfg.Alpha, cfg.K)
+	cfg.RepublishInterval = *republish
+	cfg.RecordTTL = *ttl
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	sim := dhtsim.New(dht.Simulated(cfg), *seed)
+	sim.AddNodes(ctx, *nodes)
+	exportTopology := func() error {
+		if *export == "" {
+			return nil
+		}
+		return dht.SimTopology(sim).Export(*export)
+	}
+
+	if *split > 0 {
+		if *duration == 0 {
+			*duration = *splitAt + *splitFor + 4*time.Hour
+		}
+		report, err := sim.RunPartition(ctx, dhtsim.PartitionScenario{
+			Groups:      *split,
+			At:          *splitAt,
+			Length:      *splitFor,
+			Duration:    *duration,
+			Keys:        *keys,
+			SampleEvery: *sample,
+			SampleReads: *reads,
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range report.Points {
+			fmt.Printf("t=%v split=%t routing=%.3f replicas=%.3f availability=%.3f\n", p.At, p.Split, p.Routing, p.Replicas, p.Availability)
+		}
+		if after, ok := report.Reconverged(partitionRouting, partitionReplicas); ok {
+			fmt.Printf("reconverged=%v\n", after)
+		} else {
+			fmt.Println("reconverged=never")
+		}
+		if err := exportTopology(); err != nil {
+			return err
+		}
+		if *reconverge > 0 {
+			return report.Expect(partitionRouting, partitionReplicas, *reconverge)
+		}
+		return nil
+	}
+
+	if *duration > 0 {
+		points := sim.RunChurn(ctx, dhtsim.ChurnScenario{
+			Churn:       churn,
+			Duration:    *duration,
+			Keys:        *keys,
+			SampleEvery: *sample,
+			SampleReads: *reads,
+		})
+		for _, p := range points {
+			fmt.Printf("t=%v nodes=%d down=%d availability=%.3f\n", p.At, p.Nodes, p.Down, p.Availability)
+		}
+		return exportTopology()
+	}
+
+	report := sim.Run(ctx, dhtsim.Workload{Keys: *keys, Reads: *reads, Wait: *wait})
+
+	if !*quiet {
+		for _, read := range report.Results {
+			fmt.Printf("Key: %s, Value: %s\n", read.Key, read.Value)
+		}
+	}
+	fmt.Printf("reads=%d hits=%d hit_rate=%.3f mean_hops=%.2f max_hops=%d messages=%d\n",
+		report.Reads, report.Hits, report.HitRate(), report.MeanHops(), report.MaxHops(), report.Messages)
+	return exportTopology()
+}
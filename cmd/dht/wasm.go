@@ -0,0 +1,170 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	dht "github.com/Redamancylll/2020131047"
+)
+
+// Built with GOOS=js GOARCH=wasm the dht command is a light client for
+// web pages. It cannot open sockets, so it talks to the DHT through the
+// browser's WebSocket API, dialing the ws:// and wss:// listeners of
+// ordinary nodes; it listens on nothing and is never taken into anyone's
+// routing table. Instead of running the command line it installs a global
+// dht object whose methods return Promises:
+//
+//	dht.start(seeds)   bootstraps from the given ws:// URLs, resolves to our ID
+//	dht.put(key, value) stores a string or Uint8Array
+//	dht.get(key)        resolves to a Uint8Array, rejects if not found
+//	dht.findPeer(id)    resolves to {id, addr, addrs} or null
+//	dht.close()         resolves once the node has shut down
+func init() {
+	jsMain = runJS
+}
+
+func runJS() {
+	var (
+		mu     sync.Mutex
+		node   *dht.Node
+		cancel context.CancelFunc
+	)
+	running := func() (*dht.Node, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if node == nil {
+			return nil, fmt.Errorf("dht.start has not been called")
+		}
+		return node, nil
+	}
+
+	api := js.Global().Get("Object").New()
+	api.Set("start", js.FuncOf(func(this js.Value, args []js.Value) any {
+		var seeds []string
+		if len(args) > 0 && args[0].Type() == js.TypeObject {
+			for i := 0; i < args[0].Length(); i++ {
+				seeds = append(seeds, args[0].Index(i).String())
+			}
+		}
+		return promise(func() (any, error) {
+			mu.Lock()
+			if node != nil {
+				mu.Unlock()
+				return nil, fmt.Errorf("dht.start has already been called")
+			}
+			cfg := dht.DefaultConfig()
+			cfg.LogLevel = "warn"
+			node = dht.NewNode(cfg, dht.NewBrowserTransport())
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			n := node
+			mu.Unlock()
+			if err := n.Bootstrap(ctx, seeds); err != nil {
+				return nil, err
+			}
+			go n.Run(ctx)
+			return n.ID(), nil
+		})
+	}))
+	api.Set("put", js.FuncOf(func(this js.Value, args []js.Value) any {
+		key, value := jsArg(args, 0).String(), jsBytes(jsArg(args, 1))
+		return promise(func() (any, error) {
+			n, err := running()
+			if err != nil {
+				return nil, err
+			}
+			return nil, n.Put(context.Background(), key, value)
+		})
+	}))
+	api.Set("get", js.FuncOf(func(this js.Value, args []js.Value) any {
+		key := jsArg(args, 0).String()
+		return promise(func() (any, error) {
+			n, err := running()
+			if err != nil {
+				return nil, err
+			}
+			value, err := n.Get(context.Background(), key)
+			if err != nil {
+				return nil, err
+			}
+			array := js.Global().Get("Uint8Array").New(len(value))
+			js.CopyBytesToJS(array, value)
+			return array, nil
+		})
+	}))
+	api.Set("findPeer", js.FuncOf(func(this js.Value, args []js.Value) any {
+		id := jsArg(args, 0).String()
+		return promise(func() (any, error) {
+			n, err := running()
+			if err != nil {
+				return nil, err
+			}
+			p := n.FindPeer(context.Background(), id)
+			if p == nil {
+				return nil, nil
+			}
+			addrs := make([]any, len(p.Addrs()))
+			for i, a := range p.Addrs() {
+				addrs[i] = a
+			}
+			return map[string]any{"id": p.ID(), "addr": p.Addr(), "addrs": addrs}, nil
+		})
+	}))
+	api.Set("close", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return promise(func() (any, error) {
+			mu.Lock()
+			n := node
+			if n != nil {
+				cancel()
+				node = nil
+			}
+			mu.Unlock()
+			if n == nil {
+				return nil, nil
+			}
+			return nil, n.Shutdown()
+		})
+	}))
+	js.Global().Set("dht", api)
+	select {}
+}
+
+func jsArg(args []js.Value, i int) js.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return js.Undefined()
+}
+
+// jsBytes copies a Uint8Array, or the UTF-8 encoding of anything else.
+func jsBytes(v js.Value) []byte {
+	if v.InstanceOf(js.Global().Get("Uint8Array")) {
+		b := make([]byte, v.Length())
+		js.CopyBytesToGo(b, v)
+		return b
+	}
+	return []byte(v.String())
+}
+
+// promise runs f on its own goroutine, since JavaScript callbacks must not
+// block, and settles the returned Promise with its result.
+func promise(f func() (any, error)) js.Value {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			v, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// codecDeflate is the only value codec. The standard library has no zstd
+// or snappy, and DEFLATE does well on the text and JSON values that
+// benefit from compression at all.
+const codecDeflate = "deflate"
+
+// Nodes list the codecs they can decode in every message they send, so a
+// peer learns what it may use from any exchange with us. A value is only
+// sent compressed to a peer known to accept it, and only if that makes it
+// smaller.
+
+func accepts(m *message, codec string) bool {
+	for _, c := range m.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// learnCodecs remembers whether the peer that sent m accepts compressed
+// values.
+func (n *Node) learnCodecs(m *message) {
+	n.mu.Lock()
+	if p := n.dht.findPeer(m.From.ID); p != nil {
+		p.deflate = accepts(m, codecDeflate)
+	}
+	n.mu.Unlock()
+}
+
+func (n *Node) peerAcceptsDeflate(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p := n.dht.findPeer(id)
+	return p != nil && p.deflate
+}
+
+// compressionFor is the compressValue threshold for values sent to p.
+func (n *Node) compressionFor(p *Peer) int {
+	if n.peerAcceptsDeflate(p.id) {
+		return n.cfg.CompressThreshold
+	}
+	return 0
+}
+
+// compressValue sets m's value and compresses it when it is at least
+// threshold bytes long and compression pays off. A zero threshold never
+// compresses.
+func compressValue(m *message, value []byte, threshold int) {
+	m.Value = value
+	if threshold <= 0 || len(value) < threshold {
+		return
+	}
+	if packed, ok := deflate(value); ok {
+		m.Value = packed
+		m.Codec = codecDeflate
+	}
+}
+
+// decompressValue undoes compressValue, refusing to inflate beyond limit
+// bytes.
+func decompressValue(m *message, limit int) error {
+	switch m.Codec {
+	case "":
+		return nil
+	case codecDeflate:
+		value, err := inflate(m.Value, limit)
+		if err != nil {
+			return err
+		}
+		m.Value = value
+		m.Codec = ""
+		return nil
+	}
+	return fmt.Errorf("unknown codec %q", m.Codec)
+}
+
+// deflate reports false when compressing value would not shrink it.
+func deflate(value []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(value)
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+func inflate(packed []byte, limit int) ([]byte, error) {
+	value, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(packed)), int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > limit {
+		return nil, ErrTooLarge
+	}
+	return value, nil
+}
@@ -0,0 +1,717 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything needed to start a node. It is read from a small
+// TOML subset: [sections], key = value pairs, quoted strings, integers,
+// booleans and single-line arrays of strings. Durations are strings in
+// time.ParseDuration format.
+type Config struct {
+	Listen                 []string
+	Bootstrap              []string
+	Storage                string
+	IdentityPassphraseFile string
+	EncryptStore           bool
+	StoreKeyFile           string
+	WAL                    bool
+	NetworkKeyFile         string
+	NetworkID              string
+	RequireRecords         bool
+	DetectMisbehavior      bool
+	Relay                  bool
+	Relays                 []string
+	OnionRelay             bool
+	OnionHops              int
+	K                      int
+	Alpha                  int
+	AdaptiveLookups        bool
+	LogLevel               string
+	RecordTTL              time.Duration
+	RepublishInterval      time.Duration
+	RefreshInterval        time.Duration
+	SaveInterval           time.Duration
+	PexInterval            time.Duration
+	SyncInterval           time.Duration
+	GossipInterval         time.Duration
+	PresenceInterval       time.Duration
+	AdminListen            string
+	MDNS                   bool
+	Faults                 string // see parseFaults
+	MinPeers               int
+	LeaveHandoff           bool
+	FailureRepair          bool
+	JoinHandoff            bool
+	MemoryBudget           int
+	CompressThreshold      int
+	StreamThreshold        int
+	PhiThreshold           float64
+	Placement              string
+	VirtualNodes           int
+	Clusters               []time.Duration
+	Limits                 Limits
+	Cache                  Cache
+	Retry                  RetryPolicy
+	Timeouts               Timeouts
+	Keepalive              Keepalive
+	SeriesBucket           time.Duration
+	Bridge                 Bridging
+	Namespaces             map[string]Namespace
+}
+
+// Bridging makes the daemon copy Namespaces from this node's overlay into
+// that of the node started from the Target config file, see bridge.go.
+type Bridging struct {
+	Target     string
+	Namespaces []string
+	Interval   time.Duration
+}
+
+// Keepalive bounds the interval between pings that keep NAT mappings to
+// our closest peers open. The interval starts at Max and adapts between the
+// two; a zero Max disables keepalives.
+type Keepalive struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Timeouts bound a single RPC attempt, a whole operation such as a Get and
+// the daemon's Close. Zero leaves it to the caller's context.
+type Timeouts struct {
+	RPC       time.Duration
+	Operation time.Duration
+	Shutdown  time.Duration
+}
+
+// Cache bounds the read cache of values fetched by Get. Keys the network
+// did not have are remembered for NegativeTTL; zero disables that.
+//
+// With MinTTL set, values are kept between MinTTL and MaxTTL, the longer
+// the more they are asked for, instead of for TTL; see cacheTTL.
+//
+// The Hot fields offload keys we serve often to the nodes nearby, see
+// hot.go; a zero HotRate disables that.
+type Cache struct {
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MinTTL      time.Duration // 0 keeps every value for TTL
+	MaxTTL      time.Duration
+	HotRate     float64 // requests a second
+	HotTTL      time.Duration
+	HotFanout   int
+}
+
+// Limits protect a node from its peers. MaxBytesPerPeer and MaxBytes cap
+// the key and value bytes stored for any one publisher and for everyone.
+type Limits struct {
+	MaxValueSize    int
+	MaxRecords      int
+	MaxBytesPerPeer int
+	MaxBytes        int
+	PeerRate        float64
+	PeerBurst       int
+	PeerBandwidth   int // bytes a second, see bandwidth.go
+	IPRate          float64
+	IPBurst         int
+	SubnetRate      float64
+	SubnetBurst     int
+	BucketSubnet    int // contacts per subnet, see diversity.go
+	TableSubnet     int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:            []string{"0.0.0.0:4000"},
+		K:                 BucketSize,
+		Alpha:             Alpha,
+		OnionHops:         maxOnionHops,
+		LogLevel:          "info",
+		WAL:               true,
+		RecordTTL:         24 * time.Hour,
+		RepublishInterval: time.Hour,
+		RefreshInterval:   15 * time.Minute,
+		SaveInterval:      10 * time.Minute,
+		PexInterval:       5 * time.Minute,
+		SyncInterval:      10 * time.Minute,
+		MinPeers:          1,
+		MemoryBudget:      256 << 20,
+		CompressThreshold: 1024,
+		StreamThreshold:   16 << 10,
+		PhiThreshold:      8,
+		Placement:         placementXOR,
+		VirtualNodes:      defaultVirtualNodes,
+		Limits: Limits{
+			MaxValueSize:    32 * 1024,
+			MaxRecords:      100000,
+			MaxBytesPerPeer: 4 << 20,
+			MaxBytes:        512 << 20,
+			PeerRate:        50,
+			PeerBurst:       100,
+			IPRate:          200,
+			IPBurst:         400,
+			SubnetRate:      500,
+			SubnetBurst:     1000,
+			BucketSubnet:    2,
+			TableSubnet:     10,
+		},
+		Keepalive: Keepalive{
+			Min: 15 * time.Second,
+			Max: 2 * time.Minute,
+		},
+		Timeouts: Timeouts{
+			RPC:       500 * time.Millisecond,
+			Operation: 10 * time.Second,
+			Shutdown:  10 * time.Second,
+		},
+		Retry: RetryPolicy{
+			Attempts:   2,
+			Backoff:    200 * time.Millisecond,
+			MaxBackoff: 2 * time.Second,
+			Jitter:     0.2,
+		},
+		Cache: Cache{
+			Size:        1024,
+			TTL:         time.Minute,
+			NegativeTTL: 10 * time.Second,
+			HotTTL:      defaultHotTTL,
+			HotFanout:   defaultHotFanout,
+		},
+		SeriesBucket: time.Hour,
+		Bridge: Bridging{
+			Interval: defaultBridgeInterval,
+		},
+	}
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig reads the text of a config file over the defaults. Unlike
+// LoadConfig it does not validate the result.
+func ParseConfig(data []byte) (Config, error) {
+	cfg := DefaultConfig()
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return cfg, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.TrimSpace(name)
+		if section != "" {
+			key = section + "." + key
+		}
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return cfg, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if err := cfg.set(key, value); err != nil {
+			return cfg, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+func (c *Config) set(key string, value interface{}) error {
+	var err error
+	switch key {
+	case "listen":
+		c.Listen, err = asStrings(value)
+	case "bootstrap":
+		c.Bootstrap, err = asStrings(value)
+	case "storage":
+		c.Storage, err = asString(value)
+	case "identity_passphrase_file":
+		c.IdentityPassphraseFile, err = asString(value)
+	case "encrypt_store":
+		c.EncryptStore, err = asBool(value)
+	case "store_key_file":
+		c.StoreKeyFile, err = asString(value)
+	case "wal":
+		c.WAL, err = asBool(value)
+	case "network_key_file":
+		c.NetworkKeyFile, err = asString(value)
+	case "network_id":
+		c.NetworkID, err = asString(value)
+	case "require_records":
+		c.RequireRecords, err = asBool(value)
+	case "detect_misbehavior":
+		c.DetectMisbehavior, err = asBool(value)
+	case "relay":
+		c.Relay, err = asBool(value)
+	case "relays":
+		c.Relays, err = asStrings(value)
+	case "onion_relay":
+		c.OnionRelay, err = asBool(value)
+	case "onion_hops":
+		c.OnionHops, err = asInt(value)
+	case "k":
+		c.K, err = asInt(value)
+	case "alpha":
+		c.Alpha, err = asInt(value)
+	case "adaptive_lookups":
+		c.AdaptiveLookups, err = asBool(value)
+	case "log_level":
+		c.LogLevel, err = asString(value)
+	case "record_ttl":
+		c.RecordTTL, err = asDuration(value)
+	case "republish_interval":
+		c.RepublishInterval, err = asDuration(value)
+	case "refresh_interval":
+		c.RefreshInterval, err = asDuration(value)
+	case "save_interval":
+		c.SaveInterval, err = asDuration(value)
+	case "pex_interval":
+		c.PexInterval, err = asDuration(value)
+	case "sync_interval":
+		c.SyncInterval, err = asDuration(value)
+	case "gossip_interval":
+		c.GossipInterval, err = asDuration(value)
+	case "presence_interval":
+		c.PresenceInterval, err = asDuration(value)
+	case "admin_listen":
+		c.AdminListen, err = asString(value)
+	case "mdns":
+		c.MDNS, err = asBool(value)
+	case "faults":
+		c.Faults, err = asString(value)
+	case "clusters":
+		c.Clusters, err = asDurations(value)
+	case "compress_threshold":
+		c.CompressThreshold, err = asInt(value)
+	case "stream_threshold":
+		c.StreamThreshold, err = asInt(value)
+	case "phi_threshold":
+		c.PhiThreshold, err = asFloat(value)
+	case "placement":
+		c.Placement, err = asString(value)
+	case "virtual_nodes":
+		c.VirtualNodes, err = asInt(value)
+	case "memory_budget":
+		c.MemoryBudget, err = asInt(value)
+	case "min_peers":
+		c.MinPeers, err = asInt(value)
+	case "leave_handoff":
+		c.LeaveHandoff, err = asBool(value)
+	case "failure_repair":
+		c.FailureRepair, err = asBool(value)
+	case "join_handoff":
+		c.JoinHandoff, err = asBool(value)
+	case "limits.max_value_size":
+		c.Limits.MaxValueSize, err = asInt(value)
+	case "limits.max_records":
+		c.Limits.MaxRecords, err = asInt(value)
+	case "limits.max_bytes_per_peer":
+		c.Limits.MaxBytesPerPeer, err = asInt(value)
+	case "limits.max_bytes":
+		c.Limits.MaxBytes, err = asInt(value)
+	case "limits.peer_rate":
+		c.Limits.PeerRate, err = asFloat(value)
+	case "limits.peer_burst":
+		c.Limits.PeerBurst, err = asInt(value)
+	case "limits.peer_bandwidth":
+		c.Limits.PeerBandwidth, err = asInt(value)
+	case "limits.ip_rate":
+		c.Limits.IPRate, err = asFloat(value)
+	case "limits.ip_burst":
+		c.Limits.IPBurst, err = asInt(value)
+	case "limits.subnet_rate":
+		c.Limits.SubnetRate, err = asFloat(value)
+	case "limits.subnet_burst":
+		c.Limits.SubnetBurst, err = asInt(value)
+	case "limits.bucket_subnet":
+		c.Limits.BucketSubnet, err = asInt(value)
+	case "limits.table_subnet":
+		c.Limits.TableSubnet, err = asInt(value)
+	case "cache.size":
+		c.Cache.Size, err = asInt(value)
+	case "cache.ttl":
+		c.Cache.TTL, err = asDuration(value)
+	case "cache.negative_ttl":
+		c.Cache.NegativeTTL, err = asDuration(value)
+	case "cache.min_ttl":
+		c.Cache.MinTTL, err = asDuration(value)
+	case "cache.max_ttl":
+		c.Cache.MaxTTL, err = asDuration(value)
+	case "cache.hot_rate":
+		c.Cache.HotRate, err = asFloat(value)
+	case "cache.hot_ttl":
+		c.Cache.HotTTL, err = asDuration(value)
+	case "cache.hot_fanout":
+		c.Cache.HotFanout, err = asInt(value)
+	case "keepalive.min":
+		c.Keepalive.Min, err = asDuration(value)
+	case "keepalive.max":
+		c.Keepalive.Max, err = asDuration(value)
+	case "timeouts.rpc":
+		c.Timeouts.RPC, err = asDuration(value)
+	case "timeouts.operation":
+		c.Timeouts.Operation, err = asDuration(value)
+	case "timeouts.shutdown":
+		c.Timeouts.Shutdown, err = asDuration(value)
+	case "retry.attempts":
+		c.Retry.Attempts, err = asInt(value)
+	case "retry.backoff":
+		c.Retry.Backoff, err = asDuration(value)
+	case "retry.max_backoff":
+		c.Retry.MaxBackoff, err = asDuration(value)
+	case "retry.jitter":
+		c.Retry.Jitter, err = asFloat(value)
+	case "series_bucket":
+		c.SeriesBucket, err = asDuration(value)
+	case "bridge.target":
+		c.Bridge.Target, err = asString(value)
+	case "bridge.namespaces":
+		c.Bridge.Namespaces, err = asStrings(value)
+	case "bridge.interval":
+		c.Bridge.Interval, err = asDuration(value)
+	default:
+		if strings.HasPrefix(key, "namespaces.") {
+			return c.setNamespace(key, value)
+		}
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("listen: at least one address is required")
+	}
+	for _, addr := range c.Listen {
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(addr, "ws://")); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	for _, addr := range c.Bootstrap {
+		if strings.HasPrefix(addr, dnsSeedPrefix) {
+			if _, _, ok := parseDNSSeed(addr); !ok {
+				return fmt.Errorf("bootstrap: bad dns seed %q", addr)
+			}
+			continue
+		}
+		if _, err := toMultiaddr(addr); err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
+		}
+	}
+	for _, addr := range c.Relays {
+		if _, err := toMultiaddr(addr); err != nil {
+			return fmt.Errorf("relays: %w", err)
+		}
+	}
+	if c.OnionHops < 2 || c.OnionHops > maxOnionHops {
+		return fmt.Errorf("onion_hops must be between 2 and %d", maxOnionHops)
+	}
+	if c.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListen); err != nil {
+			return fmt.Errorf("admin_listen: %w", err)
+		}
+	}
+	if c.Faults != "" {
+		if err := newFaultyTransport(nil, 0).parseFaults(c.Faults); err != nil {
+			return err
+		}
+	}
+	if c.MinPeers < 0 {
+		return fmt.Errorf("min_peers: must not be negative")
+	}
+	if c.K < 1 {
+		return fmt.Errorf("k: must be positive, got %d", c.K)
+	}
+	if c.Alpha < 1 || c.Alpha > c.K {
+		return fmt.Errorf("alpha: must be between 1 and k, got %d", c.Alpha)
+	}
+	if _, err := c.logLevel(); err != nil {
+		return err
+	}
+	if c.RecordTTL <= 0 || c.RepublishInterval <= 0 || c.RefreshInterval <= 0 || c.SaveInterval <= 0 {
+		return fmt.Errorf("record_ttl, republish_interval, refresh_interval and save_interval must be positive")
+	}
+	for i, limit := range c.Clusters {
+		if limit <= 0 || i > 0 && limit <= c.Clusters[i-1] {
+			return fmt.Errorf("clusters: limits must be positive and increasing")
+		}
+	}
+	if err := c.validateNamespaces(); err != nil {
+		return err
+	}
+	if c.StoreKeyFile != "" && !c.EncryptStore {
+		return fmt.Errorf("store_key_file: needs encrypt_store = true")
+	}
+	if c.NetworkID != "" && c.NetworkKeyFile == "" {
+		return fmt.Errorf("network_id: needs network_key_file")
+	}
+	if c.CompressThreshold < 0 {
+		return fmt.Errorf("compress_threshold: must not be negative")
+	}
+	if c.PhiThreshold < 0 {
+		return fmt.Errorf("phi_threshold: must not be negative")
+	}
+	if c.Placement != placementXOR && c.Placement != placementRing {
+		return fmt.Errorf("placement: must be %q or %q, got %q", placementXOR, placementRing, c.Placement)
+	}
+	if c.VirtualNodes < 1 || c.VirtualNodes > maxVirtualNodes {
+		return fmt.Errorf("virtual_nodes: must be between 1 and %d", maxVirtualNodes)
+	}
+	if c.MemoryBudget < 0 {
+		return fmt.Errorf("memory_budget: must not be negative")
+	}
+	if c.PexInterval < 0 {
+		return fmt.Errorf("pex_interval: must not be negative")
+	}
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("sync_interval: must not be negative")
+	}
+	if c.PresenceInterval < 0 {
+		return fmt.Errorf("presence_interval: must not be negative")
+	}
+	if c.GossipInterval < 0 {
+		return fmt.Errorf("gossip_interval: must not be negative")
+	}
+	if c.RepublishInterval >= c.RecordTTL {
+		return fmt.Errorf("republish_interval %v must be shorter than record_ttl %v", c.RepublishInterval, c.RecordTTL)
+	}
+	if c.StreamThreshold < 0 || c.StreamThreshold > maxPacketSize {
+		return fmt.Errorf("stream_threshold: must be between 0 and %d", maxPacketSize)
+	}
+	maxValue := maxPacketSize
+	if c.StreamThreshold > 0 {
+		maxValue = maxStreamValue
+	}
+	if c.Limits.MaxValueSize < 1 || c.Limits.MaxValueSize > maxValue {
+		return fmt.Errorf("limits.max_value_size: must be between 1 and %d", maxValue)
+	}
+	if c.Limits.MaxRecords < 1 {
+		return fmt.Errorf("limits.max_records: must be positive")
+	}
+	if c.Limits.MaxBytesPerPeer < 1 || c.Limits.MaxBytes < c.Limits.MaxBytesPerPeer {
+		return fmt.Errorf("limits.max_bytes_per_peer must be positive and at most limits.max_bytes")
+	}
+	if c.Limits.PeerRate < 0 || c.Limits.PeerBurst < 0 {
+		return fmt.Errorf("limits.peer_rate and limits.peer_burst must not be negative")
+	}
+	if c.Limits.IPRate < 0 || c.Limits.IPBurst < 0 || c.Limits.SubnetRate < 0 || c.Limits.SubnetBurst < 0 {
+		return fmt.Errorf("limits.ip_rate, ip_burst, subnet_rate and subnet_burst must not be negative")
+	}
+	if c.Limits.BucketSubnet < 0 || c.Limits.TableSubnet < 0 {
+		return fmt.Errorf("limits.bucket_subnet and limits.table_subnet must not be negative")
+	}
+	if c.Limits.PeerBandwidth < 0 {
+		return fmt.Errorf("limits.peer_bandwidth must not be negative")
+	}
+	if c.Keepalive.Max > 0 && (c.Keepalive.Min <= 0 || c.Keepalive.Min > c.Keepalive.Max) {
+		return fmt.Errorf("keepalive.min must be positive and at most keepalive.max")
+	}
+	if c.Timeouts.RPC < 0 || c.Timeouts.Operation < 0 || c.Timeouts.Shutdown < 0 {
+		return fmt.Errorf("timeouts.rpc, timeouts.operation and timeouts.shutdown must not be negative")
+	}
+	if c.Retry.Attempts < 1 {
+		return fmt.Errorf("retry.attempts: must be positive")
+	}
+	if c.Retry.Backoff < 0 || c.Retry.MaxBackoff < c.Retry.Backoff {
+		return fmt.Errorf("retry.backoff must not be negative or exceed retry.max_backoff")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		return fmt.Errorf("retry.jitter: must be between 0 and 1")
+	}
+	if c.Cache.Size < 0 || c.Cache.TTL < 0 || c.Cache.NegativeTTL < 0 {
+		return fmt.Errorf("cache.size, cache.ttl and cache.negative_ttl must not be negative")
+	}
+	if c.Cache.MinTTL < 0 || c.Cache.MinTTL > 0 && c.Cache.MaxTTL < c.Cache.MinTTL {
+		return fmt.Errorf("cache.min_ttl must not be negative, nor above cache.max_ttl when set")
+	}
+	if c.Cache.HotRate < 0 {
+		return fmt.Errorf("cache.hot_rate: must not be negative")
+	}
+	if c.Cache.HotRate > 0 && (c.Cache.HotTTL <= 0 || c.Cache.HotFanout < 1 || c.Cache.HotFanout > c.K) {
+		return fmt.Errorf("cache.hot_ttl must be positive and cache.hot_fanout between 1 and k")
+	}
+	if c.SeriesBucket < time.Second {
+		return fmt.Errorf("series_bucket: must be at least 1s")
+	}
+	if c.Bridge.Interval <= 0 {
+		return fmt.Errorf("bridge.interval: must be positive")
+	}
+	if c.Bridge.Target != "" && len(c.Bridge.Namespaces) == 0 {
+		return fmt.Errorf("bridge.namespaces: name at least one namespace to bridge")
+	}
+	for _, ns := range c.Bridge.Namespaces {
+		if ns == "" || strings.Contains(ns, "/") {
+			return fmt.Errorf("bridge.namespaces: bad namespace %q", ns)
+		}
+	}
+	return nil
+}
+
+func (c Config) logLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("log_level: %w", err)
+	}
+	return level, nil
+}
+
+func stripComment(line string) string {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case r == '#' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		values := make([]string, 0)
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			s, err := strconv.Unquote(item)
+			if err != nil {
+				return nil, fmt.Errorf("array item %s: %w", item, err)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case raw == "true" || raw == "false":
+		return raw == "true", nil
+	}
+	if i, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("cannot parse value %s", raw)
+}
+
+func splitArray(raw string) []string {
+	items := make([]string, 0)
+	quoted := false
+	start := 0
+	for i, r := range raw {
+		switch {
+		case r == '"' && (i == 0 || raw[i-1] != '\\'):
+			quoted = !quoted
+		case r == ',' && !quoted:
+			items = append(items, raw[start:i])
+			start = i + 1
+		}
+	}
+	items = append(items, raw[start:])
+
+	trimmed := items[:0]
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
+
+func asString(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string")
+	}
+	return s, nil
+}
+
+func asStrings(value interface{}) ([]string, error) {
+	s, ok := value.([]string)
+	if !ok {
+		return nil, fmt.Errorf("expected an array of strings")
+	}
+	return s, nil
+}
+
+func asInt(value interface{}) (int, error) {
+	i, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("expected an integer")
+	}
+	return int(i), nil
+}
+
+func asFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected a number")
+}
+
+func asBool(value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected true or false")
+	}
+	return b, nil
+}
+
+func asDuration(value interface{}) (time.Duration, error) {
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("expected a duration string such as \"30s\"")
+	}
+	return time.ParseDuration(s)
+}
+
+func asDurations(value interface{}) ([]time.Duration, error) {
+	items, err := asStrings(value)
+	if err != nil {
+		return nil, err
+	}
+	durations := make([]time.Duration, len(items))
+	for i, item := range items {
+		if durations[i], err = time.ParseDuration(item); err != nil {
+			return nil, err
+		}
+	}
+	return durations, nil
+}
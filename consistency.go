@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// A consistency level says how many of a key's replicas an operation waits
+// for, out of the replication factor r the key's namespace or its Put
+// asked for: one, a majority of r/2+1, or all r. A write at a level
+// returns as soon as that many stores, counting those handed off to stand
+// ins, have succeeded, and fails with ErrNoQuorum once every store is
+// done without; the rest carry on in the background, bounded by the
+// operation timeout. A read at QUORUM or ALL is a quorum read of that many
+// replicas, see GetQuorum. Without a level, Put waits for every store and
+// does not count them, and Get returns the first copy it comes across,
+// which is also what ONE means for reads.
+type Consistency int
+
+const (
+	ConsistencyDefault Consistency = iota
+	ConsistencyOne
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+// replicasNeeded is how many of r replicas level waits for.
+func (level Consistency) replicasNeeded(r int) int {
+	switch level {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return r/2 + 1
+	case ConsistencyAll:
+		return r
+	}
+	return 0
+}
+
+// WithWriteConsistency makes Put wait for the stores level asks for.
+func WithWriteConsistency(level Consistency) PutOption {
+	return func(o *putOptions) { o.consistency = level }
+}
+
+// GetOption changes how a single Get reads its key.
+type GetOption func(*getOptions)
+
+type getOptions struct {
+	consistency Consistency
+	private     bool // see privacy.go
+	onion       bool // see onion.go
+}
+
+// WithReadConsistency makes Get ask as many replicas as level does.
+func WithReadConsistency(level Consistency) GetOption {
+	return func(o *getOptions) { o.consistency = level }
+}
+
+// writeAcks counts the stores of one Put that succeeded. enough is closed
+// once need of them have, done once every store has finished.
+type writeAcks struct {
+	mu     sync.Mutex
+	need   int
+	acked  int
+	enough chan struct{}
+	done   chan struct{}
+}
+
+func newWriteAcks(need int) *writeAcks {
+	return &writeAcks{need: need, enough: make(chan struct{}), done: make(chan struct{})}
+}
+
+// ack counts one successful store. It does nothing on a nil writeAcks, so
+// writes that do not count can pass nil.
+func (w *writeAcks) ack() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.acked++
+	if w.acked == w.need {
+		close(w.enough)
+	}
+}
+
+func (w *writeAcks) wait(ctx context.Context) error {
+	select {
+	case <-w.enough:
+		return nil
+	case <-w.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.acked >= w.need {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d stores succeeded", ErrNoQuorum, w.acked, w.need)
+}
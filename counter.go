@@ -0,0 +1,184 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Counters are PN-counter CRDTs kept in the counter namespace. Every node
+// that touches a counter owns one entry holding the totals it has added and
+// subtracted; the value is the sum over all entries. Replicas merge what
+// they are sent entry by entry, keeping the larger totals, so concurrent
+// increments from different nodes never overwrite each other and the
+// value only ever lags behind, never goes wrong.
+const counterNamespace = "counter"
+
+type counterEntry struct {
+	Added      int64 `json:"p"`
+	Subtracted int64 `json:"n"`
+}
+
+type counterState map[string]counterEntry
+
+func (s counterState) value() int64 {
+	total := int64(0)
+	for _, e := range s {
+		total += e.Added - e.Subtracted
+	}
+	return total
+}
+
+func (s counterState) merge(other counterState) {
+	for id, e := range other {
+		mine := s[id]
+		s[id] = counterEntry{Added: max(mine.Added, e.Added), Subtracted: max(mine.Subtracted, e.Subtracted)}
+	}
+}
+
+func counterKey(key string) string {
+	return "/" + counterNamespace + "/" + key
+}
+
+// mergeCounter folds an incoming counter state into the stored one.
+func mergeCounter(stored, incoming []byte) ([]byte, error) {
+	state := make(counterState)
+	if stored != nil {
+		json.Unmarshal(stored, &state)
+	}
+	var other counterState
+	if err := json.Unmarshal(incoming, &other); err != nil {
+		return nil, err
+	}
+	state.merge(other)
+	return json.Marshal(state)
+}
+
+// fetchCounter fetches the current state of a counter from the network,
+// which is empty for a counter nobody has touched yet.
+func (n *Node) fetchCounter(ctx context.Context, key string) (counterState, error) {
+	state := make(counterState)
+	value, err := n.Get(ctx, counterKey(key))
+	if errors.Is(err, ErrNotFound) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(value, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Increment adds delta, which may be negative, to the counter key and
+// returns the value as far as this node knows it.
+func (n *Node) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	state, err := n.fetchCounter(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n.mu.Lock()
+	if n.counters == nil {
+		n.counters = make(map[string]counterEntry)
+	}
+	// Our entry on the network may be ahead of what we remember, e.g.
+	// after a restart.
+	own := state[n.self.id]
+	mine := n.counters[key]
+	own = counterEntry{Added: max(own.Added, mine.Added), Subtracted: max(own.Subtracted, mine.Subtracted)}
+	if delta >= 0 {
+		own.Added += delta
+	} else {
+		own.Subtracted -= delta
+	}
+	n.counters[key] = own
+	state[n.self.id] = own
+	n.cache.put(counterKey(key), mustJSON(state), n.clock.Now())
+	n.mu.Unlock()
+	return state.value(), n.publishCounter(ctx, key, own)
+}
+
+// Count returns the value of the counter key.
+func (n *Node) Count(ctx context.Context, key string) (int64, error) {
+	state, err := n.fetchCounter(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return state.value(), nil
+}
+
+// publishCounter sends our entry to the replicas, which merge it. When
+// we are nearer the key than one of them we are a replica ourselves and
+// merge it into our own copy instead of sending it to the farthest:
+// lookups reaching our copy would otherwise find it without our entry.
+func (n *Node) publishCounter(ctx context.Context, key string, own counterEntry) error {
+	ckey := counterKey(key)
+	value := mustJSON(counterState{n.self.id: own})
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(ckey))
+	replicas := n.replicasFor(ckey, result.closest)
+
+	n.mu.Lock()
+	kept := false
+	if n.nearerThanReplica(ckey, replicas) {
+		r := &record{key: ckey, value: value, publisher: n.self.id, stored: n.clock.Now()}
+		if ok, _ := n.admit(r); ok {
+			n.store.put(r)
+			n.evict()
+			kept = true
+		}
+	}
+	full := len(replicas) >= n.replication(ckey)
+	n.mu.Unlock()
+	if kept {
+		if err := n.logRecord(ckey); err != nil {
+			n.log.Warn("logging counter failed", "key", key, "err", err)
+		}
+		if full {
+			replicas = replicas[:len(replicas)-1]
+		}
+	}
+	n.storeAt(ctx, replicas, result.tokens, ckey, value)
+	return ctx.Err()
+}
+
+// nearerThanReplica reports whether we would be one of key's replicas
+// if we were a candidate. n.mu must be held.
+func (n *Node) nearerThanReplica(key string, replicas []*Peer) bool {
+	if len(replicas) < n.replication(key) {
+		return true
+	}
+	return compareDistance(n.self.id, replicas[len(replicas)-1].id, n.dht.hashValue(key)) < 0
+}
+
+// republishCounters resends our entry of every counter we have touched so
+// replicas do not expire it.
+func (n *Node) republishCounters(ctx context.Context) {
+	n.mu.Lock()
+	keys := make([]string, 0, len(n.counters))
+	for key := range n.counters {
+		keys = append(keys, key)
+	}
+	n.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		n.mu.Lock()
+		own := n.counters[key]
+		n.mu.Unlock()
+		if err := n.publishCounter(ctx, key, own); err != nil {
+			n.log.Warn("republishing counter failed", "key", key, "err", err)
+		}
+	}
+}
+
+func mustJSON(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
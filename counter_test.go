@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestMergeCounter(t *testing.T) {
+	a := mustJSON(counterState{"x": {Added: 5, Subtracted: 1}, "y": {Added: 2}})
+	b := mustJSON(counterState{"x": {Added: 3, Subtracted: 2}, "z": {Subtracted: 4}})
+	ab, err := mergeCounter(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, _ := mergeCounter(b, a)
+	var left, right counterState
+	json.Unmarshal(ab, &left)
+	json.Unmarshal(ba, &right)
+	if left.value() != 5-2+2-4 || right.value() != left.value() {
+		t.Errorf("merged values %d and %d, want %d", left.value(), right.value(), 5-2+2-4)
+	}
+	again, _ := mergeCounter(ab, a)
+	if string(again) != string(ab) {
+		t.Errorf("merging a state in twice changed it: %s, then %s", ab, again)
+	}
+	if _, err := mergeCounter(a, []byte("[]")); err == nil {
+		t.Error("merged a counter state that is not an object")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 11)
+	sim.AddNodes(ctx, 20)
+	nodes := simNodes(sim)
+	for i, delta := range []int64{1, 1, 5, -2, 1} {
+		if _, err := nodes[i%3].Increment(ctx, "downloads", delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := nodes[10].Count(ctx, "downloads"); err != nil || got != 6 {
+		t.Errorf("count %d, err %v, want 6", got, err)
+	}
+	if got, err := nodes[10].Count(ctx, "uploads"); err != nil || got != 0 {
+		t.Errorf("untouched counter %d, err %v, want 0", got, err)
+	}
+
+	// A replica sent an older entry keeps the newer one.
+	nodes[0].mu.Lock()
+	own := nodes[0].counters["downloads"]
+	nodes[0].mu.Unlock()
+	stale := counterEntry{Added: own.Added - 1}
+	if err := nodes[0].publishCounter(ctx, "downloads", stale); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := nodes[10].Count(ctx, "downloads"); got != 6 {
+		t.Errorf("count %d after a stale entry, want 6", got)
+	}
+}
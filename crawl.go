@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The crawler enumerates the reachable nodes of a network by walking their
+// routing tables: every node found is pinged, with our hello so that it
+// tells us its protocol version and features, and then asked find_node
+// for an ID in each of its crawlBuckets farthest buckets, which between
+// them hold nearly all of its contacts. Contacts not seen before are
+// crawled next, breadth first, until none are left or the limit is hit.
+// Nodes we hear of but cannot reach are reported as unreached.
+const (
+	crawlBuckets  = 20
+	crawlParallel = 16
+)
+
+// CrawledNode is what the crawl learned about one node.
+type CrawledNode struct {
+	ID       string        `json:"id"`
+	Addr     string        `json:"addr"`
+	Reached  bool          `json:"reached"`
+	Version  int           `json:"version,omitempty"`
+	Features []string      `json:"features,omitempty"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+	Contacts []string      `json:"contacts,omitempty"` // IDs it returned, sorted
+}
+
+// CrawlReport is what a crawl found and how long it took.
+type CrawlReport struct {
+	Elapsed time.Duration `json:"elapsed"`
+	Nodes   []CrawledNode `json:"nodes"` // ordered by ID
+}
+
+// Crawl walks the network from seeds, addresses of nodes in it, crawling up
+// to limit nodes.
+func (n *Node) Crawl(ctx context.Context, seeds []string, limit int) CrawlReport {
+	start := n.clock.Now()
+	nodes := make(map[string]*CrawledNode)
+	seen := make(map[string]bool) // IDs and seed addresses
+	frontier := make([]contact, 0, len(seeds))
+	for _, addr := range seeds {
+		seen[addr] = true
+		frontier = append(frontier, contact{Addr: addr})
+	}
+	for len(frontier) > 0 && len(nodes) < limit && ctx.Err() == nil {
+		batch := frontier[:min(len(frontier), min(crawlParallel, limit-len(nodes)))]
+		frontier = frontier[len(batch):]
+		results := make([]CrawledNode, len(batch))
+		found := make([][]contact, len(batch))
+		var wg sync.WaitGroup
+		for i, c := range batch {
+			wg.Add(1)
+			go func(i int, c contact) {
+				defer wg.Done()
+				results[i], found[i] = n.crawlNode(ctx, c)
+			}(i, c)
+		}
+		wg.Wait()
+		for i, node := range results {
+			if node.ID == "" || nodes[node.ID] != nil {
+				continue
+			}
+			seen[node.ID] = true
+			nodes[node.ID] = &results[i]
+			known := make(map[string]bool)
+			for _, c := range found[i] {
+				if c.ID == n.self.id || known[c.ID] {
+					continue
+				}
+				known[c.ID] = true
+				results[i].Contacts = append(results[i].Contacts, c.ID)
+				if !seen[c.ID] {
+					seen[c.ID] = true
+					frontier = append(frontier, c)
+				}
+			}
+			sort.Strings(results[i].Contacts)
+		}
+	}
+
+	report := CrawlReport{Elapsed: n.clock.Now().Sub(start)}
+	for _, node := range nodes {
+		report.Nodes = append(report.Nodes, *node)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool { return report.Nodes[i].ID < report.Nodes[j].ID })
+	return report
+}
+
+// crawlNode pings the node c names and asks it for its contacts. c.ID is
+// empty for seeds, whose ID the ping tells us. A node that does not answer
+// the ping comes back unreached, with an empty ID if it was a seed.
+func (n *Node) crawlNode(ctx context.Context, c contact) (CrawledNode, []contact) {
+	addr := n.pickAddr(c)
+	node := CrawledNode{ID: c.ID, Addr: addr}
+	req := n.request(msgPing)
+	req.Hello = n.hello()
+	sent := n.clock.Now()
+	resp, err := n.send(ctx, addr, req)
+	if err != nil {
+		return node, nil
+	}
+	node.ID, node.Reached, node.RTT = resp.From.ID, true, n.clock.Now().Sub(sent)
+	node.Version = legacyVersion
+	if resp.Hello != nil {
+		node.Version, node.Features = resp.Hello.Version, resp.Hello.Features
+	}
+
+	contacts := make([]contact, 0)
+	for i := 0; i < crawlBuckets && ctx.Err() == nil; i++ {
+		req := n.request(msgFindNode)
+		req.Target = flipBit(node.ID, i)
+		resp, err := n.send(ctx, addr, req)
+		if err != nil {
+			var remote *remoteError
+			if errors.As(err, &remote) {
+				continue
+			}
+			break
+		}
+		contacts = append(contacts, resp.Nodes...)
+	}
+	return node, contacts
+}
+
+// flipBit returns id with bit i, counting from the most significant,
+// inverted: an ID in the bucket of bit length IDBits-i from id.
+func flipBit(id string, i int) string {
+	digit := hexDigit(id, i/4) ^ 8>>(i%4)
+	return id[:i/4] + string("0123456789abcdef"[digit]) + id[i/4+1:]
+}
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardKeys caps the stored keys the dashboard lists.
+const dashboardKeys = 200
+
+// The dashboard is a single page on the admin listener that reloads itself
+// every few seconds. It only reads what the node exposes anyway: Stats,
+// the routing table, recent lookups and the store.
+var dashboardPage = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"short": func(id string) string { return id[:min(8, len(id))] },
+	"ms":    func(d time.Duration) string { return d.Round(100 * time.Microsecond).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>dht {{short .ID}}</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { padding: 2px 10px; text-align: left; }
+tr:nth-child(even) { background: #f4f4f4; }
+code { font-size: 13px; }
+.bar { background: #4a7; height: 10px; }
+</style>
+</head>
+<body>
+<h1>Node <code>{{.ID}}</code></h1>
+<p>{{range .Addrs}}<code>{{.}}</code> {{end}}</p>
+<table>
+<tr><th>records</th><td>{{.Stats.Records}}</td></tr>
+<tr><th>stored bytes</th><td>{{.Stats.Bytes}}</td></tr>
+<tr><th>expiring within the hour</th><td>{{.Stats.Expiring}}</td></tr>
+<tr><th>contacts</th><td>{{.Stats.Contacts}}</td></tr>
+<tr><th>estimated network size</th><td>{{.Stats.Network}}</td></tr>
+<tr><th>sent bytes</th><td>{{.Stats.Sent}}</td></tr>
+<tr><th>received bytes</th><td>{{.Stats.Received}}</td></tr>
+</table>
+
+<h2>Routing table</h2>
+<table>
+<tr><th>bucket</th><th>contacts</th><th></th></tr>
+{{range .Buckets}}<tr><td>{{.Index}}</td><td>{{.Size}}</td><td><div class="bar" style="width: {{.Width}}px"></div></td></tr>
+{{end}}</table>
+
+<h2>Peers</h2>
+<table>
+<tr><th>ID</th><th>address</th><th>RTT</th><th>version</th><th>last seen</th></tr>
+{{range .Peers}}<tr><td><code>{{.ID}}</code></td><td>{{.Addr}}</td><td>{{if .RTT}}{{ms .RTT}}{{end}}</td><td>{{.Version}}</td><td>{{.Seen.Format "15:04:05"}}</td></tr>
+{{end}}</table>
+
+<h2>Recent lookups</h2>
+<table>
+<tr><th>started</th><th>type</th><th>target</th><th>took</th><th>found</th><th>contacted</th><th>bytes</th><th>hops</th></tr>
+{{range .Lookups}}<tr><td>{{.Started.Format "15:04:05"}}</td><td>{{.Type}}</td><td><code>{{short .Target}}</code></td><td>{{ms .Took}}</td><td>{{.Found}}</td><td>{{.Contacted}}</td><td>{{.Bytes}}</td>
+<td>{{range $i, $hop := .Hops}}{{$i}}: {{range $hop}}<code>{{short .}}</code> {{end}}<br>{{end}}</td></tr>
+{{end}}</table>
+
+<h2>Stored keys{{if .More}} (first {{len .Keys}}){{end}}</h2>
+<table>
+<tr><th>key</th><th>bytes</th><th>publisher</th><th>stored</th></tr>
+{{range .Keys}}<tr><td><code>{{.Key}}</code></td><td>{{.Size}}</td><td><code>{{short .Publisher}}</code></td><td>{{.Stored.Format "15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type dashboardData struct {
+	ID      string
+	Addrs   []string
+	Stats   nodeStats
+	Buckets []struct{ Index, Size, Width int }
+	Peers   []struct {
+		ID, Addr string
+		RTT      time.Duration
+		Version  int
+		Seen     time.Time
+	}
+	Lookups []lookupTrace
+	Keys    []struct {
+		Key, Publisher string
+		Size           int
+		Stored         time.Time
+	}
+	More bool
+}
+
+func (n *Node) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	data := dashboardData{ID: n.ID(), Addrs: n.Addrs(), Stats: n.Stats(), Lookups: n.RecentLookups()}
+	for i, size := range n.BucketSizes() {
+		if size > 0 {
+			data.Buckets = append(data.Buckets, struct{ Index, Size, Width int }{i, size, size * 200 / n.cfg.K})
+		}
+	}
+
+	n.mu.Lock()
+	peers := n.dht.peers()
+	for _, p := range peers {
+		data.Peers = append(data.Peers, struct {
+			ID, Addr string
+			RTT      time.Duration
+			Version  int
+			Seen     time.Time
+		}{p.id, p.addr, p.rtt, p.version, p.seen})
+	}
+	keys := n.store.keys()
+	sort.Strings(keys)
+	data.More = len(keys) > dashboardKeys
+	for _, key := range keys[:min(len(keys), dashboardKeys)] {
+		rec, _ := n.store.peek(key)
+		data.Keys = append(data.Keys, struct {
+			Key, Publisher string
+			Size           int
+			Stored         time.Time
+		}{key, rec.publisher, rec.size(), rec.stored})
+	}
+	n.mu.Unlock()
+	sort.Slice(data.Peers, func(i, j int) bool { return data.Peers[i].ID < data.Peers[j].ID })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboardPage.Execute(w, data)
+}
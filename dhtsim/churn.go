@@ -0,0 +1,127 @@
+package dhtsim
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Churn describes how the population changes over time. Rates are per hour
+// of simulated time: JoinRate is an absolute number of new nodes, LeaveRate
+// and FailureRate are the fraction of live nodes that leave for good or
+// fail for Downtime before coming back with their state intact.
+type Churn struct {
+	JoinRate    float64
+	LeaveRate   float64
+	FailureRate float64
+	Downtime    time.Duration
+}
+
+// ChurnScenario writes Keys records up front and then applies Churn for
+// Duration, sampling availability of those records every SampleEvery with
+// SampleReads reads from random live nodes.
+type ChurnScenario struct {
+	Churn       Churn
+	Duration    time.Duration
+	Keys        int
+	SampleEvery time.Duration
+	SampleReads int
+}
+
+type AvailabilityPoint struct {
+	At           time.Duration
+	Nodes        int
+	Down         int
+	Availability float64
+}
+
+func (s *Simulation) RunChurn(ctx context.Context, sc ChurnScenario) []AvailabilityPoint {
+	values := make(map[string]string)
+	keys := make([]string, 0, sc.Keys)
+	for i := 0; i < sc.Keys; i++ {
+		key := randomString(s.rng)
+		value := randomString(s.rng)
+		values[key] = value
+		keys = append(keys, key)
+		s.randomNode().Put(ctx, key, []byte(value))
+	}
+
+	points := []AvailabilityPoint{s.sample(ctx, 0, keys, values, sc.SampleReads)}
+	var elapsed, sinceSample time.Duration
+	for elapsed < sc.Duration && ctx.Err() == nil {
+		s.churn(ctx, sc.Churn, Step)
+		s.Advance(ctx, Step)
+		elapsed += Step
+		sinceSample += Step
+		if sinceSample >= sc.SampleEvery {
+			sinceSample = 0
+			points = append(points, s.sample(ctx, elapsed, keys, values, sc.SampleReads))
+		}
+	}
+	return points
+}
+
+// churn applies one step's worth of joins, leaves, failures and recoveries.
+func (s *Simulation) churn(ctx context.Context, c Churn, step time.Duration) {
+	now := s.clock.Now()
+	for node, until := range s.down {
+		if !now.Before(until) {
+			s.Recover(node)
+		}
+	}
+
+	hours := step.Hours()
+	for _, node := range s.Live() {
+		switch r := s.rng.Float64(); {
+		case r < c.LeaveRate*hours:
+			s.remove(node)
+		case r < (c.LeaveRate+c.FailureRate)*hours:
+			s.Fail(node, c.Downtime)
+		}
+	}
+	s.AddNodes(ctx, s.poisson(c.JoinRate*hours))
+}
+
+func (s *Simulation) remove(node Node) {
+	node.Close(context.Background())
+	for i, n := range s.nodes {
+		if n == node {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Simulation) sample(ctx context.Context, at time.Duration, keys []string, values map[string]string, reads int) AvailabilityPoint {
+	point := AvailabilityPoint{At: at, Nodes: len(s.nodes), Down: len(s.down)}
+	selected := selectRandom(s.rng, keys, reads)
+	if len(selected) == 0 {
+		return point
+	}
+	hits := 0
+	for _, key := range selected {
+		node := s.randomNode()
+		if node == nil {
+			break
+		}
+		if value, _, err := node.Get(ctx, key); err == nil && string(value) == values[key] {
+			hits++
+		}
+	}
+	point.Availability = float64(hits) / float64(len(selected))
+	return point
+}
+
+// poisson draws from a Poisson distribution with the given mean using
+// Knuth's method, which is fine for the small means of a single step.
+func (s *Simulation) poisson(mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+	limit := math.Exp(-mean)
+	count := 0
+	for p := s.rng.Float64(); p > limit; p *= s.rng.Float64() {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,140 @@
+package dhtsim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrClosed      = errors.New("endpoint closed")
+	ErrUnreachable = errors.New("address unreachable")
+)
+
+// A Handler answers a datagram from another endpoint. A nil answer means
+// the request went unanswered.
+type Handler func(from string, request []byte) []byte
+
+// Network connects Endpoints in the same process. It carries bytes, so
+// whatever uses it never shares memory through it, and delivers them at
+// once, in the order they are sent.
+type Network struct {
+	mu        sync.Mutex
+	endpoints map[string]*Endpoint
+	next      int
+	messages  int
+	groups    map[string]int // partition of every address while split
+}
+
+func NewNetwork() *Network {
+	return &Network{endpoints: make(map[string]*Endpoint)}
+}
+
+// Listen opens an endpoint on a new address.
+func (m *Network) Listen() *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	e := &Endpoint{network: m, addr: fmt.Sprintf("mem:%d", m.next)}
+	m.endpoints[e.addr] = e
+	return e
+}
+
+func (m *Network) endpoint(addr string) *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages++
+	return m.endpoints[addr]
+}
+
+// Split cuts the network into partitions: requests only get through
+// between addresses in the same group. Addresses without a group are in
+// group 0.
+func (m *Network) Split(groups map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups = groups
+}
+
+// Heal joins the partitions back together.
+func (m *Network) Heal() {
+	m.Split(nil)
+}
+
+func (m *Network) Connected(a, b string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.groups == nil || m.groups[a] == m.groups[b]
+}
+
+// Messages returns how many requests were sent so far, delivered or not.
+func (m *Network) Messages() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messages
+}
+
+// Endpoint is one address on a Network.
+type Endpoint struct {
+	network *Network
+	addr    string
+	mu      sync.Mutex
+	handler Handler
+	closed  bool
+}
+
+func (e *Endpoint) Addr() string {
+	return e.addr
+}
+
+// Serve makes handler answer the requests sent to the endpoint.
+func (e *Endpoint) Serve(handler Handler) {
+	e.mu.Lock()
+	e.handler = handler
+	e.mu.Unlock()
+}
+
+// Call delivers request to addr and returns its answer. It fails with
+// ErrUnreachable when nothing serves addr, addr is on the other side of a
+// partition or it did not answer.
+func (e *Endpoint) Call(addr string, request []byte) ([]byte, error) {
+	if e.Closed() {
+		return nil, ErrClosed
+	}
+	remote := e.network.endpoint(addr)
+	if remote == nil || remote.Closed() || !e.network.Connected(e.addr, addr) {
+		return nil, ErrUnreachable
+	}
+	remote.mu.Lock()
+	handler := remote.handler
+	remote.mu.Unlock()
+	if handler == nil {
+		return nil, ErrUnreachable
+	}
+	answer := handler(e.addr, request)
+	if answer == nil {
+		return nil, ErrUnreachable
+	}
+	return answer, nil
+}
+
+func (e *Endpoint) Close() error {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	return nil
+}
+
+// Reopen brings a closed endpoint back on the same address, which is how
+// a simulation models a node recovering from a crash.
+func (e *Endpoint) Reopen() {
+	e.mu.Lock()
+	e.closed = false
+	e.mu.Unlock()
+}
+
+func (e *Endpoint) Closed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
@@ -0,0 +1,76 @@
+package dhtsim
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func echo(from string, request []byte) []byte {
+	return append([]byte(from+":"), request...)
+}
+
+func TestNetworkPartition(t *testing.T) {
+	network := NewNetwork()
+	a, b, c := network.Listen(), network.Listen(), network.Listen()
+	for _, e := range []*Endpoint{a, b, c} {
+		e.Serve(echo)
+	}
+	answer, err := a.Call(b.Addr(), []byte("hi"))
+	if err != nil || !bytes.Equal(answer, []byte(a.Addr()+":hi")) {
+		t.Fatalf("answer %q, err %v", answer, err)
+	}
+
+	network.Split(map[string]int{c.Addr(): 1})
+	if _, err := a.Call(c.Addr(), nil); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("call across the split: err %v", err)
+	}
+	if _, err := a.Call(b.Addr(), nil); err != nil {
+		t.Errorf("call within a side: err %v", err)
+	}
+	network.Heal()
+	if _, err := a.Call(c.Addr(), nil); err != nil {
+		t.Errorf("call after healing: err %v", err)
+	}
+	if got := network.Messages(); got != 4 {
+		t.Errorf("%d messages counted, want 4", got)
+	}
+}
+
+func TestEndpointClosed(t *testing.T) {
+	network := NewNetwork()
+	a, b := network.Listen(), network.Listen()
+	b.Serve(func(string, []byte) []byte { return nil })
+	if _, err := a.Call(b.Addr(), nil); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("unanswered call: err %v", err)
+	}
+	b.Serve(echo)
+	b.Close()
+	if _, err := a.Call(b.Addr(), nil); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("call to a closed endpoint: err %v", err)
+	}
+	b.Reopen()
+	if _, err := a.Call(b.Addr(), nil); err != nil {
+		t.Errorf("call to a reopened endpoint: err %v", err)
+	}
+	a.Close()
+	if _, err := a.Call(b.Addr(), nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("call from a closed endpoint: err %v", err)
+	}
+}
+
+func TestReportExpect(t *testing.T) {
+	r := Report{Reads: 4, Hits: 3, Hops: []int{1, 2, 3}}
+	if err := r.Expect(0.75, 2); err != nil {
+		t.Errorf("within bounds: %v", err)
+	}
+	if err := r.Expect(0.8, 2); err == nil {
+		t.Error("hit rate 0.75 passed a bound of 0.8")
+	}
+	if err := r.Expect(0.75, 1.5); err == nil {
+		t.Error("mean hops 2 passed a bound of 1.5")
+	}
+	if r.MaxHops() != 3 {
+		t.Errorf("max hops %d", r.MaxHops())
+	}
+}
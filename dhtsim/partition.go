@@ -0,0 +1,190 @@
+package dhtsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PartitionScenario writes Keys records, splits the network into Groups
+// random partitions At that long into the run, writes Keys more, each
+// only reaching its writer's side, heals it Length later and keeps going
+// until Duration. Every SampleEvery it records how converged
+// routing tables and replica sets are and how many of SampleReads reads
+// from random nodes succeed.
+type PartitionScenario struct {
+	Groups      int
+	At          time.Duration
+	Length      time.Duration
+	Duration    time.Duration
+	Keys        int
+	SampleEvery time.Duration
+	SampleReads int
+}
+
+// PartitionPoint is one sample. Routing is the mean fraction of every
+// node's k closest nodes, by the whole network, that its routing table
+// holds; Replicas the mean fraction of every key's closest nodes, as many
+// as its namespace replicates to, that store it.
+type PartitionPoint struct {
+	At           time.Duration
+	Split        bool
+	Routing      float64
+	Replicas     float64
+	Availability float64
+}
+
+// PartitionReport is the samples of a partition scenario and when the
+// network was healed.
+type PartitionReport struct {
+	Points   []PartitionPoint
+	HealedAt time.Duration
+}
+
+// Reconverged returns how long after healing routing and replicas first
+// reached the given levels in the same sample, false if they never did.
+func (r PartitionReport) Reconverged(routing, replicas float64) (time.Duration, bool) {
+	for _, p := range r.Points {
+		if p.At >= r.HealedAt && !p.Split && p.Routing >= routing && p.Replicas >= replicas {
+			return p.At - r.HealedAt, true
+		}
+	}
+	return 0, false
+}
+
+// Expect returns an error unless routing and replicas reconverged to the
+// given levels within the given time of healing.
+func (r PartitionReport) Expect(routing, replicas float64, within time.Duration) error {
+	after, ok := r.Reconverged(routing, replicas)
+	switch {
+	case !ok:
+		return fmt.Errorf("routing %.3f and replicas %.3f not reached after healing", routing, replicas)
+	case after > within:
+		return fmt.Errorf("reconverged after %v, more than %v", after, within)
+	}
+	return nil
+}
+
+func (s *Simulation) RunPartition(ctx context.Context, sc PartitionScenario) (PartitionReport, error) {
+	if sc.Groups < 2 {
+		return PartitionReport{}, errors.New("a partition needs at least 2 groups")
+	}
+	values := make(map[string]string)
+	keys := make([]string, 0, 2*sc.Keys)
+	write := func() {
+		for i := 0; i < sc.Keys; i++ {
+			key := randomString(s.rng)
+			value := randomString(s.rng)
+			values[key] = value
+			keys = append(keys, key)
+			s.randomNode().Put(ctx, key, []byte(value))
+		}
+	}
+	write()
+
+	report := PartitionReport{HealedAt: sc.At + sc.Length}
+	report.Points = append(report.Points, s.samplePartition(ctx, 0, false, keys, values, sc.SampleReads))
+	var elapsed, sinceSample time.Duration
+	split := false
+	for elapsed < sc.Duration && ctx.Err() == nil {
+		switch {
+		case !split && elapsed >= sc.At && elapsed < report.HealedAt:
+			groups := make(map[string]int)
+			for _, node := range s.nodes {
+				group := s.rng.Intn(sc.Groups)
+				for _, addr := range node.Addrs() {
+					groups[addr] = group
+				}
+			}
+			s.net.Split(groups)
+			split = true
+			write()
+		case split && elapsed >= report.HealedAt:
+			s.net.Heal()
+			split = false
+		}
+		s.Advance(ctx, Step)
+		elapsed += Step
+		sinceSample += Step
+		if sinceSample >= sc.SampleEvery {
+			sinceSample = 0
+			report.Points = append(report.Points, s.samplePartition(ctx, elapsed, split, keys, values, sc.SampleReads))
+		}
+	}
+	return report, ctx.Err()
+}
+
+func (s *Simulation) samplePartition(ctx context.Context, at time.Duration, split bool, keys []string, values map[string]string, reads int) PartitionPoint {
+	point := PartitionPoint{At: at, Split: split}
+	live := s.Live()
+	if len(live) < 2 {
+		return point
+	}
+	nearest := func(target string, count int, exclude Node) []Node {
+		nodes := make([]Node, 0, len(live))
+		for _, node := range live {
+			if node != exclude {
+				nodes = append(nodes, node)
+			}
+		}
+		sort.Slice(nodes, func(i, j int) bool { return closer(nodes[i].ID(), nodes[j].ID(), target) })
+		return nodes[:min(count, len(nodes))]
+	}
+
+	for _, node := range live {
+		closest := nearest(node.ID(), node.BucketSize(), node)
+		known := 0
+		for _, other := range closest {
+			if node.Knows(other.ID()) {
+				known++
+			}
+		}
+		point.Routing += float64(known) / float64(len(closest))
+	}
+	point.Routing /= float64(len(live))
+
+	for _, key := range keys {
+		target, count := live[0].Placement(key)
+		replicas := nearest(target, count, nil)
+		holding := 0
+		for _, node := range replicas {
+			if node.Holds(key) {
+				holding++
+			}
+		}
+		point.Replicas += float64(holding) / float64(len(replicas))
+	}
+	if len(keys) > 0 {
+		point.Replicas /= float64(len(keys))
+	}
+
+	availability := s.sample(ctx, at, keys, values, reads)
+	point.Availability = availability.Availability
+	return point
+}
+
+// closer tells whether the hex ID a is nearer to target than b by XOR
+// distance, comparing them one digit at a time.
+func closer(a, b, target string) bool {
+	for i := range target {
+		t := hexDigit(target, i)
+		x, y := hexDigit(a, i)^t, hexDigit(b, i)^t
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// hexDigit returns the value of the i-th hex digit of id, treating missing
+// or malformed digits as zero.
+func hexDigit(id string, i int) uint64 {
+	if i >= len(id) {
+		return 0
+	}
+	v, _ := strconv.ParseUint(id[i:i+1], 16, 8)
+	return v
+}
@@ -0,0 +1,62 @@
+package dhtsim
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Report summarizes the reads of a workload.
+type Report struct {
+	Reads    int
+	Hits     int
+	Hops     []int
+	Messages int
+	Results  []Read
+}
+
+type Read struct {
+	Key   string
+	Value string
+	Hit   bool
+	Hops  int
+}
+
+func (r Report) HitRate() float64 {
+	if r.Reads == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Reads)
+}
+
+func (r Report) MeanHops() float64 {
+	if len(r.Hops) == 0 {
+		return 0
+	}
+	total := 0
+	for _, h := range r.Hops {
+		total += h
+	}
+	return float64(total) / float64(len(r.Hops))
+}
+
+func (r Report) MaxHops() int {
+	max := 0
+	for _, h := range r.Hops {
+		if h > max {
+			max = h
+		}
+	}
+	return max
+}
+
+// Expect returns an error describing every bound the report violates.
+func (r Report) Expect(minHitRate float64, maxMeanHops float64) error {
+	var errs []error
+	if r.HitRate() < minHitRate {
+		errs = append(errs, fmt.Errorf("hit rate %.3f below %.3f", r.HitRate(), minHitRate))
+	}
+	if r.MeanHops() > maxMeanHops {
+		errs = append(errs, fmt.Errorf("mean hops %.2f above %.2f", r.MeanHops(), maxMeanHops))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,225 @@
+// Package dhtsim runs whole networks of DHT nodes in one process, for
+// tests and experiments: a clock that only moves when told, an in-memory
+// datagram network that can be split into partitions, a Simulation that
+// starts nodes on them and drives scripted workloads, churn and
+// partitions, and the reports those produce with the bounds tests hold
+// them to. It knows nodes only through the Node interface; package dht
+// provides them, see dht.Simulated.
+package dhtsim
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Step is how far Advance moves the clock before every node does its due
+// maintenance.
+const Step = time.Minute
+
+// Node is a node in a simulation.
+type Node interface {
+	ID() string
+	// Addrs are the addresses it listens on, on the simulation's network.
+	Addrs() []string
+	Bootstrap(ctx context.Context, seeds []string) error
+	Put(ctx context.Context, key string, value []byte) error
+	// Get looks key up in the network and says how many hops it took.
+	Get(ctx context.Context, key string) (value []byte, hops int, err error)
+	// Maintain does whatever maintenance is due by the clock.
+	Maintain(ctx context.Context)
+	// Fail stops it answering, as a crash would, and Recover brings it
+	// back on the same addresses with its state intact.
+	Fail()
+	Recover()
+	// Close makes it leave the network for good.
+	Close(ctx context.Context) error
+
+	// Knows tells whether id is in its routing table.
+	Knows(id string) bool
+	// Holds tells whether it stores key.
+	Holds(key string) bool
+	// Placement returns the ID key is stored nearest to and on how many
+	// of the nodes nearest to it.
+	Placement(key string) (target string, replicas int)
+	// BucketSize is how many of the nodes nearest to it it should know.
+	BucketSize() int
+}
+
+// NewNode starts a node on network that keeps time by clock and draws its
+// identity and anything else random from random.
+type NewNode func(network *Network, clock *Clock, random io.Reader) Node
+
+// Simulation runs many nodes over a Network driven by a Clock. Node IDs,
+// workloads and message ordering all derive from the seed, so the same
+// seed and script always produce the same report.
+type Simulation struct {
+	newNode NewNode
+	clock   *Clock
+	net     *Network
+	rng     *rand.Rand
+	nodes   []Node
+	down    map[Node]time.Time
+}
+
+func New(newNode NewNode, seed int64) *Simulation {
+	return &Simulation{
+		newNode: newNode,
+		clock:   NewClock(time.Unix(0, 0).UTC()),
+		net:     NewNetwork(),
+		rng:     rand.New(rand.NewSource(seed)),
+		down:    make(map[Node]time.Time),
+	}
+}
+
+func (s *Simulation) Clock() *Clock {
+	return s.clock
+}
+
+func (s *Simulation) Network() *Network {
+	return s.net
+}
+
+// Rand is the simulation's source of randomness, for scripts that should
+// stay as deterministic as the simulation itself.
+func (s *Simulation) Rand() *rand.Rand {
+	return s.rng
+}
+
+// Nodes returns every node that has not left, up or not, in the order
+// they were added.
+func (s *Simulation) Nodes() []Node {
+	return append([]Node(nil), s.nodes...)
+}
+
+// AddNodes starts count nodes, each bootstrapping through a random node that
+// is already part of the network.
+func (s *Simulation) AddNodes(ctx context.Context, count int) {
+	for i := 0; i < count; i++ {
+		node := s.newNode(s.net, s.clock, s.rng)
+		if seed := s.randomNode(); seed != nil {
+			node.Bootstrap(ctx, seed.Addrs())
+		}
+		s.nodes = append(s.nodes, node)
+	}
+}
+
+// Add makes node, started on the simulation's network but not
+// bootstrapped, part of the simulation.
+func (s *Simulation) Add(node Node) {
+	s.nodes = append(s.nodes, node)
+}
+
+// Fail takes node down for d, after which churn brings it back; a
+// script without churn recovers it with Recover.
+func (s *Simulation) Fail(node Node, d time.Duration) {
+	node.Fail()
+	s.down[node] = s.clock.Now().Add(d)
+}
+
+func (s *Simulation) Recover(node Node) {
+	node.Recover()
+	delete(s.down, node)
+}
+
+// Advance moves simulated time forward in steps, running due maintenance on
+// every node after each step.
+func (s *Simulation) Advance(ctx context.Context, d time.Duration) {
+	for d > 0 && ctx.Err() == nil {
+		step := min(d, Step)
+		s.clock.Advance(step)
+		d -= step
+		for _, node := range s.nodes {
+			if _, down := s.down[node]; !down {
+				node.Maintain(ctx)
+			}
+		}
+	}
+}
+
+// randomNode returns a random node that is currently up, or nil if there
+// is none.
+func (s *Simulation) randomNode() Node {
+	live := s.Live()
+	if len(live) == 0 {
+		return nil
+	}
+	return live[s.rng.Intn(len(live))]
+}
+
+// Live returns the nodes that are up.
+func (s *Simulation) Live() []Node {
+	live := make([]Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		if _, down := s.down[node]; !down {
+			live = append(live, node)
+		}
+	}
+	return live
+}
+
+// Workload is a scripted run: write Keys records from random nodes, let
+// Wait of simulated time pass, then read Reads of them back from random
+// nodes.
+type Workload struct {
+	Keys  int
+	Reads int
+	Wait  time.Duration
+}
+
+func (s *Simulation) Run(ctx context.Context, w Workload) Report {
+	start := s.net.Messages()
+	values := make(map[string]string)
+	keys := make([]string, 0, w.Keys)
+	for i := 0; i < w.Keys; i++ {
+		key := randomString(s.rng)
+		value := randomString(s.rng)
+		values[key] = value
+		keys = append(keys, key)
+		s.randomNode().Put(ctx, key, []byte(value))
+	}
+
+	s.Advance(ctx, w.Wait)
+
+	report := Report{}
+	for _, key := range selectRandom(s.rng, keys, w.Reads) {
+		read := Read{Key: key}
+		value, hops, err := s.randomNode().Get(ctx, key)
+		if err == nil {
+			read.Value = string(value)
+			read.Hit = read.Value == values[key]
+			read.Hops = hops
+			report.Hops = append(report.Hops, hops)
+		}
+		report.Reads++
+		if read.Hit {
+			report.Hits++
+		}
+		report.Results = append(report.Results, read)
+	}
+	report.Messages = s.net.Messages() - start
+	return report
+}
+
+func randomString(rng *rand.Rand) string {
+	length := rng.Intn(6) + 5
+	result := make([]byte, length)
+	characters := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	for i := 0; i < length; i++ {
+		result[i] = characters[rng.Intn(len(characters))]
+	}
+	return string(result)
+}
+
+func selectRandom(rng *rand.Rand, arr []string, count int) []string {
+	shuffled := make([]string, len(arr))
+	copy(shuffled, arr)
+	i := len(arr)
+	for i > 0 {
+		randomIndex := rng.Intn(i)
+		i--
+		shuffled[i], shuffled[randomIndex] = shuffled[randomIndex], shuffled[i]
+	}
+	return shuffled[:min(count, len(shuffled))]
+}
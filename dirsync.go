@@ -0,0 +1,16 @@
+//go:build !windows
+
+package dht
+
+import "os"
+
+// syncDir flushes dir's entries, so a file just renamed into it stays
+// renamed after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
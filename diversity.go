@@ -0,0 +1,44 @@
+package dht
+
+// An attacker with one subnet can make up any number of node IDs, and so
+// fill the buckets around a victim's ID with its own nodes, eclipsing it.
+// The routing table therefore takes at most limits.bucket_subnet contacts
+// from any one /24, or /64 for IPv6, at each XOR distance bit length, a
+// bucket's worth even while the leaf on our ID's path has not split, and
+// at most limits.table_subnet overall; contacts sharing an IP count as
+// sharing its subnet. Contacts over the limit are turned away, not kept as
+// replacements. Loopback and private addresses are exempt, so test
+// networks on one machine or LAN still work, and so are contacts without
+// an IP, which the in-memory transport and relays give.
+
+// subnetLimited returns the subnet of p counted against the limits, false
+// if it is exempt.
+func subnetLimited(p *Peer) (string, bool) {
+	ip, ok := addrIP(p.addr)
+	if !ok || ip.IsLoopback() || ip.IsPrivate() {
+		return "", false
+	}
+	return subnetOf(ip).String(), true
+}
+
+// diverse reports whether adding p keeps within the subnet limits.
+func (d *DHT) diverse(p *Peer) bool {
+	if d.bucketSubnet <= 0 && d.tableSubnet <= 0 {
+		return true
+	}
+	subnet, limited := subnetLimited(p)
+	if !limited {
+		return true
+	}
+	index := d.bucketIndex(p.id)
+	inBucket, inTable := 0, 0
+	for _, other := range d.peers() {
+		if s, ok := subnetLimited(other); ok && s == subnet && other.id != p.id {
+			inTable++
+			if d.bucketIndex(other.id) == index {
+				inBucket++
+			}
+		}
+	}
+	return (d.bucketSubnet <= 0 || inBucket < d.bucketSubnet) && (d.tableSubnet <= 0 || inTable < d.tableSubnet)
+}
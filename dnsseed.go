@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	dnsSeedPrefix = "dnsseed:"
+	defaultPort   = 4000
+)
+
+// parseDNSSeed splits "dnsseed:host[:port]" into the name to resolve and the
+// port to use for its A/AAAA records.
+func parseDNSSeed(entry string) (host string, port int, ok bool) {
+	rest, ok := strings.CutPrefix(entry, dnsSeedPrefix)
+	if !ok || rest == "" {
+		return "", 0, false
+	}
+	if h, p, err := net.SplitHostPort(rest); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 || h == "" {
+			return "", 0, false
+		}
+		return h, port, true
+	}
+	return rest, defaultPort, true
+}
+
+// resolveBootstrap expands dnsseed: entries into concrete addresses and
+// passes every other entry through. A seed's A and AAAA records are paired
+// with its port; each of its TXT records may list further host:port
+// addresses, optionally prefixed with "dht=".
+func (n *Node) resolveBootstrap(ctx context.Context, entries []string) []string {
+	addrs := make([]string, 0, len(entries))
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	for _, entry := range entries {
+		host, port, ok := parseDNSSeed(entry)
+		if !ok {
+			add(entry)
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			n.log.Debug("dns seed has no address records", "seed", host, "err", err)
+		}
+		for _, ip := range ips {
+			add(net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)))
+		}
+		txts, err := net.DefaultResolver.LookupTXT(ctx, host)
+		if err != nil {
+			n.log.Debug("dns seed has no txt records", "seed", host, "err", err)
+		}
+		for _, txt := range txts {
+			for _, field := range strings.Fields(txt) {
+				field = strings.TrimPrefix(field, "dht=")
+				if _, _, err := net.SplitHostPort(field); err == nil {
+					add(field)
+				}
+			}
+		}
+		n.log.Info("resolved dns seed", "seed", host, "peers", len(addrs))
+	}
+	return addrs
+}
@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDraining   = errors.New("node is draining")
+	ErrNotDrained = errors.New("records not drained")
+)
+
+// Decommission takes the node out of the network for good. Unlike Close,
+// whose leave_handoff stores each record once and leaves whatever became
+// of it, it is for planned removals that must not lose a copy: it stops
+// taking stores, refusing them with ErrDraining, and stores every record
+// it holds at the key's other replicas, looked up afresh, until a majority
+// of them, or all if fewer were found, have acknowledged it or answered
+// that they hold a newer version. Records short of that are tried once
+// more. Only if every record made it does it close the node; otherwise it
+// takes stores again, stays up and returns an error wrapping
+// ErrNotDrained, and can be called again. Pushed hot-key copies are not
+// drained, and neither are values the node Puts meanwhile.
+func (n *Node) Decommission(ctx context.Context) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.draining = true
+	keys := n.store.keys()
+	n.mu.Unlock()
+
+	var failed []string
+	for attempt := 0; attempt < 2 && len(keys) > 0; attempt++ {
+		failed = nil
+		for _, key := range keys {
+			if ctx.Err() != nil || !n.drainRecord(ctx, key) {
+				failed = append(failed, key)
+			}
+		}
+		keys = failed
+	}
+	if len(failed) > 0 {
+		n.mu.Lock()
+		n.draining = false
+		n.mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%w: %d left: %w", ErrNotDrained, len(failed), err)
+		}
+		return fmt.Errorf("%w: %d left", ErrNotDrained, len(failed))
+	}
+	n.log.Info("drained records")
+	return n.Close(ctx)
+}
+
+// drainRecord stores key at its other replicas and reports whether enough
+// of them acknowledged it, or it needs no draining.
+func (n *Node) drainRecord(ctx context.Context, key string) bool {
+	line, ok := n.snapshotRecord(key)
+	if !ok || n.pushedCopy(key) {
+		return true
+	}
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return false
+	}
+	n.mu.Lock()
+	need := min(ConsistencyQuorum.replicasNeeded(n.replication(key)), len(replicas))
+	n.mu.Unlock()
+	acked := 0
+	for _, r := range n.storeVersionAt(ctx, replicas, result.tokens, key, line.Value, line.Version) {
+		// A replica with a newer version holds the record already.
+		if r.err == nil || r.err.Error() == ErrOutdated.Error() {
+			acked++
+		}
+	}
+	if acked < need {
+		n.log.Debug("draining record fell short", "key", key, "acked", acked, "need", need)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// drainNetwork returns a simulated network of 30 nodes, K 8, in which
+// node 5 holds the only copy of every record it is a replica of.
+func drainNetwork(t *testing.T) (*dhtsim.Simulation, *Node, []string) {
+	t.Helper()
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 4)
+	sim.AddNodes(ctx, 30)
+	for i := 0; i < 30; i++ {
+		if err := simNodes(sim)[0].Put(ctx, fmt.Sprint("k", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	x := simNodes(sim)[5]
+	held := x.store.keys()
+	if len(held) == 0 {
+		t.Fatal("node holds no records")
+	}
+	for _, n := range simNodes(sim) {
+		if n == x {
+			continue
+		}
+		n.mu.Lock()
+		for _, key := range held {
+			n.store.delete(key)
+		}
+		n.mu.Unlock()
+	}
+	return sim, x, held
+}
+
+// copies counts the nodes other than x that hold key.
+func copies(sim *dhtsim.Simulation, x *Node, key string) int {
+	count := 0
+	for _, n := range simNodes(sim) {
+		n.mu.Lock()
+		if n != x && n.store.has(key) {
+			count++
+		}
+		n.mu.Unlock()
+	}
+	return count
+}
+
+func TestDecommissionDrains(t *testing.T) {
+	sim, x, held := drainNetwork(t)
+	if err := x.Decommission(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !x.closed {
+		t.Error("node still open after draining")
+	}
+	for _, key := range held {
+		// A majority of K, less ourselves.
+		if got := copies(sim, x, key); got < 4 {
+			t.Errorf("%s: %d copies left, want at least 4", key, got)
+		}
+	}
+}
+
+func TestDecommissionNewerReplicas(t *testing.T) {
+	sim, x, held := drainNetwork(t)
+	ctx := context.Background()
+	// Every other replica already holds a newer version.
+	for _, key := range held {
+		r, _ := x.store.peek(key)
+		for _, n := range simNodes(sim) {
+			if n == x {
+				continue
+			}
+			n.mu.Lock()
+			n.store.put(&record{key: key, value: []byte("newer"), publisher: r.publisher, stored: n.clock.Now(), version: r.version + 1})
+			n.mu.Unlock()
+		}
+	}
+	if err := x.Decommission(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !x.closed {
+		t.Error("node still open after draining")
+	}
+	for _, key := range held {
+		value, err := simNodes(sim)[0].Get(ctx, key)
+		if err != nil || string(value) != "newer" {
+			t.Errorf("%s: got %q, %v; want the newer version", key, value, err)
+		}
+	}
+}
+
+func TestDecommissionNowhereToGo(t *testing.T) {
+	ctx := context.Background()
+	sim := newSimulation(DefaultConfig(), 4)
+	sim.AddNodes(ctx, 1)
+	x := simNodes(sim)[0]
+	if err := x.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Decommission(ctx); !errors.Is(err, ErrNotDrained) {
+		t.Fatalf("got %v, want ErrNotDrained", err)
+	}
+	if x.closed || x.draining {
+		t.Error("node left or kept refusing stores after a failed drain")
+	}
+}
@@ -0,0 +1,335 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Node records follow the ENR format of EIP-778: an RLP list of a
+// signature, a sequence number and sorted key/value pairs, at most 300
+// bytes, written as "enr:" plus unpadded URL-safe base64. Every node signs
+// one describing itself and sends it along with its contact, and passes on
+// the verified records of the contacts it hands out, so peers learn
+// addresses and capabilities straight from their owner. The standard v4
+// identity scheme needs secp256k1, which the standard library lacks, so
+// records here use an "ed25519" scheme keyed by the node identity; the ID
+// is derived from the key exactly as for the node itself. Layout, keys
+// and encoding are otherwise those of discv5, plus an "addrs" key listing
+// the node's multiaddrs, comma-separated, when they fit.
+//
+// With require_records a node takes no contact without a valid record:
+// senders must carry one, contacts passed on by others are called only at
+// the addresses their record lists, never at those that came alongside,
+// and a peer we call is only kept if its reply carries its record. A peer
+// can then hand out the IDs of others but not tie them to addresses of
+// its choosing.
+const (
+	enrPrefix     = "enr:"
+	enrScheme     = "ed25519"
+	maxRecordSize = 300
+	maxRecordText = len(enrPrefix) + (maxRecordSize*8+5)/6
+
+	maxVerifiedRecords = 4096
+)
+
+var ErrBadRecord = errors.New("invalid node record")
+
+type nodeRecord struct {
+	seq   uint64
+	pairs map[string][]byte
+	sig   []byte
+	text  string
+	id    string
+}
+
+// newNodeRecord signs a record for key announcing addr, when it is an IP
+// address and port, addrs unless that makes the record too large, and
+// caps.
+func newNodeRecord(key ed25519.PrivateKey, seq uint64, addr string, addrs []string, caps []string) (*nodeRecord, error) {
+	r := &nodeRecord{seq: seq, pairs: map[string][]byte{
+		"id":      []byte(enrScheme),
+		enrScheme: key.Public().(ed25519.PublicKey),
+	}}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		ip := net.ParseIP(host)
+		udp, err := strconv.ParseUint(port, 10, 16)
+		if ip != nil && !ip.IsUnspecified() && err == nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				r.pairs["ip"] = ip4
+			} else {
+				r.pairs["ip6"] = ip
+			}
+			r.pairs["udp"] = binary.BigEndian.AppendUint16(nil, uint16(udp))
+		}
+	}
+	if len(caps) > 0 {
+		r.pairs["caps"] = []byte(strings.Join(caps, ","))
+	}
+	if r.hasCap(capOnion) {
+		r.pairs[onionPair] = onionKey(key).PublicKey().Bytes()
+	}
+	if len(addrs) > 0 {
+		r.pairs["addrs"] = []byte(strings.Join(addrs, ","))
+	}
+	r.sig = ed25519.Sign(key, rlpList(r.content()))
+	data := r.encode()
+	if len(data) > maxRecordSize && len(addrs) > 0 {
+		return newNodeRecord(key, seq, addr, nil, caps)
+	}
+	if len(data) > maxRecordSize {
+		return nil, fmt.Errorf("node record larger than %d bytes", maxRecordSize)
+	}
+	r.text = enrPrefix + base64.RawURLEncoding.EncodeToString(data)
+	r.id = nodeIDFromKey(key.Public().(ed25519.PublicKey))
+	return r, nil
+}
+
+// content is the signed part of the record: seq and the sorted pairs.
+func (r *nodeRecord) content() [][]byte {
+	keys := make([]string, 0, len(r.pairs))
+	for k := range r.pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := [][]byte{rlpString(rlpUint(r.seq))}
+	for _, k := range keys {
+		items = append(items, rlpString([]byte(k)), rlpString(r.pairs[k]))
+	}
+	return items
+}
+
+func (r *nodeRecord) encode() []byte {
+	return rlpList(append([][]byte{rlpString(r.sig)}, r.content()...))
+}
+
+func (r *nodeRecord) String() string {
+	return r.text
+}
+
+// parseNodeRecord decodes and verifies a record in its text form.
+func parseNodeRecord(text string) (*nodeRecord, error) {
+	if !strings.HasPrefix(text, enrPrefix) {
+		return nil, ErrBadRecord
+	}
+	data, err := base64.RawURLEncoding.DecodeString(text[len(enrPrefix):])
+	if err != nil || len(data) > maxRecordSize {
+		return nil, ErrBadRecord
+	}
+	items, err := rlpSplitList(data)
+	if err != nil || len(items) < 2 || len(items)%2 != 0 || len(items[1]) > 8 {
+		return nil, ErrBadRecord
+	}
+	r := &nodeRecord{sig: items[0], pairs: make(map[string][]byte), text: text}
+	for _, b := range items[1] {
+		r.seq = r.seq<<8 | uint64(b)
+	}
+	for i := 2; i < len(items); i += 2 {
+		k := string(items[i])
+		if i > 2 && k <= string(items[i-2]) {
+			return nil, ErrBadRecord
+		}
+		r.pairs[k] = items[i+1]
+	}
+	pub := r.pairs[enrScheme]
+	if string(r.pairs["id"]) != enrScheme || len(pub) != ed25519.PublicKeySize {
+		return nil, ErrBadRecord
+	}
+	if !ed25519.Verify(pub, rlpList(r.content()), r.sig) {
+		return nil, ErrBadSignature
+	}
+	r.id = nodeIDFromKey(pub)
+	return r, nil
+}
+
+func (r *nodeRecord) nodeID() string {
+	return r.id
+}
+
+// publicKey is the identity key that signed the record.
+func (r *nodeRecord) publicKey() ed25519.PublicKey {
+	return r.pairs[enrScheme]
+}
+
+// addr returns the UDP address the record announces, "" if none.
+func (r *nodeRecord) addr() string {
+	port := r.pairs["udp"]
+	if len(port) != 2 {
+		return ""
+	}
+	ip := net.IP(r.pairs["ip"])
+	if len(ip) != net.IPv4len {
+		if ip = net.IP(r.pairs["ip6"]); len(ip) != net.IPv6len {
+			return ""
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// addrs returns the multiaddrs the record announces.
+func (r *nodeRecord) addrs() []string {
+	if len(r.pairs["addrs"]) == 0 {
+		return nil
+	}
+	addrs := strings.Split(string(r.pairs["addrs"]), ",")
+	return addrs[:min(len(addrs), maxContactAddrs)]
+}
+
+func (r *nodeRecord) hasCap(name string) bool {
+	for _, c := range strings.Split(string(r.pairs["caps"]), ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signRecord replaces our own record with a fresh one with a higher
+// sequence number. Using the clock keeps sequence numbers growing across
+// restarts without storing them.
+func (n *Node) signRecord() {
+	caps := make([]string, 0, 1)
+	if n.cfg.CompressThreshold > 0 {
+		caps = append(caps, codecDeflate)
+	}
+	if n.cfg.OnionRelay {
+		caps = append(caps, capOnion)
+	}
+	seq := uint64(n.clock.Now().Unix())
+	if n.self.record != nil {
+		seq = max(seq, n.self.record.seq+1)
+	}
+	r, err := newNodeRecord(n.key, seq, n.self.addr, n.self.addrs, caps)
+	if err != nil {
+		n.log.Warn("not announcing a node record", "err", err)
+		return
+	}
+	n.self.record = r
+}
+
+// contactRecord returns the record a contact for id carried if it is
+// valid and really describes id, nil otherwise. Lookups see the same
+// records over and over, so verified ones are remembered, up to
+// maxVerifiedRecords at a time.
+func (n *Node) contactRecord(id, text string) *nodeRecord {
+	if text == "" {
+		return nil
+	}
+	n.mu.Lock()
+	r, ok := n.verified[text]
+	n.mu.Unlock()
+	if !ok {
+		var err error
+		if r, err = parseNodeRecord(text); err != nil {
+			return nil
+		}
+		n.mu.Lock()
+		if n.verified == nil || len(n.verified) >= maxVerifiedRecords {
+			n.verified = make(map[string]*nodeRecord)
+		}
+		n.verified[text] = r
+		n.mu.Unlock()
+	}
+	if r.nodeID() != id {
+		return nil
+	}
+	return r
+}
+
+func (c contact) withRecord(r *nodeRecord) contact {
+	if r != nil {
+		c.ENR = r.text
+	}
+	return c
+}
+
+// RLP, as far as node records need it: byte strings, and one flat list of
+// them.
+
+func rlpUint(v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	return bytes.TrimLeft(b, "\x00")
+}
+
+func rlpString(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpHeader(0x80, len(b)), b...)
+}
+
+func rlpList(items [][]byte) []byte {
+	payload := bytes.Join(items, nil)
+	return append(rlpHeader(0xc0, len(payload)), payload...)
+}
+
+func rlpHeader(base byte, size int) []byte {
+	if size <= 55 {
+		return []byte{base + byte(size)}
+	}
+	length := rlpUint(uint64(size))
+	return append([]byte{base + 55 + byte(len(length))}, length...)
+}
+
+// rlpSplitList decodes a list of byte strings taking up all of data.
+func rlpSplitList(data []byte) ([][]byte, error) {
+	list, rest, isList, err := rlpNext(data)
+	if err != nil || !isList || len(rest) > 0 {
+		return nil, ErrBadRecord
+	}
+	items := make([][]byte, 0)
+	for len(list) > 0 {
+		var item []byte
+		if item, list, isList, err = rlpNext(list); err != nil || isList {
+			return nil, ErrBadRecord
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// rlpNext splits the first item off data, returning its payload.
+func rlpNext(data []byte) (payload, rest []byte, isList bool, err error) {
+	if len(data) == 0 {
+		return nil, nil, false, ErrBadRecord
+	}
+	b := data[0]
+	var offset, size int
+	switch {
+	case b < 0x80:
+		return data[:1], data[1:], false, nil
+	case b <= 0xb7:
+		offset, size = 1, int(b-0x80)
+	case b < 0xc0:
+		offset, size, err = rlpLongSize(data, int(b-0xb7))
+	case b <= 0xf7:
+		offset, size, isList = 1, int(b-0xc0), true
+	default:
+		offset, size, err = rlpLongSize(data, int(b-0xf7))
+		isList = true
+	}
+	if err != nil || size > len(data)-offset {
+		return nil, nil, false, ErrBadRecord
+	}
+	return data[offset : offset+size], data[offset+size:], isList, nil
+}
+
+func rlpLongSize(data []byte, lengthSize int) (offset, size int, err error) {
+	if lengthSize > 2 || len(data) < 1+lengthSize || data[1] == 0 {
+		return 0, 0, ErrBadRecord
+	}
+	for _, b := range data[1 : 1+lengthSize] {
+		size = size<<8 | int(b)
+	}
+	if size <= 55 {
+		return 0, 0, ErrBadRecord
+	}
+	return 1 + lengthSize, size, nil
+}
@@ -0,0 +1,308 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Put with WithErasureCoding splits a value into data shards, adds parity
+// shards computed with a systematic Reed-Solomon code over GF(2^8), and
+// stores each shard once, under a key of its own in the shard namespace
+// derived from the value's hash and the shard's index, so shards land on
+// unrelated nodes. Under the key itself goes a small manifest, replicated
+// as usual, whose value starts with manifestMagic. Get recognises a
+// manifest and fetches shards until it has data of them, which is enough
+// to rebuild the value: it survives the loss of any parity shards, for
+// (data+parity)/data times its size where plain replication takes k
+// times. Values too large for max_value_size fit as long as their shards
+// do.
+const (
+	shardNamespace = "shard"
+	manifestMagic  = "\x00dht-erasure\x00"
+	maxShards      = 255
+	shardParallel  = 8
+)
+
+var ErrNotEnoughShards = errors.New("not enough shards to rebuild the value")
+
+// erasureManifest is what is stored under an erasure-coded key.
+type erasureManifest struct {
+	Size   int      `json:"size"`
+	Data   int      `json:"data"`
+	Parity int      `json:"parity"`
+	Sum    []byte   `json:"sum"`    // sha256 of the value
+	Shards [][]byte `json:"shards"` // sha256 of each shard
+}
+
+// WithErasureCoding stores the value as data shards and parity parity
+// shards instead of full copies.
+func WithErasureCoding(data, parity int) PutOption {
+	return func(o *putOptions) { o.data, o.parity = data, parity }
+}
+
+func (n *Node) shardKey(sum []byte, i int) string {
+	return "/" + shardNamespace + "/" + n.dht.hashValue(fmt.Sprintf("%x/%d", sum, i))
+}
+
+// decodeManifest reports whether value is a manifest and decodes it.
+func decodeManifest(value []byte) (*erasureManifest, bool) {
+	if !bytes.HasPrefix(value, []byte(manifestMagic)) {
+		return nil, false
+	}
+	var m erasureManifest
+	if err := json.Unmarshal(value[len(manifestMagic):], &m); err != nil || m.Data < 1 || m.Parity < 0 || m.Data+m.Parity > maxShards || len(m.Shards) != m.Data+m.Parity || m.Size < 0 {
+		return nil, false
+	}
+	return &m, true
+}
+
+// putErasure stores value under key as shards and a manifest.
+func (n *Node) putErasure(ctx context.Context, key string, value []byte, o putOptions) error {
+	if o.data < 1 || o.parity < 1 || o.data+o.parity > maxShards {
+		return fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, %d in all at most", maxShards)
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	shards := encodeShards(value, o.data, o.parity)
+	sum := sha256.Sum256(value)
+	m := erasureManifest{Size: len(value), Data: o.data, Parity: o.parity, Sum: sum[:]}
+	for _, s := range shards {
+		h := sha256.Sum256(s)
+		m.Shards = append(m.Shards, h[:])
+	}
+
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, shardParallel)
+	for i, s := range shards {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, s []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = n.put(ctx, n.shardKey(m.Sum, i), s, 0, putOptions{replicas: 1})
+		}(i, s)
+	}
+	wg.Wait()
+	stored := 0
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		}
+	}
+	if stored < o.data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: stored %d of %d", ErrNotEnoughShards, stored, len(shards))
+	}
+	manifest := append([]byte(manifestMagic), mustJSON(m)...)
+	return n.put(ctx, key, manifest, 0, putOptions{replicas: o.replicas, consistency: o.consistency})
+}
+
+// getErasure fetches enough shards of m to rebuild its value.
+func (n *Node) getErasure(ctx context.Context, m *erasureManifest) ([]byte, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	total := m.Data + m.Parity
+	// Only what an earlier, interrupted Get did not get, see partial.go.
+	shards := n.loadPartial(m)
+	var mu sync.Mutex
+	have := 0
+	for _, s := range shards {
+		if s != nil {
+			have++
+		}
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, shardParallel)
+	// Data shards first: with all of them nothing needs decoding.
+	for i := 0; i < total; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		mu.Lock()
+		done := have >= m.Data
+		mu.Unlock()
+		if done || ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, err := n.get(ctx, n.shardKey(m.Sum, i))
+			if err != nil {
+				return
+			}
+			if sum := sha256.Sum256(result.value); !bytes.Equal(sum[:], m.Shards[i]) {
+				return
+			}
+			n.savePartial(m, i, result.value)
+			mu.Lock()
+			shards[i] = result.value
+			have++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	value, err := decodeShards(shards, m.Data, m.Size)
+	if err != nil {
+		return nil, err
+	}
+	n.dropPartial(m)
+	if sum := sha256.Sum256(value); !bytes.Equal(sum[:], m.Sum) {
+		return nil, fmt.Errorf("rebuilt value %s does not match its manifest", hex.EncodeToString(sum[:8]))
+	}
+	return value, nil
+}
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// codingRow returns row i of the coding matrix: the identity for data
+// shards, below it a Cauchy matrix, so that any data rows of it are
+// invertible.
+func codingRow(i, data int) []byte {
+	row := make([]byte, data)
+	if i < data {
+		row[i] = 1
+		return row
+	}
+	for j := range row {
+		row[j] = gfInv(byte(i) ^ byte(j))
+	}
+	return row
+}
+
+// encodeShards splits value into data equal shards, the last padded with
+// zeros, followed by parity shards.
+func encodeShards(value []byte, data, parity int) [][]byte {
+	size := (&erasureManifest{Size: len(value), Data: data}).shardSize()
+	padded := make([]byte, size*data)
+	copy(padded, value)
+	shards := make([][]byte, data+parity)
+	for i := 0; i < data; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	for i := data; i < data+parity; i++ {
+		shards[i] = make([]byte, size)
+		for j, c := range codingRow(i, data) {
+			for b := range shards[i] {
+				shards[i][b] ^= gfMul(c, shards[j][b])
+			}
+		}
+	}
+	return shards
+}
+
+// decodeShards rebuilds a value of size bytes from shards, nil where a
+// shard is missing, of which at least data must be present.
+func decodeShards(shards [][]byte, data, size int) ([]byte, error) {
+	rows := make([][]byte, 0, data)
+	present := make([][]byte, 0, data)
+	for i, s := range shards {
+		if s != nil && len(present) < data {
+			rows = append(rows, codingRow(i, data))
+			present = append(present, s)
+		}
+	}
+	if len(present) < data {
+		return nil, ErrNotEnoughShards
+	}
+	length := len(present[0])
+	for _, s := range present {
+		if len(s) != length {
+			return nil, errors.New("shards differ in size")
+		}
+	}
+	inverse, err := invertMatrix(rows)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, data*length)
+	for i := 0; i < data; i++ {
+		shard := make([]byte, length)
+		for j, c := range inverse[i] {
+			for b := range shard {
+				shard[b] ^= gfMul(c, present[j][b])
+			}
+		}
+		value = append(value, shard...)
+	}
+	if size > len(value) {
+		return nil, errors.New("shards shorter than the value")
+	}
+	return value[:size], nil
+}
+
+// invertMatrix inverts a square matrix over GF(2^8) by Gauss-Jordan
+// elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	size := len(m)
+	work := make([][]byte, size)
+	for i, row := range m {
+		work[i] = make([]byte, 2*size)
+		copy(work[i], row)
+		work[i][size+i] = 1
+	}
+	for col := 0; col < size; col++ {
+		pivot := -1
+		for r := col; r < size; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular coding matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < size; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			f := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(f, work[col][c])
+			}
+		}
+	}
+	inverse := make([][]byte, size)
+	for i := range work {
+		inverse[i] = work[i][size:]
+	}
+	return inverse, nil
+}
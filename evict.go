@@ -0,0 +1,50 @@
+package dht
+
+// evictTarget is the fraction of the memory budget eviction frees down to,
+// so that a store at its budget does not evict on every write.
+const evictTarget = 0.9
+
+// responsible reports whether we are among the k closest nodes we know of
+// for key, i.e. whether the network expects us to hold it. n.mu must be
+// held.
+func (n *Node) responsible(key string) bool {
+	target := n.dht.hashValue(key)
+	closer := 0
+	for _, p := range n.dht.closest(target, n.cfg.K) {
+		if compareDistance(p.id, n.self.id, target) < 0 {
+			closer++
+		}
+	}
+	return closer < n.cfg.K
+}
+
+// evict moves records out of memory until the store is back under its
+// memory budget: to the disk tier when there is one, otherwise out of the
+// store. Copies we hold although others are closer to the key go first,
+// then records we are responsible for, least recently used first either
+// way, as the store queues them. Which copies we are responsible for is
+// judged when they are stored and again on each garbage collection.
+// Records we published ourselves always stay in memory. n.mu must be
+// held.
+func (n *Node) evict() {
+	budget := n.cfg.MemoryBudget
+	if budget <= 0 || n.store.memBytes <= budget {
+		return
+	}
+	spilled, evicted := 0, 0
+	for float64(n.store.memBytes) > evictTarget*float64(budget) {
+		r := n.store.coldest()
+		if r == nil {
+			break
+		}
+		if n.store.spill(r) {
+			spilled++
+		} else {
+			n.store.delete(r.key)
+			evicted++
+		}
+	}
+	if spilled+evicted > 0 {
+		n.log.Debug("evicted records", "spilled", spilled, "evicted", evicted, "bytes", n.store.memBytes, "budget", budget)
+	}
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestEvictOrder(t *testing.T) {
+	cfg := fuzzConfig()
+	cfg.MemoryBudget = 700
+	node := NewNode(cfg, newMemTransport(dhtsim.NewNetwork()))
+	start := time.Unix(1e9, 0)
+	value := []byte(strings.Repeat("v", 98))
+	add := func(key, publisher string, used time.Duration, spare bool) {
+		node.store.put(&record{key: key, value: value, publisher: publisher, stored: start.Add(used), spare: spare})
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	add("o1", node.self.id, 0, true)
+	add("o2", node.self.id, 0, true)
+	add("h1", testID, 1, false) // held, oldest
+	add("h2", testID, 2, false)
+	add("s1", testID, 3, true) // spare, newer than both held
+	add("s2", testID, 4, true)
+	add("h3", testID, 5, false)
+	add("h4", testID, 6, false)
+	node.store.touch("h1", start.Add(10))
+	add("s3", testID, 7, true)
+	add("h5", testID, 8, false)
+	add("h6", testID, 9, false)
+	node.evict()
+
+	// 11 records of 100 bytes each, freed down to 630: the three spare
+	// copies go, then h2 and h3, the least recently used of the held ones
+	// since h1 was read.
+	for _, key := range []string{"s1", "s2", "s3", "h2", "h3"} {
+		if node.store.has(key) {
+			t.Errorf("%s not evicted", key)
+		}
+	}
+	for _, key := range []string{"o1", "o2", "h1", "h4", "h5", "h6"} {
+		if !node.store.has(key) {
+			t.Errorf("%s evicted", key)
+		}
+	}
+
+	// With only our own records left over budget, evict gives up at once.
+	for _, key := range node.store.keys() {
+		if r, _ := node.store.peek(key); r.publisher != node.self.id {
+			node.store.delete(key)
+		}
+	}
+	node.cfg.MemoryBudget = 100
+	node.evict()
+	if node.store.len() != 2 || node.store.coldest() != nil {
+		t.Errorf("%d records left, coldest %v, want our two and none to evict", node.store.len(), node.store.coldest())
+	}
+}
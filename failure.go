@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+// Whether a peer that failed to answer is dropped follows the phi accrual
+// failure detector of Hayashibara et al., applied to round trip times
+// rather than heartbeats. Each contact keeps a smoothed round trip time
+// and its mean deviation, as TCP does. When a call times out after
+// waiting w, phi = -log10 P(rtt > w) under a normal distribution with
+// those parameters says how surprising the silence is: next to nothing on
+// a slow, jittery link whose answers often come close to the timeout, a
+// lot for a peer that always answers in a fraction of it. Phi adds up
+// over consecutive failures and the peer is dropped once the sum reaches
+// phi_threshold; any answer resets it. Failures other than timeouts, and
+// peers we have never measured, count as the full threshold, so those
+// are dropped at once as before.
+
+// phiMax caps what one failure contributes when the tail probability
+// underflows.
+const phiMax = 100
+
+// minRTTDeviation keeps phi finite for peers whose round trip time has
+// hardly varied so far.
+const minRTTDeviation = time.Millisecond
+
+// phi is the suspicion a timeout after waiting w raises for p.
+func phi(p *Peer, w time.Duration) float64 {
+	if p.rtt <= 0 {
+		return math.Inf(1)
+	}
+	// The normal standard deviation is about 1.25 times the mean deviation.
+	sd := max(1.25*float64(p.rttvar), float64(p.rtt)/4, float64(minRTTDeviation))
+	z := (float64(w) - float64(p.rtt)) / sd
+	tail := 0.5 * math.Erfc(z/math.Sqrt2)
+	if tail <= 0 {
+		return phiMax
+	}
+	return math.Min(-math.Log10(tail), phiMax)
+}
+
+// suspect adds the failure of a call to p that waited w and ended in err
+// to p's suspicion and reports whether p should now be dropped. n.mu must
+// be held.
+func (n *Node) suspect(p *Peer, err error, w time.Duration) bool {
+	known := n.dht.findPeer(p.id)
+	if known == nil {
+		return true
+	}
+	if wait := n.cfg.Timeouts.RPC; wait > 0 {
+		w = wait
+	}
+	if !isTimeout(err) || known.rtt <= 0 {
+		known.suspicion += n.cfg.PhiThreshold
+	} else {
+		known.suspicion += phi(known, w)
+	}
+	return known.suspicion >= n.cfg.PhiThreshold
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,259 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyDist draws a one-way delay.
+type LatencyDist func(rng *rand.Rand) time.Duration
+
+func ConstantLatency(d time.Duration) LatencyDist {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+func UniformLatency(lo, hi time.Duration) LatencyDist {
+	return func(rng *rand.Rand) time.Duration {
+		return lo + time.Duration(rng.Int63n(int64(hi-lo)+1))
+	}
+}
+
+func NormalLatency(mean, stddev time.Duration) LatencyDist {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(math.Max(0, rng.NormFloat64()*float64(stddev)+float64(mean)))
+	}
+}
+
+func ExponentialLatency(mean time.Duration) LatencyDist {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+}
+
+// Fault describes how a link misbehaves. Loss applies to each direction
+// separately; a lost request or response looks to the caller exactly like
+// an unresponsive peer, i.e. the call only returns once ctx is done.
+// Duplicate and Reorder act on datagrams in the transport underneath, both
+// requests and replies: a duplicated one goes out twice as the same bytes,
+// RPC ID and all, and a reordered one is held back ReorderDelay while
+// those after it go out. Transports that do not send datagrams of their
+// own, see packetFaulter, ignore the two.
+type Fault struct {
+	Latency      LatencyDist
+	Loss         float64
+	Duplicate    float64
+	Reorder      float64
+	ReorderDelay time.Duration
+}
+
+// faultyTransport wraps another transport and injects faults on outbound
+// calls, either for every peer or for specific peer addresses.
+type faultyTransport struct {
+	Transport
+	mu       sync.Mutex
+	rng      *rand.Rand
+	fallback Fault
+	faults   map[string]Fault
+}
+
+// packetFaulter is implemented by transports that let f decide, for every
+// datagram they send to addr, whether it goes out twice and how long it is
+// held back first.
+type packetFaulter interface {
+	faultPackets(f func(addr string) (duplicate bool, hold time.Duration))
+}
+
+func newFaultyTransport(inner Transport, seed int64) *faultyTransport {
+	t := &faultyTransport{
+		Transport: inner,
+		rng:       rand.New(rand.NewSource(seed)),
+		faults:    make(map[string]Fault),
+	}
+	if p, ok := inner.(packetFaulter); ok {
+		p.faultPackets(t.packetFault)
+	}
+	return t
+}
+
+func (t *faultyTransport) SetDefault(f Fault) {
+	t.mu.Lock()
+	t.fallback = f
+	t.mu.Unlock()
+}
+
+func (t *faultyTransport) SetFault(addr string, f Fault) {
+	t.mu.Lock()
+	t.faults[addr] = f
+	t.mu.Unlock()
+}
+
+type faultRoll struct {
+	requestDelay  time.Duration
+	responseDelay time.Duration
+	dropRequest   bool
+	dropResponse  bool
+}
+
+// fault returns the fault of the link to addr. t.mu must be held.
+func (t *faultyTransport) fault(addr string) Fault {
+	if f, ok := t.faults[addr]; ok {
+		return f
+	}
+	return t.fallback
+}
+
+func (t *faultyTransport) roll(addr string) faultRoll {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.fault(addr)
+	var r faultRoll
+	if f.Latency != nil {
+		r.requestDelay = f.Latency(t.rng)
+		r.responseDelay = f.Latency(t.rng)
+	}
+	r.dropRequest = t.rng.Float64() < f.Loss
+	r.dropResponse = t.rng.Float64() < f.Loss
+	return r
+}
+
+// packetFault rolls the faults of one datagram to addr.
+func (t *faultyTransport) packetFault(addr string) (duplicate bool, hold time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.fault(addr)
+	if t.rng.Float64() < f.Reorder {
+		hold = f.ReorderDelay
+	}
+	return t.rng.Float64() < f.Duplicate, hold
+}
+
+func (t *faultyTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	r := t.roll(addr)
+	if !sleepContext(ctx, r.requestDelay) {
+		return nil, ctx.Err()
+	}
+	if r.dropRequest {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	resp, err := t.Transport.Call(ctx, addr, req)
+	if r.dropResponse {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if !sleepContext(ctx, r.responseDelay) {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// sleepContext waits for d and reports false if ctx ended first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// parseFaults configures t from a spec such as
+//
+//	loss=0.1,latency=normal:40ms:10ms;dup=0.5,reorder=0.2:100ms@10.0.0.2:4000
+//
+// Specs are separated by ';'. One without an @addr suffix is the default for
+// every peer. Latency is a duration or one of const:d, uniform:lo:hi,
+// normal:mean:stddev and exp:mean.
+func (t *faultyTransport) parseFaults(spec string) error {
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		body, addr, perPeer := strings.Cut(part, "@")
+		f, err := parseFault(body)
+		if err != nil {
+			return fmt.Errorf("faults %q: %w", part, err)
+		}
+		if perPeer {
+			t.SetFault(addr, f)
+		} else {
+			t.SetDefault(f)
+		}
+	}
+	return nil
+}
+
+func parseFault(spec string) (Fault, error) {
+	var f Fault
+	for _, item := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return f, fmt.Errorf("expected name=value, got %q", item)
+		}
+		var err error
+		switch name {
+		case "loss":
+			f.Loss, err = strconv.ParseFloat(value, 64)
+		case "dup":
+			f.Duplicate, err = strconv.ParseFloat(value, 64)
+		case "reorder":
+			prob, delay, _ := strings.Cut(value, ":")
+			if f.Reorder, err = strconv.ParseFloat(prob, 64); err == nil {
+				f.ReorderDelay, err = time.ParseDuration(delay)
+			}
+		case "latency":
+			f.Latency, err = parseLatency(value)
+		default:
+			err = fmt.Errorf("unknown fault %q", name)
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func parseLatency(spec string) (LatencyDist, error) {
+	parts := strings.Split(spec, ":")
+	durations := make([]time.Duration, 0, len(parts))
+	kind := "const"
+	if _, err := time.ParseDuration(parts[0]); err != nil {
+		kind, parts = parts[0], parts[1:]
+	}
+	for _, p := range parts {
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return nil, err
+		}
+		durations = append(durations, d)
+	}
+
+	want := map[string]int{"const": 1, "uniform": 2, "normal": 2, "exp": 1}
+	if n, ok := want[kind]; !ok || n != len(durations) {
+		return nil, fmt.Errorf("bad latency %q", spec)
+	}
+	switch kind {
+	case "uniform":
+		if durations[1] < durations[0] {
+			return nil, fmt.Errorf("bad latency %q: max below min", spec)
+		}
+		return UniformLatency(durations[0], durations[1]), nil
+	case "normal":
+		return NormalLatency(durations[0], durations[1]), nil
+	case "exp":
+		return ExponentialLatency(durations[0]), nil
+	}
+	return ConstantLatency(durations[0]), nil
+}
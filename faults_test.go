@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// faultPair returns a faulty UDP transport and a UDP peer that records
+// the requests it gets.
+func faultPair(t *testing.T) (*faultyTransport, *udpTransport, func() []*message) {
+	t.Helper()
+	a, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	var mu sync.Mutex
+	var got []*message
+	b.Serve(func(from string, req *message) *message {
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+		return &message{Type: msgPing, From: contact{ID: testID}}
+	})
+	received := func() []*message {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*message(nil), got...)
+	}
+	return newFaultyTransport(a, 1), b, received
+}
+
+func TestDuplicateFault(t *testing.T) {
+	faulty, b, received := faultPair(t)
+	faulty.SetDefault(Fault{Duplicate: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := faulty.Call(ctx, b.Addr(), &message{Type: msgPing, From: contact{ID: testID}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	got := received()
+	if len(got) != 2 || got[0].RPCID != got[1].RPCID {
+		t.Fatalf("peer got %d requests, want the same one twice", len(got))
+	}
+}
+
+func TestReorderFault(t *testing.T) {
+	faulty, b, received := faultPair(t)
+	faulty.SetDefault(Fault{Reorder: 1, ReorderDelay: 200 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := faulty.Call(ctx, b.Addr(), &message{Type: msgPing, From: contact{ID: testID}, Key: "first"})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	faulty.SetDefault(Fault{})
+	if _, err := faulty.Call(ctx, b.Addr(), &message{Type: msgPing, From: contact{ID: testID}, Key: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	got := received()
+	if len(got) != 2 || got[0].Key != "second" || got[1].Key != "first" {
+		t.Fatalf("peer got %d requests, want the held one last", len(got))
+	}
+}
+
+func TestDuplicateFaultInMemory(t *testing.T) {
+	network := dhtsim.NewNetwork()
+	a, b := newMemTransport(network), newMemTransport(network)
+	calls := 0
+	b.Serve(func(from string, req *message) *message {
+		calls++
+		return &message{Type: msgPing, From: contact{ID: testID}}
+	})
+	faulty := newFaultyTransport(a, 1)
+	faulty.SetDefault(Fault{Duplicate: 1})
+	if _, err := faulty.Call(context.Background(), b.Addr(), &message{Type: msgPing, From: contact{ID: testID}}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", calls)
+	}
+}
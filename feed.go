@@ -0,0 +1,251 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Feeds are append-only logs, one per owner and name. Every entry is
+// signed by the owner and carries its sequence number, from 1, and the
+// hash of the entry before it, so a reader holding the newest entry can
+// check the whole chain back. Entries live in the feed namespace, each
+// under the hash of owner ID, feed name and sequence number; the newest
+// is also kept under the feed's head key. Replicas accept an entry only
+// if it is signed by the owner the key names, never replace one with a
+// different entry for the same sequence number, and only move a head
+// forward. The owner republishes its entries and head like any record of
+// its own.
+//
+// A mailbox is a feed per sender: each writes their own, the reader
+// follows all of them.
+const (
+	feedNamespace = "feed"
+	maxFeedName   = 128
+)
+
+var (
+	ErrBadFeed   = errors.New("invalid feed entry")
+	ErrFeedFork  = errors.New("feed entry conflicts with the stored one")
+	ErrStaleFeed = errors.New("stale feed head")
+)
+
+// FeedEntry is one entry of a feed as readers see it.
+type FeedEntry struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte
+}
+
+// signedEntry is what is stored for a feed entry. Sig covers the JSON
+// encoding of everything else, with Sig left empty.
+type signedEntry struct {
+	Feed  string `json:"feed"`
+	Owner []byte `json:"owner"`
+	Seq   uint64 `json:"seq"`
+	Prev  []byte `json:"prev,omitempty"` // sha256 of the previous entry as stored
+	Time  int64  `json:"time"`           // unix nanoseconds
+	Data  []byte `json:"data"`
+	Sig   []byte `json:"sig,omitempty"`
+}
+
+// ownFeed is where one of our feeds is up to.
+type ownFeed struct {
+	seq  uint64
+	prev []byte
+}
+
+// feedKey is the key of a feed's entry seq, or of its head for seq 0.
+func (n *Node) feedKey(owner, feed string, seq uint64) string {
+	at := "head"
+	if seq > 0 {
+		at = strconv.FormatUint(seq, 10)
+	}
+	return "/" + feedNamespace + "/" + n.dht.hashValue(owner+"/"+feed+"/"+at)
+}
+
+// verifyEntry decodes a feed entry stored under key and checks that it is
+// signed by its owner and is that key's entry or head.
+func (n *Node) verifyEntry(key string, value []byte) (*signedEntry, bool, error) {
+	var e signedEntry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, false, err
+	}
+	if len(e.Owner) != ed25519.PublicKeySize || e.Seq == 0 || e.Feed == "" || len(e.Feed) > maxFeedName || e.Seq > 1 && len(e.Prev) != sha256.Size {
+		return nil, false, ErrBadFeed
+	}
+	owner := nodeIDFromKey(e.Owner)
+	head := key == n.feedKey(owner, e.Feed, 0)
+	if !head && key != n.feedKey(owner, e.Feed, e.Seq) {
+		return nil, false, ErrBadFeed
+	}
+	sig := e.Sig
+	e.Sig = nil
+	if !ed25519.Verify(e.Owner, mustJSON(e), sig) {
+		return nil, false, ErrBadSignature
+	}
+	e.Sig = sig
+	return &e, head, nil
+}
+
+// mergeFeed decides whether a replica accepts an incoming feed entry or
+// head.
+func (n *Node) mergeFeed(key string, stored, incoming []byte) ([]byte, error) {
+	e, head, err := n.verifyEntry(key, incoming)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || bytes.Equal(stored, incoming) {
+		return incoming, nil
+	}
+	current, _, err := n.verifyEntry(key, stored)
+	switch {
+	case err != nil:
+		return incoming, nil
+	case !head:
+		return nil, ErrFeedFork
+	case e.Seq <= current.Seq:
+		return nil, ErrStaleFeed
+	}
+	return incoming, nil
+}
+
+// Append adds data to our feed of that name and returns its sequence
+// number.
+func (n *Node) Append(ctx context.Context, feed string, data []byte) (uint64, error) {
+	if feed == "" || len(feed) > maxFeedName {
+		return 0, ErrBadFeed
+	}
+	n.mu.Lock()
+	f := n.feeds[feed]
+	n.mu.Unlock()
+	if f == nil {
+		// After a restart, carry on from the head the network has.
+		f = &ownFeed{}
+		if e, value, err := n.feedHead(ctx, n.self.id, feed); err == nil {
+			f.seq, f.prev = e.Seq, hashEntry(value)
+		} else if !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+	}
+
+	n.mu.Lock()
+	if n.feeds == nil {
+		n.feeds = make(map[string]*ownFeed)
+	}
+	if known := n.feeds[feed]; known != nil {
+		f = known
+	}
+	n.feeds[feed] = f
+	e := signedEntry{
+		Feed:  feed,
+		Owner: n.key.Public().(ed25519.PublicKey),
+		Seq:   f.seq + 1,
+		Prev:  f.prev,
+		Time:  n.clock.Now().UnixNano(),
+		Data:  data,
+	}
+	e.Sig = ed25519.Sign(n.key, mustJSON(e))
+	value := mustJSON(e)
+	f.seq, f.prev = e.Seq, hashEntry(value)
+	n.mu.Unlock()
+
+	if err := n.put(ctx, n.feedKey(n.self.id, feed, e.Seq), value, 0, putOptions{}); err != nil {
+		return 0, err
+	}
+	return e.Seq, n.put(ctx, n.feedKey(n.self.id, feed, 0), value, 0, putOptions{})
+}
+
+func hashEntry(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return sum[:]
+}
+
+// feedHead returns the newest head of a feed any replica holds.
+func (n *Node) feedHead(ctx context.Context, owner, feed string) (*signedEntry, []byte, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := n.feedKey(owner, feed, 0)
+	_, _, copies, _ := n.replicaCopies(ctx, key)
+	var best *signedEntry
+	var bestValue []byte
+	for _, value := range copies {
+		if e, _, err := n.verifyEntry(key, value); err == nil && (best == nil || e.Seq > best.Seq) {
+			best, bestValue = e, value
+		}
+	}
+	if best == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrNotFound
+	}
+	return best, bestValue, nil
+}
+
+// feedEntry fetches entry seq of a feed, the one whose hash is want.
+func (n *Node) feedEntry(ctx context.Context, owner, feed string, seq uint64, want []byte) (*signedEntry, error) {
+	key := n.feedKey(owner, feed, seq)
+	check := func(value []byte) *signedEntry {
+		if !bytes.Equal(hashEntry(value), want) {
+			return nil
+		}
+		e, _, err := n.verifyEntry(key, value)
+		if err != nil {
+			return nil
+		}
+		return e
+	}
+	if result, err := n.get(ctx, key); err == nil {
+		if e := check(result.value); e != nil {
+			return e, nil
+		}
+	}
+	// The first copy found was not the one linked to, ask every replica.
+	_, _, copies, _ := n.replicaCopies(ctx, key)
+	for _, value := range copies {
+		if e := check(value); e != nil {
+			return e, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// ReadFeed returns the entries of owner's feed after sequence number
+// after, oldest first, at most limit of them, the newest ones if there
+// are more. Every entry returned is checked against the chain from the
+// head, which is followed back until an entry no replica has.
+func (n *Node) ReadFeed(ctx context.Context, owner, feed string, after uint64, limit int) ([]FeedEntry, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	head, _, err := n.feedHead(ctx, owner, feed)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]FeedEntry, 0)
+	e := head
+	for e.Seq > after && len(entries) < limit {
+		entries = append(entries, FeedEntry{Seq: e.Seq, Time: time.Unix(0, e.Time), Data: e.Data})
+		if e.Seq == 1 {
+			break
+		}
+		if e, err = n.feedEntry(ctx, owner, feed, e.Seq-1, e.Prev); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				break
+			}
+			return nil, err
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
@@ -0,0 +1,207 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// At most maxManifestChecks manifests we hold are checked for their shards
+// by each pass of checkManifests, taking turns.
+const maxManifestChecks = 4
+
+// collectGarbage drops the records nobody expects us to keep: copies whose
+// namespace TTL ran out without the publisher refreshing them, and copies
+// of keys we are no longer among the k closest for, as judged by the
+// routing table as it is now rather than when the copy arrived. The latter
+// only once they have gone unused for a republish interval, so that fresh
+// and popular cluster copies, which live away from their key on purpose,
+// survive; meanwhile they are queued to be evicted first, see evict.
+// Records we published ourselves are kept, but for shards none of our
+// manifests names any more, as a Put over an erasure-coded key leaves
+// behind; left to us they would be republished forever, and once we drop
+// them the other copies expire. What each pass reclaims adds up in n.gc.
+// n.mu must not be held.
+func (n *Node) collectGarbage(now time.Time) gcStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	pass := gcStats{Runs: 1, Last: now}
+	named := n.ownShards()
+	for _, key := range n.store.keys() {
+		r, _ := n.store.peek(key)
+		if r.publisher == n.self.id {
+			// Not while a Put is still storing a manifest's shards.
+			if !isShardKey(key) || named[key] || now.Sub(r.stored) <= n.cfg.RefreshInterval {
+				continue
+			}
+			pass.Orphaned++
+			pass.Bytes += int64(r.size())
+			n.store.delete(key)
+			continue
+		}
+		if now.Sub(r.stored) > n.cfg.policy(key).TTL || r.expired(now) {
+			pass.Expired++
+		} else {
+			n.store.mark(r, !n.responsible(key))
+			if !r.spare || now.Sub(r.used) <= n.cfg.RepublishInterval {
+				continue
+			}
+			pass.Orphaned++
+		}
+		pass.Bytes += int64(r.size())
+		n.store.delete(key)
+	}
+	if n.store.stale() {
+		n.store.rebuild()
+	}
+	n.gc.add(pass)
+	if pass.Expired+pass.Orphaned > 0 {
+		n.log.Debug("collected records", "expired", pass.Expired, "orphaned", pass.Orphaned, "bytes", pass.Bytes)
+	}
+	return pass
+}
+
+// ownShards returns the shard keys named by the manifests we published.
+// n.mu must be held.
+func (n *Node) ownShards() map[string]bool {
+	named := make(map[string]bool)
+	for _, key := range n.store.keys() {
+		r, _ := n.store.peek(key)
+		if m, ok := decodeManifest(r.value); ok && r.publisher == n.self.id {
+			for i := range m.Shards {
+				named[n.shardKey(m.Sum, i)] = true
+			}
+		}
+	}
+	return named
+}
+
+func isShardKey(key string) bool {
+	return strings.HasPrefix(key, "/"+shardNamespace+"/")
+}
+
+// checkManifests looks up the shards of a few of the manifests we hold for
+// others and drops those that can no longer be rebuilt, because more of
+// their shards than they have parity for are gone, along with whatever of
+// their shards we hold. A shard counts as gone only when a lookup for it
+// was answered without it, so an unreachable part of the network does not
+// make a manifest dangle. n.mu must not be held.
+func (n *Node) checkManifests(ctx context.Context, now time.Time) gcStats {
+	pass := gcStats{Last: now}
+	for _, key := range n.nextManifests() {
+		if ctx.Err() != nil {
+			break
+		}
+		n.mu.Lock()
+		r, ok := n.store.peek(key)
+		n.mu.Unlock()
+		if !ok {
+			continue
+		}
+		m, _ := decodeManifest(r.value)
+		present, missing := 0, 0
+		for i := range m.Shards {
+			if present >= m.Data || missing > m.Parity {
+				break
+			}
+			shard := n.shardKey(m.Sum, i)
+			n.mu.Lock()
+			held := n.store.has(shard)
+			n.mu.Unlock()
+			if held {
+				present++
+				continue
+			}
+			result := n.lookupValue(ctx, shard)
+			switch {
+			case result.found:
+				present++
+			case ctx.Err() == nil && len(result.closest) > 0:
+				missing++
+			}
+		}
+		if missing <= m.Parity {
+			continue
+		}
+		n.mu.Lock()
+		if current, ok := n.store.peek(key); ok && current.version == r.version {
+			pass.Dangling++
+			pass.Bytes += int64(current.size())
+			n.store.delete(key)
+			for i := range m.Shards {
+				if s, ok := n.store.peek(n.shardKey(m.Sum, i)); ok && s.publisher != n.self.id {
+					pass.Bytes += int64(s.size())
+					n.store.delete(s.key)
+				}
+			}
+		}
+		n.mu.Unlock()
+	}
+	n.mu.Lock()
+	n.gc.add(pass)
+	n.mu.Unlock()
+	if pass.Dangling > 0 {
+		n.log.Debug("collected dangling manifests", "manifests", pass.Dangling, "bytes", pass.Bytes)
+	}
+	return pass
+}
+
+// nextManifests returns the next maxManifestChecks manifests we hold for
+// others after the last one checked, wrapping around.
+func (n *Node) nextManifests() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var keys []string
+	for _, key := range n.store.keys() {
+		r, _ := n.store.peek(key)
+		if _, ok := decodeManifest(r.value); ok && r.publisher != n.self.id && r.expires.IsZero() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	i := sort.SearchStrings(keys, n.gcCursor)
+	if i < len(keys) && keys[i] == n.gcCursor {
+		i++
+	}
+	keys = append(keys[i:], keys[:i]...)
+	keys = keys[:min(len(keys), maxManifestChecks)]
+	if len(keys) > 0 {
+		n.gcCursor = keys[len(keys)-1]
+	}
+	return keys
+}
+
+// gcStats counts what garbage collection reclaimed.
+type gcStats struct {
+	Runs     int64
+	Expired  int64
+	Orphaned int64
+	Dangling int64 // manifests
+	Bytes    int64
+	Last     time.Time
+}
+
+func (s *gcStats) add(pass gcStats) {
+	s.Runs += pass.Runs
+	s.Expired += pass.Expired
+	s.Orphaned += pass.Orphaned
+	s.Dangling += pass.Dangling
+	s.Bytes += pass.Bytes
+	s.Last = pass.Last
+}
+
+// GCStats returns the totals of every garbage collection pass so far.
+func (n *Node) GCStats() gcStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.gc
+}
+
+func (n *Node) gcHandler(w http.ResponseWriter, r *http.Request) {
+	s := n.GCStats()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "runs %d\nexpired %d\norphaned %d\ndangling_manifests %d\nreclaimed_bytes %d\n", s.Runs, s.Expired, s.Orphaned, s.Dangling, s.Bytes)
+}
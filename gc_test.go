@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// erasureNetwork returns a simulated network in which node 0 put an
+// erasure-coded value of 3 data and 2 parity shards under "big".
+func erasureNetwork(t *testing.T) (*dhtsim.Simulation, *erasureManifest) {
+	t.Helper()
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 7)
+	sim.AddNodes(ctx, 20)
+	if err := simNodes(sim)[0].Put(ctx, "big", bytes.Repeat([]byte("x"), 3000), WithErasureCoding(3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := simNodes(sim)[0].store.peek("big")
+	m, ok := decodeManifest(r.value)
+	if !ok {
+		t.Fatal("no manifest under the key")
+	}
+	return sim, m
+}
+
+func TestCollectOrphanedShards(t *testing.T) {
+	sim, m := erasureNetwork(t)
+	n := simNodes(sim)[0]
+	if err := n.Put(context.Background(), "big", []byte("small now")); err != nil {
+		t.Fatal(err)
+	}
+	if pass := n.collectGarbage(sim.Clock().Now()); pass.Orphaned != 0 {
+		t.Fatalf("collected %d shards right after the Put", pass.Orphaned)
+	}
+	sim.Clock().Advance(n.cfg.RefreshInterval + 1)
+	pass := n.collectGarbage(sim.Clock().Now())
+	if pass.Orphaned != int64(len(m.Shards)) || pass.Bytes == 0 {
+		t.Errorf("collected %d records, %d bytes, want the %d shards", pass.Orphaned, pass.Bytes, len(m.Shards))
+	}
+	for i := range m.Shards {
+		if n.store.has(n.shardKey(m.Sum, i)) {
+			t.Errorf("shard %d still held", i)
+		}
+	}
+	if !n.store.has("big") {
+		t.Error("the new value was collected")
+	}
+}
+
+func TestCollectDanglingManifest(t *testing.T) {
+	sim, m := erasureNetwork(t)
+	ctx := context.Background()
+	var holder *Node
+	for _, n := range simNodes(sim)[1:] {
+		if r, ok := n.store.peek("big"); ok && r.publisher != n.self.id {
+			holder = n
+			break
+		}
+	}
+	if holder == nil {
+		t.Fatal("no other node holds the manifest")
+	}
+	if pass := holder.checkManifests(ctx, sim.Clock().Now()); pass.Dangling != 0 {
+		t.Fatal("manifest with all its shards collected")
+	}
+
+	// Losing the parity shards leaves the value whole.
+	drop := func(i int) {
+		for _, n := range simNodes(sim) {
+			n.mu.Lock()
+			n.store.delete(n.shardKey(m.Sum, i))
+			n.mu.Unlock()
+		}
+	}
+	drop(3)
+	drop(4)
+	if pass := holder.checkManifests(ctx, sim.Clock().Now()); pass.Dangling != 0 {
+		t.Fatal("manifest that can be rebuilt collected")
+	}
+	drop(0)
+	pass := holder.checkManifests(ctx, sim.Clock().Now())
+	if pass.Dangling != 1 || pass.Bytes == 0 {
+		t.Fatalf("collected %d manifests, %d bytes, want the dangling one", pass.Dangling, pass.Bytes)
+	}
+	if holder.store.has("big") {
+		t.Error("dangling manifest still held")
+	}
+	if s := holder.GCStats(); s.Dangling != 1 {
+		t.Errorf("stats count %d dangling manifests", s.Dangling)
+	}
+}
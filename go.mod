@@ -0,0 +1,3 @@
+module github.com/Redamancylll/2020131047
+
+go 1.24
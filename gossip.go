@@ -0,0 +1,143 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// The gossip layer, when gossip_interval is set, keeps a membership view
+// next to the routing table, in the style of epidemic heartbeat
+// protocols: every interval we bump our own heartbeat and swap a sample
+// of the view, most recently updated members first, with a few random
+// peers that gossip too. A member whose heartbeat has not gone up for
+// gossipSuspectRounds intervals is taken to be down and no longer passed
+// on, and it is forgotten after three times that. Unlike the k-buckets,
+// which only know the neighbourhood of our ID well, the view converges
+// towards every live node, at a cost linear in the network size, so it is
+// meant for networks small enough for that.
+const (
+	featureGossip       = "gossip" // the gossip message
+	gossipFanout        = 3
+	maxGossipEntries    = 64
+	gossipSuspectRounds = 10
+)
+
+// gossipEntry is what the view says about one member.
+type gossipEntry struct {
+	ID        string   `json:"id"`
+	Addr      string   `json:"addr,omitempty"`
+	Heartbeat uint64   `json:"hb"`
+	Features  []string `json:"features,omitempty"`
+}
+
+// member is a node in the gossip view.
+type member struct {
+	gossipEntry
+	updated time.Time // when its heartbeat last went up, by our clock
+}
+
+func (m *member) alive(now time.Time, interval time.Duration) bool {
+	return now.Sub(m.updated) < gossipSuspectRounds*interval
+}
+
+// gossip runs one gossip round.
+func (n *Node) gossip(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	n.heartbeat++
+	interval := n.cfg.GossipInterval
+	for id, m := range n.members {
+		if now.Sub(m.updated) >= 3*gossipSuspectRounds*interval {
+			delete(n.members, id)
+		}
+	}
+	targets := make([]*Peer, 0)
+	for _, p := range n.dht.peers() {
+		if hasFeature(p.features, featureGossip) {
+			targets = append(targets, p)
+		}
+	}
+	for _, m := range n.members {
+		if m.alive(now, interval) && n.dht.findPeer(m.ID) == nil {
+			targets = append(targets, &Peer{id: m.ID, addr: m.Addr})
+		}
+	}
+	n.mu.Unlock()
+
+	for i := 0; i < gossipFanout && i < len(targets); i++ {
+		j := i + n.randomIndex(len(targets)-i)
+		targets[i], targets[j] = targets[j], targets[i]
+	}
+	targets = targets[:min(gossipFanout, len(targets))]
+	for _, r := range n.callAll(ctx, targets, func(p *Peer) *message {
+		req := n.request(msgGossip)
+		req.Members = n.gossipSample(p.id)
+		return req
+	}) {
+		if r.err == nil {
+			n.mergeMembers(r.resp.Members)
+		}
+	}
+}
+
+// gossipSample returns ourselves and the live members other than exclude
+// that were updated most recently, up to maxGossipEntries.
+func (n *Node) gossipSample(exclude string) []gossipEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	live := make([]*member, 0, len(n.members))
+	for _, m := range n.members {
+		if m.ID != exclude && m.alive(now, n.cfg.GossipInterval) {
+			live = append(live, m)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if !live[i].updated.Equal(live[j].updated) {
+			return live[i].updated.After(live[j].updated)
+		}
+		return live[i].ID < live[j].ID
+	})
+	sample := []gossipEntry{{ID: n.self.id, Addr: n.self.addr, Heartbeat: n.heartbeat, Features: n.hello().Features}}
+	for _, m := range live[:min(len(live), maxGossipEntries-1)] {
+		sample = append(sample, m.gossipEntry)
+	}
+	return sample
+}
+
+// mergeMembers takes in what a peer's view says, keeping the higher
+// heartbeat of every member.
+func (n *Node) mergeMembers(entries []gossipEntry) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	for _, e := range entries {
+		if e.ID == n.self.id || n.dht.banned[e.ID] {
+			continue
+		}
+		m, ok := n.members[e.ID]
+		if ok && e.Heartbeat <= m.Heartbeat {
+			continue
+		}
+		if n.members == nil {
+			n.members = make(map[string]*member)
+		}
+		n.members[e.ID] = &member{gossipEntry: e, updated: now}
+	}
+}
+
+// Members returns the live members of the gossip view, ourselves
+// excluded, ordered by ID. It is empty unless gossip is enabled.
+func (n *Node) Members() []gossipEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	members := make([]gossipEntry, 0, len(n.members))
+	for _, m := range n.members {
+		if m.alive(now, n.cfg.GossipInterval) {
+			members = append(members, m.gossipEntry)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
@@ -0,0 +1,101 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The first request to a peer whose capabilities we do not know yet
+// carries a hello with our protocol version and the optional features we
+// support, and the peer answers with its own, so one ordinary exchange
+// doubles as the handshake. A peer that answers without a hello predates
+// the handshake and is taken to speak version 1 with no features. Peers
+// below minProtocolVersion are refused on either side. Codecs are not part
+// of the hello: every message lists them already, as a node may have
+// forgotten a peer between two messages.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 1
+	legacyVersion      = 1
+	maxFeatures        = 16
+
+	featureDeflate = "deflate" // compressed values
+)
+
+var ErrIncompatible = errors.New("incompatible protocol version")
+
+type hello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	Vnodes   int      `json:"vnodes,omitempty"` // virtual nodes, with ring placement
+}
+
+func (n *Node) hello() *hello {
+	h := &hello{Version: protocolVersion, Features: []string{featureBatch, featureSync}}
+	if n.cfg.CompressThreshold > 0 {
+		h.Features = append(h.Features, featureDeflate)
+	}
+	if n.cfg.GossipInterval > 0 {
+		h.Features = append(h.Features, featureGossip)
+	}
+	if n.cfg.Placement == placementRing {
+		h.Vnodes = n.cfg.VirtualNodes
+	}
+	return h
+}
+
+func checkHello(h *hello) error {
+	if h.Version < minProtocolVersion {
+		return fmt.Errorf("%w %d", ErrIncompatible, h.Version)
+	}
+	return nil
+}
+
+// greet attaches our hello to req unless we have already negotiated with p.
+func (n *Node) greet(p *Peer, req *message) *message {
+	n.mu.Lock()
+	known := n.dht.findPeer(p.id)
+	negotiated := known != nil && known.version != 0
+	n.mu.Unlock()
+	if !negotiated {
+		req.Hello = n.hello()
+	}
+	return req
+}
+
+// negotiate records what peer id told us in h, or that it is a legacy
+// peer when h is nil. It reports false if the peer is incompatible, in
+// which case it is dropped.
+func (n *Node) negotiate(id string, h *hello) bool {
+	if h == nil {
+		h = &hello{Version: legacyVersion}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if checkHello(h) != nil {
+		n.dht.removePeer(id)
+		return false
+	}
+	if p := n.dht.findPeer(id); p != nil {
+		p.version, p.features, p.vnodes = h.Version, h.Features, h.Vnodes
+		p.deflate = p.deflate || hasFeature(h.Features, featureDeflate)
+	}
+	return true
+}
+
+// peerSupports reports whether the handshake with id established feature.
+func (n *Node) peerSupports(id, feature string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p := n.dht.findPeer(id)
+	return p != nil && hasFeature(p.features, feature)
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
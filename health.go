@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Healthy reports whether the node is alive at all, which is all a
+// liveness probe should care about.
+func (n *Node) Healthy() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Ready reports whether the node has joined the network: bootstrap has
+// completed (or there was nothing to bootstrap from) and the routing table
+// holds at least MinPeers contacts.
+func (n *Node) Ready() error {
+	if err := n.Healthy(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.bootstrapped && len(n.cfg.Bootstrap) > 0 {
+		return errors.New("not bootstrapped")
+	}
+	if peers := len(n.dht.peers()); peers < n.cfg.MinPeers {
+		return fmt.Errorf("routing table has %d peers, need %d", peers, n.cfg.MinPeers)
+	}
+	return nil
+}
+
+// AdminHandler serves the node's admin endpoints: /healthz and /readyz
+// probes, /gc, /reload and /shell, /stats, /metrics, /misbehavior and a
+// dashboard at /. Serve it only where operators can reach it.
+func (n *Node) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probe(n.Healthy))
+	mux.HandleFunc("/readyz", probe(n.Ready))
+	mux.HandleFunc("/gc", n.gcHandler)
+	mux.HandleFunc("/reload", n.reloadHandler)
+	mux.HandleFunc("/shell", n.shellHandler)
+	mux.HandleFunc("/stats", n.statsHandler)
+	mux.HandleFunc("/metrics", n.metricsHandler)
+	mux.HandleFunc("/misbehavior", n.misbehaviorHandler)
+	mux.HandleFunc("/", n.dashboardHandler)
+	return mux
+}
+
+func probe(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
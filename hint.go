@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Hinted handoff, after Dynamo. The replicas Put meant to use are the
+// closest peers the lookup came across, answering or not; each one that
+// did not answer is stood in for by the next closest peer, which gets the
+// record with a hint naming the replica it was meant for. A replica that
+// took part in the lookup but then failed the store is handed off to the
+// next closest peer outside the replica set the same way. The hint holder
+// stores the record like any copy and keeps trying to forward it to that
+// replica, once a retry interval has passed or sooner if the replica gets
+// in touch, until it lands or the publisher's next republish makes the
+// hint moot. The holder's own copy is left to garbage collection, which
+// drops it once it goes unused away from the key.
+const (
+	hintRetryInterval = time.Minute
+	maxHints          = 1024
+	maxHintAttempts   = 3 // holders tried per replica that failed a store
+)
+
+// hint is a record we hold on behalf of a replica Put could not reach.
+type hint struct {
+	key   string
+	to    contact
+	since time.Time
+	tried time.Time
+}
+
+// storeHinted stores key at replicas, the closest peers that answered
+// result's lookup, with hints on those standing in for closer peers that
+// did not, then hands off the stores that failed. Every store that
+// succeeds is counted in acks.
+func (n *Node) storeHinted(ctx context.Context, key string, value []byte, version int64, replicas []*Peer, result *lookupResult, acks *writeAcks) {
+	target := n.dht.hashValue(key)
+	intended := append(append([]*Peer(nil), replicas...), result.unreachable...)
+	n.dht.sortByDistance(intended, target)
+	intended = n.replicasFor(key, intended)
+	wanted := make(map[string]bool, len(intended))
+	for _, p := range intended {
+		wanted[p.id] = true
+	}
+	missing := make([]*Peer, 0)
+	for _, p := range intended {
+		if !contains(replicas, p.id) {
+			missing = append(missing, p)
+		}
+	}
+	hints := make(map[string]*contact)
+	for i := len(replicas) - 1; i >= 0 && len(missing) > 0; i-- {
+		if !wanted[replicas[i].id] {
+			to := missing[0]
+			missing = missing[1:]
+			hints[replicas[i].id] = &contact{ID: to.id, Addr: to.addr, Addrs: to.addrs}
+		}
+	}
+
+	replies := n.callEach(ctx, replicas, func(p *Peer) *message {
+		req := n.storeRequest(p, result.tokens[p.id], key, value, version)
+		req.Hint = hints[p.id]
+		return req
+	}, func(r reply) {
+		if r.err == nil {
+			acks.ack()
+		}
+	})
+	n.handOff(ctx, key, value, version, replicas, replies, result.tokens, acks)
+}
+
+func contains(peers []*Peer, id string) bool {
+	for _, p := range peers {
+		if p.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handOff stores key at the next closest peers outside replicas for each
+// replica whose store failed because it did not answer.
+func (n *Node) handOff(ctx context.Context, key string, value []byte, version int64, replicas []*Peer, replies []reply, tokens map[string]string, acks *writeAcks) {
+	unreachable := make([]*Peer, 0)
+	for _, r := range replies {
+		var remote *remoteError
+		if r.err != nil && !errors.As(r.err, &remote) {
+			unreachable = append(unreachable, r.peer)
+		}
+	}
+	if len(unreachable) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	n.mu.Lock()
+	candidates := n.dht.closestWhere(n.dht.hashValue(key), len(unreachable)*maxHintAttempts, func(p *Peer) bool {
+		return !contains(replicas, p.id)
+	})
+	n.mu.Unlock()
+
+	for _, to := range unreachable {
+		for attempts := 0; attempts < maxHintAttempts && len(candidates) > 0 && ctx.Err() == nil; attempts++ {
+			holder := candidates[0]
+			candidates = candidates[1:]
+			token, ok := tokens[holder.id]
+			if !ok {
+				if token = n.writeToken(ctx, holder, key); token == "" {
+					continue
+				}
+			}
+			req := n.storeRequest(holder, token, key, value, version)
+			req.Hint = &contact{ID: to.id, Addr: to.addr, Addrs: to.addrs}
+			if _, err := n.call(ctx, holder, req); err == nil {
+				n.log.Debug("handed off record", "key", key, "replica", to.id, "holder", holder.id)
+				acks.ack()
+				break
+			}
+		}
+	}
+}
+
+// writeToken asks p for a write token for key, which peers hand out with
+// every find_node answer.
+func (n *Node) writeToken(ctx context.Context, p *Peer, key string) string {
+	req := n.request(msgFindNode)
+	req.Target = n.dht.hashValue(key)
+	resp, err := n.call(ctx, p, req)
+	if err != nil {
+		return ""
+	}
+	return resp.Token
+}
+
+// keepHint records the hint a store came with. n.mu must be held.
+func (n *Node) keepHint(key string, to contact) {
+	if to.ID == "" || to.ID == n.self.id {
+		return
+	}
+	id := key + "\x00" + to.ID
+	if _, ok := n.hints[id]; !ok && len(n.hints) >= maxHints {
+		return
+	}
+	if n.hints == nil {
+		n.hints = make(map[string]*hint)
+	}
+	now := n.clock.Now()
+	n.hints[id] = &hint{key: key, to: to, since: now, tried: now}
+}
+
+// forwardHints tries to deliver the records held for unreachable replicas
+// that are due: those whose replica we have heard from since the last
+// attempt, and the rest once per retry interval. Hints older than a
+// republish interval are dropped undelivered.
+func (n *Node) forwardHints(ctx context.Context, now time.Time) {
+	type delivery struct {
+		id      string
+		to      *Peer
+		key     string
+		value   []byte
+		version int64
+	}
+	n.mu.Lock()
+	due := make([]delivery, 0)
+	for id, h := range n.hints {
+		r, ok := n.store.get(h.key)
+		if !ok || now.Sub(h.since) > n.cfg.RepublishInterval {
+			delete(n.hints, id)
+			continue
+		}
+		to := &Peer{id: h.to.ID, addr: h.to.Addr, addrs: h.to.Addrs}
+		known := n.dht.findPeer(h.to.ID)
+		if known != nil {
+			to = known
+		}
+		if now.Sub(h.tried) < hintRetryInterval && (known == nil || !known.seen.After(h.tried)) {
+			continue
+		}
+		h.tried = now
+		due = append(due, delivery{id: id, to: to, key: h.key, value: r.value, version: r.version})
+	}
+	n.mu.Unlock()
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		token := n.writeToken(ctx, d.to, d.key)
+		if token == "" {
+			continue
+		}
+		_, err := n.call(ctx, d.to, n.storeRequest(d.to, token, d.key, d.value, d.version))
+		var remote *remoteError
+		if err == nil || errors.As(err, &remote) {
+			// Delivered, or refused for good, e.g. because the replica
+			// already has a later version.
+			n.mu.Lock()
+			delete(n.hints, d.id)
+			n.mu.Unlock()
+			n.log.Debug("delivered hinted record", "key", d.key, "replica", d.to.id, "err", err)
+		}
+	}
+}
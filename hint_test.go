@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// nearestNodes returns the count nodes of sim nearest to key's hash.
+func nearestNodes(sim *dhtsim.Simulation, key string, count int) []*Node {
+	target := simNodes(sim)[0].dht.hashValue(key)
+	nodes := append([]*Node(nil), simNodes(sim)...)
+	sort.Slice(nodes, func(i, j int) bool { return compareDistance(nodes[i].ID(), nodes[j].ID(), target) < 0 })
+	return nodes[:min(count, len(nodes))]
+}
+
+// outside returns a node of sim that is not among nodes.
+func outside(sim *dhtsim.Simulation, nodes []*Node) *Node {
+	for i := len(simNodes(sim)) - 1; i >= 0; i-- {
+		found := false
+		for _, n := range nodes {
+			found = found || n == simNodes(sim)[i]
+		}
+		if !found {
+			return simNodes(sim)[i]
+		}
+	}
+	return nil
+}
+
+func TestHintedHandoff(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 5)
+	sim.AddNodes(ctx, 30)
+	const key = "hinted"
+	replicas := nearestNodes(sim, key, cfg.policy(key).Replication)
+	x := replicas[0]
+	sim.Fail(simNode{x}, time.Hour)
+
+	if err := outside(sim, replicas).Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	hint := key + "\x00" + x.ID()
+	var holders []*Node
+	for _, n := range simNodes(sim) {
+		n.mu.Lock()
+		if _, ok := n.hints[hint]; ok {
+			holders = append(holders, n)
+		}
+		n.mu.Unlock()
+	}
+	if len(holders) == 0 {
+		t.Fatal("no node holds a hint for the unreachable replica")
+	}
+	if x.store.has(key) {
+		t.Fatal("the unreachable replica got the record")
+	}
+
+	sim.Recover(simNode{x})
+	sim.Advance(ctx, 2*hintRetryInterval)
+	x.mu.Lock()
+	has := x.store.has(key)
+	x.mu.Unlock()
+	if !has {
+		t.Error("the hint was not delivered once the replica came back")
+	}
+	for _, n := range holders {
+		n.mu.Lock()
+		if _, ok := n.hints[hint]; ok {
+			t.Errorf("node %s still holds the delivered hint", n.ID()[:8])
+		}
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// With cache.hot_rate set, a node counts the find_value requests it
+// answers with a value, per key, as a rate decaying over rateWindow. A key
+// served more than hot_rate times a second is hot: every maintenance tick
+// until it cools down, and at most every half hot_ttl, we push copies of
+// it to the hot_fanout nodes that come right after its replicas by
+// distance, as our routing table has them. Those are the nodes lookups
+// for the key pass through just before they reach a replica, so further
+// lookups find the value a hop early and the replicas see less of the
+// load. Pushed copies are stores marked with how long they may live,
+// hot_ttl at most, kept as a cached copy that expires on its own and is
+// never republished, handed off or replaces a replica's copy.
+const (
+	rateWindow       = time.Minute
+	maxTrackedKeys   = 4096
+	minTrackedRate   = 0.01 // requests a second below which a key is forgotten
+	defaultHotTTL    = time.Minute
+	defaultHotFanout = 3
+)
+
+// keyRate is how often a key was asked for: every request adds one to
+// total, which decays exponentially with time constant rateWindow.
+type keyRate struct {
+	total  float64
+	at     time.Time
+	pushed time.Time // last offloaded
+}
+
+// keyRates tracks request rates by key. Like store, it is guarded by the
+// node's mutex.
+type keyRates map[string]*keyRate
+
+// decayed returns r's total as of now.
+func (r *keyRate) decayed(now time.Time) float64 {
+	return r.total * math.Exp(-now.Sub(r.at).Seconds()/rateWindow.Seconds())
+}
+
+// perSecond returns r's rate as of now.
+func (r *keyRate) perSecond(now time.Time) float64 {
+	return r.decayed(now) / rateWindow.Seconds()
+}
+
+// hit counts a request for key at now.
+func (k keyRates) hit(key string, now time.Time) {
+	r, ok := k[key]
+	if !ok {
+		if len(k) >= maxTrackedKeys {
+			k.prune(now)
+		}
+		if len(k) >= maxTrackedKeys {
+			return
+		}
+		r = &keyRate{at: now}
+		k[key] = r
+	}
+	r.total, r.at = r.decayed(now)+1, now
+}
+
+// recent returns about how many requests for key came in over the last
+// rateWindow as of now.
+func (k keyRates) recent(key string, now time.Time) float64 {
+	if r, ok := k[key]; ok {
+		return r.decayed(now)
+	}
+	return 0
+}
+
+// rate returns key's requests a second as of now.
+func (k keyRates) rate(key string, now time.Time) float64 {
+	if r, ok := k[key]; ok {
+		return r.perSecond(now)
+	}
+	return 0
+}
+
+// prune forgets the keys that have gone cold.
+func (k keyRates) prune(now time.Time) {
+	for key, r := range k {
+		if r.perSecond(now) < minTrackedRate {
+			delete(k, key)
+		}
+	}
+}
+
+// pushedCopy reports whether our record for key is a hot-key copy.
+func (n *Node) pushedCopy(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, ok := n.store.peek(key)
+	return ok && !r.expires.IsZero()
+}
+
+// offloadHotKeys pushes copies of the keys that are hot as of now.
+func (n *Node) offloadHotKeys(ctx context.Context, now time.Time) {
+	if n.cfg.Cache.HotRate <= 0 {
+		return
+	}
+	var hot []string
+	n.mu.Lock()
+	for key, r := range n.served {
+		if r.perSecond(now) >= n.cfg.Cache.HotRate && now.Sub(r.pushed) >= n.cfg.Cache.HotTTL/2 {
+			r.pushed = now
+			hot = append(hot, key)
+		}
+	}
+	n.served.prune(now)
+	n.mu.Unlock()
+	for _, key := range hot {
+		if ctx.Err() != nil {
+			return
+		}
+		n.offload(ctx, key)
+	}
+}
+
+// offload pushes a copy of key to the nodes just outside its replica set.
+func (n *Node) offload(ctx context.Context, key string) {
+	line, ok := n.snapshotRecord(key)
+	if !ok {
+		return
+	}
+	target := n.dht.hashValue(key)
+	n.mu.Lock()
+	candidates := append(n.dht.closest(target, n.cfg.K+n.cfg.Cache.HotFanout), n.self)
+	n.dht.sortByDistance(candidates, target)
+	outer := make([]*Peer, 0, n.cfg.Cache.HotFanout)
+	for _, p := range candidates[min(n.replication(key), len(candidates)):] {
+		if p.id != n.self.id && len(outer) < n.cfg.Cache.HotFanout {
+			outer = append(outer, p)
+		}
+	}
+	n.mu.Unlock()
+	pushed := 0
+	for _, r := range n.callAll(ctx, outer, func(p *Peer) *message {
+		req := n.storeRequest(p, n.writeToken(ctx, p, key), key, line.Value, line.Version)
+		req.CacheFor = n.cfg.Cache.HotTTL.Milliseconds()
+		return req
+	}) {
+		if r.err == nil {
+			pushed++
+		}
+	}
+	n.log.Debug("offloaded hot key", "key", key, "peers", pushed)
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestHotKeyCopies(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	cfg.Cache.HotRate = 0.2
+	cfg.Cache.HotTTL = 10 * time.Minute
+	sim := newSimulation(cfg, 8)
+	sim.AddNodes(ctx, 40)
+	const key = "hot"
+	if err := simNodes(sim)[0].Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if _, err := simNodes(sim)[i%len(simNodes(sim))].Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sim.Advance(ctx, dhtsim.Step)
+
+	replicas := nearestNodes(sim, key, cfg.policy(key).Replication)
+	var pushed *Node
+	for _, n := range simNodes(sim) {
+		if n.pushedCopy(key) {
+			pushed = n
+			for _, r := range replicas {
+				if r == n {
+					t.Errorf("replica %s holds a pushed copy", n.ID()[:8])
+				}
+			}
+		}
+	}
+	if pushed == nil {
+		t.Fatal("no copies of the hot key were pushed")
+	}
+	pushed.mu.Lock()
+	r, _ := pushed.store.peek(key)
+	expires := r.expires
+	pushed.mu.Unlock()
+	if expires.After(sim.Clock().Now().Add(cfg.Cache.HotTTL)) {
+		t.Errorf("pushed copy lives until %v, past hot_ttl", expires)
+	}
+
+	// A snapshot keeps the copy a pushed copy, expiry and all.
+	var snapshot bytes.Buffer
+	if err := pushed.Export(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored := Simulated(cfg)(sim.Network(), sim.Clock(), sim.Rand()).(simNode).Node
+	if _, err := restored.Import(ctx, &snapshot, true); err != nil {
+		t.Fatal(err)
+	}
+	restored.mu.Lock()
+	r, ok := restored.store.peek(key)
+	restored.mu.Unlock()
+	switch {
+	case !ok:
+		t.Fatal("pushed copy not imported")
+	case !r.expires.Equal(expires):
+		t.Errorf("imported copy expires at %v, want %v", r.expires, expires)
+	case r.publisher == restored.ID():
+		t.Error("imported pushed copy became ours to publish")
+	}
+	sim.Clock().Advance(cfg.Cache.HotTTL + time.Second)
+	restored.get(ctx, key)
+	restored.mu.Lock()
+	_, kept := restored.store.peek(key)
+	restored.mu.Unlock()
+	if kept {
+		t.Error("imported copy outlived its expiry")
+	}
+}
@@ -0,0 +1,173 @@
+package dht
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	identityFile       = "identity.key"
+	identityPassEnv    = "DHT_IDENTITY_PASSPHRASE"
+	identityIterations = 600000
+)
+
+// identityKeyfile is the on-disk form of a node's ed25519 key. The seed is
+// sealed with AES-256-GCM under a key derived from the passphrase. With no
+// passphrase there is nothing to seal it with: the KDF is "none" and the
+// seed is kept in the clear, so the file says what it is.
+type identityKeyfile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Seed       []byte `json:"seed,omitempty"`
+	PublicKey  []byte `json:"public_key"`
+}
+
+// nodeIDFromKey derives the node ID from the identity public key, so the
+// ID is stable as long as the key is.
+func nodeIDFromKey(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:IDBits/8])
+}
+
+func generateIdentity(random io.Reader) (ed25519.PrivateKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// loadOrCreateIdentity reads the identity key from the storage directory,
+// creating and saving a new one on first run. It reports whether the key
+// is stored unencrypted, as it is without a passphrase; a keyfile saved so
+// is sealed once a passphrase is given.
+func loadOrCreateIdentity(cfg Config) (key ed25519.PrivateKey, unprotected bool, err error) {
+	passphrase, err := identityPassphrase(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	path := filepath.Join(cfg.Storage, identityFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, unprotected, err = openIdentity(data, passphrase)
+		if err != nil || !unprotected || passphrase == "" {
+			return key, unprotected, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	} else if key, err = generateIdentity(rand.Reader); err != nil {
+		return nil, false, err
+	}
+
+	data, err = sealIdentity(key, passphrase)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeFileAtomic(path, data, 0o600); err != nil {
+		return nil, false, err
+	}
+	return key, passphrase == "", nil
+}
+
+func identityPassphrase(cfg Config) (string, error) {
+	if cfg.IdentityPassphraseFile != "" {
+		data, err := os.ReadFile(cfg.IdentityPassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("identity passphrase: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv(identityPassEnv), nil
+}
+
+func identityCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealIdentity(key ed25519.PrivateKey, passphrase string) ([]byte, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	if passphrase == "" {
+		return json.MarshalIndent(identityKeyfile{
+			Version:   1,
+			KDF:       "none",
+			Seed:      key.Seed(),
+			PublicKey: pub,
+		}, "", "  ")
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aead, err := identityCipher(passphrase, salt, identityIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return json.MarshalIndent(identityKeyfile{
+		Version:    1,
+		KDF:        "pbkdf2-sha256",
+		Iterations: identityIterations,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, key.Seed(), pub),
+		PublicKey:  pub,
+	}, "", "  ")
+}
+
+// openIdentity reads a keyfile and reports whether it was unprotected:
+// saved in the clear or sealed under the empty passphrase.
+func openIdentity(data []byte, passphrase string) (ed25519.PrivateKey, bool, error) {
+	var f identityKeyfile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, false, fmt.Errorf("identity key: %w", err)
+	}
+	var seed []byte
+	switch {
+	case f.Version == 1 && f.KDF == "none":
+		seed = f.Seed
+	case f.Version == 1 && f.KDF == "pbkdf2-sha256":
+		aead, err := identityCipher(passphrase, f.Salt, f.Iterations)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(f.Nonce) != aead.NonceSize() {
+			return nil, false, errors.New("identity key: bad nonce")
+		}
+		if seed, err = aead.Open(nil, f.Nonce, f.Ciphertext, f.PublicKey); err != nil {
+			return nil, false, errors.New("identity key: wrong passphrase or corrupt keyfile")
+		}
+	default:
+		return nil, false, fmt.Errorf("identity key: unsupported version %d/%s", f.Version, f.KDF)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, false, errors.New("identity key: bad seed")
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	if !key.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(f.PublicKey)) {
+		return nil, false, errors.New("identity key: public key mismatch")
+	}
+	return key, f.KDF == "none" || passphrase == "", nil
+}
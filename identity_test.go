@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityWithoutPassphrase(t *testing.T) {
+	t.Setenv(identityPassEnv, "")
+	cfg := Config{Storage: t.TempDir()}
+	key, unprotected, err := loadOrCreateIdentity(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unprotected {
+		t.Error("key without a passphrase not reported unprotected")
+	}
+	var f identityKeyfile
+	data, err := os.ReadFile(filepath.Join(cfg.Storage, identityFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.KDF != "none" || f.Ciphertext != nil {
+		t.Errorf("keyfile kdf %q, ciphertext %d bytes, want it labelled unprotected", f.KDF, len(f.Ciphertext))
+	}
+
+	again, unprotected, err := loadOrCreateIdentity(cfg)
+	if err != nil || !unprotected || !again.Equal(key) {
+		t.Fatalf("reload: unprotected %v, same key %v, err %v", unprotected, again.Equal(key), err)
+	}
+
+	// Given a passphrase, the same key is sealed under it.
+	t.Setenv(identityPassEnv, "secret")
+	sealed, unprotected, err := loadOrCreateIdentity(cfg)
+	if err != nil || unprotected || !sealed.Equal(key) {
+		t.Fatalf("seal: unprotected %v, same key %v, err %v", unprotected, sealed.Equal(key), err)
+	}
+	data, _ = os.ReadFile(filepath.Join(cfg.Storage, identityFile))
+	if _, _, err := openIdentity(data, "wrong"); err == nil {
+		t.Error("sealed keyfile opened with the wrong passphrase")
+	}
+	if opened, unprotected, err := openIdentity(data, "secret"); err != nil || unprotected || !opened.Equal(key) {
+		t.Errorf("open sealed: unprotected %v, err %v", unprotected, err)
+	}
+}
@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix listing works by convention over ordinary records. A key such as
+// /app/users/alice is entered in one index record per enclosing path
+// segment: "/app/" lists "/app/users/" and "/app/users/" lists the key
+// itself. Index records live in the index namespace under the hash of
+// their prefix and map each entry to when it was last indexed. Peers
+// storing an index record merge what they are sent into what they have,
+// since many writers share one record, and drop entries that were not
+// refreshed within the namespace TTL. ListByPrefix walks these records
+// down from the prefix.
+const (
+	indexNamespace  = "index"
+	maxIndexEntries = 1024
+	maxIndexWalk    = 64
+)
+
+var ErrBadPrefix = errors.New(`prefix must start with "/name/"`)
+
+func (n *Node) indexKey(prefix string) string {
+	return "/" + indexNamespace + "/" + n.dht.hashValue(prefix)
+}
+
+// indexParents returns every enclosing prefix of key below the root, each
+// paired with the entry key adds to it.
+func indexParents(key string) (parents, entries []string) {
+	for i := strings.Index(key[1:], "/") + 1; i > 0 && i < len(key)-1; {
+		next := strings.Index(key[i+1:], "/")
+		parents = append(parents, key[:i+1])
+		if next < 0 {
+			entries = append(entries, key)
+			break
+		}
+		entries = append(entries, key[:i+1+next+1])
+		i += 1 + next
+	}
+	return parents, entries
+}
+
+// PutIndexed is Put plus entering key in the prefix index. The entries
+// are refreshed whenever the record is republished.
+func (n *Node) PutIndexed(ctx context.Context, key string, value []byte) error {
+	if namespaceOf(key) == "" {
+		return ErrBadPrefix
+	}
+	if err := n.Put(ctx, key, value); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.indexed == nil {
+		n.indexed = make(map[string]bool)
+	}
+	n.indexed[key] = true
+	n.mu.Unlock()
+	return n.index(ctx, key)
+}
+
+func (n *Node) index(ctx context.Context, key string) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	parents, entries := indexParents(key)
+	for i, parent := range parents {
+		value, _ := json.Marshal(map[string]int64{entries[i]: n.clock.Now().Unix()})
+		ikey := n.indexKey(parent)
+		result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(ikey))
+		replicas := n.replicasFor(ikey, result.closest)
+		n.storeAt(ctx, replicas, result.tokens, ikey, value)
+	}
+	return ctx.Err()
+}
+
+// mergeIndex folds incoming index entries into stored ones, keeping the
+// newest time for each entry, dropping entries older than ttl and then all
+// but the newest maxIndexEntries.
+func mergeIndex(stored, incoming []byte, now time.Time, ttl time.Duration) ([]byte, error) {
+	entries := make(map[string]int64)
+	if stored != nil {
+		json.Unmarshal(stored, &entries)
+	}
+	var fresh map[string]int64
+	if err := json.Unmarshal(incoming, &fresh); err != nil {
+		return nil, err
+	}
+	for entry, at := range fresh {
+		entries[entry] = max(entries[entry], at)
+	}
+	names := make([]string, 0, len(entries))
+	for entry, at := range entries {
+		if now.Sub(time.Unix(at, 0)) <= ttl {
+			names = append(names, entry)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if entries[names[i]] != entries[names[j]] {
+			return entries[names[i]] > entries[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	kept := make(map[string]int64, min(len(names), maxIndexEntries))
+	for _, entry := range names[:min(len(names), maxIndexEntries)] {
+		kept[entry] = entries[entry]
+	}
+	return json.Marshal(kept)
+}
+
+// ListByPrefix returns the indexed keys starting with prefix, in order.
+// It reads at most maxIndexWalk index records.
+func (n *Node) ListByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	boundary := prefix[:strings.LastIndex(prefix, "/")+1]
+	if !strings.HasPrefix(prefix, "/") || strings.Count(boundary, "/") < 2 {
+		return nil, ErrBadPrefix
+	}
+	ttl := n.cfg.policy(n.indexKey(boundary)).TTL
+	keys := make([]string, 0)
+	queue := []string{boundary}
+	for walked := 0; len(queue) > 0 && walked < maxIndexWalk; walked++ {
+		parent := queue[0]
+		queue = queue[1:]
+		value, err := n.Get(ctx, n.indexKey(parent))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entries map[string]int64
+		if err := json.Unmarshal(value, &entries); err != nil {
+			continue
+		}
+		for entry, at := range entries {
+			if !strings.HasPrefix(entry, prefix) || n.clock.Now().Sub(time.Unix(at, 0)) > ttl {
+				continue
+			}
+			if strings.HasSuffix(entry, "/") {
+				queue = append(queue, entry)
+			} else {
+				keys = append(keys, entry)
+			}
+		}
+		sort.Strings(queue)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,71 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIndexParents(t *testing.T) {
+	parents, entries := indexParents("/app/users/alice")
+	if want := []string{"/app/", "/app/users/"}; !reflect.DeepEqual(parents, want) {
+		t.Errorf("parents %q, want %q", parents, want)
+	}
+	if want := []string{"/app/users/", "/app/users/alice"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries %q, want %q", entries, want)
+	}
+}
+
+func TestMergeIndex(t *testing.T) {
+	now := time.Unix(1e6, 0)
+	stored, _ := json.Marshal(map[string]int64{"/a/x": now.Unix() - 10, "/a/old": now.Unix() - 7200})
+	incoming, _ := json.Marshal(map[string]int64{"/a/x": now.Unix() - 20, "/a/y": now.Unix()})
+	merged, err := mergeIndex(stored, incoming, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int64
+	json.Unmarshal(merged, &got)
+	want := map[string]int64{"/a/x": now.Unix() - 10, "/a/y": now.Unix()}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	if _, err := mergeIndex(stored, []byte("not json"), now, time.Hour); err == nil {
+		t.Error("merged an index record that is not JSON")
+	}
+}
+
+func TestListByPrefix(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 10)
+	sim.AddNodes(ctx, 20)
+	nodes := simNodes(sim)
+	for i, key := range []string{"/app/users/alice", "/app/users/bob", "/app/groups/admins", "/other/users/carol"} {
+		if err := nodes[i].PutIndexed(ctx, key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for prefix, want := range map[string][]string{
+		"/app/":        {"/app/groups/admins", "/app/users/alice", "/app/users/bob"},
+		"/app/users/b": {"/app/users/bob"},
+		"/app/nobody/": {},
+	} {
+		got, err := nodes[19].ListByPrefix(ctx, prefix)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ListByPrefix(%q): %q, err %v, want %q", prefix, got, err, want)
+		}
+	}
+	for _, prefix := range []string{"app/", "/app", ""} {
+		if _, err := nodes[19].ListByPrefix(ctx, prefix); !errors.Is(err, ErrBadPrefix) {
+			t.Errorf("ListByPrefix(%q): %v, want %v", prefix, err, ErrBadPrefix)
+		}
+	}
+	if err := nodes[0].PutIndexed(ctx, "plain", []byte("v")); !errors.Is(err, ErrBadPrefix) {
+		t.Errorf("PutIndexed outside a namespace: %v, want %v", err, ErrBadPrefix)
+	}
+}
@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Get checks a value it found on the network for more than the namespace
+// validator does before returning it. A value under a content key,
+// /blob/ followed by the hex SHA-256 of the value, is immutable and must
+// hash to its key; records of the namespaces whose records are signed,
+// names, feeds and presence, must carry a valid signature of their owner
+// for that key. A value that fails is not cached and comes back as a
+// *CorruptValueError naming the peer that served it, which
+// detect_misbehavior scores corruptValue against. Replicas refuse such
+// values when they are stored, so an honest one never serves them.
+const (
+	blobNamespace = "blob"
+	corruptValue  = 8.0
+)
+
+var ErrHashMismatch = errors.New("value does not match its content key")
+
+// CorruptValueError is returned by Get for a value that failed its
+// integrity check.
+type CorruptValueError struct {
+	Key  string
+	Peer string // node ID
+	Addr string
+	Err  error
+}
+
+func (e *CorruptValueError) Error() string {
+	return fmt.Sprintf("corrupt value for %s from %s: %v", e.Key, e.Peer, e.Err)
+}
+
+func (e *CorruptValueError) Unwrap() error {
+	return e.Err
+}
+
+// ContentKey returns the content key of value.
+func ContentKey(value []byte) string {
+	sum := sha256.Sum256(value)
+	return "/" + blobNamespace + "/" + hex.EncodeToString(sum[:])
+}
+
+// checkContent checks that a value under a content key hashes to it.
+func checkContent(key string, value []byte) error {
+	if namespaceOf(key) == blobNamespace && key != ContentKey(value) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// checkIntegrity checks value's content hash or signature, if key has
+// either.
+func (n *Node) checkIntegrity(key string, value []byte) error {
+	if err := checkContent(key, value); err != nil {
+		return err
+	}
+	var err error
+	switch namespaceOf(key) {
+	case namesNamespace:
+		// An expired name is stale, not corrupt; Resolve deals with it.
+		if _, err = n.verifyName(key, value, n.clock.Now()); errors.Is(err, ErrStaleName) {
+			err = nil
+		}
+	case feedNamespace:
+		_, _, err = n.verifyEntry(key, value)
+	case presenceNamespace:
+		_, err = n.verifyPresence(key, value)
+	}
+	return err
+}
+
+// checkFound checks a value a lookup found for key, and scores the peer
+// that served it if it is corrupt.
+func (n *Node) checkFound(key string, result *lookupResult) error {
+	err := n.checkIntegrity(key, result.value)
+	if err == nil {
+		return nil
+	}
+	p := result.holder
+	n.log.Warn("corrupt value", "key", key, "peer", p.id, "addr", p.addr, "err", err)
+	n.judge(p, corruptValue, "corrupt value")
+	return &CorruptValueError{Key: key, Peer: p.id, Addr: p.addr, Err: err}
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"time"
+)
+
+// keepAlive pings those of our k closest contacts we have not exchanged
+// anything with for the current keepalive interval. They are the peers
+// that route requests to us, so their NAT mappings towards us have to
+// stay open.
+//
+// The interval is learned from mapping lifetimes: a peer that stops
+// answering after a quiet gap suggests mappings last less than that gap,
+// so the interval drops to half of it. Every round without such a loss
+// lets it grow back by an eighth, up to the configured maximum.
+func (n *Node) keepAlive(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	interval := n.keepalive
+	due := make([]*Peer, 0, n.cfg.K)
+	gaps := make(map[string]time.Duration)
+	for _, p := range n.dht.closest(n.self.id, n.cfg.K) {
+		if gap := now.Sub(p.seen); gap >= interval {
+			due = append(due, p)
+			gaps[p.id] = gap
+		}
+	}
+	n.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	lifetime := time.Duration(0)
+	for _, r := range n.callAll(ctx, due, func(*Peer) *message { return n.request(msgPing) }) {
+		if r.err != nil && ctx.Err() == nil && (lifetime == 0 || gaps[r.peer.id] < lifetime) {
+			lifetime = gaps[r.peer.id]
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if lifetime > 0 {
+		n.keepalive = max(n.cfg.Keepalive.Min, min64(n.keepalive, lifetime/2))
+		n.log.Debug("shortening keepalive interval", "interval", n.keepalive, "lifetime", lifetime)
+	} else {
+		n.keepalive = min64(n.cfg.Keepalive.Max, n.keepalive+n.keepalive/8)
+	}
+}
@@ -0,0 +1,208 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Leases are records in the lease namespace naming a holder, a sequence
+// number and how long the holder may keep them, signed with the holder's
+// identity key as names and feeds are. Replicas only accept a write that
+// the holder signed and sent itself, whose sequence number is higher than
+// the one they have, and only from the current holder while the lease is
+// live, working out the expiry with their own clock so holders need not
+// agree on the time. A lease is
+// held once a majority of the replicas accepted it. This is best effort:
+// churn among the replicas can let two holders overlap, so the sequence
+// number doubles as a fencing token for whatever the lease protects.
+const leaseNamespace = "lease"
+
+var (
+	ErrLeaseHeld  = errors.New("lease held by another peer")
+	ErrLeaseLost  = errors.New("lease lost")
+	ErrStaleLease = errors.New("stale lease sequence number")
+	errNotHolder  = errors.New("lease not written by its holder")
+)
+
+// leaseRecord is what is stored under a lease key. Sig covers the JSON
+// encoding of everything else, with Sig and Expires left empty.
+type leaseRecord struct {
+	Key     string `json:"key"`
+	Holder  []byte `json:"holder"` // public key
+	Seq     uint64 `json:"seq"`
+	TTL     int64  `json:"ttl"`               // milliseconds, zero once released
+	Expires int64  `json:"expires,omitempty"` // unix milliseconds, set by the replica
+	Sig     []byte `json:"sig,omitempty"`
+}
+
+func (r leaseRecord) live(now time.Time) bool {
+	return r.TTL > 0 && now.UnixMilli() < r.Expires
+}
+
+// Lease is a lease this node holds.
+type Lease struct {
+	node    *Node
+	key     string
+	seq     uint64
+	expires time.Time
+}
+
+func leaseKey(key string) string {
+	return "/" + leaseNamespace + "/" + key
+}
+
+// Seq returns the sequence number of the current grant, which only grows.
+func (l *Lease) Seq() uint64 {
+	return l.seq
+}
+
+// Expires returns when the lease runs out unless renewed, measured from
+// before the grant was sent.
+func (l *Lease) Expires() time.Time {
+	return l.expires
+}
+
+// verifyLease decodes a lease write for key and checks its holder signed
+// it.
+func verifyLease(key string, value []byte) (leaseRecord, error) {
+	var r leaseRecord
+	if err := json.Unmarshal(value, &r); err != nil {
+		return r, err
+	}
+	signed := r
+	signed.Expires, signed.Sig = 0, nil
+	if r.Key != key || len(r.Holder) != ed25519.PublicKeySize || !ed25519.Verify(r.Holder, mustJSON(signed), r.Sig) {
+		return r, ErrBadSignature
+	}
+	return r, nil
+}
+
+// mergeLease decides whether a replica accepts an incoming lease write for
+// key, sent by the node from.
+func mergeLease(key string, stored, incoming []byte, from string, now time.Time) ([]byte, error) {
+	r, err := verifyLease(key, incoming)
+	if err != nil {
+		return nil, err
+	}
+	if nodeIDFromKey(r.Holder) != from {
+		return nil, errNotHolder
+	}
+	var current leaseRecord
+	if stored != nil && json.Unmarshal(stored, &current) == nil {
+		if r.Seq <= current.Seq {
+			return nil, ErrStaleLease
+		}
+		if current.live(now) && !bytes.Equal(current.Holder, r.Holder) {
+			return nil, ErrLeaseHeld
+		}
+	}
+	r.Expires = 0
+	if r.TTL > 0 {
+		r.Expires = now.UnixMilli() + r.TTL
+	}
+	return json.Marshal(r)
+}
+
+// leaseReplicas finds the replicas of a lease and asks each for its copy,
+// returning the highest sequence number any of them has seen and who holds
+// that grant.
+func (n *Node) leaseReplicas(ctx context.Context, key string) (replicas []*Peer, tokens map[string]string, latest leaseRecord) {
+	replicas, tokens, copies, _ := n.replicaCopies(ctx, key)
+	for _, value := range copies {
+		var held leaseRecord
+		if json.Unmarshal(value, &held) == nil && held.Seq > latest.Seq {
+			latest = held
+		}
+	}
+	return replicas, tokens, latest
+}
+
+// writeLease signs r as ours and stores it on the replicas, and reports
+// whether a majority took it. The replicas that did are returned.
+func (n *Node) writeLease(ctx context.Context, replicas []*Peer, tokens map[string]string, key string, r leaseRecord) ([]*Peer, bool) {
+	r.Key, r.Holder, r.Expires, r.Sig = key, n.key.Public().(ed25519.PublicKey), 0, nil
+	r.Sig = ed25519.Sign(n.key, mustJSON(r))
+	granted := make([]*Peer, 0, len(replicas))
+	for _, reply := range n.storeAt(ctx, replicas, tokens, key, mustJSON(r)) {
+		if reply.err == nil {
+			granted = append(granted, reply.peer)
+		}
+	}
+	return granted, len(granted)*2 > len(replicas)
+}
+
+// AcquireLease takes the lease on key for ttl. It fails with ErrLeaseHeld
+// while another peer holds it.
+func (n *Node) AcquireLease(ctx context.Context, key string, ttl time.Duration) (*Lease, error) {
+	if ttl < time.Millisecond {
+		return nil, errors.New("lease ttl must be at least 1ms")
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	lkey := leaseKey(key)
+	replicas, tokens, latest := n.leaseReplicas(ctx, lkey)
+	if len(replicas) == 0 {
+		return nil, ErrNoPeers
+	}
+	start := n.clock.Now()
+	r := leaseRecord{Seq: latest.Seq + 1, TTL: ttl.Milliseconds()}
+	granted, ok := n.writeLease(ctx, replicas, tokens, lkey, r)
+	if !ok {
+		// Hand back what we did get rather than blocking everyone else
+		// until it runs out.
+		r.Seq++
+		r.TTL = 0
+		n.writeLease(ctx, granted, tokens, lkey, r)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrLeaseHeld
+	}
+	return &Lease{node: n, key: key, seq: r.Seq, expires: start.Add(ttl)}, nil
+}
+
+// Renew extends the lease by ttl from now. It fails with ErrLeaseLost once
+// another peer has taken the lease over.
+func (l *Lease) Renew(ctx context.Context, ttl time.Duration) error {
+	n := l.node
+	if ttl < time.Millisecond {
+		return errors.New("lease ttl must be at least 1ms")
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	lkey := leaseKey(l.key)
+	replicas, tokens, latest := n.leaseReplicas(ctx, lkey)
+	if latest.Seq > l.seq {
+		return ErrLeaseLost
+	}
+	start := n.clock.Now()
+	r := leaseRecord{Seq: l.seq + 1, TTL: ttl.Milliseconds()}
+	if _, ok := n.writeLease(ctx, replicas, tokens, lkey, r); !ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return ErrLeaseLost
+	}
+	l.seq, l.expires = r.Seq, start.Add(ttl)
+	return nil
+}
+
+// Release gives the lease up so another peer can take it straight away.
+func (l *Lease) Release(ctx context.Context) error {
+	n := l.node
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	lkey := leaseKey(l.key)
+	replicas, tokens, latest := n.leaseReplicas(ctx, lkey)
+	if latest.Seq > l.seq {
+		return ErrLeaseLost
+	}
+	l.seq++
+	n.writeLease(ctx, replicas, tokens, lkey, leaseRecord{Seq: l.seq})
+	l.expires = time.Time{}
+	return ctx.Err()
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 7)
+	sim.AddNodes(ctx, 20)
+	a, b := simNodes(sim)[0], simNodes(sim)[1]
+
+	lease, err := a.AcquireLease(ctx, "leader", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AcquireLease(ctx, "leader", time.Minute); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("second acquire: %v, want %v", err, ErrLeaseHeld)
+	}
+	if err := lease.Renew(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := b.AcquireLease(ctx, "leader", time.Minute)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	if taken.Seq() <= lease.Seq() {
+		t.Errorf("sequence number went from %d to %d", lease.Seq(), taken.Seq())
+	}
+	if err := lease.Renew(ctx, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("renewing a released lease: %v, want %v", err, ErrLeaseLost)
+	}
+
+	// Once b's grant runs out on the replicas' clocks, a can take over.
+	sim.Clock().Advance(time.Minute + time.Second)
+	if _, err := a.AcquireLease(ctx, "leader", time.Minute); err != nil {
+		t.Errorf("acquire after expiry: %v", err)
+	}
+}
+
+func TestMergeLeaseChecksHolder(t *testing.T) {
+	holderPub, holder, _ := ed25519.GenerateKey(rand.Reader)
+	_, attacker, _ := ed25519.GenerateKey(rand.Reader)
+	attackerPub := attacker.Public().(ed25519.PublicKey)
+	key := leaseKey("leader")
+	now := time.Unix(1e9, 0)
+	grant := func(signer ed25519.PrivateKey, owner ed25519.PublicKey, key string, seq uint64) []byte {
+		r := leaseRecord{Key: key, Holder: owner, Seq: seq, TTL: time.Minute.Milliseconds()}
+		r.Sig = ed25519.Sign(signer, mustJSON(r))
+		return mustJSON(r)
+	}
+
+	stored, err := mergeLease(key, nil, grant(holder, holderPub, key, 1), nodeIDFromKey(holderPub), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		value []byte
+		from  string
+		want  error
+	}{
+		{"sent by someone else", grant(holder, holderPub, key, 2), nodeIDFromKey(attackerPub), errNotHolder},
+		{"forged signature", grant(attacker, holderPub, key, 2), nodeIDFromKey(holderPub), ErrBadSignature},
+		{"other key", grant(holder, holderPub, leaseKey("other"), 2), nodeIDFromKey(holderPub), ErrBadSignature},
+		{"taken over while live", grant(attacker, attackerPub, key, 2), nodeIDFromKey(attackerPub), ErrLeaseHeld},
+		{"replayed", grant(holder, holderPub, key, 1), nodeIDFromKey(holderPub), ErrStaleLease},
+	} {
+		if _, err := mergeLease(key, stored, c.value, c.from, now); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+	if _, err := mergeLease(key, stored, grant(holder, holderPub, key, 2), nodeIDFromKey(holderPub), now); err != nil {
+		t.Errorf("renewal by the holder: %v", err)
+	}
+}
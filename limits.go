@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const limiterIdle = 10 * time.Minute
+
+// rateLimiter is a token bucket per key. A zero rate disables it.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// set changes the rate and burst, keeping the tokens buckets have.
+func (l *rateLimiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+
+	if now.Sub(l.swept) > limiterIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > limiterIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Requests are also limited by source IP and by its /24, or /64 for IPv6,
+// since new node IDs cost nothing but addresses do. Loopback sources are
+// exempt, so can whole test networks on one machine, and so are relayed
+// requests, which the relay already counted against their sender. These
+// are the reasons requests get dropped for, counted in Stats.
+const (
+	dropBanned    = "banned"
+	dropPeerRate  = "peer_rate"
+	dropBandwidth = "bandwidth"
+	dropIPRate    = "ip_rate"
+	dropSubnet    = "subnet_rate"
+)
+
+// addrIP returns the IP of a transport address, false for those that have
+// none, such as the in-memory transport's.
+func addrIP(addr string) (netip.Addr, bool) {
+	addr = strings.TrimPrefix(addr, wsClientPrefix)
+	for _, scheme := range []string{"ws://", "wss://"} {
+		if rest, ok := strings.CutPrefix(addr, scheme); ok {
+			addr = strings.TrimSuffix(rest, "/")
+		}
+	}
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// subnetOf returns the /24 or /64 ip is in.
+func subnetOf(ip netip.Addr) netip.Prefix {
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// allowSource applies the per-IP and per-subnet limits to a request from
+// from, returning the reason to drop it for or "".
+func (n *Node) allowSource(from string, req *message, now time.Time) string {
+	ip, ok := addrIP(from)
+	if !ok || ip.IsLoopback() || req.Relayed {
+		return ""
+	}
+	if !n.ips.allow(ip.String(), now) {
+		return dropIPRate
+	}
+	if !n.subnets.allow(subnetOf(ip).String(), now) {
+		return dropSubnet
+	}
+	return ""
+}
+
+// dropRequest counts a request not answered for reason.
+func (n *Node) dropRequest(req *message, reason string, err error) {
+	n.mu.Lock()
+	if n.dropped == nil {
+		n.dropped = make(map[string]int64)
+	}
+	n.dropped[reason]++
+	n.mu.Unlock()
+	if err != nil {
+		n.log.Debug("dropping request", "peer", req.From.ID, "err", err)
+	}
+}
+
+// dropReasons returns the reasons in dropped, sorted.
+func dropReasons(dropped map[string]int64) []string {
+	reasons := make([]string, 0, len(dropped))
+	for reason := range dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// recentLookups is how many lookups a node remembers for inspection.
+const recentLookups = 32
+
+// lookupTrace is one iterative lookup as it went: the peers queried in
+// every round and how each answered, how many requests it sent and the
+// bytes they and their replies took on the wire, whether a value was
+// found and how many of the closest peers answered.
+type lookupTrace struct {
+	Type      string        `json:"type"`
+	Target    string        `json:"target"`
+	Started   time.Time     `json:"started"`
+	Took      time.Duration `json:"took"`
+	Hops      [][]string    `json:"hops"`
+	Queries   []lookupQuery `json:"queries"`
+	Contacted int           `json:"contacted"`
+	Bytes     int           `json:"bytes"`
+	Found     bool          `json:"found,omitempty"`
+	Closest   int           `json:"closest"`
+}
+
+// lookupQuery is one peer a lookup queried: in which round, its distance
+// to the target as the bit length of the XOR, how long it took to answer,
+// and whether it returned the value, how many closer contacts, or an
+// error.
+type lookupQuery struct {
+	Round    int           `json:"round"`
+	Peer     string        `json:"peer"`
+	Addr     string        `json:"addr"`
+	Distance int           `json:"distance"`
+	Took     time.Duration `json:"took"`
+	Found    bool          `json:"found,omitempty"`
+	Nodes    int           `json:"nodes"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// lookupTotals adds up every lookup of one type the node ran, for
+// comparing parameters over time rather than lookup by lookup.
+type lookupTotals struct {
+	Count     int64         `json:"count"`
+	Found     int64         `json:"found"`
+	Hops      int64         `json:"hops"`
+	MaxHops   int           `json:"max_hops"`
+	Contacted int64         `json:"contacted"`
+	Bytes     int64         `json:"bytes"`
+	Took      time.Duration `json:"took"`
+}
+
+// wireSize is the encoded size of m, zero for nil.
+func wireSize(m *message) int {
+	if m == nil {
+		return 0
+	}
+	buf, err := encodePacket(m)
+	if err != nil {
+		return 0
+	}
+	defer releasePacket(buf)
+	return buf.Len()
+}
+
+func (n *Node) recordLookup(trace lookupTrace) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.lookups) >= recentLookups {
+		n.lookups = append(n.lookups[:0], n.lookups[1:]...)
+	}
+	n.lookups = append(n.lookups, trace)
+	if n.lookupTotals == nil {
+		n.lookupTotals = make(map[string]*lookupTotals)
+	}
+	t := n.lookupTotals[trace.Type]
+	if t == nil {
+		t = new(lookupTotals)
+		n.lookupTotals[trace.Type] = t
+	}
+	t.Count++
+	if trace.Found {
+		t.Found++
+	}
+	t.Hops += int64(len(trace.Hops))
+	t.MaxHops = max(t.MaxHops, len(trace.Hops))
+	t.Contacted += int64(trace.Contacted)
+	t.Bytes += int64(trace.Bytes)
+	t.Took += trace.Took
+}
+
+// GetTraced looks key up like Get, but always over the network, ignoring
+// our own copy and the cache, and returns the value along with the trace
+// of every lookup that took: one per cluster tier tried, if any, and then
+// the whole network. The traces are returned whether the value was found
+// or not.
+func (n *Node) GetTraced(ctx context.Context, key string) ([]byte, []lookupTrace, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	result := n.lookupValue(ctx, key)
+	if !result.found {
+		if err := ctx.Err(); err != nil {
+			return nil, result.traces, err
+		}
+		return nil, result.traces, ErrNotFound
+	}
+	return result.value, result.traces, nil
+}
+
+// lookupTypes returns the types in totals in order.
+func lookupTypes(totals map[string]lookupTotals) []string {
+	types := make([]string, 0, len(totals))
+	for typ := range totals {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// RecentLookups returns the last lookups the node ran, most recent first.
+func (n *Node) RecentLookups() []lookupTrace {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	traces := make([]lookupTrace, len(n.lookups))
+	for i, trace := range n.lookups {
+		traces[len(traces)-1-i] = trace
+	}
+	return traces
+}
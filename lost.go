@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A peer the failure detector drops may only be cut off from us, as by a
+// partition, and then it is what leads us back to the nodes beyond the
+// cut: the nodes on our side dropped them as well, so no lookup will.
+// Dropped peers are remembered, up to maxLostPeers for lostRetention, and
+// on every refresh we ping the lostProbes of them tried least recently.
+// One that answers is a contact again, and the bucket refresh right after
+// finds the rest of its side of the network through it.
+const (
+	maxLostPeers  = 256
+	lostProbes    = 8
+	lostRetention = 24 * time.Hour
+)
+
+type lostPeer struct {
+	peer   *Peer
+	lost   time.Time
+	probed time.Time
+}
+
+// noteLost remembers a peer the failure detector dropped. n.mu must be
+// held.
+func (n *Node) noteLost(p *Peer, now time.Time) {
+	for i, l := range n.lost {
+		if l.peer.id == p.id {
+			n.lost = append(n.lost[:i], n.lost[i+1:]...)
+			break
+		}
+	}
+	if len(n.lost) >= maxLostPeers {
+		n.lost = n.lost[1:]
+	}
+	n.lost = append(n.lost, lostPeer{peer: p, lost: now})
+}
+
+// probeLost pings the lost peers due and takes back those that answer.
+func (n *Node) probeLost(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	kept := n.lost[:0]
+	for _, l := range n.lost {
+		if now.Sub(l.lost) < lostRetention && n.dht.findPeer(l.peer.id) == nil && !n.dht.banned[l.peer.id] {
+			kept = append(kept, l)
+		}
+	}
+	n.lost = kept
+	due := make([]*lostPeer, 0, len(n.lost))
+	for i := range n.lost {
+		due = append(due, &n.lost[i])
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].probed.Before(due[j].probed) })
+	due = due[:min(len(due), lostProbes)]
+	probes := make([]*Peer, len(due))
+	for i, l := range due {
+		l.probed = now
+		probes[i] = l.peer
+	}
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	back := make([]*Peer, len(probes))
+	for i, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := n.send(ctx, p.addr, n.request(msgPing))
+			if err == nil && resp.From.ID == p.id {
+				back[i] = &Peer{id: p.id, addr: p.addr, addrs: p.addrs, record: n.contactRecord(p.id, resp.From.ENR)}
+			}
+		}()
+	}
+	wg.Wait()
+	found := 0
+	for _, p := range back {
+		if p != nil {
+			n.addContact(p)
+			found++
+		}
+	}
+	if found > 0 {
+		n.log.Info("lost peers answered again", "peers", found, "probed", len(probes))
+	}
+}
@@ -0,0 +1,257 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Mailboxes queue messages for a recipient, named by its box key. Every
+// message is sealed to that key, see sealed.go, together with a fresh ack
+// secret, and stored in the recipient's mailbox record in the mailbox
+// namespace next to the secret's hash and an expiry. Replicas merge the
+// messages they are sent into what they have. The recipient polls its
+// mailbox, opens what it finds and acknowledges a message by sending its
+// secret, which only it could have read: replicas that see a secret
+// matching a message's hash drop its body and keep a tombstone until it
+// would have expired, so no merge brings it back. Expired messages and
+// tombstones are dropped, and the oldest messages go first when the
+// mailbox outgrows the namespace's value size or maxMailbox messages.
+//
+// Senders are not authenticated; a message that needs to say who sent it
+// must carry its own signature.
+const (
+	mailboxNamespace = "mailbox"
+	maxMailbox       = 256
+	ackSecretSize    = 16
+)
+
+var ErrNoMessage = errors.New("no such message")
+
+// Message is a message from our mailbox.
+type Message struct {
+	ID   string
+	Sent time.Time
+	Body []byte
+}
+
+// mailboxEntry is one message as stored in a mailbox record.
+type mailboxEntry struct {
+	Sealed []byte `json:"sealed,omitempty"` // nil once acknowledged
+	AckSum []byte `json:"ack"`              // sha256 of the ack secret
+	Ack    []byte `json:"secret,omitempty"` // the ack secret, once acknowledged
+	Sent   int64  `json:"sent"`             // unix milliseconds
+	Until  int64  `json:"until"`            // unix milliseconds
+}
+
+func (n *Node) mailboxKey(boxKey []byte) string {
+	return "/" + mailboxNamespace + "/" + n.dht.hashValue(hex.EncodeToString(boxKey))
+}
+
+// mergeMailbox folds incoming messages and acknowledgements into a stored
+// mailbox and drops what has expired at now, then the oldest messages
+// until it fits in maxSize.
+func mergeMailbox(stored, incoming []byte, now time.Time, maxSize int) ([]byte, error) {
+	var fresh map[string]mailboxEntry
+	if err := json.Unmarshal(incoming, &fresh); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]mailboxEntry)
+	if stored != nil {
+		json.Unmarshal(stored, &entries)
+	}
+	for id, e := range fresh {
+		if sum := sha256.Sum256(e.Ack); e.Ack != nil && string(sum[:]) != string(e.AckSum) {
+			continue
+		}
+		old, ok := entries[id]
+		switch {
+		case !ok:
+			entries[id] = e
+		case old.Ack == nil && e.Ack != nil && string(old.AckSum) == string(e.AckSum):
+			old.Sealed, old.Ack = nil, e.Ack
+			entries[id] = old
+		}
+	}
+	ids := make([]string, 0, len(entries))
+	for id, e := range entries {
+		if e.Until > now.UnixMilli() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if entries[ids[i]].Sent != entries[ids[j]].Sent {
+			return entries[ids[i]].Sent > entries[ids[j]].Sent
+		}
+		return ids[i] < ids[j]
+	})
+	ids = ids[:min(len(ids), maxMailbox)]
+	for {
+		kept := make(map[string]mailboxEntry, len(ids))
+		for _, id := range ids {
+			kept[id] = entries[id]
+		}
+		data, err := json.Marshal(kept)
+		if err != nil || len(data) <= maxSize || len(ids) == 0 {
+			return data, err
+		}
+		ids = ids[:len(ids)-1]
+	}
+}
+
+// storeMailbox sends entries to the replicas of the mailbox at key.
+func (n *Node) storeMailbox(ctx context.Context, key string, entries map[string]mailboxEntry) error {
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return ErrNoPeers
+	}
+	for _, r := range n.storeAt(ctx, replicas, result.tokens, key, mustJSON(entries)) {
+		if r.err == nil {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrNoPeers
+}
+
+// SendMessage queues body in the mailbox of the recipient with box key
+// to, for ttl or the mailbox namespace's TTL if shorter.
+func (n *Node) SendMessage(ctx context.Context, to []byte, body []byte, ttl time.Duration) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := n.mailboxKey(to)
+	secret := make([]byte, ackSecretSize)
+	io.ReadFull(n.random, secret)
+	sealed, err := sealValue(n.random, append(secret, body...), [][]byte{to})
+	if err != nil {
+		return err
+	}
+	now := n.clock.Now()
+	ttl = min64(ttl, n.cfg.policy(key).TTL)
+	sum := sha256.Sum256(secret)
+	id := sha256.Sum256(sealed)
+	return n.storeMailbox(ctx, key, map[string]mailboxEntry{
+		hex.EncodeToString(id[:16]): {Sealed: sealed, AckSum: sum[:], Sent: now.UnixMilli(), Until: now.Add(ttl).UnixMilli()},
+	})
+}
+
+// ReceiveMessages returns the messages waiting in our mailbox, oldest
+// first. They stay there until acknowledged with AckMessage or expired.
+func (n *Node) ReceiveMessages(ctx context.Context) ([]Message, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := n.mailboxKey(n.BoxKey())
+	_, _, copies, answered := n.replicaCopies(ctx, key)
+	if answered == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoPeers
+	}
+	now := n.clock.Now()
+	merged := []byte("{}")
+	for _, value := range copies {
+		// Our view is not limited to what one record can hold.
+		if m, err := mergeMailbox(merged, value, now, maxMailbox*n.cfg.Limits.MaxValueSize); err == nil {
+			merged = m
+		}
+	}
+	var entries map[string]mailboxEntry
+	json.Unmarshal(merged, &entries)
+
+	priv := boxKey(n.key)
+	messages := make([]Message, 0, len(entries))
+	secrets := make(map[string]mailboxEntry)
+	for id, e := range entries {
+		if e.Ack != nil {
+			continue
+		}
+		plain, err := openValue(priv, e.Sealed)
+		if err != nil || len(plain) < ackSecretSize {
+			continue
+		}
+		if sum := sha256.Sum256(plain[:ackSecretSize]); string(sum[:]) != string(e.AckSum) {
+			continue
+		}
+		messages = append(messages, Message{ID: id, Sent: time.UnixMilli(e.Sent), Body: plain[ackSecretSize:]})
+		e.Ack = plain[:ackSecretSize]
+		secrets[id] = e
+	}
+	n.mu.Lock()
+	n.inbox = secrets
+	n.mu.Unlock()
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].Sent.Equal(messages[j].Sent) {
+			return messages[i].Sent.Before(messages[j].Sent)
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+// AckMessage removes a message ReceiveMessages returned from our mailbox.
+func (n *Node) AckMessage(ctx context.Context, id string) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	n.mu.Lock()
+	e, ok := n.inbox[id]
+	n.mu.Unlock()
+	if !ok {
+		return ErrNoMessage
+	}
+	e.Sealed = nil
+	if err := n.storeMailbox(ctx, n.mailboxKey(n.BoxKey()), map[string]mailboxEntry{id: e}); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	delete(n.inbox, id)
+	n.mu.Unlock()
+	return nil
+}
+
+// WatchMessages polls our mailbox every interval and sends each message
+// once, oldest first, until ctx is done, when the channel is closed.
+// Messages still have to be acknowledged.
+func (n *Node) WatchMessages(ctx context.Context, interval time.Duration) <-chan Message {
+	messages := make(chan Message, 1)
+	go func() {
+		defer close(messages)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sent := make(map[string]time.Time)
+		for {
+			if received, err := n.ReceiveMessages(ctx); err == nil {
+				for _, m := range received {
+					if _, ok := sent[m.ID]; ok {
+						continue
+					}
+					select {
+					case messages <- m:
+						sent[m.ID] = m.Sent
+					case <-ctx.Done():
+						return
+					}
+				}
+				for id, at := range sent {
+					if n.clock.Now().Sub(at) > n.cfg.policy(n.mailboxKey(n.BoxKey())).TTL {
+						delete(sent, id)
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages
+}
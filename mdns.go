@@ -0,0 +1,322 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mdnsGroup    = "224.0.0.251:5353"
+	mdnsService  = "_dht._udp.local."
+	mdnsInterval = time.Minute
+	mdnsTTL      = 120
+
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+type dnsMessage struct {
+	response  bool
+	questions []dnsQuestion
+	answers   []dnsRecord
+}
+
+// StartMDNS advertises the node as a DNS-SD instance of _dht._udp on the
+// local link and browses for other instances, pinging every one it finds.
+// It runs until ctx is done.
+func (n *Node) StartMDNS(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	// ListenMulticastUDP turns off multicast loopback, so packets are sent
+	// from a plain socket to let nodes on the same host find each other.
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		sender.Close()
+	}()
+	go n.mdnsRead(ctx, conn, sender, group)
+	go func() {
+		ticker := time.NewTicker(mdnsInterval)
+		defer ticker.Stop()
+		for {
+			n.mdnsSend(sender, group, dnsMessage{questions: []dnsQuestion{{name: mdnsService, qtype: dnsTypePTR}}})
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *Node) mdnsSend(conn *net.UDPConn, group *net.UDPAddr, msg dnsMessage) {
+	data, err := msg.encode()
+	if err != nil {
+		return
+	}
+	conn.WriteToUDP(data, group)
+}
+
+func (n *Node) mdnsRead(ctx context.Context, conn, sender *net.UDPConn, group *net.UDPAddr) {
+	buf := make([]byte, 9000)
+	for {
+		size, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg, err := decodeDNS(buf[:size])
+		if err != nil {
+			continue
+		}
+		if !msg.response {
+			for _, q := range msg.questions {
+				if strings.EqualFold(q.name, mdnsService) && q.qtype == dnsTypePTR {
+					n.mdnsSend(sender, group, n.mdnsAnnouncement())
+					break
+				}
+			}
+			continue
+		}
+		for _, c := range mdnsPeers(msg, from.IP) {
+			if c.ID != n.self.id {
+				go n.mdnsContact(ctx, c)
+			}
+		}
+	}
+}
+
+func (n *Node) mdnsContact(ctx context.Context, c contact) {
+	n.mu.Lock()
+	known := n.dht.findPeer(c.ID) != nil
+	n.mu.Unlock()
+	if known {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := n.call(ctx, &Peer{id: c.ID, addr: c.Addr}, n.request(msgPing)); err == nil {
+		n.log.Debug("found peer via mdns", "peer", c.ID, "addr", c.Addr)
+	}
+}
+
+func (n *Node) mdnsAnnouncement() dnsMessage {
+	instance := n.self.id + "." + mdnsService
+	host, port, _ := net.SplitHostPort(n.self.addr)
+	txt := []string{"id=" + n.self.id, "port=" + port}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		txt = append(txt, "addr="+n.self.addr)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = n.self.id[:8]
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(portNum))
+	srv = appendDNSName(srv, hostname+".local.")
+
+	return dnsMessage{
+		response: true,
+		answers: []dnsRecord{
+			{name: mdnsService, rtype: dnsTypePTR, ttl: mdnsTTL, data: appendDNSName(nil, instance)},
+			{name: instance, rtype: dnsTypeSRV, ttl: mdnsTTL, data: srv},
+			{name: instance, rtype: dnsTypeTXT, ttl: mdnsTTL, data: encodeTXT(txt)},
+		},
+	}
+}
+
+// mdnsPeers extracts contacts from the TXT records of _dht._udp instances.
+// Peers listening on a wildcard address only advertise a port, so their
+// address is completed with the packet's source IP.
+func mdnsPeers(msg *dnsMessage, source net.IP) []contact {
+	contacts := make([]contact, 0)
+	for _, rr := range msg.answers {
+		if rr.rtype != dnsTypeTXT || !strings.HasSuffix(strings.ToLower(rr.name), mdnsService) {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, entry := range decodeTXT(rr.data) {
+			if k, v, ok := strings.Cut(entry, "="); ok {
+				fields[k] = v
+			}
+		}
+		c := contact{ID: fields["id"], Addr: fields["addr"]}
+		if c.Addr == "" && fields["port"] != "" {
+			c.Addr = net.JoinHostPort(source.String(), fields["port"])
+		}
+		if validID(c.ID) && c.Addr != "" {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+func (m dnsMessage) encode() ([]byte, error) {
+	buf := make([]byte, 12)
+	if m.response {
+		binary.BigEndian.PutUint16(buf[2:], 0x8400)
+	}
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.answers)))
+	for _, q := range m.questions {
+		buf = appendDNSName(buf, q.name)
+		buf = binary.BigEndian.AppendUint16(buf, q.qtype)
+		buf = binary.BigEndian.AppendUint16(buf, dnsClassIN)
+	}
+	for _, rr := range m.answers {
+		if len(rr.data) > 0xffff {
+			return nil, errors.New("dns record too large")
+		}
+		buf = appendDNSName(buf, rr.name)
+		buf = binary.BigEndian.AppendUint16(buf, rr.rtype)
+		buf = binary.BigEndian.AppendUint16(buf, dnsClassIN)
+		buf = binary.BigEndian.AppendUint32(buf, rr.ttl)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.data)))
+		buf = append(buf, rr.data...)
+	}
+	return buf, nil
+}
+
+func decodeDNS(data []byte) (*dnsMessage, error) {
+	if len(data) < 12 {
+		return nil, errors.New("short dns message")
+	}
+	msg := &dnsMessage{response: data[2]&0x80 != 0}
+	qdcount := int(binary.BigEndian.Uint16(data[4:]))
+	rrcount := int(binary.BigEndian.Uint16(data[6:])) + int(binary.BigEndian.Uint16(data[8:])) + int(binary.BigEndian.Uint16(data[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(data, off)
+		if err != nil || next+4 > len(data) {
+			return nil, errors.New("bad dns question")
+		}
+		msg.questions = append(msg.questions, dnsQuestion{name: name, qtype: binary.BigEndian.Uint16(data[next:])})
+		off = next + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readDNSName(data, off)
+		if err != nil || next+10 > len(data) {
+			return nil, errors.New("bad dns record")
+		}
+		length := int(binary.BigEndian.Uint16(data[next+8:]))
+		start := next + 10
+		if start+length > len(data) {
+			return nil, errors.New("bad dns record length")
+		}
+		msg.answers = append(msg.answers, dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(data[next:]),
+			ttl:   binary.BigEndian.Uint32(data[next+4:]),
+			data:  data[start : start+length],
+		})
+		off = start + length
+	}
+	return msg, nil
+}
+
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// readDNSName decodes a possibly compressed name at off and returns it with
+// the offset just past it.
+func readDNSName(data []byte, off int) (string, int, error) {
+	labels := make([]string, 0)
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(data) {
+			return "", 0, errors.New("dns name out of range")
+		}
+		length := int(data[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(data) || jumps > 16 {
+				return "", 0, errors.New("bad dns compression pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(data) {
+				return "", 0, errors.New("dns label out of range")
+			}
+			labels = append(labels, string(data[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func encodeTXT(entries []string) []byte {
+	buf := make([]byte, 0)
+	for _, e := range entries {
+		if len(e) > 255 {
+			e = e[:255]
+		}
+		buf = append(buf, byte(len(e)))
+		buf = append(buf, e...)
+	}
+	return buf
+}
+
+func decodeTXT(data []byte) []string {
+	entries := make([]string, 0)
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			break
+		}
+		entries = append(entries, string(data[1:1+length]))
+		data = data[1+length:]
+	}
+	return entries
+}
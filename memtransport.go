@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// memTransport is a Transport on a simulated network, see dhtsim. Every
+// message crosses it encoded, so nodes never share memory through it.
+type memTransport struct {
+	endpoint *dhtsim.Endpoint
+	mu       sync.Mutex
+	tamper   func(addr string) (duplicate bool, hold time.Duration) // see faults.go
+}
+
+func newMemTransport(network *dhtsim.Network) *memTransport {
+	return &memTransport{endpoint: network.Listen()}
+}
+
+func (t *memTransport) Addr() string {
+	return t.endpoint.Addr()
+}
+
+func (t *memTransport) Addrs() []string {
+	return []string{t.endpoint.Addr()}
+}
+
+func (t *memTransport) Serve(handler func(from string, req *message) *message) {
+	t.endpoint.Serve(func(from string, data []byte) []byte {
+		req, err := decodeMessage(data)
+		if err != nil {
+			return nil
+		}
+		resp := handler(from, req)
+		if resp == nil {
+			return nil
+		}
+		resp.RPCID = req.RPCID
+		resp.Reply = true
+		answer, err := json.Marshal(resp)
+		if err != nil {
+			return nil
+		}
+		return answer
+	})
+}
+
+// Call delivers req immediately. Since delivery is instantaneous a call
+// always completes once made, even if ctx is cancelled meanwhile, which
+// keeps simulations deterministic when a caller gives up on calls early.
+func (t *memTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	tamper := t.tamper
+	t.mu.Unlock()
+	if tamper != nil {
+		if duplicate, _ := tamper(addr); duplicate {
+			t.endpoint.Call(addr, data)
+		}
+	}
+	answer, err := t.endpoint.Call(addr, data)
+	switch {
+	case errors.Is(err, dhtsim.ErrClosed):
+		return nil, ErrClosed
+	case err != nil:
+		return nil, ErrUnreachable
+	}
+	resp, err := decodeMessage(answer)
+	if err != nil {
+		return nil, err
+	}
+	return resp, replyError(resp)
+}
+
+// faultPackets makes f decide which requests are delivered twice. The
+// network delivers at once, so nothing is held back.
+func (t *memTransport) faultPackets(f func(addr string) (duplicate bool, hold time.Duration)) {
+	t.mu.Lock()
+	t.tamper = f
+	t.mu.Unlock()
+}
+
+func (t *memTransport) Close() error {
+	return t.endpoint.Close()
+}
+
+// reopen brings a closed endpoint back on the same address, which is how
+// the simulator models a node recovering from a crash.
+func (t *memTransport) reopen() {
+	t.endpoint.Reopen()
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// metricsHandler serves Stats in the Prometheus text format, lookup totals
+// labelled by type, so dashboards can plot hops and fan-out per lookup
+// across parameter changes.
+func (n *Node) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s := n.Stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("dht_records", "gauge", "Records in the store.", s.Records)
+	metric("dht_store_bytes", "gauge", "Key and value bytes in the store.", s.Bytes)
+	metric("dht_contacts", "gauge", "Contacts in the routing table.", s.Contacts)
+	metric("dht_network_size", "gauge", "Estimated number of nodes in the network.", s.Network)
+	metric("dht_sent_bytes_total", "counter", "Datagram bytes sent.", s.Sent)
+	metric("dht_received_bytes_total", "counter", "Datagram bytes received.", s.Received)
+
+	fmt.Fprintf(w, "# HELP dht_dropped_requests_total Requests not answered, by reason.\n# TYPE dht_dropped_requests_total counter\n")
+	for _, reason := range dropReasons(s.Dropped) {
+		fmt.Fprintf(w, "dht_dropped_requests_total{reason=%q} %d\n", reason, s.Dropped[reason])
+	}
+
+	buckets := bucketIndexes(s.BucketStats)
+	perBucket := func(name, kind, help string, value func(bucketStats) any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, i := range buckets {
+			fmt.Fprintf(w, "%s{bucket=\"%d\"} %v\n", name, i, value(s.BucketStats[i]))
+		}
+	}
+	perBucket("dht_bucket_contacts", "gauge", "Contacts in the bucket, by XOR distance bit length.", func(b bucketStats) any { return b.Contacts })
+	perBucket("dht_bucket_replacements", "gauge", "Contacts waiting in the bucket's replacement cache.", func(b bucketStats) any { return b.Replacements })
+	perBucket("dht_bucket_evictions_total", "counter", "Contacts dropped from the bucket.", func(b bucketStats) any { return b.Evictions })
+	perBucket("dht_bucket_evictions_per_hour", "gauge", "Contacts dropped from the bucket over the last hour.", func(b bucketStats) any { return b.EvictionsPerHour })
+	perBucket("dht_bucket_contact_age_seconds", "gauge", "Mean time since the bucket's contacts were added.", func(b bucketStats) any { return b.Age })
+
+	types := lookupTypes(s.Lookups)
+	counter := func(name, help string, value func(lookupTotals) any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, typ := range types {
+			fmt.Fprintf(w, "%s{type=%q} %v\n", name, typ, value(s.Lookups[typ]))
+		}
+	}
+	counter("dht_lookups_total", "Iterative lookups run.", func(t lookupTotals) any { return t.Count })
+	counter("dht_lookups_found_total", "Lookups that found a value.", func(t lookupTotals) any { return t.Found })
+	counter("dht_lookup_hops_total", "Rounds of queries over all lookups.", func(t lookupTotals) any { return t.Hops })
+	counter("dht_lookup_peers_contacted_total", "Requests sent by lookups.", func(t lookupTotals) any { return t.Contacted })
+	counter("dht_lookup_bytes_total", "Encoded bytes of lookup requests and replies.", func(t lookupTotals) any { return t.Bytes })
+	counter("dht_lookup_seconds_total", "Time spent in lookups.", func(t lookupTotals) any { return t.Took.Seconds() })
+	fmt.Fprintf(w, "# HELP dht_lookup_max_hops Most rounds any one lookup took.\n# TYPE dht_lookup_max_hops gauge\n")
+	for _, typ := range types {
+		fmt.Fprintf(w, "dht_lookup_max_hops{type=%q} %d\n", typ, s.Lookups[typ].MaxHops)
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import "context"
+
+// Interceptors wrap every RPC a node answers or sends, to add logging,
+// authentication, rate limiting or metrics without touching the handlers.
+// An inbound interceptor sees each request before handle does and may
+// answer it itself, change it, or return nil to drop it. An outbound one
+// sees each request before it is sent, retries and all, and may fail it
+// without sending. Both see the reply on the way back. The first
+// interceptor registered is the outermost.
+
+// inboundRPC answers a request that arrived from from; nil means no reply.
+type inboundRPC func(from string, req *message) *message
+
+// outboundRPC sends req to addr and returns the reply.
+type outboundRPC func(ctx context.Context, addr string, req *message) (*message, error)
+
+type (
+	inboundInterceptor  func(next inboundRPC) inboundRPC
+	outboundInterceptor func(next outboundRPC) outboundRPC
+)
+
+// Intercept adds interceptors around the RPCs the node answers and sends.
+// Either may be nil.
+func (n *Node) Intercept(in inboundInterceptor, out outboundInterceptor) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if in != nil {
+		n.inbound = append(n.inbound, in)
+	}
+	if out != nil {
+		n.outbound = append(n.outbound, out)
+	}
+}
+
+// serve is the handler the node gives its transport. A closing node
+// answers nothing.
+func (n *Node) serve(from string, req *message) *message {
+	n.mu.Lock()
+	chain, closed := n.inbound, n.closed
+	n.mu.Unlock()
+	if closed {
+		return nil
+	}
+	h := inboundRPC(n.handle)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	resp := h(from, req)
+	n.bandwidth.add(n.clock.Now(), req.From.ID, req.Type, wireSize(resp), wireSize(req))
+	return resp
+}
+
+// send makes one RPC through the outbound interceptors and then
+// sendRetrying.
+func (n *Node) send(ctx context.Context, addr string, req *message) (*message, error) {
+	n.mu.Lock()
+	chain := n.outbound
+	n.mu.Unlock()
+	call := outboundRPC(n.sendRetrying)
+	for i := len(chain) - 1; i >= 0; i-- {
+		call = chain[i](call)
+	}
+	resp, err := call(ctx, addr, req)
+	peer := ""
+	if resp != nil {
+		peer = resp.From.ID
+	}
+	n.bandwidth.add(n.clock.Now(), peer, req.Type, wireSize(req), wireSize(resp))
+	return resp, err
+}
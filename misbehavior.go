@@ -0,0 +1,205 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// With detect_misbehavior, peers earn a score for what honest nodes
+// rarely do, and lose some of it for what they do:
+//
+//   - a contact a peer handed us in a lookup that does not answer, or
+//     answers with another ID, scores bogusContact against the peer, one
+//     that answers earns goodReferral back;
+//   - a peer that acknowledged storing a record of ours and, asked for it
+//     some auditDelay later, says it has none scores missingStore. One in
+//     auditOneIn acknowledged stores is audited;
+//   - a peer that returns a value for a key whose k closest nodes, by our
+//     estimate of the network size, should all be nearer the key than it
+//     by more than plausibleSlack bits scores implausibleHit. Only with xor
+//     placement and no clusters, which store copies anywhere;
+//   - a peer that serves a value failing the integrity check of Get, see
+//     integrity.go, scores corruptValue.
+//
+// At downgradeScore a peer is dropped from the routing table and kept out
+// for downgradeFor; at banScore it is banned. Every decision is logged and
+// kept among the recent events served at /misbehavior.
+const (
+	bogusContact   = 1.0
+	goodReferral   = -0.5
+	missingStore   = 4.0
+	implausibleHit = 4.0
+	downgradeScore = 10.0
+	banScore       = 20.0
+	downgradeFor   = 10 * time.Minute
+	plausibleSlack = 8
+	auditDelay     = time.Minute
+	auditOneIn     = 8
+	maxAudits      = 64
+	recentEvents   = 32
+)
+
+const (
+	actionDowngrade = "downgrade"
+	actionBan       = "ban"
+)
+
+// misbehaviorEvent records a decision taken against a peer.
+type misbehaviorEvent struct {
+	Peer   string    `json:"peer"`
+	Addr   string    `json:"addr"`
+	Action string    `json:"action"`
+	Reason string    `json:"reason"` // the offence that tipped it
+	Score  float64   `json:"score"`
+	At     time.Time `json:"at"`
+}
+
+// storeAudit is a store of ours a peer acknowledged, to be checked.
+type storeAudit struct {
+	peer *Peer
+	key  string
+	due  time.Time
+}
+
+// judge adds delta to the peer's score and acts on it.
+func (n *Node) judge(p *Peer, delta float64, reason string) {
+	if !n.cfg.DetectMisbehavior {
+		return
+	}
+	n.mu.Lock()
+	if n.scores == nil {
+		n.scores = make(map[string]float64)
+	}
+	score := max(n.scores[p.id]+delta, 0)
+	n.scores[p.id] = score
+	action := ""
+	switch {
+	case delta <= 0:
+	case score >= banScore:
+		action = actionBan
+		n.dht.ban(p.id)
+		delete(n.scores, p.id)
+		delete(n.downgraded, p.id)
+	case score >= downgradeScore && n.downgraded[p.id].IsZero():
+		action = actionDowngrade
+		if n.downgraded == nil {
+			n.downgraded = make(map[string]time.Time)
+		}
+		n.downgraded[p.id] = n.clock.Now().Add(downgradeFor)
+		n.dht.removePeer(p.id)
+	}
+	if action == "" {
+		n.mu.Unlock()
+		return
+	}
+	event := misbehaviorEvent{Peer: p.id, Addr: p.addr, Action: action, Reason: reason, Score: score, At: n.clock.Now()}
+	if len(n.events) >= recentEvents {
+		n.events = append(n.events[:0], n.events[1:]...)
+	}
+	n.events = append(n.events, event)
+	n.mu.Unlock()
+	n.log.Warn("peer misbehaving", "peer", p.id, "addr", p.addr, "action", action, "reason", reason, "score", score)
+}
+
+// isDowngraded reports whether id is kept out of the routing table. n.mu
+// must be held.
+func (n *Node) isDowngraded(id string) bool {
+	until, ok := n.downgraded[id]
+	if ok && !n.clock.Now().Before(until) {
+		delete(n.downgraded, id)
+		return false
+	}
+	return ok
+}
+
+// judgeReferral scores the peer that referred a contact by how the
+// contact's call went. Calls cancelled count for nothing.
+func (n *Node) judgeReferral(referrer *Peer, r reply) {
+	var remote *remoteError
+	switch {
+	case errors.Is(r.err, context.Canceled):
+	case r.err == nil && r.resp.From.ID == r.peer.id, errors.As(r.err, &remote):
+		n.judge(referrer, goodReferral, "")
+	default:
+		n.judge(referrer, bogusContact, "bogus contacts")
+	}
+}
+
+// plausibleHolder reports whether p could be expected to hold a value for
+// target, a key's hash.
+func (n *Node) plausibleHolder(p *Peer, target string) bool {
+	if n.cfg.Placement != placementXOR || len(n.cfg.Clusters) > 0 {
+		return true
+	}
+	n.mu.Lock()
+	size := n.networkSize()
+	n.mu.Unlock()
+	// The k closest nodes of size share about log2(size/k) leading bits
+	// with the key.
+	shared := math.Log2(float64(size) / float64(n.cfg.K))
+	return float64(distanceBits(p.id, target)) <= IDBits-shared+plausibleSlack
+}
+
+// scheduleAudit remembers some stores of ours peers acknowledged.
+func (n *Node) scheduleAudit(r reply) {
+	if !n.cfg.DetectMisbehavior || r.err != nil || r.req.Type != msgStore || n.randomIndex(auditOneIn) != 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if rec, ok := n.store.peek(r.req.Key); !ok || rec.publisher != n.self.id || len(n.audits) >= maxAudits {
+		return
+	}
+	n.audits = append(n.audits, storeAudit{peer: r.peer, key: r.req.Key, due: n.clock.Now().Add(auditDelay)})
+}
+
+// auditStores asks peers for the records of ours they acknowledged.
+func (n *Node) auditStores(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	due := make([]storeAudit, 0)
+	kept := n.audits[:0]
+	for _, a := range n.audits {
+		if now.Before(a.due) {
+			kept = append(kept, a)
+		} else {
+			due = append(due, a)
+		}
+	}
+	n.audits = kept
+	n.mu.Unlock()
+	for _, a := range due {
+		n.mu.Lock()
+		held := n.store.has(a.key)
+		n.mu.Unlock()
+		if !held || ctx.Err() != nil {
+			continue
+		}
+		req := n.request(msgFindValue)
+		req.Key, req.Target = a.key, n.dht.hashValue(a.key)
+		resp, err := n.call(ctx, a.peer, req)
+		if err == nil && !resp.Found {
+			n.judge(a.peer, missingStore, "lost acknowledged store")
+		}
+	}
+}
+
+// Misbehavior returns the recent decisions against peers, most recent
+// first.
+func (n *Node) Misbehavior() []misbehaviorEvent {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	events := make([]misbehaviorEvent, len(n.events))
+	for i, e := range n.events {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+func (n *Node) misbehaviorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.Misbehavior())
+}
@@ -0,0 +1,126 @@
+// Package mobile is a facade over a dht node for apps that embed one
+// through gomobile bind, see the android and ios targets in the Makefile:
+// its methods only take and return strings, byte slices, errors and the
+// callback interfaces below, which gomobile maps to Java and Objective-C.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	dht "github.com/Redamancylll/2020131047"
+)
+
+var errPeerNotFound = errors.New("peer not found")
+
+// MobileNode is a running node. Lists are returned as newline-separated
+// text. Calls block until the operation is done or its timeout runs out,
+// so apps make them off the UI thread, or use FindPeerAsync.
+type MobileNode struct {
+	node   *dht.Node
+	cancel context.CancelFunc
+}
+
+// PeerListener hears of every peer a MobileNode adds to its routing table.
+type PeerListener interface {
+	OnPeer(id, addr string)
+}
+
+// PeerCallback receives the outcome of FindPeerAsync.
+type PeerCallback interface {
+	OnFound(id, addr string)
+	OnError(message string)
+}
+
+// NewMobileNode starts a node configured by config, the text of a TOML
+// file like the daemon's, or "" for the defaults. Apps should set storage
+// to a directory of their own to keep the node's identity and contacts.
+// listener may be nil. The node does routine maintenance until Close, but
+// only joins the network on Bootstrap.
+func NewMobileNode(config string, listener PeerListener) (*MobileNode, error) {
+	cfg, err := dht.ParseConfig([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	node, err := dht.StartNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if listener != nil {
+		node.OnPeer(func(p *dht.Peer) { listener.OnPeer(p.ID(), p.Addr()) })
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.MDNS {
+		if err := node.StartMDNS(ctx); err != nil {
+			node.Logger().Warn("mdns discovery disabled", "err", err)
+		}
+	}
+	go node.Run(ctx)
+	return &MobileNode{node: node, cancel: cancel}, nil
+}
+
+// Bootstrap joins the network through addrs, comma-separated, or through
+// the configured bootstrap nodes and saved contacts if addrs is empty.
+func (m *MobileNode) Bootstrap(addrs string) error {
+	if addrs == "" {
+		return m.node.Join(context.Background())
+	}
+	return m.node.Bootstrap(context.Background(), strings.Split(addrs, ","))
+}
+
+func (m *MobileNode) ID() string {
+	return m.node.ID()
+}
+
+// Addrs returns the node's multiaddrs, one per line.
+func (m *MobileNode) Addrs() string {
+	return strings.Join(m.node.Addrs(), "\n")
+}
+
+func (m *MobileNode) Put(key string, value []byte) error {
+	return m.node.Put(context.Background(), key, value)
+}
+
+func (m *MobileNode) Get(key string) ([]byte, error) {
+	return m.node.Get(context.Background(), key)
+}
+
+// FindPeer returns the address of the node with the given ID.
+func (m *MobileNode) FindPeer(id string) (string, error) {
+	p := m.node.FindPeer(context.Background(), id)
+	if p == nil {
+		return "", errPeerNotFound
+	}
+	return p.Addr(), nil
+}
+
+// FindPeerAsync is FindPeer reporting to cb from another goroutine.
+func (m *MobileNode) FindPeerAsync(id string, cb PeerCallback) {
+	go func() {
+		addr, err := m.FindPeer(id)
+		if err != nil {
+			cb.OnError(err.Error())
+			return
+		}
+		cb.OnFound(id, addr)
+	}()
+}
+
+// Peers returns the routing table, one "id addr" line per contact.
+func (m *MobileNode) Peers() string {
+	var b strings.Builder
+	for _, p := range m.node.Peers() {
+		b.WriteString(p.ID() + " " + p.Addr() + "\n")
+	}
+	return b.String()
+}
+
+// Close shuts the node down, see dht.Node.Shutdown.
+func (m *MobileNode) Close() error {
+	m.cancel()
+	return m.node.Shutdown()
+}
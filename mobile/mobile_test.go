@@ -0,0 +1,56 @@
+package mobile
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type peerLog struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (l *peerLog) OnPeer(id, addr string) {
+	l.mu.Lock()
+	l.ids = append(l.ids, id)
+	l.mu.Unlock()
+}
+
+func TestMobileNode(t *testing.T) {
+	const config = `listen = ["127.0.0.1:0"]`
+	a, err := NewMobileNode(config, nil)
+	if err != nil {
+		t.Skip("udp unavailable:", err)
+	}
+	defer a.Close()
+	heard := &peerLog{}
+	b, err := NewMobileNode(config, heard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.Bootstrap(a.node.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.Peers(), a.ID()+" ") {
+		t.Errorf("peers %q lack %s", b.Peers(), a.ID())
+	}
+	heard.mu.Lock()
+	if len(heard.ids) == 0 || heard.ids[0] != a.ID() {
+		t.Errorf("listener heard of %v", heard.ids)
+	}
+	heard.mu.Unlock()
+
+	if err := b.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := a.Get("key"); err != nil || !bytes.Equal(value, []byte("value")) {
+		t.Errorf("get %q, err %v", value, err)
+	}
+	if found, err := b.FindPeer(a.ID()); err != nil || found == "" {
+		t.Errorf("find peer %q, err %v", found, err)
+	}
+}
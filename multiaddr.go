@@ -0,0 +1,214 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Contacts list every endpoint a peer listens on as multiaddrs, the
+// self-describing address format of libp2p, so a node listening on both
+// IPv4 and IPv6 can be reached over either and the caller picks the one
+// it can actually send to. Only the parts this DHT speaks are supported:
+// /ip4/<addr>/udp/<port>, /ip6/<addr>/udp/<port>, /dns/<host>/udp/<port>
+// (also dns4 and dns6), the same with /tcp/<port>/ws or /tcp/<port>/wss
+// for WebSocket listeners, and /mem/<n> for the in-memory transport. Any
+// of them followed by /p2p-circuit is a relay the peer is reachable
+// through.
+const (
+	maxContactAddrs   = 8
+	maxMultiaddrBytes = 128
+)
+
+var ErrBadMultiaddr = errors.New("invalid multiaddr")
+
+type multiaddr struct {
+	proto string // ip4, ip6, dns, dns4, dns6 or mem
+	host  string
+	port  string // empty for mem
+	ws    string // ws or wss over TCP, empty for UDP
+
+	circuit bool // through the relay listening there, see relay.go
+}
+
+func parseMultiaddr(s string) (multiaddr, error) {
+	if len(s) > maxMultiaddrBytes {
+		return multiaddr{}, ErrBadMultiaddr
+	}
+	if rest, ok := strings.CutSuffix(s, relayCircuit); ok {
+		m, err := parseMultiaddr(rest)
+		if err == nil && m.circuit {
+			return multiaddr{}, ErrBadMultiaddr
+		}
+		m.circuit = true
+		return m, err
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) == 3 && parts[0] == "" && parts[1] == "mem" && parts[2] != "" {
+		return multiaddr{proto: "mem", host: parts[2]}, nil
+	}
+	var m multiaddr
+	switch {
+	case len(parts) == 5 && parts[0] == "" && parts[3] == "udp":
+		m = multiaddr{proto: parts[1], host: parts[2], port: parts[4]}
+	case len(parts) == 6 && parts[0] == "" && parts[3] == "tcp" && (parts[5] == "ws" || parts[5] == "wss"):
+		m = multiaddr{proto: parts[1], host: parts[2], port: parts[4], ws: parts[5]}
+	default:
+		return multiaddr{}, ErrBadMultiaddr
+	}
+	if port, err := strconv.ParseUint(m.port, 10, 16); err != nil || port == 0 {
+		return multiaddr{}, ErrBadMultiaddr
+	}
+	ip := net.ParseIP(m.host)
+	switch m.proto {
+	case "ip4":
+		if ip == nil || ip.To4() == nil {
+			return multiaddr{}, ErrBadMultiaddr
+		}
+	case "ip6":
+		if ip == nil || ip.To4() != nil {
+			return multiaddr{}, ErrBadMultiaddr
+		}
+	case "dns", "dns4", "dns6":
+		if m.host == "" || ip != nil {
+			return multiaddr{}, ErrBadMultiaddr
+		}
+	default:
+		return multiaddr{}, ErrBadMultiaddr
+	}
+	return m, nil
+}
+
+// toMultiaddr converts a transport address, a host:port, ws://host:port,
+// wss://host:port or mem:n, to a multiaddr.
+func toMultiaddr(addr string) (multiaddr, error) {
+	if n, ok := strings.CutPrefix(addr, "mem:"); ok {
+		return parseMultiaddr("/mem/" + n)
+	}
+	ws := ""
+	for _, scheme := range []string{"ws", "wss"} {
+		if rest, ok := strings.CutPrefix(addr, scheme+"://"); ok {
+			addr, ws = strings.TrimSuffix(rest, "/"), scheme
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return multiaddr{}, err
+	}
+	proto := "dns"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		proto, host = "ip4", ip.To4().String()
+	} else if ip != nil {
+		proto = "ip6"
+	}
+	m, err := parseMultiaddr("/" + proto + "/" + host + "/udp/" + port)
+	if err == nil {
+		m.ws = ws
+	}
+	return m, err
+}
+
+func (m multiaddr) String() string {
+	s := "/" + m.proto + "/" + m.host + "/udp/" + m.port
+	switch {
+	case m.proto == "mem":
+		s = "/mem/" + m.host
+	case m.ws != "":
+		s = "/" + m.proto + "/" + m.host + "/tcp/" + m.port + "/" + m.ws
+	}
+	if m.circuit {
+		s += relayCircuit
+	}
+	return s
+}
+
+// dialAddr is the address the transport calls m at, the relay's for a
+// circuit.
+func (m multiaddr) dialAddr() string {
+	switch {
+	case m.proto == "mem":
+		return "mem:" + m.host
+	case m.ws != "":
+		return m.ws + "://" + net.JoinHostPort(m.host, m.port)
+	}
+	return net.JoinHostPort(m.host, m.port)
+}
+
+// reaches reports whether a socket listening on m can send to other. An
+// IPv6 socket bound to the unspecified address is dual-stack and reaches
+// IPv4 as well; names are assumed to resolve to something reachable. A
+// WebSocket listener dials any WebSocket address over TCP, and only those.
+func (m multiaddr) reaches(other multiaddr) bool {
+	switch {
+	case m.proto == "mem" || other.proto == "mem":
+		return m.proto == other.proto
+	case m.ws != "" || other.ws != "":
+		return m.ws != "" && other.ws != ""
+	case other.proto == "dns" || m.proto == other.proto:
+		return true
+	case other.proto == "dns4":
+		return m.proto == "ip4" || isUnspecified(m)
+	case other.proto == "dns6":
+		return m.proto == "ip6"
+	}
+	return other.proto == "ip4" && isUnspecified(m)
+}
+
+func isUnspecified(m multiaddr) bool {
+	ip := net.ParseIP(m.host)
+	return m.proto == "ip6" && ip != nil && ip.IsUnspecified()
+}
+
+// listenAddrs returns the node's endpoints as multiaddrs.
+func (n *Node) listenAddrs() []string {
+	addrs := make([]string, 0, 1)
+	for _, addr := range n.transport.Addrs() {
+		if m, err := toMultiaddr(addr); err == nil && len(addrs) < maxContactAddrs {
+			addrs = append(addrs, m.String())
+		}
+	}
+	return addrs
+}
+
+// pickAddr chooses the address to call a contact at. The plain address
+// it came with is the one the peer was last seen at, so it wins if we can
+// send to it; otherwise the first of its multiaddrs, in the order the peer
+// listed them, that one of our endpoints reaches. Unspecified addresses
+// such as 0.0.0.0 are never picked. A peer that lists relays cannot be
+// called directly, so one of those comes first.
+func (n *Node) pickAddr(c contact) string {
+	if addr := n.circuitAddr(c); addr != "" {
+		return addr
+	}
+	if m, err := toMultiaddr(c.Addr); err != nil || n.canReach(m) {
+		return c.Addr
+	}
+	for _, s := range c.Addrs {
+		if m, err := parseMultiaddr(s); err == nil && !m.circuit && n.canReach(m) {
+			return m.dialAddr()
+		}
+	}
+	return c.Addr
+}
+
+func (n *Node) canReach(theirs multiaddr) bool {
+	if ip := net.ParseIP(theirs.host); ip != nil && ip.IsUnspecified() {
+		return false
+	}
+	if d, ok := n.transport.(dialer); ok {
+		return d.dials(theirs)
+	}
+	for _, own := range n.self.addrs {
+		if ours, err := parseMultiaddr(own); err == nil && ours.reaches(theirs) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialer is implemented by transports that call out without listening,
+// such as the browser's, and so have no endpoints of their own to go by.
+type dialer interface {
+	dials(m multiaddr) bool
+}
@@ -0,0 +1,270 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name records map a human-chosen, DNS-style name to addresses and text
+// the way A, AAAA and TXT records do. They live in the names namespace
+// under the hash of the name and are signed by the node that published
+// them, which owns the name until its record expires: replicas reject
+// records for a live name from anyone else, and from the owner unless
+// their sequence number is higher than the stored one. The owner re-signs
+// its names whenever it republishes.
+const (
+	namesNamespace = "names"
+	maxNameRecords = 32
+	maxNameLength  = 253
+)
+
+var (
+	ErrBadName      = errors.New("invalid name")
+	ErrNameTaken    = errors.New("name owned by another peer")
+	ErrStaleName    = errors.New("stale name record")
+	ErrBadSignature = errors.New("bad record signature")
+)
+
+// NameRecord is one entry of a name: Type is A, AAAA or TXT.
+type NameRecord struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// signedName is what is stored under a name. Sig covers the JSON encoding
+// of everything else, with Sig left empty.
+type signedName struct {
+	Name    string       `json:"name"`
+	Owner   []byte       `json:"owner"`
+	Seq     uint64       `json:"seq"`
+	Expires int64        `json:"expires"` // unix seconds
+	Records []NameRecord `json:"records"`
+	Sig     []byte       `json:"sig,omitempty"`
+}
+
+type publishedName struct {
+	records []NameRecord
+	ttl     time.Duration
+	seq     uint64
+}
+
+// normalizeName lower-cases name, drops a trailing dot and checks it is
+// made of valid DNS labels.
+func normalizeName(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > maxNameLength {
+		return "", ErrBadName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", ErrBadName
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", ErrBadName
+			}
+		}
+	}
+	return name, nil
+}
+
+func (n *Node) nameKey(name string) string {
+	return "/" + namesNamespace + "/" + n.dht.hashValue(name)
+}
+
+func checkNameRecords(records []NameRecord) error {
+	if len(records) == 0 || len(records) > maxNameRecords {
+		return fmt.Errorf("a name needs between 1 and %d records", maxNameRecords)
+	}
+	for _, r := range records {
+		ip := net.ParseIP(r.Value)
+		switch {
+		case r.Type == "A" && (ip == nil || ip.To4() == nil):
+			return fmt.Errorf("A record %q is not an IPv4 address", r.Value)
+		case r.Type == "AAAA" && (ip == nil || ip.To4() != nil):
+			return fmt.Errorf("AAAA record %q is not an IPv6 address", r.Value)
+		case r.Type == "TXT" && len(r.Value) > 255:
+			return errors.New("TXT record longer than 255 bytes")
+		case r.Type != "A" && r.Type != "AAAA" && r.Type != "TXT":
+			return fmt.Errorf("unknown record type %q", r.Type)
+		}
+	}
+	return nil
+}
+
+// verifyName decodes a name record stored under key and checks that it
+// is for that key, well formed, signed by its owner and not expired.
+func (n *Node) verifyName(key string, value []byte, now time.Time) (*signedName, error) {
+	var s signedName
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+	if name, err := normalizeName(s.Name); err != nil || name != s.Name || n.nameKey(name) != key {
+		return nil, ErrBadName
+	}
+	if err := checkNameRecords(s.Records); err != nil {
+		return nil, err
+	}
+	if now.Unix() >= s.Expires {
+		return nil, ErrStaleName
+	}
+	sig := s.Sig
+	s.Sig = nil
+	if len(s.Owner) != ed25519.PublicKeySize || !ed25519.Verify(s.Owner, mustJSON(s), sig) {
+		return nil, ErrBadSignature
+	}
+	s.Sig = sig
+	return &s, nil
+}
+
+// mergeName decides whether a replica accepts an incoming name record.
+// A name we publish ourselves is never handed to anyone else, since lookups
+// leave the publisher out of its own replicas. n.mu must be held.
+func (n *Node) mergeName(key string, stored, incoming []byte, now time.Time) ([]byte, error) {
+	s, err := n.verifyName(key, incoming, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, ours := n.names[s.Name]; ours && !n.key.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(s.Owner)) {
+		return nil, ErrNameTaken
+	}
+	if stored == nil {
+		return incoming, nil
+	}
+	current, err := n.verifyName(key, stored, now)
+	if err != nil {
+		return incoming, nil
+	}
+	if !ed25519.PublicKey(current.Owner).Equal(ed25519.PublicKey(s.Owner)) {
+		return nil, ErrNameTaken
+	}
+	if s.Seq <= current.Seq {
+		return nil, ErrStaleName
+	}
+	return incoming, nil
+}
+
+// PublishName signs records for name, valid for ttl, and stores them on
+// the name's replicas. The node keeps the name alive by republishing it,
+// so ttl should be longer than the republish interval.
+func (n *Node) PublishName(ctx context.Context, name string, records []NameRecord, ttl time.Duration) error {
+	name, err := normalizeName(name)
+	if err != nil {
+		return err
+	}
+	if err := checkNameRecords(records); err != nil {
+		return err
+	}
+	if ttl < time.Minute {
+		return errors.New("name ttl must be at least 1m")
+	}
+	n.mu.Lock()
+	if n.names == nil {
+		n.names = make(map[string]*publishedName)
+	}
+	p := n.names[name]
+	if p == nil {
+		p = &publishedName{}
+		n.names[name] = p
+	}
+	p.records, p.ttl = append([]NameRecord(nil), records...), ttl
+	n.mu.Unlock()
+	return n.signAndStoreName(ctx, name)
+}
+
+// signAndStoreName signs our current records for name with a fresh
+// sequence number and expiry and sends them to the replicas.
+func (n *Node) signAndStoreName(ctx context.Context, name string) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	now := n.clock.Now()
+	n.mu.Lock()
+	p := n.names[name]
+	// Deriving the sequence number from the clock keeps it growing across
+	// restarts without storing it.
+	p.seq = max(p.seq+1, uint64(now.UnixNano()))
+	s := signedName{
+		Name:    name,
+		Owner:   n.key.Public().(ed25519.PublicKey),
+		Seq:     p.seq,
+		Expires: now.Add(p.ttl).Unix(),
+		Records: p.records,
+	}
+	n.mu.Unlock()
+	s.Sig = ed25519.Sign(n.key, mustJSON(s))
+
+	key := n.nameKey(name)
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return ErrNoPeers
+	}
+	accepted, taken := 0, false
+	for _, r := range n.storeAt(ctx, replicas, result.tokens, key, mustJSON(s)) {
+		if r.err == nil {
+			accepted++
+		} else if r.err.Error() == ErrNameTaken.Error() {
+			taken = true
+		}
+	}
+	switch {
+	case accepted*2 > len(replicas):
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case taken:
+		return ErrNameTaken
+	}
+	return ErrNoPeers
+}
+
+// republishNames re-signs every name we published.
+func (n *Node) republishNames(ctx context.Context) {
+	n.mu.Lock()
+	names := make([]string, 0, len(n.names))
+	for name := range n.names {
+		names = append(names, name)
+	}
+	n.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := n.signAndStoreName(ctx, name); err != nil {
+			n.log.Warn("republishing name failed", "name", name, "err", err)
+		}
+	}
+}
+
+// ResolveName returns the records published for name. Copies that fail
+// verification are ignored and of the rest the newest wins.
+func (n *Node) ResolveName(ctx context.Context, name string) ([]NameRecord, error) {
+	name, err := normalizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := n.nameKey(name)
+	_, _, copies, answered := n.replicaCopies(ctx, key)
+	var best *signedName
+	for _, value := range copies {
+		if s, err := n.verifyName(key, value, n.clock.Now()); err == nil && (best == nil || s.Seq > best.Seq) {
+			best = s
+		}
+	}
+	switch {
+	case best != nil:
+		return best.Records, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case answered == 0:
+		return nil, ErrNoPeers
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Example.COM.": "example.com",
+		"a-b.c1":       "a-b.c1",
+		"":             "",
+		"-a.com":       "",
+		"a..com":       "",
+		"a_b.com":      "",
+	} {
+		got, err := normalizeName(name)
+		if want == "" && !errors.Is(err, ErrBadName) || want != "" && got != want {
+			t.Errorf("normalizeName(%q): %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 13)
+	sim.AddNodes(ctx, 20)
+	nodes := simNodes(sim)
+	records := []NameRecord{{Type: "A", Value: "192.0.2.1"}, {Type: "TXT", Value: "hello"}}
+	if err := nodes[0].PublishName(ctx, "Www.Example.com", records, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nodes[19].ResolveName(ctx, "www.example.com."); err != nil || !reflect.DeepEqual(got, records) {
+		t.Errorf("resolved %v, err %v, want %v", got, err, records)
+	}
+	if _, err := nodes[19].ResolveName(ctx, "nobody.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resolving an unpublished name: %v, want %v", err, ErrNotFound)
+	}
+	if err := nodes[1].PublishName(ctx, "www.example.com", records, time.Hour); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("publishing another node's name: %v, want %v", err, ErrNameTaken)
+	}
+	if err := nodes[1].PublishName(ctx, "www.example.com", []NameRecord{{Type: "A", Value: "::1"}}, time.Hour); err == nil {
+		t.Error("published an IPv6 address as an A record")
+	}
+
+	updated := []NameRecord{{Type: "AAAA", Value: "2001:db8::1"}}
+	if err := nodes[0].PublishName(ctx, "www.example.com", updated, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nodes[19].ResolveName(ctx, "www.example.com"); err != nil || !reflect.DeepEqual(got, updated) {
+		t.Errorf("resolved %v after an update, err %v, want %v", got, err, updated)
+	}
+}
+
+func TestMergeNameChecksSignature(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	replica := newNode(fuzzConfig(), newMemTransport(dhtsim.NewNetwork()), dhtsim.NewClock(now), rand.Reader, nil)
+	key := replica.nameKey("example.com")
+	sign := func(signer ed25519.PrivateKey, seq uint64, value string) []byte {
+		s := signedName{
+			Name:    "example.com",
+			Owner:   signer.Public().(ed25519.PublicKey),
+			Seq:     seq,
+			Expires: now.Add(time.Hour).Unix(),
+			Records: []NameRecord{{Type: "TXT", Value: value}},
+		}
+		s.Sig = ed25519.Sign(signer, mustJSON(s))
+		return mustJSON(s)
+	}
+	_, key1, _ := ed25519.GenerateKey(rand.Reader)
+	_, key2, _ := ed25519.GenerateKey(rand.Reader)
+
+	stored := sign(key1, 2, "first")
+	if _, err := replica.mergeName(key, nil, stored, now); err != nil {
+		t.Fatalf("merging a signed record: %v", err)
+	}
+
+	// A record whose contents changed after signing.
+	var forged signedName
+	json.Unmarshal(sign(key1, 3, "genuine"), &forged)
+	forged.Records[0].Value = "forged"
+	if _, err := replica.mergeName(key, stored, mustJSON(forged), now); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("merging a forged record: %v, want %v", err, ErrBadSignature)
+	}
+	if _, err := replica.mergeName(key, stored, sign(key2, 3, "taken"), now); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("merging another owner's record: %v, want %v", err, ErrNameTaken)
+	}
+	if _, err := replica.mergeName(key, stored, sign(key1, 1, "older"), now); !errors.Is(err, ErrStaleName) {
+		t.Errorf("merging an older record: %v, want %v", err, ErrStaleName)
+	}
+	if _, err := replica.mergeName(key, stored, sign(key1, 3, "newer"), now); err != nil {
+		t.Errorf("merging a newer record: %v", err)
+	}
+	if _, err := replica.mergeName(key, nil, sign(key1, 3, "expired"), now.Add(2*time.Hour)); !errors.Is(err, ErrStaleName) {
+		t.Errorf("merging an expired record: %v, want %v", err, ErrStaleName)
+	}
+}
@@ -0,0 +1,190 @@
+package dht
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A key of the form /name/rest lives in namespace name; any other key is
+// in the default namespace. Each configured namespace can override how
+// long its records live, how large they may be, how many peers store
+// them and what their values must look like, so applications sharing the
+// DHT cannot step on each other's data.
+type Namespace struct {
+	TTL          time.Duration
+	MaxValueSize int
+	Replication  int
+	Validator    string
+}
+
+// Validator decides which records a namespace accepts. Validate is
+// consulted before a value is stored, locally or on behalf of a peer, and
+// on every value a lookup returns. When a namespace's validator does more
+// than check values, Get collects the copies held by all of the key's
+// replicas and returns the one Select picks, so applications can prefer
+// e.g. the newest of several signed versions. Replicas use Select too,
+// refusing a store that would replace a copy it prefers.
+type Validator interface {
+	Validate(key string, value []byte) error
+	// Select returns the index of the best of values, which have all
+	// passed Validate and number at least one.
+	Select(key string, values [][]byte) int
+}
+
+// valueCheck is a Validator that only looks at the value and has no
+// preference between valid ones.
+type valueCheck func(value []byte) error
+
+func (f valueCheck) Validate(_ string, value []byte) error {
+	return f(value)
+}
+
+func (valueCheck) Select(string, [][]byte) int {
+	return 0
+}
+
+var (
+	validatorsMu sync.RWMutex
+	// validators are the validators a namespace may name.
+	validators = map[string]Validator{
+		"any": valueCheck(func([]byte) error { return nil }),
+		"utf8": valueCheck(func(value []byte) error {
+			if !utf8.Valid(value) {
+				return errors.New("value is not valid UTF-8")
+			}
+			return nil
+		}),
+		"json": valueCheck(func(value []byte) error {
+			if !json.Valid(value) {
+				return errors.New("value is not valid JSON")
+			}
+			return nil
+		}),
+		"addr": valueCheck(func(value []byte) error {
+			if _, _, err := net.SplitHostPort(string(value)); err != nil {
+				return fmt.Errorf("value is not a host:port address: %w", err)
+			}
+			return nil
+		}),
+	}
+)
+
+// RegisterValidator makes v available to namespaces under name. It is
+// meant to be called from init, before any config naming it is loaded,
+// and panics if name is taken. Validators are shared by every node in the
+// process.
+func RegisterValidator(name string, v Validator) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	if v == nil {
+		panic("dht: RegisterValidator with nil validator")
+	}
+	if _, dup := validators[name]; dup {
+		panic("dht: validator " + name + " registered twice")
+	}
+	validators[name] = v
+}
+
+func lookupValidator(name string) (Validator, bool) {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+	v, ok := validators[name]
+	return v, ok
+}
+
+// namespaceOf returns the namespace name of key, "" for the default one.
+func namespaceOf(key string) string {
+	if !strings.HasPrefix(key, "/") {
+		return ""
+	}
+	name, _, ok := strings.Cut(key[1:], "/")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// policy returns the namespace policy for key with everything it leaves
+// unset filled in from the node-wide settings.
+func (c Config) policy(key string) Namespace {
+	p := c.Namespaces[namespaceOf(key)]
+	if p.TTL == 0 {
+		p.TTL = c.RecordTTL
+	}
+	if p.MaxValueSize == 0 {
+		p.MaxValueSize = c.Limits.MaxValueSize
+	}
+	if p.Replication == 0 {
+		p.Replication = c.K
+	}
+	if p.Validator == "" {
+		p.Validator = "any"
+	}
+	return p
+}
+
+// validator returns the Validator of key's namespace.
+func (c Config) validator(key string) Validator {
+	v, _ := lookupValidator(c.policy(key).Validator)
+	return v
+}
+
+// checkValue applies key's namespace size limit and validator to value.
+func (c Config) checkValue(key string, value []byte) error {
+	if len(value) > c.policy(key).MaxValueSize {
+		return ErrTooLarge
+	}
+	return c.validator(key).Validate(key, value)
+}
+
+func (c *Config) setNamespace(key string, value interface{}) error {
+	name, field, ok := strings.Cut(strings.TrimPrefix(key, "namespaces."), ".")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if c.Namespaces == nil {
+		c.Namespaces = make(map[string]Namespace)
+	}
+	ns := c.Namespaces[name]
+	var err error
+	switch field {
+	case "ttl":
+		ns.TTL, err = asDuration(value)
+	case "max_value_size":
+		ns.MaxValueSize, err = asInt(value)
+	case "replication":
+		ns.Replication, err = asInt(value)
+	case "validator":
+		ns.Validator, err = asString(value)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	c.Namespaces[name] = ns
+	return nil
+}
+
+func (c Config) validateNamespaces() error {
+	for name, ns := range c.Namespaces {
+		switch {
+		case ns.TTL < 0 || ns.TTL > 0 && ns.TTL <= c.RepublishInterval:
+			return fmt.Errorf("namespaces.%s.ttl: must be longer than republish_interval", name)
+		case ns.MaxValueSize < 0 || ns.MaxValueSize > c.Limits.MaxValueSize:
+			return fmt.Errorf("namespaces.%s.max_value_size: must be at most limits.max_value_size", name)
+		case ns.Replication < 0 || ns.Replication > c.K:
+			return fmt.Errorf("namespaces.%s.replication: must be between 1 and k", name)
+		}
+		if _, ok := lookupValidator(ns.Validator); ns.Validator != "" && !ok {
+			return fmt.Errorf("namespaces.%s.validator: unknown validator %q", name, ns.Validator)
+		}
+	}
+	return nil
+}
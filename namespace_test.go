@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const namespaceConfig = `
+k = 8
+[namespaces.peers]
+ttl = "2h"
+max_value_size = 32
+replication = 3
+validator = "addr"
+
+[namespaces.app]
+validator = "json"
+`
+
+func TestNamespacePolicies(t *testing.T) {
+	cfg, err := ParseConfig([]byte(namespaceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	defaults := Namespace{TTL: cfg.RecordTTL, MaxValueSize: cfg.Limits.MaxValueSize, Replication: 8, Validator: "any"}
+	for key, want := range map[string]Namespace{
+		"/peers/a": {TTL: 2 * time.Hour, MaxValueSize: 32, Replication: 3, Validator: "addr"},
+		"/app/a":   {TTL: cfg.RecordTTL, MaxValueSize: cfg.Limits.MaxValueSize, Replication: 8, Validator: "json"},
+		"/other/a": defaults,
+		"peers/a":  defaults,
+		"/peers":   defaults,
+	} {
+		if got := cfg.policy(key); got != want {
+			t.Errorf("policy of %q: %+v, want %+v", key, got, want)
+		}
+	}
+
+	for _, c := range []struct {
+		key, value string
+		ok         bool
+	}{
+		{"/peers/a", "127.0.0.1:4000", true},
+		{"/peers/a", "not an address", false},
+		{"/peers/a", "127.0.0.1:" + strings.Repeat("0", 30), false},
+		{"/app/a", `{"a": 1}`, true},
+		{"/app/a", `{"a": `, false},
+		{"a", `{"a": `, true},
+	} {
+		if err := cfg.checkValue(c.key, []byte(c.value)); (err == nil) != c.ok {
+			t.Errorf("checkValue(%q, %q): %v", c.key, c.value, err)
+		}
+	}
+	if err := cfg.checkValue("/peers/a", []byte(strings.Repeat("1", 33))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("value over max_value_size: %v, want %v", err, ErrTooLarge)
+	}
+
+	for _, bad := range []string{
+		"[namespaces.a]\nreplication = 9",
+		"[namespaces.a]\nttl = \"1h\"",
+		"[namespaces.a]\nvalidator = \"nosuch\"",
+		"[namespaces.a]\ncolour = \"red\"",
+	} {
+		cfg, err := ParseConfig([]byte("k = 8\n" + bad))
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err == nil {
+			t.Errorf("config %q accepted", bad)
+		}
+	}
+}
+
+func TestNamespaceReplication(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := ParseConfig([]byte(namespaceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := newSimulation(cfg, 9)
+	sim.AddNodes(ctx, 20)
+	for key, c := range map[string]struct {
+		value    string
+		replicas int
+	}{
+		"/peers/a": {"127.0.0.1:4000", 3},
+		"/app/a":   {`{"a": 1}`, 8},
+	} {
+		writer := outside(sim, nearestNodes(sim, key, 8))
+		if err := writer.Put(ctx, key, []byte("{")); err == nil {
+			t.Errorf("%s: Put of a value the validator refuses succeeded", key)
+		}
+		if err := writer.Put(ctx, key, []byte(c.value)); err != nil {
+			t.Fatal(err)
+		}
+		holders := 0
+		for _, n := range simNodes(sim) {
+			n.mu.Lock()
+			if n != writer && n.store.has(key) {
+				holders++
+			}
+			n.mu.Unlock()
+		}
+		if holders != c.replicas {
+			t.Errorf("%s stored on %d replicas, want %d", key, holders, c.replicas)
+		}
+	}
+}
+
+// versioned accepts values "v<n>" and prefers the highest n.
+type versioned struct{}
+
+func (versioned) Validate(_ string, value []byte) error {
+	if _, err := strconv.Atoi(strings.TrimPrefix(string(value), "v")); err != nil || value[0] != 'v' {
+		return errors.New("not a version")
+	}
+	return nil
+}
+
+func (versioned) Select(_ string, values [][]byte) int {
+	best, version := 0, -1
+	for i, value := range values {
+		if n, _ := strconv.Atoi(string(value[1:])); n > version {
+			best, version = i, n
+		}
+	}
+	return best
+}
+
+func init() {
+	RegisterValidator("versioned", versioned{})
+}
+
+func TestNamespaceSelect(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := ParseConfig([]byte("k = 8\n[namespaces.docs]\nvalidator = \"versioned\""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := newSimulation(cfg, 14)
+	sim.AddNodes(ctx, 20)
+	const key = "/docs/readme"
+	replicas := nearestNodes(sim, key, 8)
+	writer := outside(sim, replicas)
+	if err := writer.Put(ctx, key, []byte("draft")); err == nil {
+		t.Error("Put of a value the validator refuses succeeded")
+	}
+	if err := writer.Put(ctx, key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas keep the version they prefer over an older one.
+	writer.Put(ctx, key, []byte("v1"))
+	for _, n := range replicas {
+		n.mu.Lock()
+		r, ok := n.store.get(key)
+		n.mu.Unlock()
+		if !ok || string(r.value) != "v2" {
+			t.Errorf("replica %s holds %q after an older version, want v2", n.ID(), r.value)
+		}
+	}
+
+	// Get picks the preferred copy even when only one replica has it.
+	newer := &record{key: key, value: []byte("v3"), publisher: writer.ID(), stored: sim.Clock().Now()}
+	replicas[len(replicas)-1].mu.Lock()
+	replicas[len(replicas)-1].store.put(newer)
+	replicas[len(replicas)-1].mu.Unlock()
+	if got, err := writer.Get(ctx, key); err != nil || string(got) != "v3" {
+		t.Errorf("Get returned %q, err %v, want v3", got, err)
+	}
+}
@@ -0,0 +1,1425 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("key not found")
+	ErrNoPeers     = errors.New("no reachable peers")
+	ErrTooLarge    = errors.New("value too large")
+	ErrStoreFull   = errors.New("store full")
+	ErrRateLimited = errors.New("rate limited")
+	ErrBandwidth   = errors.New("bandwidth budget exceeded")
+	ErrIPRate      = errors.New("source address rate limited")
+	ErrBadToken    = errors.New("missing or expired write token")
+	ErrQuota       = errors.New("storage quota exceeded")
+	ErrOutdated    = errors.New("a better version is already stored")
+)
+
+// Node is a live DHT participant: a routing table and local store served
+// over a Transport, plus iterative lookups against the rest of the network.
+type Node struct {
+	cfg       Config
+	self      *Peer
+	key       ed25519.PrivateKey
+	dht       *DHT
+	store     *store
+	cache     *valueCache
+	served    keyRates // find_value answers with a value, by key
+	requested keyRates // Gets, by key
+	transport Transport
+	limiter   *rateLimiter
+	ips       *rateLimiter // by source IP
+	subnets   *rateLimiter // by its /24 or /64
+	bandwidth *bandwidthMeter
+	log       *slog.Logger
+	level     *slog.LevelVar
+	clock     clock
+	random    io.Reader
+	mu        sync.Mutex
+
+	bootstrapped  bool
+	closed        bool
+	draining      bool // see drain.go
+	lastRefresh   time.Time
+	lastRepublish time.Time
+	lastSave      time.Time
+	lastPex       time.Time
+	lastKeepalive time.Time
+	lastSync      time.Time
+	lastGossip    time.Time
+	lastRelay     time.Time
+	lastPresence  time.Time
+	presenceSeq   int64
+	heartbeat     uint64
+	lookupSize    float64            // network size averaged over lookups
+	members       map[string]*member // the gossip view
+	keepalive     time.Duration
+	pexPending    map[string]string
+	tokens        tokenSecrets
+	indexed       map[string]bool
+	counters      map[string]counterEntry // our own counter entries
+	services      map[string]*registration
+	names         map[string]*publishedName
+	feeds         map[string]*ownFeed
+	partials      map[string]*partialFetch // erasure-coded downloads, without storage
+	partialDisk   *diskTier                // the same with storage
+	inbox         map[string]mailboxEntry  // last received, with their ack secrets
+	verified      map[string]*nodeRecord   // node records by text form
+	hints         map[string]*hint         // by key and intended replica
+	lookups       []lookupTrace            // the most recent, oldest first
+	lookupTotals  map[string]*lookupTotals // by lookup type
+	window        lookupWindow             // adaptive alpha and hop timeout
+	relayed       map[string]relayed       // nodes we relay for, by ID
+	scores        map[string]float64       // misbehavior, by peer ID
+	downgraded    map[string]time.Time     // kept out of the routing table until
+	audits        []storeAudit             // acknowledged stores to check
+	deaths        []*Peer                  // dropped as dead, see repair.go
+	lost          []lostPeer               // the same to probe again, see lost.go
+	arrivals      []*Peer                  // new contacts, see rebalance.go
+	churn         bucketChurn              // contacts dropped, see buckets.go
+	events        []misbehaviorEvent       // the most recent, oldest first
+	dropped       map[string]int64         // requests not answered, by reason
+	discovered    func(p *Peer)            // told of new contacts, if set
+	rpcHandlers   map[string]rpcHandler    // application message types
+	inbound       []inboundInterceptor
+	outbound      []outboundInterceptor
+	gc            gcStats
+	gcCursor      string          // the last manifest checkManifests looked at
+	wal           *storeLog       // nil without storage or with wal off
+	reload        func() error    // rereads the config file, if the node has one
+	life          context.Context // cancelled by Close once operations had their chance
+	halt          context.CancelFunc
+	ops           sync.WaitGroup // operations in flight
+	running       sync.WaitGroup // Run loops
+}
+
+// NewNode creates a node serving on transport. cfg is expected to have
+// passed Validate.
+// The node gets a fresh identity; StartNode keeps one across restarts.
+func NewNode(cfg Config, transport Transport) *Node {
+	return newNode(cfg, transport, systemClock{}, rand.Reader, nil)
+}
+
+// newNode lets the simulator supply its own clock and a seeded source of
+// randomness. When key is nil a new identity is generated from random.
+func newNode(cfg Config, transport Transport, clock clock, random io.Reader, key ed25519.PrivateKey) *Node {
+	if key == nil {
+		var err error
+		if key, err = generateIdentity(random); err != nil {
+			panic(err)
+		}
+	}
+	level := new(slog.LevelVar)
+	if l, err := cfg.logLevel(); err == nil {
+		level.Set(l)
+	}
+	self := &Peer{id: nodeIDFromKey(key.Public().(ed25519.PublicKey)), addr: transport.Addr()}
+	n := &Node{
+		cfg:           cfg,
+		self:          self,
+		key:           key,
+		dht:           newRoutingTable(self, cfg.K),
+		store:         newStore(self.id),
+		cache:         newValueCache(cfg.Cache.Size, cfg.Cache.TTL, cfg.Cache.NegativeTTL),
+		served:        make(keyRates),
+		requested:     make(keyRates),
+		transport:     transport,
+		limiter:       newRateLimiter(cfg.Limits.PeerRate, cfg.Limits.PeerBurst),
+		ips:           newRateLimiter(cfg.Limits.IPRate, cfg.Limits.IPBurst),
+		subnets:       newRateLimiter(cfg.Limits.SubnetRate, cfg.Limits.SubnetBurst),
+		bandwidth:     newBandwidthMeter(),
+		log:           slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})).With("node", self.id[:8]),
+		level:         level,
+		clock:         clock,
+		random:        random,
+		lastRefresh:   clock.Now(),
+		lastRepublish: clock.Now(),
+		lastSave:      clock.Now(),
+		lastPex:       clock.Now(),
+		lastKeepalive: clock.Now(),
+		lastSync:      clock.Now(),
+		lastGossip:    clock.Now(),
+		keepalive:     cfg.Keepalive.Max,
+	}
+	n.life, n.halt = context.WithCancel(context.Background())
+	n.dht.bucketSubnet, n.dht.tableSubnet = cfg.Limits.BucketSubnet, cfg.Limits.TableSubnet
+	n.dht.removed = func(p *Peer) { n.churn.noteEviction(n.dht.bucketIndex(p.id), n.clock.Now()) }
+	if cfg.Storage != "" {
+		aead, err := storeCipher(cfg)
+		var disk *diskTier
+		if err == nil {
+			disk, err = openDiskTier(filepath.Join(cfg.Storage, recordsDir), cfg.CompressThreshold, aead)
+		}
+		if err != nil {
+			n.log.Warn("records will not spill to disk", "err", err)
+		} else {
+			n.store.disk = disk
+		}
+		if err == nil {
+			n.partialDisk, err = openPartials(filepath.Join(cfg.Storage, partialDir), cfg.CompressThreshold, aead)
+		}
+		if err != nil {
+			n.log.Warn("partial downloads will not survive a restart", "err", err)
+		}
+	}
+	self.addrs = n.listenAddrs()
+	for _, addr := range circuitAddrs(cfg.Relays) {
+		if len(self.addrs) < maxContactAddrs {
+			self.addrs = append(self.addrs, addr)
+		}
+	}
+	n.signRecord()
+	transport.Serve(n.serve)
+	return n
+}
+
+// StartNode opens a UDP socket, or a WebSocket listener for ws:// ones,
+// for every configured listen address and creates a node on top of them,
+// injecting the configured faults, if any, into its outbound calls.
+func StartNode(cfg Config) (*Node, error) {
+	var key ed25519.PrivateKey
+	var unprotected bool
+	if cfg.Storage != "" {
+		if err := os.MkdirAll(cfg.Storage, 0o700); err != nil {
+			return nil, fmt.Errorf("storage: %w", err)
+		}
+		var err error
+		if key, unprotected, err = loadOrCreateIdentity(cfg); err != nil {
+			return nil, err
+		}
+	}
+	transports := make(multiTransport, 0, len(cfg.Listen))
+	for _, addr := range cfg.Listen {
+		var t Transport
+		var err error
+		if strings.HasPrefix(addr, "ws://") {
+			t, err = listenWS(addr)
+		} else {
+			t, err = listenUDP(addr, cfg.StreamThreshold)
+		}
+		if err != nil {
+			transports.Close()
+			return nil, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		transports = append(transports, t)
+	}
+	var transport Transport = transports
+	if cfg.NetworkKeyFile != "" {
+		key, err := networkKey(cfg)
+		if err != nil {
+			transports.Close()
+			return nil, fmt.Errorf("network_key_file: %w", err)
+		}
+		transport = &authTransport{Transport: transports, key: key, network: cfg.NetworkID}
+	}
+	if cfg.Faults != "" {
+		faulty := newFaultyTransport(transport, time.Now().UnixNano())
+		if err := faulty.parseFaults(cfg.Faults); err != nil {
+			transports.Close()
+			return nil, err
+		}
+		transport = faulty
+	}
+	n := newNode(cfg, transport, systemClock{}, rand.Reader, key)
+	if unprotected {
+		n.log.Warn("identity key is stored unencrypted, set identity_passphrase_file or $"+identityPassEnv,
+			"file", filepath.Join(cfg.Storage, identityFile))
+	}
+	if cfg.Storage != "" && cfg.WAL {
+		if err := n.openStoreLog(); err != nil {
+			transport.Close()
+			return nil, fmt.Errorf("wal: %w", err)
+		}
+	}
+	return n, nil
+}
+
+func newNodeID(random io.Reader) string {
+	id := make([]byte, IDBits/8)
+	io.ReadFull(random, id)
+	return hex.EncodeToString(id)
+}
+
+func (n *Node) ID() string {
+	return n.self.id
+}
+
+// Logger returns the node's logger, for code embedding the node to log
+// alongside it.
+func (n *Node) Logger() *slog.Logger {
+	return n.log
+}
+
+// OnPeer makes f hear of every peer added to the routing table from now
+// on, nil to stop. f is called without the node's lock held.
+func (n *Node) OnPeer(f func(p *Peer)) {
+	n.mu.Lock()
+	n.discovered = f
+	n.mu.Unlock()
+}
+
+func (n *Node) Addr() string {
+	return n.self.addr
+}
+
+// Addrs returns the multiaddrs of every endpoint the node listens on.
+func (n *Node) Addrs() []string {
+	return n.self.addrs
+}
+
+// Bootstrap pings each address to learn its ID and then looks up our own ID
+// so the buckets around us fill up. Addresses may be dnsseed: entries.
+func (n *Node) Bootstrap(ctx context.Context, addrs []string) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	addrs = n.resolveBootstrap(ctx, addrs)
+	joined := 0
+	for _, addr := range addrs {
+		resp, err := n.send(ctx, addr, n.request(msgPing))
+		if err != nil {
+			continue
+		}
+		n.addContact(&Peer{id: resp.From.ID, addr: addr, record: n.contactRecord(resp.From.ID, resp.From.ENR)})
+		joined++
+	}
+	if len(addrs) > 0 && joined == 0 {
+		return ErrNoPeers
+	}
+	n.iterate(ctx, msgFindNode, "", n.self.id)
+	n.mu.Lock()
+	n.bootstrapped = true
+	n.mu.Unlock()
+	n.log.Info("bootstrapped", "seeds", joined, "peers", len(n.Peers()))
+	return nil
+}
+
+// Run performs routine maintenance until ctx is done: refreshing buckets,
+// republishing the records we published, collecting garbage, exchanging
+// contacts, gossip and records with other peers, keeping NAT mappings
+// open, renewing service registrations and forwarding hinted records.
+func (n *Node) Run(ctx context.Context) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.running.Add(1)
+	n.mu.Unlock()
+	defer n.running.Done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(n.life, cancel)()
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.maintain(ctx)
+		}
+	}
+}
+
+// maintain runs whatever periodic work is due according to the node's
+// clock. The simulator calls it directly after advancing its clock.
+func (n *Node) maintain(ctx context.Context) {
+	now := n.clock.Now()
+	n.mu.Lock()
+	refresh := now.Sub(n.lastRefresh) >= n.cfg.RefreshInterval
+	if refresh {
+		n.lastRefresh = now
+	}
+	republish := now.Sub(n.lastRepublish) >= n.cfg.RepublishInterval
+	if republish {
+		n.lastRepublish = now
+	}
+	save := now.Sub(n.lastSave) >= n.cfg.SaveInterval
+	if save {
+		n.lastSave = now
+	}
+	pex := n.cfg.PexInterval > 0 && now.Sub(n.lastPex) >= n.cfg.PexInterval
+	if pex {
+		n.lastPex = now
+	}
+	keepalive := n.cfg.Keepalive.Max > 0 && now.Sub(n.lastKeepalive) >= n.cfg.Keepalive.Min
+	if keepalive {
+		n.lastKeepalive = now
+	}
+	reconcile := n.cfg.SyncInterval > 0 && now.Sub(n.lastSync) >= n.cfg.SyncInterval
+	if reconcile {
+		n.lastSync = now
+	}
+	gossip := n.cfg.GossipInterval > 0 && now.Sub(n.lastGossip) >= n.cfg.GossipInterval
+	if gossip {
+		n.lastGossip = now
+	}
+	relays := len(n.cfg.Relays) > 0 && now.Sub(n.lastRelay) >= relayRenew
+	n.mu.Unlock()
+
+	if relays {
+		n.registerRelays(ctx)
+	}
+	if refresh {
+		n.collectGarbage(now)
+		n.checkManifests(ctx, now)
+		n.probeLost(ctx, now)
+		n.refresh(ctx)
+	}
+	if republish {
+		n.republish(ctx)
+	}
+	if pex {
+		n.exchangePeers(ctx)
+	}
+	if reconcile {
+		n.antiEntropy(ctx)
+	}
+	if gossip {
+		n.gossip(ctx, now)
+	}
+	if keepalive {
+		n.keepAlive(ctx, now)
+	}
+	n.renewServices(ctx, now)
+	n.heartbeatPresence(ctx, now)
+	n.sweepPartials(now)
+	n.auditStores(ctx, now)
+	n.forwardHints(ctx, now)
+	n.repairDeaths(ctx)
+	n.rebalanceArrivals(ctx)
+	n.offloadHotKeys(ctx, now)
+	if save {
+		if err := n.saveContacts(); err != nil {
+			n.log.Warn("saving contacts failed", "err", err)
+		}
+		if err := n.checkpoint(); err != nil {
+			n.log.Warn("checkpointing store failed", "err", err)
+		}
+	}
+}
+
+// refresh looks up a random ID in every bucket that holds contacts or
+// should, by the estimated network size.
+func (n *Node) refresh(ctx context.Context) {
+	sizes := n.BucketSizes()
+	network := n.NetworkSize()
+	for i, size := range sizes {
+		if (size > 0 || expectedInBucket(network, i) >= 1) && ctx.Err() == nil {
+			n.iterate(ctx, msgFindNode, "", n.randomIDInBucket(i))
+		}
+	}
+}
+
+func (n *Node) republish(ctx context.Context) {
+	n.mu.Lock()
+	own := make([]*record, 0)
+	for _, key := range n.store.keys() {
+		if r, _ := n.store.peek(key); r.publisher == n.self.id {
+			own = append(own, r)
+		}
+	}
+	n.mu.Unlock()
+
+	n.republishCounters(ctx)
+	n.republishNames(ctx)
+	for _, r := range own {
+		if err := n.put(ctx, r.key, r.value, r.version, putOptions{replicas: r.replicas}); err != nil {
+			n.log.Warn("republish failed", "key", r.key, "err", err)
+		}
+		n.mu.Lock()
+		indexed := n.indexed[r.key]
+		n.mu.Unlock()
+		if indexed {
+			if err := n.index(ctx, r.key); err != nil {
+				n.log.Warn("reindexing failed", "key", r.key, "err", err)
+			}
+		}
+	}
+}
+
+// randomIDInBucket returns a random ID whose XOR distance from us has bit
+// length i, i.e. one that would land in bucket i.
+func (n *Node) randomIDInBucket(i int) string {
+	buf := make([]byte, IDBits/8)
+	io.ReadFull(n.random, buf)
+	offset := new(big.Int).SetBytes(buf)
+	offset.Rsh(offset, uint(IDBits-i))
+	offset.SetBit(offset, i-1, 1)
+	self, _ := new(big.Int).SetString(n.self.id, 16)
+	return fmt.Sprintf("%032x", offset.Xor(offset, self))
+}
+
+// PutOption changes how a single Put replicates its key.
+type PutOption func(*putOptions)
+
+type putOptions struct {
+	replicas     int
+	namespace    string
+	consistency  Consistency
+	data, parity int // shards, see erasure.go
+}
+
+// WithReplicas stores the key on count peers instead of as many as its
+// namespace asks for. count must be between 1 and K.
+func WithReplicas(count int) PutOption {
+	return func(o *putOptions) { o.replicas = count }
+}
+
+// WithNamespacePolicy replicates the key as widely as the configured
+// namespace name does, whichever namespace the key is in.
+func WithNamespacePolicy(name string) PutOption {
+	return func(o *putOptions) { o.namespace = name }
+}
+
+var errBadReplicas = errors.New("replica count out of range")
+
+// Put stores value under key locally and on the closest peers, as many as
+// key's namespace asks for unless an option says otherwise. The count is
+// kept with the record, sent to the replicas and used again whenever the
+// record is republished or repaired.
+func (n *Node) Put(ctx context.Context, key string, value []byte, opts ...PutOption) error {
+	var o putOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.namespace != "" {
+		if _, ok := n.cfg.Namespaces[o.namespace]; !ok {
+			return fmt.Errorf("no namespace %q", o.namespace)
+		}
+		if o.replicas == 0 {
+			o.replicas = n.cfg.policy("/" + o.namespace + "/").Replication
+		}
+	}
+	if o.replicas < 0 || o.replicas > n.cfg.K {
+		return fmt.Errorf("%w: %d", errBadReplicas, o.replicas)
+	}
+	if o.data > 0 || o.parity > 0 {
+		return n.putErasure(ctx, key, value, o)
+	}
+	return n.put(ctx, key, value, 0, o)
+}
+
+// put is Put with the version to store value under. A zero version stamps
+// a new one from the clock, later than any we stored for key before;
+// republishing passes the version a record already has, so a newer write
+// by someone else is not overtaken by an old one refreshed. o.replicas
+// is the number of copies to keep, zero for the namespace's.
+func (n *Node) put(ctx context.Context, key string, value []byte, version int64, o putOptions) error {
+	if err := n.cfg.checkValue(key, value); err != nil {
+		return err
+	}
+	if err := checkContent(key, value); err != nil {
+		return err
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	n.mu.Lock()
+	if version == 0 {
+		version = max(n.clock.Now().UnixNano(), 1)
+		if old, ok := n.store.peek(key); ok && old.version >= version {
+			version = old.version + 1
+		}
+	}
+	n.store.put(&record{key: key, value: value, publisher: n.self.id, stored: n.clock.Now(), version: version, replicas: o.replicas})
+	n.cache.remove(key)
+	n.evict()
+	n.mu.Unlock()
+	if err := n.logRecord(key); err != nil {
+		n.log.Warn("logging put failed", "key", key, "err", err)
+	}
+
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if o.consistency == ConsistencyDefault {
+		n.storeHinted(ctx, key, value, version, replicas, result, nil)
+		n.storeInClusters(ctx, key, value, version)
+		return ctx.Err()
+	}
+	n.mu.Lock()
+	acks := newWriteAcks(o.consistency.replicasNeeded(n.replication(key)))
+	n.mu.Unlock()
+	// The stores carry on once enough have succeeded.
+	storeCtx, done := n.operation(context.Background())
+	go func() {
+		defer done()
+		n.storeHinted(storeCtx, key, value, version, replicas, result, acks)
+		close(acks.done)
+		n.storeInClusters(storeCtx, key, value, version)
+	}()
+	return acks.wait(ctx)
+}
+
+// Get returns the value stored under key, the first copy found unless an
+// option asks for a quorum read. Options can also make the lookup private.
+func (n *Node) Get(ctx context.Context, key string, opts ...GetOption) ([]byte, error) {
+	var o getOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.consistency == ConsistencyQuorum || o.consistency == ConsistencyAll {
+		n.mu.Lock()
+		quorum := o.consistency.replicasNeeded(n.replication(key))
+		n.mu.Unlock()
+		return n.GetQuorum(ctx, key, quorum)
+	}
+	get := n.get
+	switch {
+	case o.onion:
+		get = n.getOnion
+	case o.private:
+		get = n.getPrivate
+	}
+	result, err := get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := decodeManifest(result.value); ok {
+		return n.getErasure(ctx, m)
+	}
+	return result.value, nil
+}
+
+func (n *Node) get(ctx context.Context, key string) (*lookupResult, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	if _, plain := n.cfg.validator(key).(valueCheck); !plain {
+		return n.getSelected(ctx, key)
+	}
+	n.mu.Lock()
+	r, ok := n.store.get(key)
+	if ok && r.expired(n.clock.Now()) {
+		n.store.delete(key)
+		ok = false
+	}
+	n.store.touch(key, n.clock.Now())
+	n.evict()
+	n.requested.hit(key, n.clock.Now())
+	cached, hit := n.cache.get(key, n.clock.Now())
+	missing := !hit && n.cache.missing(key, n.clock.Now())
+	n.mu.Unlock()
+	if ok {
+		return &lookupResult{value: r.value, found: true}, nil
+	}
+	if hit {
+		return &lookupResult{value: cached, found: true}, nil
+	}
+	if missing {
+		return nil, ErrNotFound
+	}
+
+	result := n.lookupValue(ctx, key)
+	if !result.found {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n.mu.Lock()
+		n.cache.putMissing(key, n.clock.Now())
+		n.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	if err := n.checkFound(key, result); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.cache.putFor(key, result.value, n.clock.Now(), n.cacheTTL(key, n.clock.Now()))
+	n.mu.Unlock()
+	return result, nil
+}
+
+// getSelected gets key from a namespace whose validator chooses between
+// versions: it gathers our own copy and those of every replica, falling
+// back to an ordinary lookup when none of them has one, and returns the
+// copy the validator selects. Such values are never cached.
+func (n *Node) getSelected(ctx context.Context, key string) (*lookupResult, error) {
+	v := n.cfg.validator(key)
+	values := make([][]byte, 0)
+	n.mu.Lock()
+	if r, ok := n.store.get(key); ok {
+		n.store.touch(key, n.clock.Now())
+		values = append(values, r.value)
+	}
+	n.mu.Unlock()
+	_, _, copies, _ := n.replicaCopies(ctx, key)
+	for _, value := range copies {
+		if v.Validate(key, value) == nil {
+			values = append(values, value)
+		}
+	}
+	hops := 0
+	if len(values) == 0 {
+		result := n.lookupValue(ctx, key)
+		if result.found {
+			values = append(values, result.value)
+		}
+		hops = result.hops
+	}
+	if len(values) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	i := v.Select(key, values)
+	if i < 0 || i >= len(values) {
+		i = 0
+	}
+	return &lookupResult{value: values[i], found: true, hops: hops}, nil
+}
+
+// Lookup returns the closest reachable peers to target.
+func (n *Node) Lookup(ctx context.Context, target string) []*Peer {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	return n.iterate(ctx, msgFindNode, "", target).closest
+}
+
+// FindPeer returns a copy of the peer with the given ID, from the routing
+// table if it is there and otherwise by looking it up, or nil if no one
+// knows it.
+func (n *Node) FindPeer(ctx context.Context, id string) *Peer {
+	n.mu.Lock()
+	p := n.dht.findPeer(id)
+	n.mu.Unlock()
+	if p == nil {
+		for _, found := range n.Lookup(ctx, id) {
+			if found.id == id {
+				p = found
+			}
+		}
+	}
+	if p == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cp := *p
+	return &cp
+}
+
+// operation bounds a whole Bootstrap, Put, Get or Lookup by the configured
+// operation timeout, on top of whatever deadline ctx already has. Close
+// waits for it to be cancelled and cancels it itself if it runs too long;
+// once the node is closing it comes back cancelled already.
+func (n *Node) operation(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if n.cfg.Timeouts.Operation <= 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeouts.Operation)
+	}
+	n.mu.Lock()
+	closed := n.closed
+	if !closed {
+		n.ops.Add(1)
+	}
+	n.mu.Unlock()
+	if closed {
+		cancel()
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(n.life, cancel)
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			stop()
+			cancel()
+			n.ops.Done()
+		})
+	}
+}
+
+func (n *Node) Ban(id string) {
+	n.mu.Lock()
+	n.dht.ban(id)
+	n.mu.Unlock()
+}
+
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dht.peers()
+}
+
+// BucketSizes returns the number of contacts in every bucket, indexed by
+// the bit length of their XOR distance from us.
+func (n *Node) BucketSizes() []int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sizes := make([]int, IDBits+1)
+	for _, p := range n.dht.peers() {
+		sizes[n.dht.bucketIndex(p.id)]++
+	}
+	return sizes
+}
+
+func (n *Node) request(typ string) *message {
+	m := &message{Type: typ, From: contact{ID: n.self.id, Addr: n.self.addr, Addrs: n.self.addrs}.withRecord(n.self.record)}
+	if n.cfg.CompressThreshold > 0 {
+		m.Codecs = []string{codecDeflate}
+	}
+	return m
+}
+
+func (n *Node) addContact(p *Peer) {
+	if p.id == "" || p.id == n.self.id {
+		return
+	}
+	n.mu.Lock()
+	existing := n.dht.findPeer(p.id)
+	if n.isDowngraded(p.id) || n.cfg.RequireRecords && p.record == nil && (existing == nil || existing.record == nil) {
+		n.mu.Unlock()
+		return
+	}
+	if existing != nil {
+		existing.addr = p.addr
+		if p.addrs != nil {
+			existing.addrs = p.addrs
+		}
+		if p.record != nil && (existing.record == nil || p.record.seq > existing.record.seq) {
+			existing.record = p.record
+		}
+		p = existing
+	} else {
+		p.added = n.clock.Now()
+	}
+	p.seen = n.clock.Now()
+	n.dht.addPeer(p)
+	discovered, added := n.discovered, *p
+	if existing != nil || n.dht.findPeer(p.id) == nil {
+		discovered = nil
+	} else {
+		n.noteArrival(p)
+	}
+	n.mu.Unlock()
+	if discovered != nil {
+		discovered(&added)
+	}
+}
+
+// call sends req to p and updates the routing table with the outcome.
+func (n *Node) call(ctx context.Context, p *Peer, req *message) (*message, error) {
+	start := n.clock.Now()
+	req = n.greet(p, req)
+	resp, err := n.send(ctx, p.addr, req)
+	n.observe(ctx, reply{peer: p, req: req, resp: resp, rtt: n.clock.Now().Sub(start), err: err, greeted: req.Hello != nil})
+	return resp, err
+}
+
+type reply struct {
+	peer    *Peer
+	req     *message
+	resp    *message
+	rtt     time.Duration
+	err     error
+	greeted bool // the request carried our hello
+}
+
+// callAll sends a request to every peer in parallel and returns the replies
+// in peer order. Routing table updates are applied in that order as well so
+// the result never depends on which reply happened to arrive first.
+func (n *Node) callAll(ctx context.Context, peers []*Peer, build func(p *Peer) *message) []reply {
+	return n.callEach(ctx, peers, build, nil)
+}
+
+// callEach is callAll that also passes every reply to arrived, if not nil,
+// as soon as it comes in.
+func (n *Node) callEach(ctx context.Context, peers []*Peer, build func(p *Peer) *message, arrived func(reply)) []reply {
+	replies := make([]reply, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *Peer) {
+			defer wg.Done()
+			start := n.clock.Now()
+			req := n.greet(p, build(p))
+			resp, err := n.send(ctx, p.addr, req)
+			replies[i] = reply{peer: p, req: req, resp: resp, rtt: n.clock.Now().Sub(start), err: err, greeted: req.Hello != nil}
+			if arrived != nil {
+				arrived(replies[i])
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	for _, r := range replies {
+		n.observe(ctx, r)
+	}
+	return replies
+}
+
+// callFirst is callAll for requests where a single good answer is enough:
+// once done accepts a reply, the calls still in flight are cancelled.
+// Peers whose calls were cancelled are not held against them.
+func (n *Node) callFirst(ctx context.Context, peers []*Peer, build func(p *Peer) *message, done func(*message) bool) []reply {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replies := make([]reply, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *Peer) {
+			defer wg.Done()
+			start := n.clock.Now()
+			req := n.greet(p, build(p))
+			resp, err := n.send(ctx, p.addr, req)
+			replies[i] = reply{peer: p, req: req, resp: resp, rtt: n.clock.Now().Sub(start), err: err, greeted: req.Hello != nil}
+			if err == nil && done(resp) {
+				cancel()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	for _, r := range replies {
+		n.observe(ctx, r)
+	}
+	return replies
+}
+
+// observe refreshes the peer in the routing table if it answered and,
+// if it did not, drops it once the failure detector suspects it enough.
+// A peer that answered with an error is still alive. The round trip time
+// feeds exponentially weighted averages of it and its deviation kept on
+// the contact.
+func (n *Node) observe(ctx context.Context, r reply) {
+	p, rtt := r.peer, r.rtt
+	n.scheduleAudit(r)
+	var remote *remoteError
+	if r.err == nil || errors.As(r.err, &remote) {
+		if r.resp != nil && r.resp.From.ID == p.id {
+			if rec := n.contactRecord(p.id, r.resp.From.ENR); rec != nil {
+				n.mu.Lock()
+				if p.record == nil || rec.seq > p.record.seq {
+					p.record = rec
+				}
+				n.mu.Unlock()
+			}
+		} else if n.cfg.RequireRecords {
+			return
+		}
+		n.addContact(p)
+		n.mu.Lock()
+		if existing := n.dht.findPeer(p.id); existing != nil {
+			existing.suspicion = 0
+			if rtt > 0 && existing.rtt == 0 {
+				existing.rtt, existing.rttvar = rtt, rtt/2
+			} else if rtt > 0 {
+				existing.rttvar = (3*existing.rttvar + abs64(existing.rtt-rtt)) / 4
+				existing.rtt = (7*existing.rtt + rtt) / 8
+			}
+		}
+		n.mu.Unlock()
+		if r.resp != nil {
+			n.learnCodecs(r.resp)
+			if r.greeted || r.resp.Hello != nil {
+				n.negotiate(p.id, r.resp.Hello)
+			}
+		}
+		return
+	}
+	if ctx.Err() == nil {
+		n.mu.Lock()
+		if n.suspect(p, r.err, rtt) {
+			n.dht.removePeer(p.id)
+			n.noteDeath(p)
+			n.noteLost(p, n.clock.Now())
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) handle(from string, req *message) *message {
+	n.mu.Lock()
+	banned := n.dht.banned[req.From.ID]
+	budget := n.cfg.Limits.PeerBandwidth
+	n.mu.Unlock()
+	if banned {
+		n.dropRequest(req, dropBanned, nil)
+		return nil
+	}
+	if reason := n.allowSource(from, req, n.clock.Now()); reason != "" {
+		n.dropRequest(req, reason, ErrIPRate)
+		return nil
+	}
+	if !n.limiter.allow(req.From.ID, n.clock.Now()) {
+		n.dropRequest(req, dropPeerRate, ErrRateLimited)
+		return nil
+	}
+	if !controlMessage(req) && n.bandwidth.overBudget(n.clock.Now(), req.From.ID, budget) {
+		n.dropRequest(req, dropBandwidth, ErrBandwidth)
+		return nil
+	}
+	resp := n.request(req.Type)
+	if req.Hello != nil {
+		if err := checkHello(req.Hello); err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		resp.Hello = n.hello()
+	}
+	if addr := n.contactAddr(from, req.From); addr != "" && !req.Relayed {
+		n.addContact(&Peer{id: req.From.ID, addr: addr, addrs: req.From.Addrs, record: n.contactRecord(req.From.ID, req.From.ENR)})
+	}
+	n.learnCodecs(req)
+	if req.Hello != nil {
+		n.negotiate(req.From.ID, req.Hello)
+	}
+
+	if err := decompressValue(req, n.cfg.Limits.MaxValueSize); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	switch req.Type {
+	case msgPing:
+	case msgFindNode:
+		resp.Nodes = n.closestContacts(req.Target, req.From.ID)
+		resp.Token = n.issueToken(from)
+	case msgFindValue:
+		resp.Token = n.issueToken(from)
+		n.mu.Lock()
+		now := n.clock.Now()
+		r, ok := n.store.get(req.Key)
+		if ok && r.expired(now) {
+			n.store.delete(req.Key)
+			ok = false
+		}
+		if ok {
+			n.served.hit(req.Key, now)
+		}
+		n.store.touch(req.Key, now)
+		n.evict()
+		n.mu.Unlock()
+		if ok {
+			resp.Found = true
+			threshold := 0
+			if accepts(req, codecDeflate) {
+				threshold = n.cfg.CompressThreshold
+			}
+			compressValue(resp, r.value, threshold)
+			resp.Version = r.version
+		} else {
+			resp.Nodes = n.closestContacts(n.dht.hashValue(req.Key), req.From.ID)
+		}
+	case msgSync:
+		resp.Token = n.issueToken(from)
+		n.handleSync(req.From.ID, req, resp)
+	case msgGossip:
+		if n.cfg.GossipInterval > 0 {
+			n.mergeMembers(req.Members)
+			resp.Members = n.gossipSample(req.From.ID)
+		}
+	case msgPex:
+		n.offerPeers(req.Nodes)
+		resp.Nodes = n.pexSample(req.From.ID)
+	case msgStore:
+		if !n.validToken(from, req.Token) {
+			n.log.Debug("rejected store", "peer", req.From.ID, "key", req.Key, "err", ErrBadToken)
+			resp.Error = ErrBadToken.Error()
+		} else if err := n.storeRemote(req); errors.Is(err, errLog) {
+			n.log.Warn("logging store failed", "key", req.Key, "err", err)
+			resp.Error = err.Error()
+		} else if err != nil {
+			n.log.Debug("rejected store", "peer", req.From.ID, "key", req.Key, "err", err)
+			resp.Error = err.Error()
+		}
+	case msgRelayRegister:
+		n.handleRelayRegister(from, req, resp)
+	case msgRelay:
+		n.handleRelay(req, resp)
+	case msgOnion:
+		n.handleOnion(req, resp)
+	default:
+		n.handleCustom(req, resp)
+	}
+	return resp
+}
+
+func (n *Node) storeRemote(req *message) error {
+	if err := n.cfg.checkValue(req.Key, req.Value); err != nil {
+		return err
+	}
+	r := &record{key: req.Key, publisher: req.From.ID, stored: n.clock.Now(), version: req.Version}
+	if req.Replicas > 0 {
+		r.replicas = min(req.Replicas, n.cfg.K)
+	}
+	if req.CacheFor > 0 {
+		r.expires = r.stored.Add(min64(time.Duration(req.CacheFor)*time.Millisecond, n.cfg.policy(req.Key).TTL))
+	}
+	admit := func() (bool, error) {
+		if n.draining {
+			return false, ErrDraining
+		}
+		r.value = req.Value
+		return n.admit(r)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ok, err := admit()
+	if ok && n.wal != nil {
+		// The copy is logged before it is applied, so we never hold one
+		// the log lacks. n.mu is let go while the log syncs, and the
+		// store may change meanwhile, so the checks run again after.
+		line := n.recordLine(r, r.value)
+		n.mu.Unlock()
+		err = n.wal.append(line)
+		n.mu.Lock()
+		if err != nil {
+			return fmt.Errorf("%w: %w", errLog, err)
+		}
+		ok, err = admit()
+	}
+	if !ok {
+		return err
+	}
+	r.spare = !n.responsible(r.key)
+	n.store.put(r)
+	if req.Hint != nil {
+		n.keepHint(req.Key, *req.Hint)
+	}
+	n.evict()
+	return nil
+}
+
+// admit checks a copy of r.key from elsewhere, a peer's store or a
+// snapshot, against the copy we hold and the store's limits, and merges
+// its value into ours where the namespace asks for it. It reports false
+// with a nil error when the copy we hold wins. n.mu must be held.
+func (n *Node) admit(r *record) (bool, error) {
+	if !n.store.has(r.key) && n.store.len() >= n.cfg.Limits.MaxRecords {
+		return false, ErrStoreFull
+	}
+	old, held := n.store.peek(r.key)
+	if held && r.version < old.version {
+		return false, ErrOutdated
+	}
+	if held && !r.expires.IsZero() && old.expires.IsZero() {
+		// Our copy as a replica beats a pushed one.
+		return false, nil
+	}
+	value, err := n.mergeRemote(r.key, r.publisher, r.value)
+	if err != nil {
+		return false, err
+	}
+	r.value = value
+	if !n.store.fits(r, n.cfg.Limits.MaxBytesPerPeer, n.cfg.Limits.MaxBytes) {
+		return false, ErrQuota
+	}
+	return true, nil
+}
+
+// mergeRemote combines a stored value with an incoming one for the
+// namespaces whose records have many writers, or rejects the incoming one,
+// sent by the node from. Everything else is simply replaced. n.mu must be
+// held.
+func (n *Node) mergeRemote(key, from string, value []byte) ([]byte, error) {
+	ns := namespaceOf(key)
+	if !multiWriter(ns) {
+		if err := checkContent(key, value); err != nil {
+			return nil, err
+		}
+		return value, n.preferIncoming(key, value)
+	}
+	var stored []byte
+	if old, ok := n.store.get(key); ok {
+		stored = old.value
+	}
+	var merged []byte
+	var err error
+	switch ns {
+	case indexNamespace:
+		merged, err = mergeIndex(stored, value, n.clock.Now(), n.cfg.policy(key).TTL)
+	case seriesNamespace:
+		merged, err = mergeSeries(stored, value)
+	case presenceNamespace:
+		merged, err = n.mergePresence(key, stored, value)
+	case mailboxNamespace:
+		merged, err = mergeMailbox(stored, value, n.clock.Now(), n.cfg.policy(key).MaxValueSize)
+	case counterNamespace:
+		merged, err = mergeCounter(stored, value)
+	case leaseNamespace:
+		merged, err = mergeLease(key, stored, value, from, n.clock.Now())
+	case serviceNamespace:
+		merged, err = mergeServices(stored, value, n.clock.Now())
+	case namesNamespace:
+		merged, err = n.mergeName(key, stored, value, n.clock.Now())
+	case feedNamespace:
+		merged, err = n.mergeFeed(key, stored, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return merged, n.cfg.checkValue(key, merged)
+}
+
+// multiWriter reports whether the records of namespace ns have many
+// writers, whose copies mergeRemote combines.
+func multiWriter(ns string) bool {
+	switch ns {
+	case indexNamespace, counterNamespace, leaseNamespace, serviceNamespace, namesNamespace, feedNamespace, seriesNamespace, presenceNamespace, mailboxNamespace:
+		return true
+	}
+	return false
+}
+
+// preferIncoming rejects value when key's validator selects the copy we
+// already store over it, so a replica never trades a better version for a
+// worse one. n.mu must be held.
+func (n *Node) preferIncoming(key string, value []byte) error {
+	v := n.cfg.validator(key)
+	if _, plain := v.(valueCheck); plain {
+		return nil
+	}
+	old, ok := n.store.get(key)
+	if ok && v.Select(key, [][]byte{value, old.value}) == 1 {
+		return ErrOutdated
+	}
+	return nil
+}
+
+// validValue reports whether a value a peer returned for key is one we
+// accept as the result of a lookup.
+func (n *Node) validValue(key string, value []byte) bool {
+	return n.cfg.checkValue(key, value) == nil
+}
+
+func (n *Node) closestContacts(target string, exclude string) []contact {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	contacts := make([]contact, 0, n.cfg.K)
+	for _, p := range n.dht.closest(target, n.cfg.K+1) {
+		if p.id != exclude && len(contacts) < n.cfg.K {
+			contacts = append(contacts, contact{ID: p.id, Addr: p.addr, Addrs: p.addrs}.withRecord(p.record))
+		}
+	}
+	return contacts
+}
+
+// nextCandidates picks the alpha unqueried peers to ask next. shortlist is
+// ordered by distance to target; peers whose distance has the same bit
+// length are about as useful to the lookup, so among those the ones with
+// the lowest measured round trip time go first. Unmeasured peers come
+// after measured ones at the same distance.
+func (n *Node) nextCandidates(shortlist []*Peer, queried map[string]bool, target string) []*Peer {
+	type candidate struct {
+		peer *Peer
+		bits int
+		rtt  time.Duration
+	}
+	pending := make([]candidate, 0, len(shortlist))
+	n.mu.Lock()
+	for _, p := range shortlist {
+		if queried[p.id] {
+			continue
+		}
+		c := candidate{peer: p, bits: distanceBits(p.id, target), rtt: time.Duration(math.MaxInt64)}
+		if known := n.dht.findPeer(p.id); known != nil && known.rtt > 0 {
+			c.rtt = known.rtt
+		}
+		pending = append(pending, c)
+	}
+	alpha := n.alpha()
+	n.mu.Unlock()
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].bits != pending[j].bits {
+			return pending[i].bits < pending[j].bits
+		}
+		return pending[i].rtt < pending[j].rtt
+	})
+
+	candidates := make([]*Peer, 0, alpha)
+	for _, c := range pending[:min(alpha, len(pending))] {
+		candidates = append(candidates, c.peer)
+	}
+	return candidates
+}
+
+type lookupResult struct {
+	closest     []*Peer
+	unreachable []*Peer           // queried but never answered
+	tokens      map[string]string // write tokens by peer ID
+	value       []byte
+	version     int64
+	found       bool
+	holder      *Peer // the peer the value came from
+	hops        int
+	traces      []lookupTrace // one per iterative lookup run
+}
+
+// iterate runs a Kademlia lookup for target, querying alpha unqueried peers
+// from the current k closest each round until none are left. For
+// find_value it stops as soon as any peer returns the value.
+func (n *Node) iterate(ctx context.Context, typ string, key string, target string) *lookupResult {
+	return n.iterateWhere(ctx, typ, key, target, nil)
+}
+
+// iterateWhere is iterate confined to the peers keep accepts. keep is called
+// with the node's mutex held.
+func (n *Node) iterateWhere(ctx context.Context, typ string, key string, target string, keep func(*Peer) bool) *lookupResult {
+	n.mu.Lock()
+	shortlist := n.dht.closestWhere(target, n.cfg.K, keep)
+	n.mu.Unlock()
+
+	result := &lookupResult{tokens: make(map[string]string)}
+	trace := lookupTrace{Type: typ, Target: target, Started: n.clock.Now()}
+	seen := make(map[string]bool)
+	queried := make(map[string]bool)
+	responded := make(map[string]bool)
+	referrers := make(map[string]*Peer) // who handed us each contact
+	// The node records of contacts not queried yet.
+	unverified := make(map[string]string)
+	for _, p := range shortlist {
+		seen[p.id] = true
+	}
+
+	for ctx.Err() == nil {
+		candidates := n.nextCandidates(shortlist, queried, target)
+		if len(candidates) == 0 {
+			break
+		}
+		result.hops++
+
+		hop := make([]string, 0, len(candidates))
+		for _, p := range candidates {
+			queried[p.id] = true
+			hop = append(hop, p.id)
+			if text, ok := unverified[p.id]; ok {
+				delete(unverified, p.id)
+				if p.record = n.contactRecord(p.id, text); p.record != nil {
+					p.deflate = p.record.hasCap(codecDeflate)
+				}
+			}
+		}
+		trace.Hops = append(trace.Hops, hop)
+		build := func(p *Peer) *message {
+			req := n.request(typ)
+			req.Key = key
+			req.Target = target
+			return req
+		}
+		found := func(resp *message) bool {
+			return resp.Found && n.validValue(key, resp.Value)
+		}
+		var replies []reply
+		round, cancel := n.hopContext(ctx)
+		if typ == msgFindValue {
+			replies = n.callFirst(round, candidates, build, found)
+		} else {
+			replies = n.callAll(round, candidates, build)
+		}
+		cancel()
+		n.observeRound(replies)
+		for _, r := range replies {
+			trace.Contacted++
+			trace.Bytes += wireSize(r.req) + wireSize(r.resp)
+			query := lookupQuery{Round: result.hops, Peer: r.peer.id, Addr: r.peer.addr, Distance: distanceBits(r.peer.id, target), Took: r.rtt}
+			if referrer := referrers[r.peer.id]; referrer != nil {
+				n.judgeReferral(referrer, r)
+			}
+			if r.err != nil {
+				query.Error = r.err.Error()
+				trace.Queries = append(trace.Queries, query)
+				var remote *remoteError
+				if !errors.As(r.err, &remote) {
+					result.unreachable = append(result.unreachable, r.peer)
+				}
+				continue
+			}
+			query.Found, query.Nodes = found(r.resp), len(r.resp.Nodes)
+			if query.Found && !n.plausibleHolder(r.peer, target) {
+				n.judge(r.peer, implausibleHit, "implausible value holder")
+			}
+			trace.Queries = append(trace.Queries, query)
+			responded[r.peer.id] = true
+			result.tokens[r.peer.id] = r.resp.Token
+			if query.Found && !result.found {
+				result.found = true
+				result.value = r.resp.Value
+				result.version = r.resp.Version
+				result.holder = r.peer
+			}
+			for _, c := range r.resp.Nodes {
+				if c.ID == n.self.id || seen[c.ID] {
+					continue
+				}
+				seen[c.ID] = true
+				p := &Peer{id: c.ID, addr: n.pickAddr(c), addrs: c.Addrs}
+				if !n.cfg.RequireRecords && p.addr != "" {
+					// Checking signatures is most of what a lookup costs
+					// and most contacts are never queried, so a record we
+					// do not need yet waits until its peer is.
+					if c.ENR != "" {
+						unverified[p.id] = c.ENR
+					}
+				} else {
+					p.record = n.contactRecord(c.ID, c.ENR)
+					if n.cfg.RequireRecords {
+						if p.record == nil {
+							continue
+						}
+						signed := contact{Addr: p.record.addr(), Addrs: p.record.addrs()}
+						if p.addr, p.addrs = n.pickAddr(signed), signed.Addrs; p.addr == "" {
+							continue
+						}
+					}
+					if p.record != nil {
+						p.deflate = p.record.hasCap(codecDeflate)
+						if p.addr == "" {
+							p.addr = p.record.addr()
+						}
+					}
+				}
+				if keep != nil {
+					n.mu.Lock()
+					ok := keep(p)
+					n.mu.Unlock()
+					if !ok {
+						continue
+					}
+				}
+				referrers[p.id] = r.peer
+				shortlist = append(shortlist, p)
+			}
+		}
+		if result.found {
+			break
+		}
+
+		n.dht.sortByDistance(shortlist, target)
+		kept := shortlist[:0]
+		for _, p := range shortlist {
+			if (!queried[p.id] || responded[p.id]) && len(kept) < n.cfg.K {
+				kept = append(kept, p)
+			}
+		}
+		shortlist = kept
+	}
+
+	for _, p := range shortlist {
+		if responded[p.id] {
+			result.closest = append(result.closest, p)
+		}
+	}
+	if keep == nil && !result.found && ctx.Err() == nil {
+		n.observeLookup(target, result.closest)
+	}
+	trace.Found, trace.Closest, trace.Took = result.found, len(result.closest), n.clock.Now().Sub(trace.Started)
+	n.recordLookup(trace)
+	result.traces = []lookupTrace{trace}
+	return result
+}
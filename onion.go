@@ -0,0 +1,322 @@
+package dht
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// An onion-routed Get sends each of its lookup's queries through
+// onion_hops relays picked at random from the routing table, so the nodes
+// that serve the key never see our address and the relays that see it do
+// not learn the key. Relays are nodes running with onion_relay, which
+// announce the "onion" capability and an X25519 key, derived from their
+// identity, in their signed record.
+//
+// The query is wrapped once per relay, innermost for the last: each layer
+// is sealed with AES-GCM under a key agreed between a fresh X25519 key,
+// sent along, and the relay's. A relay opens its layer and finds either
+// the address of the next relay and the sealed rest, or, at the last one,
+// the peer and the request to send it in its own name. Each relay seals
+// the reply it gets back under a second key from the same agreement, so
+// only we can unwrap it, layer by layer. Values come back uncompressed.
+const (
+	capOnion      = "onion"
+	onionPair     = "x25519"
+	maxOnionHops  = 3
+	onionLayerKey = "onion layer"
+	onionReplyKey = "onion reply"
+)
+
+var (
+	ErrNoOnionRoute = errors.New("not enough onion relays known")
+	errNotOnion     = errors.New("not an onion relay")
+)
+
+// onionLayer is what a relay finds in its layer of an onion request.
+type onionLayer struct {
+	Next    string        `json:"next,omitempty"`    // the next relay
+	Payload []byte        `json:"payload,omitempty"` // its sealed layer
+	Peer    string        `json:"peer,omitempty"`    // at the last relay, whom to ask
+	Request *onionRequest `json:"request,omitempty"`
+}
+
+// onionRequest is the lookup query the last relay sends.
+type onionRequest struct {
+	Type   string `json:"type"`
+	Key    string `json:"key,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// onionKey derives the node's X25519 key from its identity.
+func onionKey(key ed25519.PrivateKey) *ecdh.PrivateKey {
+	seed := sha256.Sum256(append([]byte(onionLayerKey), key.Seed()...))
+	k, err := ecdh.X25519().NewPrivateKey(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// onionPublic returns the X25519 key the record announces, nil if none.
+func (r *nodeRecord) onionPublic() *ecdh.PublicKey {
+	if r == nil || !r.hasCap(capOnion) {
+		return nil
+	}
+	pub, err := ecdh.X25519().NewPublicKey(r.pairs[onionPair])
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// onionKeys derives the layer and reply keys from an X25519 agreement.
+func onionKeys(secret []byte) (layer, reply cipher.AEAD) {
+	aead := func(label string) cipher.AEAD {
+		sum := sha256.Sum256(append([]byte(label), secret...))
+		block, _ := aes.NewCipher(sum[:])
+		gcm, _ := cipher.NewGCM(block)
+		return gcm
+	}
+	return aead(onionLayerKey), aead(onionReplyKey)
+}
+
+func seal(aead cipher.AEAD, random io.Reader, data []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	io.ReadFull(random, nonce)
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func unseal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("short sealed data")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// sealLayer seals layer for the relay with key pub and returns it with
+// the key its reply will be sealed under.
+func (n *Node) sealLayer(pub *ecdh.PublicKey, layer onionLayer) ([]byte, cipher.AEAD, error) {
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return nil, nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(n.random)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	layerKey, replyKey := onionKeys(secret)
+	return append(eph.PublicKey().Bytes(), seal(layerKey, n.random, data)...), replyKey, nil
+}
+
+// openLayer opens our layer of an onion request.
+func (n *Node) openLayer(data []byte) (onionLayer, cipher.AEAD, error) {
+	var layer onionLayer
+	if len(data) < 32 {
+		return layer, nil, errors.New("short onion layer")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return layer, nil, err
+	}
+	secret, err := onionKey(n.key).ECDH(eph)
+	if err != nil {
+		return layer, nil, err
+	}
+	layerKey, replyKey := onionKeys(secret)
+	plain, err := unseal(layerKey, data[32:])
+	if err != nil {
+		return layer, nil, err
+	}
+	return layer, replyKey, json.Unmarshal(plain, &layer)
+}
+
+// handleOnion passes an onion request on, or at the last relay makes the
+// query in it, and seals the reply.
+func (n *Node) handleOnion(req, resp *message) {
+	if !n.cfg.OnionRelay {
+		resp.Error = errNotOnion.Error()
+		return
+	}
+	layer, replyKey, err := n.openLayer(req.Value)
+	if err != nil {
+		resp.Error = "bad onion layer"
+		return
+	}
+	ctx, cancel := n.operation(context.Background())
+	defer cancel()
+	var reply *message
+	switch {
+	case layer.Next != "":
+		onion := n.request(msgOnion)
+		onion.Value = layer.Payload
+		if reply, err = n.send(ctx, layer.Next, onion); err == nil {
+			resp.Value = seal(replyKey, n.random, reply.Value)
+		}
+	case layer.Request != nil && (layer.Request.Type == msgFindNode || layer.Request.Type == msgFindValue):
+		query := n.request(layer.Request.Type)
+		query.Key, query.Target = layer.Request.Key, layer.Request.Target
+		query.Codecs = nil
+		if reply, err = n.send(ctx, layer.Peer, query); err == nil {
+			var data []byte
+			if data, err = json.Marshal(reply); err == nil {
+				resp.Value = seal(replyKey, n.random, data)
+			}
+		}
+	default:
+		err = errors.New("bad onion layer")
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+}
+
+// onionRelays picks hops distinct relays from the routing table, none of
+// them the peer to be asked.
+func (n *Node) onionRelays(hops int, except string) ([]*Peer, error) {
+	n.mu.Lock()
+	candidates := make([]*Peer, 0)
+	for _, p := range n.dht.peers() {
+		if p.id != except && p.record.onionPublic() != nil {
+			candidates = append(candidates, p)
+		}
+	}
+	n.mu.Unlock()
+	if len(candidates) < hops {
+		return nil, ErrNoOnionRoute
+	}
+	for i := 0; i < hops; i++ {
+		j := i + n.randomIndex(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates[:hops], nil
+}
+
+// callOnion sends query to p through a fresh onion route.
+func (n *Node) callOnion(ctx context.Context, p *Peer, query onionRequest) (*message, error) {
+	relays, err := n.onionRelays(n.cfg.OnionHops, p.id)
+	if err != nil {
+		return nil, err
+	}
+	layer := onionLayer{Peer: p.addr, Request: &query}
+	keys := make([]cipher.AEAD, len(relays))
+	for i := len(relays) - 1; i >= 0; i-- {
+		sealed, replyKey, err := n.sealLayer(relays[i].record.onionPublic(), layer)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = replyKey
+		if i > 0 {
+			layer = onionLayer{Next: relays[i].addr, Payload: sealed}
+		} else {
+			layer = onionLayer{Payload: sealed}
+		}
+	}
+	onion := n.request(msgOnion)
+	onion.Value = layer.Payload
+	resp, err := n.send(ctx, relays[0].addr, onion)
+	if err != nil {
+		return nil, err
+	}
+	data := resp.Value
+	for _, key := range keys {
+		if data, err = unseal(key, data); err != nil {
+			return nil, fmt.Errorf("onion reply: %w", err)
+		}
+	}
+	reply, err := decodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyError(reply)
+}
+
+// onionLookup is a find_value lookup whose every query goes through an
+// onion route. Peers' answers do not update the routing table, since we
+// never talk to them directly.
+func (n *Node) onionLookup(ctx context.Context, key string) (*lookupResult, error) {
+	target := n.dht.hashValue(key)
+	n.mu.Lock()
+	shortlist := n.dht.closest(target, n.cfg.K)
+	n.mu.Unlock()
+	seen := make(map[string]bool)
+	queried := make(map[string]bool)
+	for _, p := range shortlist {
+		seen[p.id] = true
+	}
+	for ctx.Err() == nil {
+		candidates := n.nextCandidates(shortlist, queried, target)
+		if len(candidates) == 0 {
+			break
+		}
+		replies := make([]*message, len(candidates))
+		errs := make([]error, len(candidates))
+		var wg sync.WaitGroup
+		for i, p := range candidates {
+			queried[p.id] = true
+			wg.Add(1)
+			go func(i int, p *Peer) {
+				defer wg.Done()
+				replies[i], errs[i] = n.callOnion(ctx, p, onionRequest{Type: msgFindValue, Key: key, Target: target})
+			}(i, p)
+		}
+		wg.Wait()
+		for i, resp := range replies {
+			if errors.Is(errs[i], ErrNoOnionRoute) {
+				return nil, errs[i]
+			}
+			if errs[i] != nil {
+				continue
+			}
+			if resp.Found && n.validValue(key, resp.Value) {
+				result := &lookupResult{value: resp.Value, version: resp.Version, found: true, holder: candidates[i]}
+				if err := n.checkFound(key, result); err != nil {
+					return nil, err
+				}
+				return result, nil
+			}
+			for _, c := range resp.Nodes {
+				if c.ID != n.self.id && !seen[c.ID] {
+					seen[c.ID] = true
+					shortlist = append(shortlist, &Peer{id: c.ID, addr: n.pickAddr(c), addrs: c.Addrs})
+				}
+			}
+		}
+		n.dht.sortByDistance(shortlist, target)
+		shortlist = shortlist[:min(len(shortlist), n.cfg.K)]
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// WithOnionRouting makes Get send its lookup's queries through onion
+// routes and skip the cache.
+func WithOnionRouting() GetOption {
+	return func(o *getOptions) { o.onion = true }
+}
+
+func (n *Node) getOnion(ctx context.Context, key string) (*lookupResult, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	n.mu.Lock()
+	r, ok := n.store.get(key)
+	n.mu.Unlock()
+	if ok {
+		return &lookupResult{value: r.value, found: true}, nil
+	}
+	return n.onionLookup(ctx, key)
+}
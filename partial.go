@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Shards of an erasure-coded value that a Get fetched but could not use
+// yet, because it was cancelled or too few shards answered, are kept as
+// partial-download state keyed by the value's hash, and the next Get of
+// that value fetches only the shards still missing. With storage the
+// shards go to files under partialDir, in the disk tier's format and
+// encrypted like it, and a restarted node resumes too; without, the
+// state is in memory, for at most maxPartials values. Once a value is
+// rebuilt its state is dropped, and state without progress is dropped
+// after partialTTL. Kept shards are checked against the manifest again
+// when they are loaded.
+const (
+	partialDir  = "partial"
+	maxPartials = 16
+	partialTTL  = 24 * time.Hour
+)
+
+// partialFetch is the in-memory state of one value's download.
+type partialFetch struct {
+	shards  [][]byte
+	touched time.Time
+}
+
+// openPartials opens the partial-download directory, keeping what an
+// earlier run left in it.
+func openPartials(dir string, threshold int, aead cipher.AEAD) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskTier{dir: dir, threshold: threshold, aead: aead}, nil
+}
+
+func partialKey(m *erasureManifest, i int) string {
+	return fmt.Sprintf("%x/%d", m.Sum, i)
+}
+
+// shardSize is the size of each of m's shards.
+func (m *erasureManifest) shardSize() int {
+	return max((m.Size+m.Data-1)/m.Data, 1)
+}
+
+// loadPartial returns the shards of m fetched before, nil where missing.
+func (n *Node) loadPartial(m *erasureManifest) [][]byte {
+	shards := make([][]byte, m.Data+m.Parity)
+	n.mu.Lock()
+	if f, ok := n.partials[hex.EncodeToString(m.Sum)]; ok {
+		copy(shards, f.shards)
+		f.touched = n.clock.Now()
+	}
+	n.mu.Unlock()
+	if n.partialDisk != nil {
+		for i := range shards {
+			if s, err := n.partialDisk.read(partialKey(m, i), m.shardSize()); err == nil {
+				shards[i] = s
+			}
+		}
+	}
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if sum := sha256.Sum256(s); string(sum[:]) != string(m.Shards[i]) {
+			shards[i] = nil
+		}
+	}
+	return shards
+}
+
+// savePartial keeps shard i of m, which has been checked.
+func (n *Node) savePartial(m *erasureManifest, i int, shard []byte) {
+	if n.partialDisk != nil {
+		n.partialDisk.write(partialKey(m, i), shard)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id := hex.EncodeToString(m.Sum)
+	f, ok := n.partials[id]
+	if !ok {
+		if n.partials == nil {
+			n.partials = make(map[string]*partialFetch)
+		}
+		if len(n.partials) >= maxPartials {
+			var oldest string
+			for other, g := range n.partials {
+				if oldest == "" || g.touched.Before(n.partials[oldest].touched) {
+					oldest = other
+				}
+			}
+			delete(n.partials, oldest)
+		}
+		f = &partialFetch{shards: make([][]byte, len(m.Shards))}
+		n.partials[id] = f
+	}
+	f.shards[i] = shard
+	f.touched = n.clock.Now()
+}
+
+// dropPartial forgets what was fetched of m.
+func (n *Node) dropPartial(m *erasureManifest) {
+	n.mu.Lock()
+	delete(n.partials, hex.EncodeToString(m.Sum))
+	n.mu.Unlock()
+	if n.partialDisk != nil {
+		for i := range m.Shards {
+			n.partialDisk.remove(partialKey(m, i))
+		}
+	}
+}
+
+// sweepPartials drops downloads that made no progress for partialTTL.
+func (n *Node) sweepPartials(now time.Time) {
+	n.mu.Lock()
+	for id, f := range n.partials {
+		if now.Sub(f.touched) > partialTTL {
+			delete(n.partials, id)
+		}
+	}
+	n.mu.Unlock()
+	if n.partialDisk == nil {
+		return
+	}
+	entries, _ := os.ReadDir(n.partialDisk.dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > partialTTL {
+			os.Remove(filepath.Join(n.partialDisk.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// converged is the routing and replica level taken as reconverged.
+const converged = 0.95
+
+func TestPartitionReconverges(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 3)
+	sim.AddNodes(ctx, 20)
+	report, err := sim.RunPartition(ctx, dhtsim.PartitionScenario{
+		Groups:      2,
+		At:          30 * time.Minute,
+		Length:      time.Hour,
+		Duration:    3 * time.Hour,
+		Keys:        20,
+		SampleEvery: 15 * time.Minute,
+		SampleReads: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := false
+	for _, p := range report.Points {
+		if p.Split && p.Routing < converged {
+			split = true
+		}
+	}
+	if !split {
+		t.Fatal("the split never showed in the routing tables")
+	}
+	if err := report.Expect(converged, converged, time.Hour); err != nil {
+		t.Error(err)
+	}
+	if last := report.Points[len(report.Points)-1]; last.Availability < 1 {
+		t.Errorf("availability %.3f after healing", last.Availability)
+	}
+}
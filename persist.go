@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const contactsFile = "contacts.json"
+
+// saveContacts writes the routing table to the storage directory. Only
+// contacts that made it into the table are saved, i.e. peers that have
+// answered us at some point.
+func (n *Node) saveContacts() error {
+	if n.cfg.Storage == "" {
+		return nil
+	}
+	n.mu.Lock()
+	contacts := make([]contact, 0)
+	for _, p := range n.dht.peers() {
+		contacts = append(contacts, contact{ID: p.id, Addr: p.addr})
+	}
+	n.mu.Unlock()
+
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(n.cfg.Storage, contactsFile), data, 0o600)
+}
+
+func (n *Node) loadContacts() ([]contact, error) {
+	if n.cfg.Storage == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(n.cfg.Storage, contactsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var contacts []contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+	valid := contacts[:0]
+	for _, c := range contacts {
+		if validID(c.ID) && c.Addr != "" {
+			valid = append(valid, c)
+		}
+	}
+	return valid, nil
+}
+
+// Join rejoins through the contacts saved by a previous run and only falls
+// back to the configured bootstrap peers when none of them answer.
+func (n *Node) Join(ctx context.Context) error {
+	n.registerRelays(ctx)
+	saved, err := n.loadContacts()
+	if err != nil {
+		n.log.Warn("ignoring saved contacts", "err", err)
+	}
+	if len(saved) > 0 {
+		peers := make([]*Peer, 0, len(saved))
+		for _, c := range saved {
+			peers = append(peers, &Peer{id: c.ID, addr: c.Addr})
+		}
+		// Many saved contacts are gone after a long break, so do not wait
+		// for retries on each of them.
+		probe := withRetry(ctx, RetryPolicy{Attempts: 1})
+		alive := 0
+		for _, r := range n.callAll(probe, peers, func(*Peer) *message { return n.request(msgPing) }) {
+			if r.err == nil && r.resp.From.ID == r.peer.id {
+				alive++
+			}
+		}
+		if alive > 0 {
+			n.log.Info("rejoining through saved contacts", "alive", alive, "saved", len(saved))
+			return n.Bootstrap(ctx, nil)
+		}
+	}
+	n.mu.Lock()
+	seeds := n.cfg.Bootstrap
+	n.mu.Unlock()
+	return n.Bootstrap(ctx, seeds)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// pexFanout is how many peers each exchange round talks to.
+const pexFanout = 3
+
+// pexSample returns the most recently seen contact of every non-empty
+// bucket, farthest first, which spreads the sample across the whole ID
+// space, capped at k.
+func (n *Node) pexSample(exclude string) []contact {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sample := make([]contact, 0, n.cfg.K)
+	for _, bucket := range n.dht.buckets() {
+		if len(sample) >= n.cfg.K {
+			break
+		}
+		nodes := bucket.nodes
+		for j := len(nodes) - 1; j >= 0; j-- {
+			if nodes[j].id != exclude {
+				sample = append(sample, contact{ID: nodes[j].id, Addr: nodes[j].addr, Addrs: nodes[j].addrs}.withRecord(nodes[j].record))
+				break
+			}
+		}
+	}
+	return sample
+}
+
+// offerPeers queues contacts we do not know yet. They only enter the
+// routing table once they have answered a ping from us, so a peer cannot
+// fill our buckets with addresses it made up.
+func (n *Node) offerPeers(contacts []contact) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range contacts {
+		if len(n.pexPending) >= maxNodesPerMessage {
+			return
+		}
+		if c.ID == n.self.id || c.Addr == "" || n.dht.banned[c.ID] || n.dht.findPeer(c.ID) != nil {
+			continue
+		}
+		if n.pexPending == nil {
+			n.pexPending = make(map[string]string)
+		}
+		n.pexPending[c.ID] = c.Addr
+	}
+}
+
+// exchangePeers sends a sample of our routing table to a few random peers,
+// queues the samples they send back and then pings everything queued since
+// the last round.
+func (n *Node) exchangePeers(ctx context.Context) {
+	peers := n.Peers()
+	for i := 0; i < pexFanout && i < len(peers); i++ {
+		j := i + n.randomIndex(len(peers)-i)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	peers = peers[:min(pexFanout, len(peers))]
+	for _, r := range n.callAll(ctx, peers, func(p *Peer) *message {
+		req := n.request(msgPex)
+		req.Nodes = n.pexSample(p.id)
+		return req
+	}) {
+		if r.err == nil {
+			n.offerPeers(r.resp.Nodes)
+		}
+	}
+
+	n.mu.Lock()
+	candidates := make([]*Peer, 0, len(n.pexPending))
+	for id, addr := range n.pexPending {
+		candidates = append(candidates, &Peer{id: id, addr: addr})
+	}
+	n.pexPending = nil
+	n.mu.Unlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+
+	learned := 0
+	for _, r := range n.callAll(ctx, candidates, func(*Peer) *message { return n.request(msgPing) }) {
+		if r.err == nil && r.resp.From.ID == r.peer.id {
+			learned++
+		}
+	}
+	if learned > 0 {
+		n.log.Debug("learned peers through exchange", "learned", learned, "offered", len(candidates))
+	}
+}
+
+func (n *Node) randomIndex(size int) int {
+	var buf [8]byte
+	io.ReadFull(n.random, buf[:])
+	return int(binary.BigEndian.Uint64(buf[:]) % uint64(size))
+}
@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// With placement = "ring" the replicas of a key are not simply the
+// closest peers to it but are chosen among them by consistent hashing
+// with virtual nodes: every candidate owns as many points on a hash ring
+// as the virtual nodes it advertises, and the key goes to the owners of
+// the first points clockwise from its hash, one copy per owner. A node
+// given virtual_nodes in proportion to its capacity thus takes a
+// proportional share of the keys it is close to, where XOR placement
+// loads every close node alike. The candidates are still the k closest
+// peers, so lookups find the replicas as before and every node choosing
+// among the same candidates picks the same ones; a network should use
+// one placement mode throughout.
+const (
+	placementXOR        = "xor"
+	placementRing       = "ring"
+	defaultVirtualNodes = 16 // assumed for peers that did not say
+	maxVirtualNodes     = 1024
+)
+
+// ringPoint is one virtual node.
+type ringPoint struct {
+	pos  uint64
+	peer *Peer
+}
+
+// replicasFor returns the peers among candidates, which are sorted by
+// distance to key, that should hold it. n.mu must not be held.
+func (n *Node) replicasFor(key string, candidates []*Peer) []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.placeReplicas(key, candidates)
+}
+
+// placeReplicas is replicasFor with n.mu held.
+func (n *Node) placeReplicas(key string, candidates []*Peer) []*Peer {
+	count := min(n.replication(key), len(candidates))
+	if n.cfg.Placement != placementRing || count == len(candidates) {
+		return candidates[:count]
+	}
+	ring := make([]ringPoint, 0, len(candidates)*defaultVirtualNodes)
+	for _, p := range candidates {
+		for i := 0; i < n.virtualNodes(p); i++ {
+			ring = append(ring, ringPoint{pos: ringPosition(p.id + "/" + strconv.Itoa(i)), peer: p})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].pos < ring[j].pos })
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].pos >= ringPosition(key) })
+	replicas := make([]*Peer, 0, count)
+	for i := 0; i < len(ring) && len(replicas) < count; i++ {
+		p := ring[(start+i)%len(ring)].peer
+		if !contains(replicas, p.id) {
+			replicas = append(replicas, p)
+		}
+	}
+	return replicas
+}
+
+// replication returns how many peers should hold key: as many as its
+// publisher asked for, if we hold a copy that says, else as many as its
+// namespace asks for. n.mu must be held.
+func (n *Node) replication(key string) int {
+	if r, ok := n.store.peek(key); ok && r.replicas > 0 {
+		return r.replicas
+	}
+	return n.cfg.policy(key).Replication
+}
+
+// virtualNodes returns how many points p owns on the ring. n.mu must be
+// held.
+func (n *Node) virtualNodes(p *Peer) int {
+	if p.id == n.self.id {
+		return n.cfg.VirtualNodes
+	}
+	if known := n.dht.findPeer(p.id); known != nil && known.vnodes > 0 {
+		return min(known.vnodes, maxVirtualNodes)
+	}
+	return defaultVirtualNodes
+}
+
+func ringPosition(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
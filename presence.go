@@ -0,0 +1,150 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// With presence_interval set, a node announces that it is online, and at
+// which addresses, in a presence record under the hash of its ID, signed
+// by it and good for presenceLifetimes intervals, and renews it every
+// interval. It withdraws the record when it closes. Replicas keep the
+// record with the highest sequence number, and a node that stops without
+// closing shows as offline once its last record runs out, a few intervals
+// later. Online asks every replica of a peer's record.
+const (
+	presenceNamespace = "presence"
+	presenceLifetimes = 3
+)
+
+var ErrStalePresence = errors.New("stale presence record")
+
+// Presence is what a peer last said about being online.
+type Presence struct {
+	Online bool
+	Addrs  []string
+	Until  time.Time // when the peer counts as offline unless it renews
+}
+
+// signedPresence is what is stored for a node's presence. Sig covers the
+// JSON encoding of everything else, with Sig left empty.
+type signedPresence struct {
+	Owner []byte   `json:"owner"`
+	Seq   int64    `json:"seq"`   // unix nanoseconds of the announcement
+	Until int64    `json:"until"` // unix milliseconds
+	Addrs []string `json:"addrs,omitempty"`
+	Sig   []byte   `json:"sig,omitempty"`
+}
+
+func (n *Node) presenceKey(id string) string {
+	return "/" + presenceNamespace + "/" + n.dht.hashValue(id)
+}
+
+// verifyPresence decodes a presence record stored under key and checks
+// its signature and that it is its owner's.
+func (n *Node) verifyPresence(key string, value []byte) (*signedPresence, error) {
+	var p signedPresence
+	if err := json.Unmarshal(value, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Owner) != ed25519.PublicKeySize || n.presenceKey(nodeIDFromKey(p.Owner)) != key {
+		return nil, ErrBadRecord
+	}
+	sig := p.Sig
+	p.Sig = nil
+	if !ed25519.Verify(p.Owner, mustJSON(p), sig) {
+		return nil, ErrBadSignature
+	}
+	p.Sig = sig
+	return &p, nil
+}
+
+// mergePresence decides whether a replica takes an incoming presence
+// record over the stored one.
+func (n *Node) mergePresence(key string, stored, incoming []byte) ([]byte, error) {
+	p, err := n.verifyPresence(key, incoming)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return incoming, nil
+	}
+	if current, err := n.verifyPresence(key, stored); err == nil && p.Seq <= current.Seq {
+		return nil, ErrStalePresence
+	}
+	return incoming, nil
+}
+
+// announcePresence signs and stores our presence, online until until.
+func (n *Node) announcePresence(ctx context.Context, until time.Time) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	n.mu.Lock()
+	// As for names, the clock keeps the sequence growing across restarts.
+	n.presenceSeq = max(n.presenceSeq+1, n.clock.Now().UnixNano())
+	p := signedPresence{
+		Owner: n.key.Public().(ed25519.PublicKey),
+		Seq:   n.presenceSeq,
+		Until: until.UnixMilli(),
+	}
+	n.mu.Unlock()
+	if until.After(n.clock.Now()) {
+		p.Addrs = n.Addrs()
+	}
+	p.Sig = ed25519.Sign(n.key, mustJSON(p))
+	key := n.presenceKey(n.self.id)
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return ErrNoPeers
+	}
+	n.storeAt(ctx, replicas, result.tokens, key, mustJSON(p))
+	return ctx.Err()
+}
+
+// heartbeatPresence renews our presence if an interval has gone by.
+func (n *Node) heartbeatPresence(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	interval := n.cfg.PresenceInterval
+	due := interval > 0 && now.Sub(n.lastPresence) >= interval
+	if due {
+		n.lastPresence = now
+	}
+	n.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := n.announcePresence(ctx, now.Add(presenceLifetimes*interval)); err != nil {
+		n.log.Warn("announcing presence failed", "err", err)
+	}
+}
+
+// Online reports whether the peer with ID id is online by its newest
+// presence record, and at which addresses. A peer that never announced
+// its presence is offline.
+func (n *Node) Online(ctx context.Context, id string) (Presence, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := n.presenceKey(id)
+	_, _, copies, answered := n.replicaCopies(ctx, key)
+	var best *signedPresence
+	for _, value := range copies {
+		if p, err := n.verifyPresence(key, value); err == nil && (best == nil || p.Seq > best.Seq) {
+			best = p
+		}
+	}
+	if answered == 0 {
+		if err := ctx.Err(); err != nil {
+			return Presence{}, err
+		}
+		return Presence{}, ErrNoPeers
+	}
+	if best == nil {
+		return Presence{}, nil
+	}
+	until := time.UnixMilli(best.Until)
+	return Presence{Online: n.clock.Now().Before(until), Addrs: best.Addrs, Until: until}, nil
+}
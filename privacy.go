@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+)
+
+// A private lookup keeps the nodes along the way from learning which key
+// we want. An ordinary one sends the key's hash to every node it asks,
+// and the key itself to the ones asked for the value. A private one
+// instead looks up privacyDecoys random IDs that share only a prefix with
+// the hash: one short enough that, by our estimate of the network size,
+// about k*2^privacyBlur nodes share it too. Only then are the nodes found
+// closest to the hash asked for the value, alpha at a time, along with
+// the closer ones they name, up to 2k of them, so the key goes only to
+// nodes in its neighbourhood, which would hold it anyway. This costs the
+// extra lookups.
+const (
+	privacyBlur   = 3
+	privacyDecoys = 4
+)
+
+// WithPrivateLookup makes Get find its key by a private lookup and skip
+// the cache.
+func WithPrivateLookup() GetOption {
+	return func(o *getOptions) { o.private = true }
+}
+
+// blurredTarget returns a random ID sharing the first bits bits of target.
+func (n *Node) blurredTarget(target string, bits int) string {
+	buf := make([]byte, IDBits/8)
+	io.ReadFull(n.random, buf)
+	offset := new(big.Int).SetBytes(buf)
+	offset.Rsh(offset, uint(bits))
+	t, _ := new(big.Int).SetString(target, 16)
+	return fmt.Sprintf("%032x", offset.Xor(offset, t))
+}
+
+func (n *Node) getPrivate(ctx context.Context, key string) (*lookupResult, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	n.mu.Lock()
+	r, ok := n.store.get(key)
+	size := n.networkSize()
+	n.mu.Unlock()
+	if ok {
+		return &lookupResult{value: r.value, found: true}, nil
+	}
+
+	target := n.dht.hashValue(key)
+	bits := max(int(math.Log2(float64(size)/float64(n.cfg.K)))-privacyBlur, 0)
+	seen := make(map[string]bool)
+	var near []*Peer
+	for i := 0; i < privacyDecoys && ctx.Err() == nil; i++ {
+		for _, p := range n.iterate(ctx, msgFindNode, "", n.blurredTarget(target, bits)).closest {
+			if !seen[p.id] {
+				seen[p.id] = true
+				near = append(near, p)
+			}
+		}
+	}
+
+	build := func(p *Peer) *message {
+		req := n.request(msgFindValue)
+		req.Key, req.Target = key, target
+		return req
+	}
+	found := func(resp *message) bool {
+		return resp.Found && n.validValue(key, resp.Value)
+	}
+	queried := make(map[string]bool)
+	for asked := 0; asked < 2*n.cfg.K && ctx.Err() == nil; {
+		n.dht.sortByDistance(near, target)
+		candidates := make([]*Peer, 0, n.cfg.Alpha)
+		for _, p := range near[:min(len(near), n.cfg.K)] {
+			if !queried[p.id] && len(candidates) < n.cfg.Alpha {
+				queried[p.id] = true
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		asked += len(candidates)
+		for _, r := range n.callFirst(ctx, candidates, build, found) {
+			if r.err != nil {
+				continue
+			}
+			if found(r.resp) {
+				result := &lookupResult{value: r.resp.Value, version: r.resp.Version, found: true, holder: r.peer}
+				if err := n.checkFound(key, result); err != nil {
+					return nil, err
+				}
+				return result, nil
+			}
+			for _, c := range r.resp.Nodes {
+				if c.ID != n.self.id && !seen[c.ID] {
+					seen[c.ID] = true
+					near = append(near, &Peer{id: c.ID, addr: n.pickAddr(c), addrs: c.Addrs})
+				}
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
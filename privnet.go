@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// On a private network every message carries a MAC: HMAC-SHA256, keyed
+// with the network's pre-shared secret, over the network ID and the
+// message's JSON encoding without its MAC, rpc_id, reply and stream
+// fields, which the transport underneath fills in. Requests without a
+// valid MAC are dropped unanswered, so to everyone else the node looks
+// like a closed port, and replies without one are treated as lost.
+// Members must share both the key and the network ID.
+
+var errUnauthenticated = errors.New("message not authenticated")
+
+// authTransport signs and checks every message going through the
+// transport it wraps.
+type authTransport struct {
+	Transport
+	key     []byte
+	network string
+}
+
+// networkKey reads the pre-shared secret from cfg.NetworkKeyFile.
+func networkKey(cfg Config) ([]byte, error) {
+	secret, err := os.ReadFile(cfg.NetworkKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimRight(string(secret), "\r\n"))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", cfg.NetworkKeyFile)
+	}
+	return secret, nil
+}
+
+func (t *authTransport) mac(m *message) []byte {
+	unsigned := *m
+	unsigned.MAC, unsigned.RPCID, unsigned.Reply = nil, 0, false
+	unsigned.StreamOK, unsigned.Stream = false, ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(t.network))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (t *authTransport) verify(m *message) bool {
+	sum := t.mac(m)
+	return sum != nil && hmac.Equal(m.MAC, sum)
+}
+
+func (t *authTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	req.MAC = t.mac(req)
+	resp, err := t.Transport.Call(ctx, addr, req)
+	if resp != nil && !t.verify(resp) {
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, errUnauthenticated)
+	}
+	return resp, err
+}
+
+func (t *authTransport) Serve(handler func(from string, req *message) *message) {
+	t.Transport.Serve(func(from string, req *message) *message {
+		if !t.verify(req) {
+			return nil
+		}
+		resp := handler(from, req)
+		if resp != nil {
+			resp.MAC = t.mac(resp)
+		}
+		return resp
+	})
+}
+
+func (t *authTransport) traffic() (sent, received int64) {
+	if c, ok := t.Transport.(trafficCounter); ok {
+		return c.traffic()
+	}
+	return 0, 0
+}
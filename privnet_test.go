@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestNetworkKey(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{NetworkKeyFile: filepath.Join(dir, "psk")}
+	os.WriteFile(cfg.NetworkKeyFile, []byte("secret\r\n"), 0o600)
+	if key, err := networkKey(cfg); err != nil || string(key) != "secret" {
+		t.Errorf("key %q, err %v, want %q", key, err, "secret")
+	}
+	os.WriteFile(cfg.NetworkKeyFile, []byte("\n"), 0o600)
+	if _, err := networkKey(cfg); err == nil {
+		t.Error("accepted an empty key file")
+	}
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	ctx := context.Background()
+	network := dhtsim.NewNetwork()
+	clock := dhtsim.NewClock(time.Unix(0, 0))
+	start := func(key, id string) *Node {
+		var transport Transport = newMemTransport(network)
+		if key != "" {
+			transport = &authTransport{Transport: transport, key: []byte(key), network: id}
+		}
+		return newNode(fuzzConfig(), transport, clock, rand.Reader, nil)
+	}
+	member := start("secret", "prod")
+	peer := start("secret", "prod")
+	knows := func(id string) bool {
+		return simNode{peer}.Knows(id)
+	}
+	if _, err := member.send(ctx, peer.Addr(), member.request(msgPing)); err != nil {
+		t.Fatalf("ping between members: %v", err)
+	}
+	if !knows(member.ID()) {
+		t.Error("member not added to the routing table")
+	}
+
+	for name, outsider := range map[string]*Node{
+		"wrong key":        start("guess", "prod"),
+		"wrong network ID": start("secret", "test"),
+		"no key":           start("", ""),
+	} {
+		// Their requests go unanswered and unnoticed.
+		if _, err := outsider.send(ctx, peer.Addr(), outsider.request(msgPing)); !errors.Is(err, ErrUnreachable) {
+			t.Errorf("%s: ping a member: %v, want %v", name, err, ErrUnreachable)
+		}
+		if knows(outsider.ID()) {
+			t.Errorf("%s: added to a member's routing table", name)
+		}
+		// Their answers count as lost.
+		if _, err := member.send(ctx, outsider.Addr(), member.request(msgPing)); !errors.Is(err, ErrUnreachable) {
+			t.Errorf("%s: ping from a member: %v, want %v", name, err, ErrUnreachable)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+)
+
+// A quorum read asks the replicas of a key for their copies until R of
+// them have answered, found or not, and returns the newest copy among
+// them, so one replica that missed the latest write cannot answer for the
+// rest. Newest means the highest version, the publisher's write time that
+// every copy of a plain value carries; namespaces whose validator chooses
+// between versions leave the choice to Select as Get does. Replicas that
+// answered with nothing or with an older copy are sent the newest one in
+// the background, so the replica set converges without waiting for the
+// publisher's next republish.
+
+var ErrNoQuorum = errors.New("too few replicas answered")
+
+// replicaCopy is one replica's answer to a quorum read.
+type replicaCopy struct {
+	peer    *Peer
+	value   []byte
+	version int64
+	found   bool
+}
+
+// quorumRead is the outcome of asking key's replicas.
+type quorumRead struct {
+	key     string
+	tokens  map[string]string
+	answers []replicaCopy // from the replicas that answered, in distance order
+	best    int           // index into answers of the copy returned, -1 if none
+}
+
+// GetQuorum returns the newest copy of key held by the first quorum of
+// its replicas to answer. A quorum of zero or less means a majority of
+// the namespace's replication factor.
+func (n *Node) GetQuorum(ctx context.Context, key string, quorum int) ([]byte, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	q, err := n.readQuorum(ctx, key, quorum)
+	if err != nil {
+		return nil, err
+	}
+	if stale := n.staleReplicas(q); len(stale) > 0 {
+		repairCtx, done := n.operation(context.Background())
+		go func() {
+			defer done()
+			n.repair(repairCtx, q, stale)
+		}()
+	}
+	return q.answers[q.best].value, nil
+}
+
+func (n *Node) readQuorum(ctx context.Context, key string, quorum int) (*quorumRead, error) {
+	n.mu.Lock()
+	replication := n.replication(key)
+	n.mu.Unlock()
+	if quorum <= 0 {
+		quorum = replication/2 + 1
+	}
+	quorum = min(quorum, replication)
+
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) < quorum {
+		return nil, ErrNoQuorum
+	}
+	var mu sync.Mutex
+	answered := 0
+	replies := n.callFirst(ctx, replicas, func(p *Peer) *message {
+		req := n.request(msgFindValue)
+		req.Key = key
+		return req
+	}, func(*message) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		answered++
+		return answered >= quorum
+	})
+
+	q := &quorumRead{key: key, tokens: result.tokens, best: -1}
+	for _, r := range replies {
+		if r.err != nil || r.resp == nil {
+			continue
+		}
+		q.tokens[r.peer.id] = r.resp.Token
+		a := replicaCopy{peer: r.peer}
+		if r.resp.Found && n.validValue(key, r.resp.Value) {
+			a.value, a.version, a.found = r.resp.Value, r.resp.Version, true
+		}
+		q.answers = append(q.answers, a)
+	}
+	if len(q.answers) < quorum {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoQuorum
+	}
+	q.best = n.newestCopy(key, q.answers)
+	if q.best < 0 {
+		return nil, ErrNotFound
+	}
+	return q, nil
+}
+
+// newestCopy returns the index of the newest of the copies found, the
+// closest replica's on a tie, or -1 if none was found.
+func (n *Node) newestCopy(key string, answers []replicaCopy) int {
+	v := n.cfg.validator(key)
+	if _, plain := v.(valueCheck); !plain {
+		index := make([]int, 0, len(answers))
+		values := make([][]byte, 0, len(answers))
+		for i, a := range answers {
+			if a.found {
+				index = append(index, i)
+				values = append(values, a.value)
+			}
+		}
+		if len(values) == 0 {
+			return -1
+		}
+		i := v.Select(key, values)
+		if i < 0 || i >= len(values) {
+			i = 0
+		}
+		return index[i]
+	}
+	best := -1
+	for i, a := range answers {
+		if a.found && (best < 0 || a.version > answers[best].version) {
+			best = i
+		}
+	}
+	return best
+}
+
+// staleReplicas returns the replicas whose answer to q lacked the copy it
+// returned or held one that copy supersedes.
+func (n *Node) staleReplicas(q *quorumRead) []*Peer {
+	best := q.answers[q.best]
+	v := n.cfg.validator(q.key)
+	_, plain := v.(valueCheck)
+	stale := make([]*Peer, 0)
+	for _, a := range q.answers {
+		switch {
+		case !a.found:
+		case plain && a.version < best.version:
+		case !plain && !bytes.Equal(a.value, best.value) && v.Select(q.key, [][]byte{a.value, best.value}) == 1:
+		default:
+			continue
+		}
+		stale = append(stale, a.peer)
+	}
+	return stale
+}
+
+// repair stores the copy q returned at the stale replicas. It runs after
+// the read has returned, in an operation of its own started before the
+// read returned, so that Close waits for it.
+func (n *Node) repair(ctx context.Context, q *quorumRead, stale []*Peer) {
+	best := q.answers[q.best]
+	repaired := 0
+	for _, r := range n.storeVersionAt(ctx, stale, q.tokens, q.key, best.value, best.version) {
+		if r.err == nil {
+			repaired++
+		}
+	}
+	n.log.Debug("read repair", "key", q.key, "stale", len(stale), "repaired", repaired)
+}
@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestQuorumReadRepairsReplicas(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 6)
+	sim.AddNodes(ctx, 30)
+	const key = "quorum"
+	if err := simNodes(sim)[0].Put(ctx, key, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	replicas := nearestNodes(sim, key, cfg.policy(key).Replication)
+	newest := replicas[len(replicas)-1]
+	newest.mu.Lock()
+	old, ok := newest.store.peek(key)
+	if !ok {
+		newest.mu.Unlock()
+		t.Fatal("replica lacks the record")
+	}
+	version := old.version + 1
+	newest.store.put(&record{key: key, value: []byte("new"), publisher: old.publisher, stored: sim.Clock().Now(), version: version})
+	newest.mu.Unlock()
+	missed := replicas[0]
+	missed.mu.Lock()
+	missed.store.delete(key)
+	missed.mu.Unlock()
+
+	reader := outside(sim, append(replicas, simNodes(sim)[0]))
+	value, err := reader.Get(ctx, key, WithReadConsistency(ConsistencyAll))
+	if err != nil || string(value) != "new" {
+		t.Fatalf("quorum read got %q, err %v, want the newest copy", value, err)
+	}
+
+	// The stale replicas are repaired in the background, done by the
+	// next step.
+	sim.Advance(ctx, dhtsim.Step)
+	stale := 0
+	for _, n := range replicas {
+		n.mu.Lock()
+		if r, ok := n.store.peek(key); !ok || r.version < version {
+			stale++
+		}
+		n.mu.Unlock()
+	}
+	if stale > 0 {
+		t.Errorf("%d replicas still stale after the read", stale)
+	}
+}
@@ -0,0 +1,90 @@
+package dht
+
+import "context"
+
+// With join_handoff, a node that joins near a key does not wait for the
+// next republish to get its copy. Peers new to our routing table are
+// queued, and on the next maintenance tick we store at them every record
+// we hold whose replica set, as we now see it, takes one of them in, so
+// Gets that end at the newcomer find the value right away. Only the
+// closest other replica of a key by our view and the key's publisher do
+// this, so a newcomer is not sent the same record by every copy. At most
+// maxPendingArrivals are queued between ticks.
+const maxPendingArrivals = 64
+
+// noteArrival queues a peer just added to the routing table. n.mu must be
+// held.
+func (n *Node) noteArrival(p *Peer) {
+	if n.cfg.JoinHandoff && len(n.arrivals) < maxPendingArrivals {
+		n.arrivals = append(n.arrivals, p)
+	}
+}
+
+// rebalanceArrivals stores at the queued arrivals the records they are now
+// replicas of.
+func (n *Node) rebalanceArrivals(ctx context.Context) {
+	n.mu.Lock()
+	arrived := make(map[string]*Peer, len(n.arrivals))
+	for _, p := range n.arrivals {
+		if n.dht.findPeer(p.id) != nil {
+			arrived[p.id] = p
+		}
+	}
+	n.arrivals = nil
+	moves := make(map[string][]*Peer)
+	if len(arrived) > 0 {
+		for _, key := range n.store.keys() {
+			if to := n.gainedReplicas(key, arrived); len(to) > 0 {
+				moves[key] = to
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	moved := 0
+	for key, to := range moves {
+		if ctx.Err() != nil {
+			break
+		}
+		line, ok := n.snapshotRecord(key)
+		if !ok {
+			continue
+		}
+		for _, r := range n.callAll(ctx, to, func(p *Peer) *message {
+			return n.storeRequest(p, n.writeToken(ctx, p, key), key, line.Value, line.Version)
+		}) {
+			if r.err == nil {
+				moved++
+			}
+		}
+	}
+	if len(moves) > 0 {
+		n.log.Info("moved records to joined peers", "joined", len(arrived), "stored", moved, "records", len(moves))
+	}
+}
+
+// gainedReplicas returns the arrivals that are now replicas of key, if it
+// is up to us to give them its record. n.mu must be held.
+func (n *Node) gainedReplicas(key string, arrived map[string]*Peer) []*Peer {
+	r, ok := n.store.peek(key)
+	if !ok || !r.expires.IsZero() {
+		return nil
+	}
+	target := n.dht.hashValue(key)
+	candidates := append(n.dht.closest(target, n.cfg.K), n.self)
+	n.dht.sortByDistance(candidates, target)
+	replicas := n.placeReplicas(key, candidates)
+	var gained []*Peer
+	first := ""
+	for _, p := range replicas[:min(n.replication(key), len(replicas))] {
+		if _, ok := arrived[p.id]; ok {
+			gained = append(gained, p)
+		} else if first == "" {
+			first = p.id
+		}
+	}
+	if first != n.self.id && r.publisher != n.self.id {
+		return nil
+	}
+	return gained
+}
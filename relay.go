@@ -0,0 +1,211 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Relays let nodes that cannot be called, such as those behind a
+// symmetric NAT, take part anyway. A node with relays configured registers
+// with each of them every relayRenew, which also keeps its NAT mapping
+// towards them open, and lists <relay multiaddr>/p2p-circuit among its own
+// addresses. Peers then call it at relay:<id>@<relay address>: the request
+// goes to the relay wrapped in a relay message, the relay passes it on to
+// the registered node at the address its registrations come from and
+// returns the reply the same way. A node only relays with relay = true,
+// and only for nodes registered in the last relayTTL.
+//
+// Registering takes two requests. The first is answered with a token
+// bound to the sender's address, and the second carries that token signed
+// with the sender's identity key, along with the node record the key is
+// taken from, so nobody can register a node ID that is not theirs. A live
+// registration is only renewed from the address it was made from; a node
+// whose address changes registers again once it has expired.
+//
+// A relayed request is marked as such, so the node it reaches does not
+// record the sender at the relay's address.
+const (
+	relayPrefix  = "relay:"
+	relayCircuit = "/p2p-circuit"
+	relayRenew   = 30 * time.Second
+	relayTTL     = 2 * time.Minute
+	maxRelayed   = 256
+)
+
+var (
+	errNotRelay   = errors.New("not relaying")
+	errRelayFull  = errors.New("relaying for too many nodes")
+	errNotRelayed = errors.New("not registered for relaying")
+	errRelayProof = errors.New("relay registration not signed by its node")
+	errRelayTaken = errors.New("registered for relaying from another address")
+)
+
+// relayed is a node registered with us for relaying.
+type relayed struct {
+	addr    string
+	expires time.Time
+}
+
+// relayAddr is the address to call id at through the relay at m.
+func relayAddr(id string, m multiaddr) string {
+	return relayPrefix + id + "@" + m.dialAddr()
+}
+
+// circuitAddrs returns our relay addresses, for the relays configured.
+func circuitAddrs(relays []string) []string {
+	addrs := make([]string, 0, len(relays))
+	for _, addr := range relays {
+		if m, err := toMultiaddr(addr); err == nil {
+			m.circuit = true
+			addrs = append(addrs, m.String())
+		}
+	}
+	return addrs
+}
+
+// circuitAddr returns the address to call c at through one of its relays,
+// "" if it lists none we can reach or we are its relay ourselves.
+func (n *Node) circuitAddr(c contact) string {
+	n.mu.Lock()
+	_, ours := n.relayed[c.ID]
+	n.mu.Unlock()
+	if ours {
+		return ""
+	}
+	for _, s := range c.Addrs {
+		if m, err := parseMultiaddr(s); err == nil && m.circuit && n.canReach(m) {
+			return relayAddr(c.ID, m)
+		}
+	}
+	return ""
+}
+
+// callRelayed sends req to the node addr names, through its relay.
+func (n *Node) callRelayed(ctx context.Context, addr string, req *message) (*message, error) {
+	id, via, ok := strings.Cut(strings.TrimPrefix(addr, relayPrefix), "@")
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	inner, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	outer := n.request(msgRelay)
+	outer.Target, outer.Value = id, inner
+	resp, err := n.transport.Call(ctx, via, outer)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := decodeMessage(resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyError(reply)
+}
+
+// registerRelays registers us with every configured relay.
+func (n *Node) registerRelays(ctx context.Context) {
+	n.mu.Lock()
+	n.lastRelay = n.clock.Now()
+	n.mu.Unlock()
+	for _, addr := range n.cfg.Relays {
+		resp, err := n.send(ctx, addr, n.request(msgRelayRegister))
+		if err == nil {
+			req := n.request(msgRelayRegister)
+			req.Token, req.Value = resp.Token, ed25519.Sign(n.key, relayProof(resp.Token))
+			_, err = n.send(ctx, addr, req)
+		}
+		if err != nil {
+			n.log.Warn("relay registration failed", "relay", addr, "err", err)
+		}
+	}
+}
+
+// relayProof is what a node signs to register with a relay.
+func relayProof(token string) []byte {
+	return []byte("relay-register:" + token)
+}
+
+// handleRelayRegister registers the sender of req, at from, for relaying.
+func (n *Node) handleRelayRegister(from string, req, resp *message) {
+	if !n.cfg.Relay {
+		resp.Error = errNotRelay.Error()
+		return
+	}
+	if req.Token == "" {
+		resp.Token = n.issueToken(from)
+		return
+	}
+	record := n.contactRecord(req.From.ID, req.From.ENR)
+	if record == nil || !n.validToken(from, req.Token) || !ed25519.Verify(record.publicKey(), relayProof(req.Token), req.Value) {
+		resp.Error = errRelayProof.Error()
+		return
+	}
+	now := n.clock.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.relayed == nil {
+		n.relayed = make(map[string]relayed)
+	}
+	old, ok := n.relayed[req.From.ID]
+	if ok && old.addr != from && now.Before(old.expires) {
+		resp.Error = errRelayTaken.Error()
+		return
+	}
+	if !ok && len(n.relayed) >= maxRelayed {
+		for id, r := range n.relayed {
+			if !now.Before(r.expires) {
+				delete(n.relayed, id)
+			}
+		}
+		if len(n.relayed) >= maxRelayed {
+			resp.Error = errRelayFull.Error()
+			return
+		}
+	}
+	n.relayed[req.From.ID] = relayed{addr: from, expires: now.Add(relayTTL)}
+}
+
+// handleRelay passes the request wrapped in req on to the node it is for
+// and wraps its reply in resp.
+func (n *Node) handleRelay(req, resp *message) {
+	now := n.clock.Now()
+	n.mu.Lock()
+	r, ok := n.relayed[req.Target]
+	if ok && !now.Before(r.expires) {
+		delete(n.relayed, req.Target)
+		ok = false
+	}
+	n.mu.Unlock()
+	if !n.cfg.Relay || !ok {
+		resp.Error = errNotRelayed.Error()
+		return
+	}
+	inner, err := decodeMessage(req.Value)
+	if err != nil || inner.Type == msgRelay || inner.From.ID != req.From.ID {
+		resp.Error = "bad relayed message"
+		return
+	}
+	inner.Relayed, inner.RPCID, inner.Reply = true, 0, false
+	ctx := context.Background()
+	if n.cfg.Timeouts.RPC > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeouts.RPC)
+		defer cancel()
+	}
+	reply, err := n.transport.Call(ctx, r.addr, inner)
+	if reply == nil {
+		if err == nil {
+			err = ErrUnreachable
+		}
+		resp.Error = err.Error()
+		return
+	}
+	if resp.Value, err = json.Marshal(reply); err != nil {
+		resp.Error = err.Error()
+	}
+}
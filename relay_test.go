@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestRelayRegistration(t *testing.T) {
+	ctx := context.Background()
+	network := dhtsim.NewNetwork()
+	clock := dhtsim.NewClock(time.Unix(0, 0))
+	start := func(cfg Config, key ed25519.PrivateKey) *Node {
+		return newNode(cfg, newMemTransport(network), clock, rand.Reader, key)
+	}
+	relayCfg := fuzzConfig()
+	relayCfg.Relay = true
+	relay := start(relayCfg, nil)
+	cfg := fuzzConfig()
+	cfg.Relays = []string{relay.Addr()}
+	client := start(cfg, nil)
+	registeredAt := func() string {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.relayed[client.ID()].addr
+	}
+
+	client.registerRelays(ctx)
+	if addr := registeredAt(); addr != client.Addr() {
+		t.Fatalf("client registered at %q, want %q", addr, client.Addr())
+	}
+
+	// Requests reach the client through the relay.
+	caller := start(fuzzConfig(), nil)
+	reply, err := caller.callRelayed(ctx, relayPrefix+client.ID()+"@"+relay.Addr(), caller.request(msgPing))
+	if err != nil || reply.From.ID != client.ID() {
+		t.Fatalf("relayed ping: %v, err %v", reply, err)
+	}
+
+	// Nobody else can register the client's ID, not with its node record
+	// and a token of their own, nor with a proof made for its address.
+	attacker := start(fuzzConfig(), nil)
+	for _, proof := range []struct {
+		name  string
+		token string
+		key   ed25519.PrivateKey
+	}{
+		{"own token", relay.issueToken(attacker.Addr()), attacker.key},
+		{"client's proof", relay.issueToken(client.Addr()), client.key},
+	} {
+		req := client.request(msgRelayRegister)
+		req.Token, req.Value = proof.token, ed25519.Sign(proof.key, relayProof(proof.token))
+		resp := &message{}
+		relay.handleRelayRegister(attacker.Addr(), req, resp)
+		if resp.Error != errRelayProof.Error() {
+			t.Errorf("%s: registration answered %q, want %q", proof.name, resp.Error, errRelayProof)
+		}
+	}
+	if addr := registeredAt(); addr != client.Addr() {
+		t.Fatalf("client's registration moved to %q", addr)
+	}
+
+	// A live registration stays where it was made, even when the node
+	// itself registers from elsewhere, until it expires.
+	moved := start(cfg, client.key)
+	moved.registerRelays(ctx)
+	if addr := registeredAt(); addr != client.Addr() {
+		t.Errorf("live registration moved to %q", addr)
+	}
+	clock.Advance(relayTTL)
+	moved.registerRelays(ctx)
+	if addr := registeredAt(); addr != moved.Addr() {
+		t.Errorf("expired registration not replaced: at %q, want %q", addr, moved.Addr())
+	}
+}
@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// Reload applies the settings of cfg that can change while the node runs:
+// log_level, bootstrap, and the limits on request rates, peer bandwidth
+// and what the store holds. Records already stored over a lowered quota
+// stay until they expire. Every other setting needs a restart; a cfg that
+// changes one is still applied, with a warning.
+func (n *Node) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	level, err := cfg.logLevel()
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	rest := cfg
+	rest.LogLevel, rest.Bootstrap = n.cfg.LogLevel, n.cfg.Bootstrap
+	rest.Limits.PeerRate, rest.Limits.PeerBurst, rest.Limits.PeerBandwidth = n.cfg.Limits.PeerRate, n.cfg.Limits.PeerBurst, n.cfg.Limits.PeerBandwidth
+	rest.Limits.IPRate, rest.Limits.IPBurst, rest.Limits.SubnetRate, rest.Limits.SubnetBurst = n.cfg.Limits.IPRate, n.cfg.Limits.IPBurst, n.cfg.Limits.SubnetRate, n.cfg.Limits.SubnetBurst
+	rest.Limits.MaxRecords, rest.Limits.MaxBytesPerPeer, rest.Limits.MaxBytes = n.cfg.Limits.MaxRecords, n.cfg.Limits.MaxBytesPerPeer, n.cfg.Limits.MaxBytes
+	restart := !reflect.DeepEqual(rest, n.cfg)
+
+	n.cfg.LogLevel, n.cfg.Bootstrap = cfg.LogLevel, cfg.Bootstrap
+	n.cfg.Limits.PeerRate, n.cfg.Limits.PeerBurst, n.cfg.Limits.PeerBandwidth = cfg.Limits.PeerRate, cfg.Limits.PeerBurst, cfg.Limits.PeerBandwidth
+	n.cfg.Limits.IPRate, n.cfg.Limits.IPBurst, n.cfg.Limits.SubnetRate, n.cfg.Limits.SubnetBurst = cfg.Limits.IPRate, cfg.Limits.IPBurst, cfg.Limits.SubnetRate, cfg.Limits.SubnetBurst
+	n.cfg.Limits.MaxRecords, n.cfg.Limits.MaxBytesPerPeer, n.cfg.Limits.MaxBytes = cfg.Limits.MaxRecords, cfg.Limits.MaxBytesPerPeer, cfg.Limits.MaxBytes
+	n.mu.Unlock()
+
+	n.level.Set(level)
+	n.limiter.set(cfg.Limits.PeerRate, cfg.Limits.PeerBurst)
+	n.ips.set(cfg.Limits.IPRate, cfg.Limits.IPBurst)
+	n.subnets.set(cfg.Limits.SubnetRate, cfg.Limits.SubnetBurst)
+	if restart {
+		n.log.Warn("some changed settings take effect only after a restart")
+	}
+	n.log.Info("configuration reloaded")
+	return nil
+}
+
+// SetConfigFile names the file the node was started from, which a POST
+// to its admin /reload rereads.
+func (n *Node) SetConfigFile(path string) {
+	n.mu.Lock()
+	n.reload = func() error { return n.reloadConfig(path) }
+	n.mu.Unlock()
+}
+
+// reloadConfig rereads the config file at path into the node.
+func (n *Node) reloadConfig(path string) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return n.Reload(cfg)
+}
+
+func (n *Node) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	n.mu.Lock()
+	reload := n.reload
+	n.mu.Unlock()
+	if reload == nil {
+		http.Error(w, "no config file to reload", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := reload(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,89 @@
+package dht
+
+import "context"
+
+// With failure_repair, records do not stay a copy short from the moment
+// the failure detector drops a peer until the next republish. Peers it
+// drops are queued, and on the next maintenance tick we store every
+// record we hold whose replica set, as we see it, had one of them in it
+// at the key's replicas looked up afresh, which take in the next-closest
+// live node in its place. Only the closest live replica of a key by our
+// view and the key's publisher do this, so one death does not set off a
+// store from every surviving copy, and a peer that answered again in the
+// meantime is left alone. At most maxPendingDeaths are queued between
+// ticks.
+const maxPendingDeaths = 64
+
+// noteDeath queues a peer the failure detector dropped. n.mu must be held.
+func (n *Node) noteDeath(p *Peer) {
+	if n.cfg.FailureRepair && len(n.deaths) < maxPendingDeaths {
+		n.deaths = append(n.deaths, p)
+	}
+}
+
+// repairDeaths re-replicates the records the queued deaths left short.
+func (n *Node) repairDeaths(ctx context.Context) {
+	n.mu.Lock()
+	dead := make(map[string]*Peer, len(n.deaths))
+	for _, p := range n.deaths {
+		if n.dht.findPeer(p.id) == nil {
+			dead[p.id] = p
+		}
+	}
+	n.deaths = nil
+	var keys []string
+	if len(dead) > 0 {
+		for _, key := range n.store.keys() {
+			if n.lostReplica(key, dead) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	repaired := 0
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		line, ok := n.snapshotRecord(key)
+		if !ok {
+			continue
+		}
+		result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+		replicas := n.replicasFor(key, result.closest)
+		for _, r := range n.storeVersionAt(ctx, replicas, result.tokens, key, line.Value, line.Version) {
+			if r.err == nil {
+				repaired++
+				break
+			}
+		}
+	}
+	if len(keys) > 0 {
+		n.log.Info("re-replicated records of dead peers", "dead", len(dead), "records", repaired, "affected", len(keys))
+	}
+}
+
+// lostReplica reports whether one of dead was a replica of key and it is
+// up to us to replace it. n.mu must be held.
+func (n *Node) lostReplica(key string, dead map[string]*Peer) bool {
+	r, ok := n.store.peek(key)
+	if !ok || !r.expires.IsZero() {
+		return false
+	}
+	target := n.dht.hashValue(key)
+	candidates := append(n.dht.closest(target, n.cfg.K), n.self)
+	for _, p := range dead {
+		candidates = append(candidates, p)
+	}
+	n.dht.sortByDistance(candidates, target)
+	lost, first := false, ""
+	for _, p := range n.placeReplicas(key, candidates[:min(len(candidates), n.cfg.K)]) {
+		if _, gone := dead[p.id]; gone {
+			lost = true
+		} else if first == "" {
+			first = p.id
+		}
+	}
+	return lost && (first == n.self.id || r.publisher == n.self.id)
+}
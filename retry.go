@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// RetryPolicy says how often an RPC is attempted before giving up and how
+// long to wait in between. The wait doubles after every failed attempt up
+// to MaxBackoff and is then spread by up to Jitter of itself either way.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+type retryKey struct{}
+
+// withRetry overrides the node's retry policy for the RPCs made with ctx.
+func withRetry(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, policy)
+}
+
+func (n *Node) retryPolicy(ctx context.Context) RetryPolicy {
+	if policy, ok := ctx.Value(retryKey{}).(RetryPolicy); ok {
+		return policy
+	}
+	return n.cfg.Retry
+}
+
+// retryable reports whether err may go away by itself. An error from the
+// peer is an answer and a closed transport never comes back.
+func retryable(err error) bool {
+	var remote *remoteError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &remote), errors.Is(err, ErrClosed):
+		return false
+	case errors.Is(err, ErrUnreachable), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// sendRetrying makes one RPC under the retry policy in effect for ctx. Each
+// attempt gets the configured RPC timeout, so a silent peer costs one
+// timeout per attempt rather than the caller's whole deadline.
+func (n *Node) sendRetrying(ctx context.Context, addr string, req *message) (*message, error) {
+	policy := n.retryPolicy(ctx)
+	for attempt := 1; ; attempt++ {
+		resp, err := n.attempt(ctx, addr, req)
+		if err == nil {
+			if err := decompressValue(resp, n.cfg.Limits.MaxValueSize); err != nil {
+				return nil, &remoteError{msg: err.Error()}
+			}
+		}
+		if err == nil || attempt >= policy.Attempts || !retryable(err) || ctx.Err() != nil {
+			return resp, err
+		}
+		timer := time.NewTimer(n.backoff(policy, attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (n *Node) attempt(ctx context.Context, addr string, req *message) (*message, error) {
+	call, timeout := n.transport.Call, n.cfg.Timeouts.RPC
+	if strings.HasPrefix(addr, relayPrefix) {
+		// Two hops, the relay's own call to the node included.
+		call, timeout = n.callRelayed, 2*timeout
+	}
+	if req.Type == msgOnion {
+		// Every relay's call to the next, and the last one's query.
+		timeout *= maxOnionHops + 1
+	}
+	if timeout <= 0 {
+		return call(ctx, addr, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return call(ctx, addr, req)
+}
+
+func (n *Node) backoff(policy RetryPolicy, attempt int) time.Duration {
+	wait := policy.Backoff
+	for i := 1; i < attempt && wait < policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min64(wait, policy.MaxBackoff)
+	if policy.Jitter > 0 {
+		spread := (float64(n.randomIndex(1<<20))/(1<<20)*2 - 1) * policy.Jitter
+		wait += time.Duration(float64(wait) * spread)
+	}
+	return wait
+}
@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Applications can add message types of their own without touching the
+// dispatch in handle. A request of a registered type goes through the same
+// checks as any other, bans, rate limits, the handshake and the routing
+// table update, and then its value is given to the handler, whose result
+// is the value of the reply. An error becomes the reply's error, which
+// the caller gets back as a remote error. Nodes that do not know the type
+// answer "unknown message type".
+
+// rpcHandler answers an application-defined request from the peer with
+// the given ID.
+type rpcHandler func(ctx context.Context, from string, payload []byte) ([]byte, error)
+
+var errReservedType = errors.New("message type is reserved")
+
+func builtinType(typ string) bool {
+	switch typ {
+	case msgPing, msgFindNode, msgFindValue, msgStore, msgPex, msgSync, msgGossip, msgRelay, msgRelayRegister, msgOnion:
+		return true
+	}
+	return false
+}
+
+// Handle registers h for requests of type typ, replacing any handler
+// registered before. The built-in types cannot be taken over.
+func (n *Node) Handle(typ string, h rpcHandler) error {
+	if typ == "" || builtinType(typ) {
+		return fmt.Errorf("%w: %q", errReservedType, typ)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rpcHandlers == nil {
+		n.rpcHandlers = make(map[string]rpcHandler)
+	}
+	n.rpcHandlers[typ] = h
+	return nil
+}
+
+// Call sends a request of an application-defined type to the node with
+// the given ID, finding it first if it is not in the routing table, and
+// returns the value of its reply.
+func (n *Node) Call(ctx context.Context, id, typ string, payload []byte) ([]byte, error) {
+	if builtinType(typ) {
+		return nil, fmt.Errorf("%w: %q", errReservedType, typ)
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	p := n.FindPeer(ctx, id)
+	if p == nil {
+		return nil, ErrNoPeers
+	}
+	req := n.request(typ)
+	compressValue(req, payload, n.compressionFor(p))
+	resp, err := n.call(ctx, p, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := decompressValue(resp, n.cfg.Limits.MaxValueSize); err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// handleCustom answers req with the handler registered for its type.
+func (n *Node) handleCustom(req, resp *message) {
+	n.mu.Lock()
+	h := n.rpcHandlers[req.Type]
+	n.mu.Unlock()
+	if h == nil {
+		resp.Error = "unknown message type " + req.Type
+		return
+	}
+	// The caller stops waiting after its RPC timeout, so there is no point
+	// in the handler going on much longer.
+	ctx := context.Background()
+	if n.cfg.Timeouts.RPC > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeouts.RPC)
+		defer cancel()
+	}
+	out, err := h(ctx, req.From.ID, req.Value)
+	if err != nil {
+		resp.Error = err.Error()
+		return
+	}
+	threshold := 0
+	if accepts(req, codecDeflate) {
+		threshold = n.cfg.CompressThreshold
+	}
+	compressValue(resp, out, threshold)
+}
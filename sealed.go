@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sealed values are encrypted to the X25519 box keys of their recipients,
+// so the nodes storing them cannot read them. Every node derives its box
+// key from its identity; BoxKey returns the public half to hand out.
+//
+// A sealed value is sealedVersion, a fresh X25519 public key, the number
+// of recipients and, for each, the value's content key sealed with AES-GCM
+// under a key agreed between the fresh key and the recipient's, followed
+// by the value sealed under the content key. The slots carry no names: a
+// recipient tries each until one opens, so the value does not tell
+// storing nodes who it is for either.
+const (
+	sealedVersion  = 1
+	maxRecipients  = 32
+	sealedKeyLabel = "sealed box"
+	sealedSlot     = 12 + 32 + 16 // nonce, content key, tag
+)
+
+var (
+	ErrNotRecipient = errors.New("sealed value is not for us")
+	errBadSealed    = errors.New("malformed sealed value")
+)
+
+// boxKey derives the node's X25519 box key from its identity.
+func boxKey(key ed25519.PrivateKey) *ecdh.PrivateKey {
+	seed := sha256.Sum256(append([]byte(sealedKeyLabel), key.Seed()...))
+	k, err := ecdh.X25519().NewPrivateKey(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// BoxKey returns the public key values can be sealed to for this node.
+func (n *Node) BoxKey() []byte {
+	return boxKey(n.key).PublicKey().Bytes()
+}
+
+// slotCipher is the cipher a recipient's slot is sealed with.
+func slotCipher(secret, eph, recipient []byte) cipher.AEAD {
+	sum := sha256.Sum256(append(append(append([]byte(sealedKeyLabel), secret...), eph...), recipient...))
+	block, _ := aes.NewCipher(sum[:])
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+// sealValue encrypts value to every recipient's box key.
+func sealValue(random io.Reader, value []byte, recipients [][]byte) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("sealed values need 1 to %d recipients", maxRecipients)
+	}
+	eph, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := make([]byte, 32)
+	if _, err := io.ReadFull(random, contentKey); err != nil {
+		return nil, err
+	}
+	out := append([]byte{sealedVersion}, eph.PublicKey().Bytes()...)
+	out = append(out, byte(len(recipients)))
+	for _, r := range recipients {
+		pub, err := ecdh.X25519().NewPublicKey(r)
+		if err != nil {
+			return nil, fmt.Errorf("recipient key: %w", err)
+		}
+		secret, err := eph.ECDH(pub)
+		if err != nil {
+			return nil, fmt.Errorf("recipient key: %w", err)
+		}
+		out = append(out, seal(slotCipher(secret, eph.PublicKey().Bytes(), r), random, contentKey)...)
+	}
+	block, _ := aes.NewCipher(contentKey)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	io.ReadFull(random, nonce)
+	// The header is authenticated, so slots cannot be swapped or dropped.
+	return gcm.Seal(append(out, nonce...), nonce, value, out), nil
+}
+
+// openValue decrypts a sealed value with the box key priv.
+func openValue(priv *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 34 || data[0] != sealedVersion {
+		return nil, errBadSealed
+	}
+	count := int(data[33])
+	header := 34 + count*sealedSlot
+	if count == 0 || len(data) < header+12 {
+		return nil, errBadSealed
+	}
+	ephBytes := data[1:33]
+	eph, err := ecdh.X25519().NewPublicKey(ephBytes)
+	if err != nil {
+		return nil, errBadSealed
+	}
+	secret, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, errBadSealed
+	}
+	slots := slotCipher(secret, ephBytes, priv.PublicKey().Bytes())
+	for i := 0; i < count; i++ {
+		contentKey, err := unseal(slots, data[34+i*sealedSlot:34+(i+1)*sealedSlot])
+		if err != nil {
+			continue
+		}
+		block, _ := aes.NewCipher(contentKey)
+		gcm, _ := cipher.NewGCM(block)
+		nonce := data[header : header+gcm.NonceSize()]
+		value, err := gcm.Open(nil, nonce, data[header+gcm.NonceSize():], data[:header])
+		if err != nil {
+			return nil, errBadSealed
+		}
+		return value, nil
+	}
+	return nil, ErrNotRecipient
+}
+
+// PutSealed stores value under key encrypted to the recipients' box keys.
+// Include our own BoxKey among them to be able to read it back.
+func (n *Node) PutSealed(ctx context.Context, key string, value []byte, recipients [][]byte, opts ...PutOption) error {
+	sealed, err := sealValue(n.random, value, recipients)
+	if err != nil {
+		return err
+	}
+	return n.Put(ctx, key, sealed, opts...)
+}
+
+// GetSealed fetches the sealed value stored under key and opens it with
+// our box key.
+func (n *Node) GetSealed(ctx context.Context, key string, opts ...GetOption) ([]byte, error) {
+	sealed, err := n.Get(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return openValue(boxKey(n.key), sealed)
+}
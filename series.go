@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Series are time-stamped samples published under a name, such as a
+// metric or a status history. They are kept by convention over ordinary
+// records: the samples of a series that fall in one series_bucket of time
+// share a bucket record in the series namespace, under the hash of the
+// series name and the bucket's start, so every node on the network must
+// use the same series_bucket. Writers send replicas just their new
+// sample, which the replicas merge into what they have, keeping the
+// newest maxSeriesSamples. Buckets are not republished and expire with
+// the namespace TTL after their last write, which makes it the series'
+// retention. ReadSeries fetches every bucket a window touches from all of
+// its replicas, a few buckets at a time.
+const (
+	seriesNamespace  = "series"
+	maxSeriesSamples = 1024
+	maxSeriesBuckets = 256
+	seriesParallel   = 8
+)
+
+var ErrSeriesWindow = errors.New("series window spans too many buckets")
+
+// Sample is one published value of a series.
+type Sample struct {
+	Time      time.Time
+	Publisher string // node ID
+	Value     []byte
+}
+
+// seriesSample is a sample as stored in a bucket record.
+type seriesSample struct {
+	Time      int64  `json:"t"` // unix nanoseconds
+	Publisher string `json:"p"`
+	Value     []byte `json:"v"`
+}
+
+// seriesKey is the key of the bucket of series starting at start.
+func (n *Node) seriesKey(series string, start time.Time) string {
+	return "/" + seriesNamespace + "/" + n.dht.hashValue(series+"@"+strconv.FormatInt(start.Unix(), 10))
+}
+
+// mergeSeries folds incoming samples into a stored bucket, dropping
+// duplicates and then all but the newest maxSeriesSamples.
+func mergeSeries(stored, incoming []byte) ([]byte, error) {
+	var fresh []seriesSample
+	if err := json.Unmarshal(incoming, &fresh); err != nil {
+		return nil, err
+	}
+	var samples []seriesSample
+	if stored != nil {
+		json.Unmarshal(stored, &samples)
+	}
+	type id struct {
+		publisher string
+		at        int64
+	}
+	seen := make(map[id]bool, len(samples)+len(fresh))
+	merged := make([]seriesSample, 0, len(samples)+len(fresh))
+	for _, s := range append(samples, fresh...) {
+		if k := (id{s.Publisher, s.Time}); !seen[k] {
+			seen[k] = true
+			merged = append(merged, s)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Time != merged[j].Time {
+			return merged[i].Time < merged[j].Time
+		}
+		return merged[i].Publisher < merged[j].Publisher
+	})
+	return json.Marshal(merged[max(len(merged)-maxSeriesSamples, 0):])
+}
+
+// PutSample publishes value as the sample of series at time at.
+func (n *Node) PutSample(ctx context.Context, series string, at time.Time, value []byte) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	sample := mustJSON([]seriesSample{{Time: at.UnixNano(), Publisher: n.self.id, Value: value}})
+	key := n.seriesKey(series, at.Truncate(n.cfg.SeriesBucket))
+	if err := n.cfg.checkValue(key, sample); err != nil {
+		return err
+	}
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return ErrNoPeers
+	}
+	for _, r := range n.storeAt(ctx, replicas, result.tokens, key, sample) {
+		if r.err == nil {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrNoPeers
+}
+
+// ReadSeries returns the samples of series from from up to, not
+// including, to, oldest first.
+func (n *Node) ReadSeries(ctx context.Context, series string, from, to time.Time) ([]Sample, error) {
+	start := from.Truncate(n.cfg.SeriesBucket)
+	if !to.After(from) {
+		return nil, nil
+	}
+	if to.Sub(start) > maxSeriesBuckets*n.cfg.SeriesBucket {
+		return nil, ErrSeriesWindow
+	}
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	samples := make([]Sample, 0)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, seriesParallel)
+	for at := start; at.Before(to); at = at.Add(n.cfg.SeriesBucket) {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			_, _, copies, _ := n.replicaCopies(ctx, key)
+			var bucket []byte
+			for _, c := range copies {
+				if merged, err := mergeSeries(bucket, c); err == nil {
+					bucket = merged
+				}
+			}
+			var stored []seriesSample
+			json.Unmarshal(bucket, &stored)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, s := range stored {
+				at := time.Unix(0, s.Time)
+				if !at.Before(from) && at.Before(to) {
+					samples = append(samples, Sample{Time: at, Publisher: s.Publisher, Value: s.Value})
+				}
+			}
+		}(n.seriesKey(series, at))
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if !samples[i].Time.Equal(samples[j].Time) {
+			return samples[i].Time.Before(samples[j].Time)
+		}
+		return samples[i].Publisher < samples[j].Publisher
+	})
+	return samples, nil
+}
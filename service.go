@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Service discovery keeps one record per service name in the service
+// namespace, mapping each endpoint to when it registered and how long it
+// stays healthy without being registered again. Replicas merge the entries
+// they are sent, the later registration of an endpoint winning, and drop
+// the ones whose health TTL ran out. A node renews its own registrations
+// once half their TTL has gone by, so an endpoint disappears a TTL after
+// its node does.
+const serviceNamespace = "service"
+
+var ErrBadEndpoint = errors.New("endpoint must not be empty")
+
+type serviceEntry struct {
+	At    int64 `json:"at"`    // unix milliseconds of the registration
+	Until int64 `json:"until"` // unix milliseconds when it stops being healthy
+}
+
+type registration struct {
+	name     string
+	endpoint string
+	ttl      time.Duration
+	renewed  time.Time
+}
+
+func serviceKey(name string) string {
+	return "/" + serviceNamespace + "/" + name
+}
+
+// mergeServices folds incoming entries into stored ones and drops those
+// that are no longer healthy at now.
+func mergeServices(stored, incoming []byte, now time.Time) ([]byte, error) {
+	entries := make(map[string]serviceEntry)
+	if stored != nil {
+		json.Unmarshal(stored, &entries)
+	}
+	var fresh map[string]serviceEntry
+	if err := json.Unmarshal(incoming, &fresh); err != nil {
+		return nil, err
+	}
+	for endpoint, e := range fresh {
+		if e.At >= entries[endpoint].At {
+			entries[endpoint] = e
+		}
+	}
+	for endpoint, e := range entries {
+		if e.Until <= now.UnixMilli() {
+			delete(entries, endpoint)
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// RegisterService announces endpoint under name, healthy for ttl. The node
+// keeps renewing it until DeregisterService or until it stops.
+func (n *Node) RegisterService(ctx context.Context, name, endpoint string, ttl time.Duration) error {
+	if endpoint == "" {
+		return ErrBadEndpoint
+	}
+	if ttl < time.Second {
+		return errors.New("service ttl must be at least 1s")
+	}
+	now := n.clock.Now()
+	n.mu.Lock()
+	if n.services == nil {
+		n.services = make(map[string]*registration)
+	}
+	n.services[serviceKey(name)+" "+endpoint] = &registration{name: name, endpoint: endpoint, ttl: ttl, renewed: now}
+	n.mu.Unlock()
+	return n.announceService(ctx, name, endpoint, now, now.Add(ttl))
+}
+
+// DeregisterService withdraws endpoint from name straight away.
+func (n *Node) DeregisterService(ctx context.Context, name, endpoint string) error {
+	n.mu.Lock()
+	delete(n.services, serviceKey(name)+" "+endpoint)
+	n.mu.Unlock()
+	now := n.clock.Now()
+	return n.announceService(ctx, name, endpoint, now, now)
+}
+
+func (n *Node) announceService(ctx context.Context, name, endpoint string, at, until time.Time) error {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	key := serviceKey(name)
+	value := mustJSON(map[string]serviceEntry{endpoint: {At: at.UnixMilli(), Until: until.UnixMilli()}})
+	result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+	replicas := n.replicasFor(key, result.closest)
+	if len(replicas) == 0 {
+		return ErrNoPeers
+	}
+	n.storeAt(ctx, replicas, result.tokens, key, value)
+	return ctx.Err()
+}
+
+// renewServices re-registers every endpoint of ours that is past half its
+// TTL.
+func (n *Node) renewServices(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	due := make([]*registration, 0)
+	for _, r := range n.services {
+		if now.Sub(r.renewed) >= r.ttl/2 {
+			r.renewed = now
+			due = append(due, r)
+		}
+	}
+	n.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].name != due[j].name {
+			return due[i].name < due[j].name
+		}
+		return due[i].endpoint < due[j].endpoint
+	})
+	for _, r := range due {
+		if err := n.announceService(ctx, r.name, r.endpoint, now, now.Add(r.ttl)); err != nil {
+			n.log.Warn("renewing service failed", "service", r.name, "endpoint", r.endpoint, "err", err)
+		}
+	}
+}
+
+// ResolveService returns the healthy endpoints of name in order. It asks
+// every replica rather than trusting the first answer, since each may have
+// missed some registrations.
+func (n *Node) ResolveService(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := n.operation(ctx)
+	defer cancel()
+	_, _, copies, answered := n.replicaCopies(ctx, serviceKey(name))
+	now := n.clock.Now()
+	merged := []byte("{}")
+	for _, value := range copies {
+		if m, err := mergeServices(merged, value, now); err == nil {
+			merged = m
+		}
+	}
+	if answered == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoPeers
+	}
+	var entries map[string]serviceEntry
+	json.Unmarshal(merged, &entries)
+	endpoints := make([]string, 0, len(entries))
+	for endpoint := range entries {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// WatchService resolves name every interval and sends the endpoints each
+// time they change, starting with the first successful resolution. The
+// channel is closed once ctx is done.
+func (n *Node) WatchService(ctx context.Context, name string, interval time.Duration) <-chan []string {
+	changes := make(chan []string, 1)
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last []string
+		first := true
+		for {
+			if endpoints, err := n.ResolveService(ctx, name); err == nil && (first || !equalStrings(endpoints, last)) {
+				select {
+				case changes <- endpoints:
+				case <-ctx.Done():
+					return
+				}
+				last, first = endpoints, false
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeServices(t *testing.T) {
+	now := time.Unix(1e6, 0)
+	ms := now.UnixMilli()
+	stored := mustJSON(map[string]serviceEntry{"a:1": {At: ms - 10, Until: ms + 1000}, "b:1": {At: ms - 5000, Until: ms - 1}})
+	incoming := mustJSON(map[string]serviceEntry{"a:1": {At: ms - 20, Until: ms - 10}, "c:1": {At: ms, Until: ms + 1000}})
+	merged, err := mergeServices(stored, incoming, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(mustJSON(map[string]serviceEntry{"a:1": {At: ms - 10, Until: ms + 1000}, "c:1": {At: ms, Until: ms + 1000}}))
+	if string(merged) != want {
+		t.Errorf("merged %s, want %s", merged, want)
+	}
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 12)
+	sim.AddNodes(ctx, 20)
+	nodes := simNodes(sim)
+	if err := nodes[0].RegisterService(ctx, "api", "", time.Minute); err != ErrBadEndpoint {
+		t.Errorf("registering an empty endpoint: %v, want ErrBadEndpoint", err)
+	}
+	ttl := 10 * time.Minute
+	for i, endpoint := range []string{"10.0.0.2:80", "10.0.0.1:80", "10.0.0.3:80"} {
+		if err := nodes[i].RegisterService(ctx, "api", endpoint, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve := func(want ...string) {
+		t.Helper()
+		got, err := nodes[19].ResolveService(ctx, "api")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("resolved %q, err %v, want %q", got, err, want)
+		}
+	}
+	resolve("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+
+	// Registrations are renewed while their nodes run, so they outlive
+	// their TTL.
+	sim.Advance(ctx, 2*ttl)
+	resolve("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+
+	if err := nodes[1].DeregisterService(ctx, "api", "10.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	resolve("10.0.0.2:80", "10.0.0.3:80")
+
+	// The endpoint of a node that goes down lasts at most a TTL longer.
+	sim.Fail(simNode{nodes[2]}, 10*ttl)
+	sim.Advance(ctx, ttl+time.Minute)
+	resolve("10.0.0.2:80")
+}
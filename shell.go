@@ -0,0 +1,500 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shellTimeout = 10 * time.Second
+
+// maxShellLine bounds a command line sent to /shell.
+const maxShellLine = 1 << 20
+
+// shellFeedLimit caps the entries feed shows.
+const shellFeedLimit = 50
+
+const shellHelp = `commands:
+  get <key>            fetch a value from the network
+  pget <key>           fetch a value without telling the nodes on the way which key
+  oget <key>           fetch a value through onion relays, hiding our address
+  qget <key> [r]       fetch the newest copy held by r replicas, default a majority
+  put <key> <value>    store a value on the closest peers
+  sput <key> <box key>[,<box key>...] <value>
+                       put a value only the holders of those box keys can read
+  sget <key>           fetch and open a value sealed to this node's box key
+  send <box key> <ttl> <message>
+                       queue a message in the mailbox of that box key
+  inbox                list the messages waiting in this node's mailbox
+  ack <id>             remove a message inbox listed from the mailbox
+  eput <key> <data> <parity> <value>
+                       put a value as data plus parity erasure-coded shards
+  iput <key> <value>   put and add /name/... keys to the prefix index
+  list <prefix>        list indexed keys starting with a /name/ prefix
+  sample <series> <value>
+                       publish a sample of a time series, stamped now
+  series <series> <window>
+                       show a series' samples over the last window, e.g. 1h
+  append <feed> <data> add an entry to this node's feed of that name
+  feed <owner id> <feed> [after]
+                       show a feed's entries after sequence number after
+  incr <key> [delta]   add delta, default 1, to a distributed counter
+  count <key>          show the value of a distributed counter
+  register <name> <endpoint> <ttl>
+                       announce a service endpoint, renewed while running
+  resolve <name>       list the healthy endpoints of a service
+  publish <name> <type>=<value>...
+                       sign and publish A, AAAA or TXT records for a name
+  dig <name>           show the records published for a name
+  export <file>        write a snapshot of the local store to file, on the daemon's host
+  import <file>        load a snapshot from the daemon's host and take over the
+                       records it published
+  peers                list every contact in the routing table
+  members              list the live members of the gossip view
+  buckets              show contact counts of non-empty buckets
+  stats                show store and routing table statistics
+  lookup <key>         show the closest reachable peers to a key
+  trace <key>          fetch a value from the network, showing every peer asked
+  online <id>          tell whether a peer announcing its presence is online
+  ban <id>             drop a peer and ignore it from now on
+  id                   print this node's ID, addresses, node record and box key
+  help                 show this message
+  quit                 leave the shell`
+
+// shellHandler runs the shell command line in a POST's body and answers
+// with what it prints. A command that fails is answered 422, with the
+// error printed last.
+func (n *Node) shellHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	line, err := io.ReadAll(io.LimitReader(r.Body, maxShellLine))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		http.Error(w, "no command", http.StatusBadRequest)
+		return
+	}
+	var out bytes.Buffer
+	err = shellCommand(r.Context(), n, &out, fields[0], fields[1:])
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		fmt.Fprintln(&out, "error:", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	w.Write(out.Bytes())
+}
+
+func shellCommand(ctx context.Context, node *Node, out io.Writer, cmd string, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, shellTimeout)
+	defer cancel()
+
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: get <key>")
+		}
+		value, err := node.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "pget":
+		if len(args) != 1 {
+			return errors.New("usage: pget <key>")
+		}
+		value, err := node.Get(ctx, args[0], WithPrivateLookup())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "oget":
+		if len(args) != 1 {
+			return errors.New("usage: oget <key>")
+		}
+		value, err := node.Get(ctx, args[0], WithOnionRouting())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "qget":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: qget <key> [r]")
+		}
+		quorum := 0
+		if len(args) == 2 {
+			var err error
+			if quorum, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+		}
+		value, err := node.GetQuorum(ctx, args[0], quorum)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "put":
+		if len(args) < 2 {
+			return errors.New("usage: put <key> <value>")
+		}
+		if err := node.Put(ctx, args[0], []byte(strings.Join(args[1:], " "))); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "sput":
+		if len(args) < 3 {
+			return errors.New("usage: sput <key> <box key>[,<box key>...] <value>")
+		}
+		var recipients [][]byte
+		for _, s := range strings.Split(args[1], ",") {
+			r, err := hex.DecodeString(s)
+			if err != nil {
+				return fmt.Errorf("box key %q: %w", s, err)
+			}
+			recipients = append(recipients, r)
+		}
+		if err := node.PutSealed(ctx, args[0], []byte(strings.Join(args[2:], " ")), recipients); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "sget":
+		if len(args) != 1 {
+			return errors.New("usage: sget <key>")
+		}
+		value, err := node.GetSealed(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "send":
+		if len(args) < 3 {
+			return errors.New("usage: send <box key> <ttl> <message>")
+		}
+		to, err := hex.DecodeString(args[0])
+		if err != nil {
+			return fmt.Errorf("box key: %w", err)
+		}
+		ttl, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		if err := node.SendMessage(ctx, to, []byte(strings.Join(args[2:], " ")), ttl); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "inbox":
+		messages, err := node.ReceiveMessages(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			fmt.Fprintf(out, "%s\t%s\t%s\n", m.ID, m.Sent.Format(time.RFC3339), m.Body)
+		}
+	case "ack":
+		if len(args) != 1 {
+			return errors.New("usage: ack <id>")
+		}
+		if err := node.AckMessage(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "eput":
+		if len(args) < 4 {
+			return errors.New("usage: eput <key> <data> <parity> <value>")
+		}
+		data, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		parity, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		if err := node.Put(ctx, args[0], []byte(strings.Join(args[3:], " ")), WithErasureCoding(data, parity)); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "iput":
+		if len(args) < 2 {
+			return errors.New("usage: iput <key> <value>")
+		}
+		if err := node.PutIndexed(ctx, args[0], []byte(strings.Join(args[1:], " "))); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "append":
+		if len(args) < 2 {
+			return errors.New("usage: append <feed> <data>")
+		}
+		seq, err := node.Append(ctx, args[0], []byte(strings.Join(args[1:], " ")))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, seq)
+	case "feed":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: feed <owner id> <feed> [after]")
+		}
+		after := uint64(0)
+		if len(args) == 3 {
+			var err error
+			if after, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+				return err
+			}
+		}
+		entries, err := node.ReadFeed(ctx, args[0], args[1], after, shellFeedLimit)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Fprintf(out, "%d\t%s\t%s\n", e.Seq, e.Time.Format(time.RFC3339), e.Data)
+		}
+	case "sample":
+		if len(args) < 2 {
+			return errors.New("usage: sample <series> <value>")
+		}
+		if err := node.PutSample(ctx, args[0], time.Now(), []byte(strings.Join(args[1:], " "))); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "series":
+		if len(args) != 2 {
+			return errors.New("usage: series <series> <window>")
+		}
+		window, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		samples, err := node.ReadSeries(ctx, args[0], now.Add(-window), now)
+		if err != nil {
+			return err
+		}
+		for _, s := range samples {
+			fmt.Fprintf(out, "%s\t%s\t%s\n", s.Time.Format(time.RFC3339), s.Publisher, s.Value)
+		}
+	case "list":
+		if len(args) != 1 {
+			return errors.New("usage: list <prefix>")
+		}
+		keys, err := node.ListByPrefix(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintln(out, key)
+		}
+	case "incr":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: incr <key> [delta]")
+		}
+		delta := int64(1)
+		if len(args) == 2 {
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return err
+			}
+		}
+		value, err := node.Increment(ctx, args[0], delta)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, value)
+	case "count":
+		if len(args) != 1 {
+			return errors.New("usage: count <key>")
+		}
+		value, err := node.Count(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, value)
+	case "register":
+		if len(args) != 3 {
+			return errors.New("usage: register <name> <endpoint> <ttl>")
+		}
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil {
+			return err
+		}
+		if err := node.RegisterService(ctx, args[0], args[1], ttl); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "resolve":
+		if len(args) != 1 {
+			return errors.New("usage: resolve <name>")
+		}
+		endpoints, err := node.ResolveService(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			fmt.Fprintln(out, endpoint)
+		}
+	case "publish":
+		if len(args) < 2 {
+			return errors.New("usage: publish <name> <type>=<value>...")
+		}
+		records := make([]NameRecord, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			typ, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return errors.New("usage: publish <name> <type>=<value>...")
+			}
+			records = append(records, NameRecord{Type: strings.ToUpper(typ), Value: value})
+		}
+		if err := node.PublishName(ctx, args[0], records, node.cfg.RecordTTL); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "dig":
+		if len(args) != 1 {
+			return errors.New("usage: dig <name>")
+		}
+		records, err := node.ResolveName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			fmt.Fprintf(out, "%s %s\n", r.Type, r.Value)
+		}
+	case "export":
+		if len(args) != 1 {
+			return errors.New("usage: export <file>")
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		if err := node.Export(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "import":
+		if len(args) != 1 {
+			return errors.New("usage: import <file>")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		count, err := node.Import(ctx, f, true)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "imported", count, "records")
+	case "peers":
+		for _, p := range node.Peers() {
+			fmt.Fprintf(out, "%s %s\n", p.id, p.addr)
+		}
+	case "members":
+		for _, m := range node.Members() {
+			fmt.Fprintf(out, "%s %s heartbeat=%d\n", m.ID, m.Addr, m.Heartbeat)
+		}
+	case "buckets":
+		for i, size := range node.BucketSizes() {
+			if size > 0 {
+				fmt.Fprintf(out, "%3d: %d\n", i, size)
+			}
+		}
+	case "stats":
+		s := node.Stats()
+		fmt.Fprintf(out, "records=%d bytes=%d expiring=%d contacts=%d network_size=%d\n", s.Records, s.Bytes, s.Expiring, s.Contacts, s.Network)
+		namespaces := make([]string, 0, len(s.Namespaces))
+		for ns := range s.Namespaces {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			fmt.Fprintf(out, "namespace %q: %d\n", ns, s.Namespaces[ns])
+		}
+	case "lookup":
+		if len(args) != 1 {
+			return errors.New("usage: lookup <key>")
+		}
+		target := node.dht.hashValue(args[0])
+		fmt.Fprintln(out, "target", target)
+		for _, p := range node.Lookup(ctx, target) {
+			fmt.Fprintf(out, "%s %s distance=%d\n", p.id, p.addr, node.dht.distance(p.id, target).BitLen())
+		}
+	case "trace":
+		if len(args) != 1 {
+			return errors.New("usage: trace <key>")
+		}
+		value, traces, err := node.GetTraced(ctx, args[0])
+		for _, trace := range traces {
+			fmt.Fprintf(out, "lookup %s took=%v found=%v\n", trace.Target, trace.Took, trace.Found)
+			for _, q := range trace.Queries {
+				fmt.Fprintf(out, "  round %d %s %s distance=%d took=%v", q.Round, q.Peer, q.Addr, q.Distance, q.Took)
+				switch {
+				case q.Error != "":
+					fmt.Fprintf(out, " error=%q\n", q.Error)
+				case q.Found:
+					fmt.Fprintln(out, " value")
+				default:
+					fmt.Fprintf(out, " nodes=%d\n", q.Nodes)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(value))
+	case "online":
+		if len(args) != 1 {
+			return errors.New("usage: online <id>")
+		}
+		p, err := node.Online(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if !p.Online {
+			fmt.Fprintln(out, "offline")
+			break
+		}
+		fmt.Fprintln(out, "online until", p.Until.Format(time.RFC3339))
+		for _, addr := range p.Addrs {
+			fmt.Fprintln(out, addr)
+		}
+	case "ban":
+		if len(args) != 1 {
+			return errors.New("usage: ban <id>")
+		}
+		node.Ban(args[0])
+		fmt.Fprintln(out, "banned", args[0])
+	case "id":
+		fmt.Fprintln(out, node.ID(), node.Addr())
+		for _, addr := range node.Addrs() {
+			fmt.Fprintln(out, addr)
+		}
+		if node.self.record != nil {
+			fmt.Fprintln(out, node.self.record)
+		}
+		fmt.Fprintln(out, "box key", hex.EncodeToString(node.BoxKey()))
+	case "help":
+		fmt.Fprintln(out, shellHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestShellHandler(t *testing.T) {
+	node := NewNode(fuzzConfig(), newMemTransport(dhtsim.NewNetwork()))
+	server := httptest.NewServer(node.AdminHandler())
+	defer server.Close()
+
+	for _, c := range []struct {
+		line   string
+		status int
+		want   string
+	}{
+		{"id", http.StatusOK, node.ID()},
+		{"ban " + testID, http.StatusOK, "banned " + testID},
+		{"nosuch", http.StatusUnprocessableEntity, `error: unknown command "nosuch"`},
+		{"  ", http.StatusBadRequest, "no command"},
+	} {
+		resp, err := http.Post(server.URL+"/shell", "text/plain", strings.NewReader(c.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || !strings.Contains(string(body), c.want) {
+			t.Errorf("%q: %s %q, want %d and %q", c.line, resp.Status, body, c.status, c.want)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /shell: %s, want 405", resp.Status)
+	}
+}
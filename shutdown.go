@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Close shuts the node down. With presence_interval set it first withdraws
+// its presence. It stops answering RPCs and starting new operations, then
+// gives those in flight until ctx is done to finish before cancelling
+// them. With leave_handoff it next stores every record it holds at the
+// key's other replicas, so nothing waits for a republish to find its copy
+// gone, unless Decommission drained them already. Last it stops Run,
+// saves the routing table and store checkpoint and closes the transport.
+// The identity was saved when the node started. Closing a closed node
+// does nothing.
+func (n *Node) Close(ctx context.Context) error {
+	n.mu.Lock()
+	closed := n.closed
+	n.mu.Unlock()
+	if closed {
+		return nil
+	}
+	if n.cfg.PresenceInterval > 0 {
+		if err := n.announcePresence(ctx, n.clock.Now()); err != nil {
+			n.log.Warn("withdrawing presence failed", "err", err)
+		}
+	}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	drained := n.draining
+	n.mu.Unlock()
+
+	if !waitGroup(ctx, &n.ops) {
+		n.log.Warn("cancelling operations still running")
+	}
+	if n.cfg.LeaveHandoff && !drained && ctx.Err() == nil {
+		n.leaveHandoff(ctx)
+	}
+	n.halt()
+	n.ops.Wait()
+	n.running.Wait()
+
+	err := errors.Join(n.saveContacts(), n.checkpoint(), n.transport.Close())
+	if n.wal != nil {
+		err = errors.Join(err, n.wal.f.Close())
+	}
+	return err
+}
+
+// Shutdown is Close within the shutdown timeout.
+func (n *Node) Shutdown() error {
+	ctx := context.Background()
+	if n.cfg.Timeouts.Shutdown > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeouts.Shutdown)
+		defer cancel()
+	}
+	return n.Close(ctx)
+}
+
+// waitGroup waits for wg, false if ctx is done first.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// leaveHandoff stores every record we hold at the other replicas of its
+// key, looking them up afresh since ours may be the only copy a lookup
+// would have ended at.
+func (n *Node) leaveHandoff(ctx context.Context) {
+	n.mu.Lock()
+	keys := n.store.keys()
+	n.mu.Unlock()
+	handed := 0
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		line, ok := n.snapshotRecord(key)
+		if !ok || n.pushedCopy(key) {
+			continue
+		}
+		result := n.iterate(ctx, msgFindNode, "", n.dht.hashValue(key))
+		replicas := n.replicasFor(key, result.closest)
+		for _, r := range n.storeVersionAt(ctx, replicas, result.tokens, key, line.Value, line.Version) {
+			if r.err == nil {
+				handed++
+				break
+			}
+		}
+	}
+	n.log.Info("handed off records", "count", handed, "held", len(keys))
+}
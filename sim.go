@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"context"
+	"io"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// Simulated returns what starts nodes with cfg in a dhtsim simulation,
+// each on its own address of the simulated network. A few settings are
+// overridden to suit simulated time and a network without loss or NATs.
+func Simulated(cfg Config) dhtsim.NewNode {
+	cfg.LogLevel = "error"
+	// Simulated time stands still while a workload runs, so a per-peer
+	// rate limit would never refill.
+	cfg.Limits.PeerRate = 0
+	// Reads measure the network, not what a node happens to remember.
+	cfg.Cache.Size = 0
+	// An unreachable simulated peer stays unreachable for the whole call.
+	cfg.Retry.Attempts = 1
+	// There are no NATs between simulated nodes.
+	cfg.Keepalive.Max = 0
+	return func(network *dhtsim.Network, clock *dhtsim.Clock, random io.Reader) dhtsim.Node {
+		return simNode{newNode(cfg, newMemTransport(network), clock, random, nil)}
+	}
+}
+
+// simNode is a Node as a simulation sees it.
+type simNode struct {
+	*Node
+}
+
+// Addrs returns the node's addresses on the simulated network.
+func (n simNode) Addrs() []string {
+	return n.transport.Addrs()
+}
+
+func (n simNode) Put(ctx context.Context, key string, value []byte) error {
+	return n.Node.Put(ctx, key, value)
+}
+
+func (n simNode) Get(ctx context.Context, key string) ([]byte, int, error) {
+	result, err := n.get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result.value, result.hops, nil
+}
+
+// Maintain first waits for what the node carries on with in the
+// background, such as read repair, so that whatever a script did before
+// a step of simulated time has finished by the end of it.
+func (n simNode) Maintain(ctx context.Context) {
+	n.ops.Wait()
+	n.maintain(ctx)
+}
+
+func (n simNode) Fail() {
+	n.transport.Close()
+}
+
+func (n simNode) Recover() {
+	n.transport.(*memTransport).reopen()
+}
+
+func (n simNode) Knows(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dht.findPeer(id) != nil
+}
+
+func (n simNode) Holds(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.store.has(key)
+}
+
+func (n simNode) Placement(key string) (string, int) {
+	return n.dht.hashValue(key), n.cfg.policy(key).Replication
+}
+
+func (n simNode) BucketSize() int {
+	return n.cfg.K
+}
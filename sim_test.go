@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func newSimulation(cfg Config, seed int64) *dhtsim.Simulation {
+	return dhtsim.New(Simulated(cfg), seed)
+}
+
+// simNodes returns the nodes of sim.
+func simNodes(sim *dhtsim.Simulation) []*Node {
+	nodes := make([]*Node, 0)
+	for _, n := range sim.Nodes() {
+		nodes = append(nodes, n.(simNode).Node)
+	}
+	return nodes
+}
+
+func TestSimulationWorkload(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.K = 8
+	sim := newSimulation(cfg, 1)
+	sim.AddNodes(ctx, 50)
+	report := sim.Run(ctx, dhtsim.Workload{Keys: 50, Reads: 50, Wait: time.Hour})
+	if err := report.Expect(1, 3); err != nil {
+		t.Error(err)
+	}
+	if report.Messages == 0 {
+		t.Error("no messages counted")
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	run := func() dhtsim.Report {
+		ctx := context.Background()
+		sim := newSimulation(DefaultConfig(), 2)
+		sim.AddNodes(ctx, 30)
+		return sim.Run(ctx, dhtsim.Workload{Keys: 20, Reads: 20})
+	}
+	if a, b := run(), run(); !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed, different reports: %+v and %+v", a, b)
+	}
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"math"
+	"strconv"
+)
+
+// Network size estimation. IDs are uniformly random, so among N nodes the
+// i-th closest to any point lies at about i/N of the ID space from it. A
+// least squares fit of the distances d_i of the closest nodes we know to
+// a point, as fractions of the ID space, gives N = sum(i^2) / sum(i d_i).
+// We fit it to our own neighbourhood, which the routing table knows best,
+// and to the closest nodes every complete lookup converges on, whose
+// targets are spread over the whole ID space and average out the
+// clustering of any one neighbourhood.
+const sizeSmoothing = 0.1 // weight of each new lookup in the average
+
+// estimateSize fits N to peers, sorted by distance to target.
+func estimateSize(target string, peers []*Peer) float64 {
+	var squares, weighted float64
+	for i, p := range peers {
+		squares += float64((i + 1) * (i + 1))
+		weighted += float64(i+1) * distanceFraction(p.id, target)
+	}
+	if weighted == 0 {
+		return 0
+	}
+	return squares / weighted
+}
+
+// distanceFraction is the XOR distance between a and b as a fraction of
+// the ID space, to the precision of a float64.
+func distanceFraction(a, b string) float64 {
+	x, _ := strconv.ParseUint(a[:16], 16, 64)
+	y, _ := strconv.ParseUint(b[:16], 16, 64)
+	return float64(x^y) / math.Exp2(64)
+}
+
+// observeLookup folds the peers a complete lookup for target converged on
+// into the running estimate. n.mu must not be held.
+func (n *Node) observeLookup(target string, closest []*Peer) {
+	if len(closest) < 2 {
+		return
+	}
+	estimate := estimateSize(target, closest)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lookupSize == 0 {
+		n.lookupSize = estimate
+	} else {
+		n.lookupSize += sizeSmoothing * (estimate - n.lookupSize)
+	}
+}
+
+// NetworkSize returns the estimated number of nodes in the network,
+// counting ourselves.
+func (n *Node) NetworkSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.networkSize()
+}
+
+// networkSize is NetworkSize with n.mu held.
+func (n *Node) networkSize() int {
+	closest := n.dht.closest(n.self.id, n.cfg.K)
+	if len(closest) == 0 {
+		return 1
+	}
+	size := estimateSize(n.self.id, closest) + 1
+	if n.lookupSize > 0 {
+		size = (size + n.lookupSize) / 2
+	}
+	// There are at least as many nodes as we know.
+	return max(int(math.Round(size)), len(n.dht.peers())+1)
+}
+
+// expectedInBucket returns how many nodes a network of size has at a
+// distance of bit length i from us, which spans a 2^(i-1-IDBits) share of
+// the ID space. Bucket i holds up to k of them.
+func expectedInBucket(size, i int) float64 {
+	return float64(size) * math.Exp2(float64(i-1-IDBits))
+}
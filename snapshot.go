@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A snapshot is JSON lines: a header, then one line per record. Lines keep
+// memory flat however large the store is, and leave the file greppable.
+// Records we published carry no expiry, as we republish them for as long
+// as we run; the others expire a namespace TTL after they were stored.
+const (
+	snapshotFormat  = "dht-snapshot"
+	snapshotVersion = 1
+)
+
+type snapshotHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Node    string    `json:"node"`
+	Created time.Time `json:"created"`
+	Records int       `json:"records"`
+}
+
+type snapshotRecord struct {
+	Key        string     `json:"key"`
+	Value      []byte     `json:"value"`
+	Publisher  string     `json:"publisher"`
+	Stored     time.Time  `json:"stored"`
+	Version    int64      `json:"version,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Indexed    bool       `json:"indexed,omitempty"`
+	Replicas   int        `json:"replicas,omitempty"`
+	CacheUntil *time.Time `json:"cache_until,omitempty"` // pushed hot-key copies only, see hot.go
+}
+
+// Export writes a snapshot of the local store to w. Records are read one
+// at a time, spilled ones straight from disk, so the store stays usable
+// while a large snapshot is written.
+func (n *Node) Export(w io.Writer) error {
+	n.mu.Lock()
+	keys := n.store.keys()
+	n.mu.Unlock()
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	header := snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, Node: n.self.id, Created: n.clock.Now().UTC(), Records: len(keys)}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		line, ok := n.snapshotRecord(key)
+		if !ok {
+			continue
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// snapshotRecord returns the snapshot line for key, false if the record
+// went away or its value cannot be read back.
+func (n *Node) snapshotRecord(key string) (snapshotRecord, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, ok := n.store.peek(key)
+	if !ok {
+		return snapshotRecord{}, false
+	}
+	value := r.value
+	if r.onDisk {
+		var err error
+		if value, err = n.store.disk.read(key, r.length); err != nil {
+			n.log.Warn("leaving record out of snapshot", "key", key, "err", err)
+			return snapshotRecord{}, false
+		}
+	}
+	return n.recordLine(r, value), true
+}
+
+// recordLine is the snapshot line for r, whose value is value. n.mu must
+// be held.
+func (n *Node) recordLine(r *record, value []byte) snapshotRecord {
+	line := snapshotRecord{Key: r.key, Value: value, Publisher: r.publisher, Stored: r.stored.UTC(), Version: r.version, Indexed: n.indexed[r.key], Replicas: r.replicas}
+	if r.publisher != n.self.id {
+		expires := r.stored.Add(n.cfg.policy(r.key).TTL).UTC()
+		if !r.expires.IsZero() {
+			expires = r.expires.UTC()
+			line.CacheUntil = &expires
+		}
+		line.Expires = &expires
+	}
+	return line
+}
+
+// Import loads a snapshot written by Export, possibly on another node.
+// Every record is validated again as if a peer had stored it and expired
+// ones are dropped. With announce, the records the exporting node had
+// published become ours: they are stored on the network again right away
+// and republished from then on, so a replacement node takes over for the
+// old one. Otherwise they keep their publisher and expire like any copy.
+// Pushed hot-key copies stay such copies, and never beat a replica's.
+// It returns how many records were imported.
+func (n *Node) Import(ctx context.Context, r io.Reader, announce bool) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("snapshot header: %w", err)
+	}
+	if header.Format != snapshotFormat || header.Version < 1 || header.Version > snapshotVersion {
+		return 0, fmt.Errorf("not a version %d snapshot", snapshotVersion)
+	}
+
+	imported := 0
+	adopted := make([]snapshotRecord, 0)
+	for {
+		var line snapshotRecord
+		err := dec.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("snapshot record %d: %w", imported+1, err)
+		}
+		adopt := announce && line.CacheUntil == nil && (line.Publisher == header.Node || line.Publisher == n.self.id)
+		if err := n.importRecord(line, adopt); err != nil {
+			n.log.Debug("skipping snapshot record", "key", line.Key, "err", err)
+			continue
+		}
+		imported++
+		if adopt {
+			adopted = append(adopted, line)
+		}
+	}
+	n.mu.Lock()
+	n.evict()
+	n.mu.Unlock()
+
+	for _, line := range adopted {
+		if err := n.put(ctx, line.Key, line.Value, line.Version, putOptions{replicas: line.Replicas}); err != nil {
+			return imported, err
+		}
+		if line.Indexed {
+			if err := n.index(ctx, line.Key); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, nil
+}
+
+var errExpired = errors.New("record expired")
+
+func (n *Node) importRecord(line snapshotRecord, adopt bool) error {
+	now := n.clock.Now()
+	publisher := line.Publisher
+	if line.CacheUntil != nil {
+		adopt = false // a pushed copy is never ours to publish
+	}
+	if adopt {
+		publisher = n.self.id
+	} else if now.Sub(line.Stored) > n.cfg.policy(line.Key).TTL || line.Expires != nil && !now.Before(*line.Expires) {
+		return errExpired
+	}
+	if err := n.cfg.checkValue(line.Key, line.Value); err != nil {
+		return err
+	}
+	rec := &record{key: line.Key, value: line.Value, publisher: publisher, stored: line.Stored, version: line.Version}
+	if line.Replicas > 0 {
+		rec.replicas = min(line.Replicas, n.cfg.K)
+	}
+	if line.CacheUntil != nil {
+		rec.expires = *line.CacheUntil
+	}
+	if adopt {
+		rec.stored = now
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ok, err := n.admit(rec); !ok {
+		return err
+	}
+	rec.spare = !n.responsible(rec.key)
+	n.store.put(rec)
+	if adopt && line.Indexed {
+		if n.indexed == nil {
+			n.indexed = make(map[string]bool)
+		}
+		n.indexed[line.Key] = true
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// expiryHorizon is how far ahead Stats counts expiring records.
+const expiryHorizon = time.Hour
+
+// nodeStats describes what a node stores and whom it knows. Namespaces
+// counts records by namespace, "" for keys outside any. Expiring counts
+// the copies whose TTL runs out within the next hour unless their
+// publisher refreshes them; records we published ourselves never expire.
+// Buckets holds the contact count of every non-empty bucket, by the bit
+// length of the XOR distance from us, and BucketStats the health of every
+// bucket in use, see buckets.go. Sent and Received count datagram
+// bytes, for transports that keep count. PeerTraffic and TypeTraffic
+// count RPC bytes over the last minute by peer and by message type, see
+// bandwidth.go. Dropped counts requests not answered, by reason, see
+// limits.go. Lookups holds the totals of every lookup type run so far.
+type nodeStats struct {
+	Records     int                      `json:"records"`
+	Bytes       int                      `json:"bytes"`
+	Namespaces  map[string]int           `json:"namespaces"`
+	Expiring    int                      `json:"expiring"`
+	Contacts    int                      `json:"contacts"`
+	Network     int                      `json:"network_size"` // estimated, see NetworkSize
+	Buckets     map[int]int              `json:"buckets"`
+	BucketStats map[int]bucketStats      `json:"bucket_stats"`
+	Sent        int64                    `json:"sent_bytes"`
+	Received    int64                    `json:"received_bytes"`
+	PeerTraffic map[string]trafficTotals `json:"peer_traffic"`
+	TypeTraffic map[string]trafficTotals `json:"type_traffic"`
+	Dropped     map[string]int64         `json:"dropped"`
+	Lookups     map[string]lookupTotals  `json:"lookups"`
+}
+
+// Stats returns a snapshot of the store and routing table.
+func (n *Node) Stats() nodeStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	s := nodeStats{
+		Records:    n.store.len(),
+		Bytes:      n.store.bytes,
+		Namespaces: make(map[string]int),
+		Buckets:    make(map[int]int),
+	}
+	for _, key := range n.store.keys() {
+		r, _ := n.store.peek(key)
+		s.Namespaces[namespaceOf(key)]++
+		if r.publisher != n.self.id && r.stored.Add(n.cfg.policy(key).TTL).Sub(now) <= expiryHorizon {
+			s.Expiring++
+		}
+	}
+	s.Network = n.networkSize()
+	s.BucketStats = n.bucketStats(now)
+	for _, p := range n.dht.peers() {
+		s.Contacts++
+		s.Buckets[n.dht.bucketIndex(p.id)]++
+	}
+	if c, ok := n.transport.(trafficCounter); ok {
+		s.Sent, s.Received = c.traffic()
+	}
+	s.PeerTraffic, s.TypeTraffic = n.bandwidth.totals(now)
+	s.Dropped = make(map[string]int64, len(n.dropped))
+	for reason, count := range n.dropped {
+		s.Dropped[reason] = count
+	}
+	s.Lookups = make(map[string]lookupTotals, len(n.lookupTotals))
+	for typ, t := range n.lookupTotals {
+		s.Lookups[typ] = *t
+	}
+	return s
+}
+
+func (n *Node) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.Stats())
+}
@@ -0,0 +1,240 @@
+package dht
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+type record struct {
+	key       string
+	value     []byte
+	publisher string
+	version   int64  // publisher's write time in unix nanoseconds, 0 if unknown
+	digest    uint64 // of value, for comparing copies without sending them
+	stored    time.Time
+	used      time.Time // last stored or read, for eviction
+	length    int       // of value, which is nil while onDisk
+	onDisk    bool
+	replicas  int       // copies its publisher asked for, 0 for the namespace's
+	expires   time.Time // of a pushed hot-key copy, see hot.go; zero otherwise
+	spare     bool      // others are closer to key, as of its last check
+	queued    *list.Element
+}
+
+// expired reports whether r is a hot-key copy that has run out.
+func (r *record) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
+
+func valueDigest(value []byte) uint64 {
+	sum := sha256.Sum256(value)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// size is what a record counts against storage quotas.
+func (r *record) size() int {
+	return len(r.key) + r.length
+}
+
+// store keeps a bloom filter over its keys so that lookups for keys we do
+// not hold, the common case when answering find_value, skip the map.
+// Deleted keys stay in the filter until rebuild. With a disk tier, cold
+// values can be spilled to disk; bytes counts both tiers, memBytes only
+// the values held in memory. The records in memory that owner did not
+// publish wait in two eviction queues, least recently used first: spare
+// for the copies others are closer to the key than we are, held for the
+// rest.
+type store struct {
+	records  map[string]*record
+	filter   *bloomFilter
+	deleted  int
+	bytes    int
+	memBytes int
+	usage    map[string]int // bytes by publisher
+	disk     *diskTier
+	owner    string
+	spare    *list.List
+	held     *list.List
+}
+
+func newStore(owner string) *store {
+	return &store{records: make(map[string]*record), filter: newBloomFilter(0), usage: make(map[string]int), owner: owner, spare: list.New(), held: list.New()}
+}
+
+func (s *store) put(r *record) {
+	if r.used.IsZero() {
+		r.used = r.stored
+	}
+	r.length = len(r.value)
+	r.digest = valueDigest(r.value)
+	if old, ok := s.records[r.key]; ok {
+		s.drop(old)
+	} else {
+		s.filter.add(r.key)
+	}
+	s.records[r.key] = r
+	s.account(r, 1)
+	s.queue(r)
+	if len(s.records) > s.filter.capacity {
+		s.rebuild()
+	}
+}
+
+// get returns the record for key with its value, reading the value back
+// into memory first if it was spilled to disk.
+func (s *store) get(key string) (*record, bool) {
+	r, ok := s.peek(key)
+	if ok && r.onDisk && !s.promote(r) {
+		return nil, false
+	}
+	return r, ok
+}
+
+// peek returns the record for key without promoting it, so the value of a
+// spilled record is nil.
+func (s *store) peek(key string) (*record, bool) {
+	if !s.filter.mayContain(key) {
+		return nil, false
+	}
+	r, ok := s.records[key]
+	return r, ok
+}
+
+func (s *store) touch(key string, now time.Time) {
+	if r, ok := s.peek(key); ok {
+		r.used = now
+		if r.queued != nil {
+			s.queueOf(r).MoveToBack(r.queued)
+		}
+	}
+}
+
+func (s *store) queueOf(r *record) *list.List {
+	if r.spare {
+		return s.spare
+	}
+	return s.held
+}
+
+// queue puts r in its eviction queue, or takes it out if it is ours or
+// not in memory. The queue stays ordered by use.
+func (s *store) queue(r *record) {
+	s.unqueue(r)
+	if r.publisher == s.owner || r.onDisk {
+		return
+	}
+	q := s.queueOf(r)
+	at := q.Back()
+	for at != nil && at.Value.(*record).used.After(r.used) {
+		at = at.Prev()
+	}
+	if at == nil {
+		r.queued = q.PushFront(r)
+	} else {
+		r.queued = q.InsertAfter(r, at)
+	}
+}
+
+func (s *store) unqueue(r *record) {
+	if r.queued != nil {
+		s.queueOf(r).Remove(r.queued)
+		r.queued = nil
+	}
+}
+
+// mark records whether others are closer to r's key than we are.
+func (s *store) mark(r *record, spare bool) {
+	if r.spare != spare {
+		s.unqueue(r)
+		r.spare = spare
+		s.queue(r)
+	}
+}
+
+// coldest returns the record to evict first, nil if there is none.
+func (s *store) coldest() *record {
+	for _, q := range []*list.List{s.spare, s.held} {
+		if front := q.Front(); front != nil {
+			return front.Value.(*record)
+		}
+	}
+	return nil
+}
+
+func (s *store) has(key string) bool {
+	_, ok := s.peek(key)
+	return ok
+}
+
+func (s *store) delete(key string) {
+	if r, ok := s.records[key]; ok {
+		s.drop(r)
+		delete(s.records, key)
+		s.deleted++
+	}
+}
+
+// drop takes r out of the accounting and off the disk.
+func (s *store) drop(r *record) {
+	if r.onDisk {
+		s.disk.remove(r.key)
+	}
+	s.unqueue(r)
+	s.account(r, -1)
+}
+
+func (s *store) account(r *record, sign int) {
+	s.bytes += sign * r.size()
+	if !r.onDisk {
+		s.memBytes += sign * r.size()
+	}
+	s.usage[r.publisher] += sign * r.size()
+	if s.usage[r.publisher] == 0 {
+		delete(s.usage, r.publisher)
+	}
+}
+
+// fits reports whether replacing whatever is stored under r.key with r
+// keeps r's publisher within perPeer bytes and the store within total.
+func (s *store) fits(r *record, perPeer, total int) bool {
+	size := len(r.key) + len(r.value)
+	bytes, usage := s.bytes+size, s.usage[r.publisher]+size
+	if old, ok := s.records[r.key]; ok {
+		bytes -= old.size()
+		if old.publisher == r.publisher {
+			usage -= old.size()
+		}
+	}
+	return usage <= perPeer && bytes <= total
+}
+
+// stale reports whether enough keys were deleted since the last rebuild
+// that the filter lets through noticeably more misses than it should.
+func (s *store) stale() bool {
+	return s.deleted > len(s.records)/2 && s.deleted > bloomMinKeys/8
+}
+
+// rebuild sizes a fresh filter for twice the current number of keys.
+func (s *store) rebuild() {
+	s.filter = newBloomFilter(2 * len(s.records))
+	for key := range s.records {
+		s.filter.add(key)
+	}
+	s.deleted = 0
+}
+
+func (s *store) len() int {
+	return len(s.records)
+}
+
+func (s *store) keys() []string {
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestStorageQuotas(t *testing.T) {
+	cfg := fuzzConfig()
+	cfg.Limits.MaxBytesPerPeer = 100
+	cfg.Limits.MaxBytes = 250
+	node := NewNode(cfg, newMemTransport(dhtsim.NewNetwork()))
+	a, b, c := strings.Repeat("a", 32), strings.Repeat("b", 32), strings.Repeat("c", 32)
+	// Every record is its two byte key plus size bytes of value.
+	store := func(publisher, key string, size int) error {
+		return node.storeRemote(&message{Type: msgStore, From: contact{ID: publisher}, Key: key, Value: bytes.Repeat([]byte("x"), size)})
+	}
+	for _, s := range []struct {
+		publisher, key string
+		size           int
+		want           error
+	}{
+		{a, "a1", 48, nil},
+		{a, "a2", 48, nil},
+		{a, "a3", 1, ErrQuota},  // over a's 100 bytes
+		{a, "a2", 48, nil},      // a replacement only counts the difference
+		{b, "b1", 98, nil},      // b has a quota of its own
+		{c, "c1", 98, ErrQuota}, // but all of them share 250
+		{c, "c1", 48, nil},
+	} {
+		if err := store(s.publisher, s.key, s.size); !errors.Is(err, s.want) {
+			t.Errorf("store %s of %d bytes: %v, want %v", s.key, s.size, err, s.want)
+		}
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if got := node.store.usage[a]; got != 100 {
+		t.Errorf("a uses %d bytes, want 100", got)
+	}
+	if node.store.bytes != 250 {
+		t.Errorf("store holds %d bytes, want 250", node.store.bytes)
+	}
+}
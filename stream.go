@@ -0,0 +1,289 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// A UDP transport with stream_threshold set also listens for TCP on its
+// port number, and messages whose encoding exceeds the threshold go over a
+// stream instead of a datagram, which large ones would only reach the peer
+// as IP fragments lose together. A large request is written to a fresh
+// connection to the peer, which answers on it. A large reply to a request
+// that came in as a datagram is kept for streamOfferTTL under a random
+// token, and the datagram reply says only that; the requester then fetches
+// it over a connection of its own, which it can open through NATs that
+// would not let the replying node in. Requests say whether their sender
+// knows to fetch, so older peers are always answered with datagrams, and a
+// peer that refuses the connection is sent a datagram after all.
+//
+// TCP does the flow control: data goes out a streamChunk at a time, so a
+// peer that keeps reading is never cut off however slow it is, while one
+// that stops for streamIdle is.
+const (
+	streamRequest   = 'q'
+	streamFetch     = 'f'
+	maxStreamSize   = 16 << 20 // encoded message
+	maxStreamValue  = 8 << 20
+	maxStreamOffers = 256
+	streamOfferTTL  = 30 * time.Second
+	streamIdle      = 10 * time.Second
+	streamChunk     = 32 << 10
+	streamTokenSize = 16
+)
+
+var errNoStream = errors.New("peer takes no streams")
+
+type streamOffer struct {
+	data    []byte
+	expires time.Time
+}
+
+// listenStream starts the stream listener for messages over above bytes.
+// If the port is taken for TCP the transport keeps to datagrams.
+func (t *udpTransport) listenStream(above int) {
+	ln, err := net.Listen("tcp", t.conn.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	t.stream, t.streamAbove = ln, above
+	t.offers = make(map[string]*streamOffer)
+	go t.acceptStreams()
+}
+
+// streams reports whether a message of size bytes goes over a stream.
+func (t *udpTransport) streams(size int) bool {
+	return t.stream != nil && size > t.streamAbove
+}
+
+// offer keeps a reply to be fetched and returns its token, or "" if too
+// many are waiting already.
+func (t *udpTransport) offer(data []byte) string {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for token, o := range t.offers {
+		if now.After(o.expires) {
+			delete(t.offers, token)
+		}
+	}
+	if len(t.offers) >= maxStreamOffers {
+		return ""
+	}
+	token := make([]byte, streamTokenSize)
+	rand.Read(token)
+	t.offers[hex.EncodeToString(token)] = &streamOffer{data: append([]byte(nil), data...), expires: now.Add(streamOfferTTL)}
+	return hex.EncodeToString(token)
+}
+
+// takeOffer returns the reply waiting under token and forgets it.
+func (t *udpTransport) takeOffer(token string) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.offers[token]
+	delete(t.offers, token)
+	if !ok || time.Now().After(o.expires) {
+		return nil
+	}
+	return o.data
+}
+
+// dialStream connects to the stream listener of the peer at addr, and
+// closes the connection when ctx is done.
+func (t *udpTransport) dialStream(ctx context.Context, addr netip.AddrPort) (net.Conn, func(), error) {
+	d := net.Dialer{Timeout: streamIdle}
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("%w: %w", errNoStream, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, func() { stop(); conn.Close() }, nil
+}
+
+// callStream sends a request, encoded as data, over a stream to addr and
+// reads the reply off it.
+func (t *udpTransport) callStream(ctx context.Context, addr netip.AddrPort, data []byte) (*message, error) {
+	conn, done, err := t.dialStream(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// Our UDP port, which the peer reports as where the request came from.
+	header := []byte{streamRequest, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(t.conn.LocalAddr().(*net.UDPAddr).Port))
+	conn.SetWriteDeadline(time.Now().Add(streamIdle))
+	if _, err := conn.Write(header); err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	if err := t.writeStream(conn, data); err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	reply, err := t.readStream(conn, maxStreamSize)
+	if err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	resp, err := decodeSized(reply, maxStreamSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	return resp, replyError(resp)
+}
+
+// fetchStream fetches the reply stub stands for from the peer at addr.
+func (t *udpTransport) fetchStream(ctx context.Context, addr netip.AddrPort, stub *message) (*message, error) {
+	conn, done, err := t.dialStream(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	defer done()
+	conn.SetWriteDeadline(time.Now().Add(streamIdle))
+	if _, err := conn.Write([]byte{streamFetch}); err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	if err := t.writeStream(conn, []byte(stub.Stream)); err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	data, err := t.readStream(conn, maxStreamSize)
+	if err != nil {
+		return nil, t.streamError(ctx, err)
+	}
+	resp, err := decodeSized(data, maxStreamSize)
+	if err != nil || resp.RPCID != stub.RPCID || !resp.Reply {
+		return nil, fmt.Errorf("%w: streamed reply gone or garbled", ErrUnreachable)
+	}
+	return resp, replyError(resp)
+}
+
+func (t *udpTransport) streamError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %w", ErrUnreachable, err)
+}
+
+func (t *udpTransport) acceptStreams() {
+	for {
+		conn, err := t.stream.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go t.serveStream(conn)
+	}
+}
+
+// serveStream answers a request or hands out an offered reply.
+func (t *udpTransport) serveStream(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(streamIdle))
+	var kind [1]byte
+	if _, err := io.ReadFull(conn, kind[:]); err != nil {
+		return
+	}
+	switch kind[0] {
+	case streamFetch:
+		token, err := t.readStream(conn, 2*streamTokenSize)
+		if err != nil {
+			return
+		}
+		t.writeStream(conn, t.takeOffer(string(token)))
+	case streamRequest:
+		var port [2]byte
+		if _, err := io.ReadFull(conn, port[:]); err != nil {
+			return
+		}
+		data, err := t.readStream(conn, maxStreamSize)
+		if err != nil {
+			return
+		}
+		req, err := decodeSized(data, maxStreamSize)
+		if err != nil || req.Reply {
+			return
+		}
+		t.mu.Lock()
+		handler := t.handler
+		t.mu.Unlock()
+		remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if handler == nil || !ok {
+			return
+		}
+		from := netip.AddrPortFrom(remote.AddrPort().Addr().Unmap(), binary.BigEndian.Uint16(port[:]))
+		resp := handler(from.String(), req)
+		if resp == nil {
+			return
+		}
+		resp.RPCID = req.RPCID
+		resp.Reply = true
+		buf, err := encodePacket(resp)
+		if err != nil {
+			return
+		}
+		t.writeStream(conn, buf.Bytes())
+		releasePacket(buf)
+	}
+}
+
+// writeStream writes data to conn, length first.
+func (t *udpTransport) writeStream(conn net.Conn, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	conn.SetWriteDeadline(time.Now().Add(streamIdle))
+	if _, err := conn.Write(size[:]); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), streamChunk)]
+		conn.SetWriteDeadline(time.Now().Add(streamIdle))
+		written, err := conn.Write(chunk)
+		t.mu.Lock()
+		t.sent += int64(written)
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// readStream reads what writeStream wrote, of at most limit bytes. It
+// allocates as the data arrives, not up front for the length a peer
+// claims.
+func (t *udpTransport) readStream(conn net.Conn, limit int) ([]byte, error) {
+	var size [4]byte
+	conn.SetReadDeadline(time.Now().Add(streamIdle))
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(size[:]))
+	if length > limit {
+		return nil, fmt.Errorf("%d bytes on a stream", length)
+	}
+	data := make([]byte, 0, min(length, streamChunk))
+	chunk := make([]byte, streamChunk)
+	for len(data) < length {
+		conn.SetReadDeadline(time.Now().Add(streamIdle))
+		read, err := io.ReadFull(conn, chunk[:min(length-len(data), streamChunk)])
+		t.mu.Lock()
+		t.received += int64(read)
+		t.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:read]...)
+	}
+	return data, nil
+}
@@ -0,0 +1,305 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// Anti-entropy: every sync interval we pick one of our closest peers,
+// which are responsible for most of the keys we are, and reconcile the
+// records we both should hold. Both sides see those records as the leaves
+// of a Merkle tree over key hashes, one level per hex digit: a node's hash
+// combines the key, version and value digest of every record under its
+// prefix. Starting from the root we send the hashes of the prefixes still
+// in question and the peer answers with its own for the ones that differ,
+// whose children we ask about next, so only the parts of the key space
+// where the copies diverge get looked at and a round takes O(log n)
+// hashes. A differing prefix with few records under it is settled by
+// exchanging a summary of them: the peer answers with the keys it wants
+// from us, those it lacks or holds an older version of, and a summary of
+// its own records under the prefix that we lack or hold an older version
+// of, which we then fetch. Copies of multi-writer records that differ at
+// all go both ways, as merging them is how they converge. This repairs
+// what churn and dropped stores leave behind without waiting for
+// publishers to republish.
+const (
+	featureSync      = "sync" // the sync message
+	maxSyncEntries   = 256    // summary entries or tree nodes per message
+	maxSyncSummary   = 32 << 10
+	maxSyncTransfers = 64 // records sent or fetched per round
+	syncLeafSize     = 32 // records under a prefix settled by summary
+	syncFanout       = 16 // children of a tree node, one per hex digit
+)
+
+// syncEntry summarises one record. The short field names keep summaries
+// small.
+type syncEntry struct {
+	Key     string `json:"k"`
+	Version int64  `json:"v,omitempty"`
+	Digest  uint64 `json:"d"`
+}
+
+// merkleNode is the hash of the records under a prefix of key hashes, the
+// XOR of one hash per record, and how many there are.
+type merkleNode struct {
+	Prefix string `json:"p"`
+	Hash   uint64 `json:"h,omitempty"`
+	Count  int    `json:"n,omitempty"`
+}
+
+// merkleLeaf is one record's place in the tree.
+type merkleLeaf struct {
+	hash string // of the key
+	key  string
+	sum  uint64 // of key, version and value digest
+}
+
+// antiEntropy runs one sync round with a random close peer that supports
+// it.
+func (n *Node) antiEntropy(ctx context.Context) {
+	n.mu.Lock()
+	partners := make([]*Peer, 0, n.cfg.K)
+	for _, p := range n.dht.closest(n.self.id, n.cfg.K) {
+		if hasFeature(p.features, featureSync) {
+			partners = append(partners, p)
+		}
+	}
+	n.mu.Unlock()
+	if len(partners) == 0 {
+		return
+	}
+	partner := partners[n.randomIndex(len(partners))]
+
+	differing := n.diffTree(ctx, partner)
+	sent, fetched := 0, 0
+	for _, prefix := range differing {
+		if ctx.Err() != nil || sent+fetched >= maxSyncTransfers {
+			break
+		}
+		s, f := n.syncPrefix(ctx, partner, prefix, maxSyncTransfers-sent-fetched)
+		sent += s
+		fetched += f
+	}
+	if sent+fetched > 0 {
+		n.log.Debug("synced records", "peer", partner.id, "ranges", len(differing), "sent", sent, "fetched", fetched)
+	}
+}
+
+// diffTree walks our tree and partner's down from the root and returns
+// the prefixes few enough records sit under to settle by summary.
+func (n *Node) diffTree(ctx context.Context, partner *Peer) []string {
+	n.mu.Lock()
+	leaves := n.merkleLeaves(partner.id)
+	n.mu.Unlock()
+
+	settle := make([]string, 0)
+	pending := []string{""}
+	for len(pending) > 0 && ctx.Err() == nil {
+		batch := pending[:min(len(pending), maxSyncEntries)]
+		pending = pending[len(batch):]
+		req := n.request(msgSync)
+		for _, prefix := range batch {
+			req.Merkle = append(req.Merkle, merkleNodeOf(leaves, prefix))
+		}
+		resp, err := n.call(ctx, partner, req)
+		if err != nil {
+			n.log.Debug("sync failed", "peer", partner.id, "err", err)
+			return settle
+		}
+		for _, theirs := range resp.Merkle {
+			ours := merkleNodeOf(leaves, theirs.Prefix)
+			if len(theirs.Prefix) >= IDBits/4 || max(ours.Count, theirs.Count) <= syncLeafSize {
+				settle = append(settle, theirs.Prefix)
+				continue
+			}
+			for i := 0; i < syncFanout; i++ {
+				pending = append(pending, theirs.Prefix+string("0123456789abcdef"[i]))
+			}
+		}
+	}
+	return settle
+}
+
+// syncPrefix exchanges summaries of the records under prefix with
+// partner and sends and fetches what is missing or outdated, at most
+// limit records. It returns how many were sent and fetched.
+func (n *Node) syncPrefix(ctx context.Context, partner *Peer, prefix string, limit int) (sent, fetched int) {
+	from, until := prefixRange(prefix)
+	n.mu.Lock()
+	keys := n.syncKeys(partner.id, from, until)
+	summary := make([]syncEntry, 0, min(len(keys), maxSyncEntries))
+	for _, key := range keys[:min(len(keys), maxSyncEntries)] {
+		summary = append(summary, n.syncEntry(key))
+	}
+	n.mu.Unlock()
+
+	req := n.request(msgSync)
+	req.Target, req.Until, req.Summary = from, until, summary
+	resp, err := n.call(ctx, partner, req)
+	if err != nil {
+		n.log.Debug("sync failed", "peer", partner.id, "err", err)
+		return 0, 0
+	}
+	for _, key := range resp.Want {
+		if ctx.Err() != nil || sent >= limit {
+			break
+		}
+		n.mu.Lock()
+		r, ok := n.store.get(key)
+		n.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if _, err := n.call(ctx, partner, n.storeRequest(partner, resp.Token, key, r.value, r.version)); err == nil {
+			sent++
+		}
+	}
+	for _, e := range resp.Summary {
+		if ctx.Err() != nil || sent+fetched >= limit {
+			break
+		}
+		if n.fetchFrom(ctx, partner, e.Key) == nil {
+			fetched++
+		}
+	}
+	return sent, fetched
+}
+
+// fetchFrom gets key from p and stores it as if p had stored it with us.
+func (n *Node) fetchFrom(ctx context.Context, p *Peer, key string) error {
+	req := n.request(msgFindValue)
+	req.Key = key
+	resp, err := n.call(ctx, p, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Found {
+		return ErrNotFound
+	}
+	return n.storeRemote(&message{From: contact{ID: p.id}, Key: key, Value: resp.Value, Version: resp.Version})
+}
+
+// prefixRange returns the lowest and highest hash starting with prefix.
+func prefixRange(prefix string) (string, string) {
+	pad := IDBits/4 - len(prefix)
+	return prefix + strings.Repeat("0", pad), prefix + strings.Repeat("f", pad)
+}
+
+// syncKeys returns the keys we hold that peer id should hold too, by our
+// routing table, whose hashes fall between from and until, in hash order.
+// n.mu must be held.
+func (n *Node) syncKeys(id, from, until string) []string {
+	keys := make([]string, 0)
+	for _, leaf := range n.merkleLeaves(id) {
+		if leaf.hash >= from && leaf.hash <= until {
+			keys = append(keys, leaf.key)
+		}
+	}
+	return keys
+}
+
+// merkleLeaves returns the records we share with peer id in hash order.
+// n.mu must be held.
+func (n *Node) merkleLeaves(id string) []merkleLeaf {
+	leaves := make([]merkleLeaf, 0)
+	for _, key := range n.store.keys() {
+		if !n.shares(key, id) {
+			continue
+		}
+		r, _ := n.store.peek(key)
+		var buf [16]byte
+		binary.BigEndian.PutUint64(buf[:8], uint64(r.version))
+		binary.BigEndian.PutUint64(buf[8:], r.digest)
+		sum := sha256.Sum256(append([]byte(key), buf[:]...))
+		leaves = append(leaves, merkleLeaf{hash: n.dht.hashValue(key), key: key, sum: binary.BigEndian.Uint64(sum[:8])})
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].hash < leaves[j].hash })
+	return leaves
+}
+
+// merkleNodeOf combines the leaves under prefix, which are sorted by hash.
+func merkleNodeOf(leaves []merkleLeaf, prefix string) merkleNode {
+	from, until := prefixRange(prefix)
+	lo := sort.Search(len(leaves), func(i int) bool { return leaves[i].hash >= from })
+	hi := sort.Search(len(leaves), func(i int) bool { return leaves[i].hash > until })
+	node := merkleNode{Prefix: prefix, Count: hi - lo}
+	for _, leaf := range leaves[lo:hi] {
+		node.Hash ^= leaf.sum
+	}
+	return node
+}
+
+// shares reports whether we and peer id should both hold key, as far as
+// we know the peers close to it. n.mu must be held.
+func (n *Node) shares(key, id string) bool {
+	target := n.dht.hashValue(key)
+	candidates := append(n.dht.closest(target, n.cfg.K), n.self)
+	n.dht.sortByDistance(candidates, target)
+	replicas := n.placeReplicas(key, candidates)
+	return contains(replicas, n.self.id) && contains(replicas, id)
+}
+
+// syncEntry summarises the record under key. n.mu must be held.
+func (n *Node) syncEntry(key string) syncEntry {
+	r, _ := n.store.peek(key)
+	return syncEntry{Key: key, Version: r.version, Digest: r.digest}
+}
+
+// newerThan reports whether record r is a later copy than the one e
+// summarises, or one to merge with it.
+func newerThan(r *record, e syncEntry) bool {
+	if multiWriter(namespaceOf(e.Key)) {
+		return r.digest != e.Digest
+	}
+	return r.version > e.Version
+}
+
+// olderThan is newerThan the other way round.
+func olderThan(r *record, e syncEntry) bool {
+	if multiWriter(namespaceOf(e.Key)) {
+		return r.digest != e.Digest
+	}
+	return r.version < e.Version
+}
+
+// handleSync answers a sync request from peer id. For tree nodes it
+// returns ours for the prefixes whose hashes differ. For a summary it
+// returns the keys of it we want, and the summary of those records of
+// ours between Target and Until that the peer should have but does not
+// have as they are here.
+func (n *Node) handleSync(id string, req, resp *message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(req.Merkle) > 0 {
+		leaves := n.merkleLeaves(id)
+		for _, theirs := range req.Merkle {
+			if ours := merkleNodeOf(leaves, theirs.Prefix); ours != theirs {
+				resp.Merkle = append(resp.Merkle, ours)
+			}
+		}
+		return
+	}
+
+	theirs := make(map[string]syncEntry, len(req.Summary))
+	for _, e := range req.Summary {
+		theirs[e.Key] = e
+		if r, ok := n.store.peek(e.Key); ok && olderThan(r, e) || !ok && n.responsible(e.Key) {
+			resp.Want = append(resp.Want, e.Key)
+		}
+	}
+	size := 0
+	for _, key := range n.syncKeys(id, req.Target, req.Until) {
+		if len(resp.Summary) >= maxSyncEntries || size+len(key) > maxSyncSummary {
+			break
+		}
+		r, _ := n.store.peek(key)
+		if e, ok := theirs[key]; ok && !newerThan(r, e) {
+			continue
+		}
+		resp.Summary = append(resp.Summary, n.syncEntry(key))
+		size += len(key)
+	}
+}
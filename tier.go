@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const recordsDir = "records"
+
+// diskTier holds the values of records spilled out of memory, one file per
+// key. The records themselves, minus their values, stay in the store, so
+// lookups, quotas and expiry work the same for both tiers. Nothing in it
+// outlives the process: the store is rebuilt from the write-ahead log and
+// by republishing after a restart, so openDiskTier starts from an empty
+// directory.
+//
+// Each file starts with one byte saying whether the rest is the value as
+// is or DEFLATE-compressed, which values of at least threshold bytes are
+// when that makes them smaller. With an AEAD the file is that, sealed and
+// prefixed with its nonce, with the file name as additional data so files
+// cannot be swapped.
+type diskTier struct {
+	dir       string
+	threshold int
+	aead      cipher.AEAD // seals whole files when encryption is on
+}
+
+const (
+	diskRaw byte = iota
+	diskDeflate
+)
+
+func openDiskTier(dir string, threshold int, aead cipher.AEAD) (*diskTier, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskTier{dir: dir, threshold: threshold, aead: aead}, nil
+}
+
+func (d *diskTier) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *diskTier) write(key string, value []byte) error {
+	data := append([]byte{diskRaw}, value...)
+	if d.threshold > 0 && len(value) >= d.threshold {
+		if packed, ok := deflate(value); ok {
+			data = append([]byte{diskDeflate}, packed...)
+		}
+	}
+	path := d.path(key)
+	if d.aead != nil {
+		nonce := make([]byte, d.aead.NonceSize())
+		rand.Read(nonce)
+		data = d.aead.Seal(nonce, nonce, data, []byte(filepath.Base(path)))
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// read returns the value stored for key, which is expected to be length
+// bytes long.
+func (d *diskTier) read(key string, length int) ([]byte, error) {
+	path := d.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if d.aead != nil {
+		size := d.aead.NonceSize()
+		if len(data) < size {
+			return nil, errors.New("short record file")
+		}
+		if data, err = d.aead.Open(nil, data[:size], data[size:], []byte(filepath.Base(path))); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty record file")
+	}
+	switch data[0] {
+	case diskRaw:
+		return data[1:], nil
+	case diskDeflate:
+		return inflate(data[1:], length)
+	}
+	return nil, fmt.Errorf("unknown record encoding %d", data[0])
+}
+
+func (d *diskTier) remove(key string) {
+	os.Remove(d.path(key))
+}
+
+// spill moves r's value to disk. It reports false when there is no disk
+// tier or writing failed, in which case the caller evicts r instead.
+func (s *store) spill(r *record) bool {
+	if s.disk == nil || r.onDisk {
+		return false
+	}
+	if err := s.disk.write(r.key, r.value); err != nil {
+		return false
+	}
+	s.memBytes -= r.size()
+	r.value = nil
+	r.onDisk = true
+	s.unqueue(r)
+	return true
+}
+
+// promote reads a spilled value back into memory. A value that cannot be
+// read is dropped along with its record.
+func (s *store) promote(r *record) bool {
+	value, err := s.disk.read(r.key, r.length)
+	if err != nil || len(value) != r.length {
+		s.delete(r.key)
+		return false
+	}
+	s.disk.remove(r.key)
+	r.value = value
+	r.onDisk = false
+	s.memBytes += r.size()
+	s.queue(r)
+	return true
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// tokenRotation is how often the write token secret changes. Tokens made
+// with the previous secret are still accepted, so a token stays valid for
+// between one and two rotations.
+const tokenRotation = 5 * time.Minute
+
+// Write tokens work as in BitTorrent's mainline DHT: every find_node and
+// find_value reply carries a token bound to the requester's address, and a
+// store is only accepted with a token we handed to that address recently.
+// A peer therefore has to have looked us up before it can store with us,
+// which rules out blind store floods from spoofed addresses.
+type tokenSecrets struct {
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+// rotateTokens replaces the secret when it is due. n.mu must be held.
+func (n *Node) rotateTokens(now time.Time) {
+	s := &n.tokens
+	if s.current != nil && now.Sub(s.rotated) < tokenRotation {
+		return
+	}
+	s.previous = s.current
+	s.current = make([]byte, 32)
+	io.ReadFull(n.random, s.current)
+	s.rotated = now
+}
+
+func writeToken(secret []byte, addr string) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, addr)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (n *Node) issueToken(addr string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rotateTokens(n.clock.Now())
+	return writeToken(n.tokens.current, addr)
+}
+
+func (n *Node) validToken(addr, token string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rotateTokens(n.clock.Now())
+	for _, secret := range [][]byte{n.tokens.current, n.tokens.previous} {
+		if secret != nil && hmac.Equal([]byte(token), []byte(writeToken(secret, addr))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestWriteTokenRotation(t *testing.T) {
+	clock := dhtsim.NewClock(time.Unix(0, 0))
+	node := newNode(fuzzConfig(), newMemTransport(dhtsim.NewNetwork()), clock, rand.Reader, nil)
+	const addr = "mem:7"
+	token := node.issueToken(addr)
+	if !node.validToken(addr, token) {
+		t.Fatal("fresh token rejected")
+	}
+	if node.validToken("mem:8", token) {
+		t.Error("token accepted from another address")
+	}
+	clock.Advance(tokenRotation)
+	if !node.validToken(addr, token) {
+		t.Error("token rejected one rotation later")
+	}
+	clock.Advance(tokenRotation)
+	if node.validToken(addr, token) {
+		t.Error("token accepted two rotations later")
+	}
+}
+
+func TestStoreNeedsToken(t *testing.T) {
+	ctx := context.Background()
+	network := dhtsim.NewNetwork()
+	a := NewNode(fuzzConfig(), newMemTransport(network))
+	b := NewNode(fuzzConfig(), newMemTransport(network))
+	store := func(token string) error {
+		req := a.request(msgStore)
+		req.Key, req.Value, req.Token = "k", []byte("v"), token
+		_, err := a.send(ctx, b.Addr(), req)
+		return err
+	}
+
+	for name, token := range map[string]string{
+		"no":             "",
+		"a made up":      "0123456789abcdef",
+		"someone else's": b.issueToken("mem:99"),
+	} {
+		if err := store(token); err == nil || err.Error() != ErrBadToken.Error() {
+			t.Errorf("store with %s token: %v, want %v", name, err, ErrBadToken)
+		}
+	}
+
+	// A lookup hands out the token the store needs.
+	req := a.request(msgFindValue)
+	req.Key = "k"
+	resp, err := a.send(ctx, b.Addr(), req)
+	if err != nil || resp.Token == "" {
+		t.Fatalf("find_value gave token %q, err %v", resp.Token, err)
+	}
+	if err := store(resp.Token); err != nil {
+		t.Fatalf("store with the lookup's token: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.store.has("k") {
+		t.Error("accepted store not kept")
+	}
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+// Topology is a network's node graph: an edge from a to b means b is in
+// a's routing table, in the bucket of the bit length of their XOR
+// distance. It comes from a crawl, which only sees the contacts nodes
+// return to find_node, or from the simulator, which sees whole routing
+// tables.
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+type TopologyNode struct {
+	ID      string `json:"id"`
+	Addr    string `json:"addr,omitempty"`
+	Reached bool   `json:"reached"`
+}
+
+type TopologyEdge struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Bucket int    `json:"bucket"`
+}
+
+func (r CrawlReport) Topology() Topology {
+	var t Topology
+	for _, node := range r.Nodes {
+		t.Nodes = append(t.Nodes, TopologyNode{ID: node.ID, Addr: node.Addr, Reached: node.Reached})
+		for _, id := range node.Contacts {
+			t.Edges = append(t.Edges, TopologyEdge{From: node.ID, To: id, Bucket: distanceBits(node.ID, id)})
+		}
+	}
+	return t
+}
+
+// SimTopology returns the routing tables of the nodes of sim that are up,
+// which must have been started by Simulated.
+func SimTopology(sim *dhtsim.Simulation) Topology {
+	var t Topology
+	for _, live := range sim.Live() {
+		node := live.(simNode)
+		t.Nodes = append(t.Nodes, TopologyNode{ID: node.ID(), Addr: node.Addr(), Reached: true})
+		node.mu.Lock()
+		peers := node.dht.peers()
+		node.mu.Unlock()
+		sort.Slice(peers, func(i, j int) bool { return peers[i].id < peers[j].id })
+		for _, p := range peers {
+			t.Edges = append(t.Edges, TopologyEdge{From: node.ID(), To: p.id, Bucket: distanceBits(node.ID(), p.id)})
+		}
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool { return t.Nodes[i].ID < t.Nodes[j].ID })
+	return t
+}
+
+// writeDOT writes t as a Graphviz digraph. Nodes are labelled with the
+// first eight hex digits of their ID; unreached ones are dashed. Edges
+// carry their bucket as an attribute, which layouts ignore.
+func (t Topology) writeDOT(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph dht {\n\tnode [shape=box, fontname=monospace];"); err != nil {
+		return err
+	}
+	for _, node := range t.Nodes {
+		style := ""
+		if !node.Reached {
+			style = ", style=dashed"
+		}
+		if _, err := fmt.Fprintf(w, "\t%q [label=%q%s];\n", node.ID, node.ID[:min(8, len(node.ID))], style); err != nil {
+			return err
+		}
+	}
+	for _, e := range t.Edges {
+		if _, err := fmt.Fprintf(w, "\t%q -> %q [bucket=%d];\n", e.From, e.To, e.Bucket); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// Export writes t to path, as DOT if it ends in .dot or .gv and as JSON
+// otherwise.
+func (t Topology) Export(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".dot", ".gv":
+		err = t.writeDOT(f)
+	default:
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(t)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
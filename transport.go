@@ -0,0 +1,601 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	msgPing      = "ping"
+	msgFindNode  = "find_node"
+	msgFindValue = "find_value"
+	msgStore     = "store"
+	msgPex       = "pex"
+	msgSync      = "sync"
+	msgGossip    = "gossip"
+
+	msgRelay         = "relay"
+	msgRelayRegister = "relay_register"
+	msgOnion         = "onion"
+)
+
+const (
+	maxPacketSize      = 65507
+	maxNodesPerMessage = 64
+)
+
+// Every RPC goes out over the one socket a udpTransport listens on, so
+// there are no connections to set up per call. What is kept per peer is the
+// resolved address, dropped after peerIdle without traffic and capped at
+// maxPeerAddrs entries.
+const (
+	peerIdle     = 10 * time.Minute
+	maxPeerAddrs = 4096
+)
+
+// Outgoing packets are encoded into buffers from packetPool, which go back
+// to the pool once written, and each read loop decodes out of one buffer
+// of its own; addresses are handled as netip.AddrPort values, which do not
+// allocate. Decoded messages are left alone: handlers and callers keep
+// them well past the packet they came in.
+var packetPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// encodePacket encodes m into a pooled buffer, which the caller hands back
+// with releasePacket once it has been sent.
+func encodePacket(m *message) (*bytes.Buffer, error) {
+	buf := packetPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(m); err != nil {
+		releasePacket(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releasePacket(buf *bytes.Buffer) {
+	// Keep the odd huge store from pinning its buffer forever.
+	if buf.Cap() <= 16<<10 {
+		packetPool.Put(buf)
+	}
+}
+
+var (
+	ErrClosed      = errors.New("transport closed")
+	ErrUnreachable = errors.New("peer unreachable")
+)
+
+// pendingCalls are the RPCs a transport is waiting for replies to, by
+// RPC ID. IDs are random, and a reply is only taken from the address its
+// request went to, so a host off the path can neither guess an ID nor
+// answer for the peer. The transport's mutex guards it.
+type pendingCalls map[uint64]*pendingCall
+
+type pendingCall struct {
+	to    string
+	reply chan *message
+}
+
+// add registers a call to to under a fresh ID and returns the ID and the
+// channel its reply arrives on.
+func (p pendingCalls) add(to string) (uint64, chan *message) {
+	var id uint64
+	for id == 0 || p[id] != nil {
+		var b [8]byte
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint64(b[:])
+	}
+	call := &pendingCall{to: to, reply: make(chan *message, 1)}
+	p[id] = call
+	return id, call.reply
+}
+
+// deliver hands resp, which came from from, to the call waiting for it,
+// if there is one and it was sent there.
+func (p pendingCalls) deliver(from string, resp *message) {
+	call, ok := p[resp.RPCID]
+	if !ok || call.to != from {
+		return
+	}
+	select {
+	case call.reply <- resp:
+	default:
+	}
+}
+
+// remoteError is an error reported by the peer itself, as opposed to a
+// failure to reach it.
+type remoteError struct {
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func replyError(resp *message) error {
+	if resp.Error == "" {
+		return nil
+	}
+	return &remoteError{msg: resp.Error}
+}
+
+// decodeMessage parses and sanity-checks one packet. Everything that comes
+// off the wire goes through here before a handler sees it.
+func decodeMessage(data []byte) (*message, error) {
+	return decodeSized(data, maxPacketSize)
+}
+
+// decodeSized is decodeMessage for messages of up to limit bytes.
+func decodeSized(data []byte, limit int) (*message, error) {
+	if len(data) > limit {
+		return nil, errors.New("packet too large")
+	}
+	msg := new(message)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	if err := msg.validate(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (m *message) validate() error {
+	if m.Type == "" {
+		return errors.New("missing message type")
+	}
+	if !validID(m.From.ID) {
+		return fmt.Errorf("bad sender id %q", m.From.ID)
+	}
+	if len(m.From.ENR) > maxRecordText {
+		return errors.New("sender record too large")
+	}
+	if len(m.From.Addrs) > maxContactAddrs {
+		return fmt.Errorf("%d sender addresses", len(m.From.Addrs))
+	}
+	if m.Hello != nil && len(m.Hello.Features) > maxFeatures {
+		return fmt.Errorf("%d features in hello", len(m.Hello.Features))
+	}
+	if m.Hello != nil && (m.Hello.Vnodes < 0 || m.Hello.Vnodes > maxVirtualNodes) {
+		return fmt.Errorf("%d virtual nodes in hello", m.Hello.Vnodes)
+	}
+	if m.Target != "" && !validID(m.Target) {
+		return fmt.Errorf("bad target id %q", m.Target)
+	}
+	if m.Until != "" && !validID(m.Until) {
+		return fmt.Errorf("bad window end %q", m.Until)
+	}
+	if m.Hint != nil && !validID(m.Hint.ID) {
+		return fmt.Errorf("bad hint id %q", m.Hint.ID)
+	}
+	if len(m.Summary) > maxSyncEntries || len(m.Want) > maxSyncEntries || len(m.Merkle) > maxSyncEntries {
+		return fmt.Errorf("%d summary entries, %d wanted keys and %d tree nodes in one message", len(m.Summary), len(m.Want), len(m.Merkle))
+	}
+	if len(m.Members) > maxGossipEntries {
+		return fmt.Errorf("%d members in one message", len(m.Members))
+	}
+	for _, e := range m.Members {
+		if !validID(e.ID) || len(e.Features) > maxFeatures {
+			return fmt.Errorf("bad member %q", e.ID)
+		}
+	}
+	for _, node := range m.Merkle {
+		if len(node.Prefix) > IDBits/4 || strings.Trim(node.Prefix, "0123456789abcdef") != "" {
+			return fmt.Errorf("bad tree prefix %q", node.Prefix)
+		}
+	}
+	if len(m.Nodes) > maxNodesPerMessage {
+		return fmt.Errorf("%d nodes in one message", len(m.Nodes))
+	}
+	for _, c := range m.Nodes {
+		if !validID(c.ID) {
+			return fmt.Errorf("bad node id %q", c.ID)
+		}
+		if len(c.ENR) > maxRecordText {
+			return fmt.Errorf("record of node %q too large", c.ID)
+		}
+		if len(c.Addrs) > maxContactAddrs {
+			return fmt.Errorf("%d addresses for node %q", len(c.Addrs), c.ID)
+		}
+	}
+	return nil
+}
+
+func validID(id string) bool {
+	if len(id) != IDBits/4 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+type contact struct {
+	ID    string   `json:"id"`
+	Addr  string   `json:"addr,omitempty"`
+	Addrs []string `json:"addrs,omitempty"` // multiaddrs of every endpoint
+	ENR   string   `json:"enr,omitempty"`
+}
+
+type message struct {
+	Type     string        `json:"type"`
+	RPCID    uint64        `json:"rpc_id"`
+	Reply    bool          `json:"reply,omitempty"`
+	From     contact       `json:"from"`
+	Target   string        `json:"target,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	Value    []byte        `json:"value,omitempty"`
+	Version  int64         `json:"version,omitempty"`
+	Replicas int           `json:"replicas,omitempty"`  // asked for by a store's publisher
+	CacheFor int64         `json:"cache_for,omitempty"` // milliseconds a pushed hot-key copy lives
+	Codec    string        `json:"codec,omitempty"`
+	Found    bool          `json:"found,omitempty"`
+	Nodes    []contact     `json:"nodes,omitempty"`
+	Token    string        `json:"token,omitempty"`
+	Codecs   []string      `json:"codecs,omitempty"`
+	Hello    *hello        `json:"hello,omitempty"`
+	Hint     *contact      `json:"hint,omitempty"`  // the replica a store was meant for
+	Until    string        `json:"until,omitempty"` // end of a sync window that starts at Target
+	Summary  []syncEntry   `json:"summary,omitempty"`
+	Want     []string      `json:"want,omitempty"`
+	Merkle   []merkleNode  `json:"merkle,omitempty"`
+	Members  []gossipEntry `json:"members,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Relayed  bool          `json:"relayed,omitempty"`   // passed on by the sender's relay
+	MAC      []byte        `json:"mac,omitempty"`       // on private networks
+	StreamOK bool          `json:"stream_ok,omitempty"` // the sender fetches large replies off a stream
+	Stream   string        `json:"stream,omitempty"`    // token of a reply waiting on a stream
+}
+
+// Transport carries request/response messages between nodes. Handlers get
+// the observed source address of the request, which is what the node
+// records as the sender's contact address.
+type Transport interface {
+	Addr() string
+	Addrs() []string // every address it listens on, Addr first
+	Call(ctx context.Context, addr string, req *message) (*message, error)
+	Serve(handler func(from string, req *message) *message)
+	Close() error
+}
+
+// multiTransport serves requests on every listener. It sends from the
+// first one that can reach the destination, the first listener by default,
+// whose address is the main one we advertise.
+type multiTransport []Transport
+
+func (m multiTransport) Addr() string {
+	return m[0].Addr()
+}
+
+func (m multiTransport) Addrs() []string {
+	addrs := make([]string, 0, len(m))
+	for _, t := range m {
+		addrs = append(addrs, t.Addrs()...)
+	}
+	return addrs
+}
+
+func (m multiTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	if theirs, err := toMultiaddr(addr); err == nil {
+		for _, t := range m {
+			if ours, err := toMultiaddr(t.Addr()); err == nil && ours.reaches(theirs) {
+				return t.Call(ctx, addr, req)
+			}
+		}
+	}
+	return m[0].Call(ctx, addr, req)
+}
+
+func (m multiTransport) Serve(handler func(from string, req *message) *message) {
+	for _, t := range m {
+		t.Serve(handler)
+	}
+}
+
+func (m multiTransport) traffic() (sent, received int64) {
+	for _, t := range m {
+		if c, ok := t.(trafficCounter); ok {
+			s, r := c.traffic()
+			sent, received = sent+s, received+r
+		}
+	}
+	return sent, received
+}
+
+func (m multiTransport) faultPackets(f func(addr string) (duplicate bool, hold time.Duration)) {
+	for _, t := range m {
+		if p, ok := t.(packetFaulter); ok {
+			p.faultPackets(f)
+		}
+	}
+}
+
+func (m multiTransport) Close() error {
+	var first error
+	for _, t := range m {
+		if err := t.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type udpTransport struct {
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	pending pendingCalls
+	handler func(from string, req *message) *message
+	closed  bool
+	peers   map[string]*peerAddr
+	swept   time.Time
+
+	queues     map[netip.AddrPort]*peerQueue
+	batchers   map[netip.AddrPort]time.Time // peers taking batches, last seen
+	batchSwept time.Time
+
+	stream      net.Listener // nil without streams, see stream.go
+	streamAbove int
+	offers      map[string]*streamOffer
+
+	sent, received int64 // bytes of every datagram and stream
+
+	tamper func(addr string) (duplicate bool, hold time.Duration) // see faults.go
+}
+
+// trafficCounter is implemented by transports that count the bytes they
+// send and receive.
+type trafficCounter interface {
+	traffic() (sent, received int64)
+}
+
+type peerAddr struct {
+	addr netip.AddrPort
+	used time.Time
+}
+
+// listenUDP listens on addr, sending messages over streamAbove bytes over
+// streams unless it is 0.
+func listenUDP(addr string, streamAbove int) (*udpTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTransport{
+		conn:     conn,
+		pending:  make(pendingCalls),
+		peers:    make(map[string]*peerAddr),
+		queues:   make(map[netip.AddrPort]*peerQueue),
+		batchers: make(map[netip.AddrPort]time.Time),
+	}
+	if streamAbove > 0 {
+		t.listenStream(streamAbove)
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+func (t *udpTransport) Addr() string {
+	return t.conn.LocalAddr().String()
+}
+
+func (t *udpTransport) Addrs() []string {
+	return []string{t.Addr()}
+}
+
+func (t *udpTransport) Serve(handler func(from string, req *message) *message) {
+	t.mu.Lock()
+	t.handler = handler
+	t.mu.Unlock()
+}
+
+// resolve returns the UDP address for addr, resolving it only the first
+// time a peer is called or after it has been idle.
+func (t *udpTransport) resolve(addr string) (netip.AddrPort, error) {
+	now := time.Now()
+	t.mu.Lock()
+	if now.Sub(t.swept) > peerIdle {
+		for key, p := range t.peers {
+			if now.Sub(p.used) > peerIdle {
+				delete(t.peers, key)
+			}
+		}
+		t.swept = now
+	}
+	if p, ok := t.peers[addr]; ok {
+		p.used = now
+		t.mu.Unlock()
+		return p.addr, nil
+	}
+	t.mu.Unlock()
+
+	resolved, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	udpAddr := resolved.AddrPort()
+	t.mu.Lock()
+	if len(t.peers) < maxPeerAddrs {
+		t.peers[addr] = &peerAddr{addr: udpAddr, used: now}
+	}
+	t.mu.Unlock()
+	return udpAddr, nil
+}
+
+func (t *udpTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	udpAddr, err := t.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	var ch chan *message
+	req.RPCID, ch = t.pending.add(unmapped(udpAddr).String())
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.RPCID)
+		t.mu.Unlock()
+	}()
+
+	req.StreamOK = t.stream != nil
+	buf, err := encodePacket(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.streams(buf.Len()) {
+		resp, err := t.callStream(ctx, udpAddr, buf.Bytes())
+		if !errors.Is(err, errNoStream) {
+			releasePacket(buf)
+			return resp, err
+		}
+		// Not listening for streams: a datagram it is, if it fits.
+	}
+	err = t.write(buf.Bytes(), udpAddr, controlMessage(req))
+	releasePacket(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Stream != "" {
+			return t.fetchStream(ctx, udpAddr, resp)
+		}
+		return resp, replyError(resp)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *udpTransport) writeTo(data []byte, addr netip.AddrPort) (int, error) {
+	t.mu.Lock()
+	tamper := t.tamper
+	t.mu.Unlock()
+	if tamper != nil {
+		duplicate, hold := tamper(unmapped(addr).String())
+		if duplicate {
+			t.send(data, addr)
+		}
+		if hold > 0 {
+			data = append([]byte(nil), data...)
+			time.AfterFunc(hold, func() { t.send(data, addr) })
+			return len(data), nil
+		}
+	}
+	return t.send(data, addr)
+}
+
+func (t *udpTransport) send(data []byte, addr netip.AddrPort) (int, error) {
+	n, err := t.conn.WriteToUDPAddrPort(data, addr)
+	t.mu.Lock()
+	t.sent += int64(n)
+	t.mu.Unlock()
+	return n, err
+}
+
+func (t *udpTransport) faultPackets(f func(addr string) (duplicate bool, hold time.Duration)) {
+	t.mu.Lock()
+	t.tamper = f
+	t.mu.Unlock()
+}
+
+func (t *udpTransport) traffic() (sent, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent, t.received
+}
+
+func (t *udpTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	if t.stream != nil {
+		t.stream.Close()
+	}
+	return t.conn.Close()
+}
+
+func (t *udpTransport) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := t.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		t.mu.Lock()
+		t.received += int64(n)
+		t.mu.Unlock()
+		msgs, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			t.learnBatching(from, msg)
+			if msg.Reply {
+				t.mu.Lock()
+				t.pending.deliver(unmapped(from).String(), msg)
+				t.mu.Unlock()
+				continue
+			}
+			go t.handle(from, msg)
+		}
+	}
+}
+
+// unmapped is addr with an IPv4-mapped IPv6 address as plain IPv4.
+func unmapped(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+func (t *udpTransport) handle(from netip.AddrPort, req *message) {
+	t.mu.Lock()
+	handler := t.handler
+	t.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	// Report IPv4 peers of a dual-stack socket by their IPv4 address.
+	resp := handler(unmapped(from).String(), req)
+	if resp == nil {
+		return
+	}
+	resp.RPCID = req.RPCID
+	resp.Reply = true
+	buf, err := encodePacket(resp)
+	if err != nil {
+		return
+	}
+	if t.streams(buf.Len()) && req.StreamOK {
+		if token := t.offer(buf.Bytes()); token != "" {
+			releasePacket(buf)
+			stub := &message{Type: resp.Type, RPCID: req.RPCID, Reply: true, From: resp.From, Stream: token}
+			if buf, err = encodePacket(stub); err != nil {
+				return
+			}
+		}
+	}
+	t.write(buf.Bytes(), from, controlMessage(resp))
+	releasePacket(buf)
+}
@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+const testID = "5de5e65c694befdc1d96d7fdda9686a3"
+
+// TestReplyFromElsewhere checks that a reply carrying a pending call's ID
+// is only taken from the address the call went to.
+func TestReplyFromElsewhere(t *testing.T) {
+	a, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := listenUDP("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	release := make(chan struct{})
+	b.Serve(func(from string, req *message) *message {
+		<-release
+		return &message{Type: msgPing, From: contact{ID: testID}, Key: "real"}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan *message, 1)
+	go func() {
+		resp, err := a.Call(ctx, b.Addr(), &message{Type: msgPing, From: contact{ID: testID}})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	var id uint64
+	for deadline := time.Now().Add(5 * time.Second); id == 0 && time.Now().Before(deadline); {
+		a.mu.Lock()
+		for pending := range a.pending {
+			id = pending
+		}
+		a.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	if id == 0 {
+		t.Fatal("call never registered")
+	}
+
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+	forged, _ := json.Marshal(&message{Type: msgPing, From: contact{ID: testID}, RPCID: id, Reply: true, Key: "forged"})
+	if _, err := spoofer.WriteToUDP(forged, a.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if resp := <-done; resp == nil || resp.Key != "real" {
+		t.Fatalf("got %+v, want the reply of the peer called", resp)
+	}
+}
+
+func TestRandomRPCIDs(t *testing.T) {
+	p := make(pendingCalls)
+	first, _ := p.add("a")
+	second, _ := p.add("a")
+	if first == second || second == first+1 {
+		t.Errorf("IDs %d then %d look sequential", first, second)
+	}
+}
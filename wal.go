@@ -0,0 +1,243 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The write-ahead log makes the records a node accepted survive a crash.
+// Every record stored for a peer is appended to storage/store.wal and
+// synced before it is applied and the store acknowledged, and every record
+// we put ourselves is appended once stored. Every save interval, and on shutdown, the whole store is
+// written to storage/store.checkpoint and the log emptied. On startup the
+// checkpoint and then the log are loaded back, each line going through the
+// same checks as a snapshot record: copies whose TTL ran out are dropped
+// and ours are kept, to be republished as usual. Deletions are not
+// logged; expiry and eviction simply apply again after loading.
+//
+// Both files are JSON lines of snapshot records. With encrypt_store each
+// line is instead the quoted base64 of the record sealed with the key
+// from store_key_file, its nonce first. A last line cut short by a crash
+// is ignored.
+const (
+	walFile        = "store.wal"
+	checkpointFile = "store.checkpoint"
+)
+
+var walData = []byte("wal")
+
+// errLog wraps a failure to append to the log.
+var errLog = errors.New("wal")
+
+// storeLog is the open write-ahead log.
+type storeLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	aead cipher.AEAD
+}
+
+func openStoreLog(path string, aead cipher.AEAD) (*storeLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &storeLog{f: f, aead: aead}, nil
+}
+
+func encodeLogLine(line snapshotRecord, aead cipher.AEAD) ([]byte, error) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return nil, err
+	}
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		if data, err = json.Marshal(base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, data, walData))); err != nil {
+			return nil, err
+		}
+	}
+	return append(data, '\n'), nil
+}
+
+func decodeLogLine(data []byte, aead cipher.AEAD) (snapshotRecord, error) {
+	var line snapshotRecord
+	if aead != nil {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return line, err
+		}
+		sealed, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return line, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return line, errors.New("short sealed record")
+		}
+		size := aead.NonceSize()
+		if data, err = aead.Open(nil, sealed[:size], sealed[size:], walData); err != nil {
+			return line, err
+		}
+	}
+	err := json.Unmarshal(data, &line)
+	return line, err
+}
+
+func (l *storeLog) append(line snapshotRecord) error {
+	data, err := encodeLogLine(line, l.aead)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(data); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// logRecord appends the record now stored under key to the log, if there
+// is one. n.mu must not be held. Our own puts are logged this way, after
+// they are applied; stores from peers are logged before, see storeRemote.
+func (n *Node) logRecord(key string) error {
+	if n.wal == nil {
+		return nil
+	}
+	line, ok := n.snapshotRecord(key)
+	if !ok {
+		return nil
+	}
+	if err := n.wal.append(line); err != nil {
+		return fmt.Errorf("%w: %w", errLog, err)
+	}
+	return nil
+}
+
+// openStoreLog loads what the checkpoint and log hold and starts logging,
+// with a fresh checkpoint of what was loaded.
+func (n *Node) openStoreLog() error {
+	if n.cfg.EncryptStore && n.cfg.StoreKeyFile == "" {
+		// Without a key file the store key changes every start, see
+		// storeKey, so nothing logged could be read back.
+		n.log.Warn("wal needs store_key_file with encrypt_store, not logging stores")
+		return nil
+	}
+	aead, err := storeCipher(n.cfg)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	for _, name := range []string{checkpointFile, walFile} {
+		count, err := n.loadStoreLog(filepath.Join(n.cfg.Storage, name), aead)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		loaded += count
+	}
+	n.mu.Lock()
+	n.evict()
+	n.mu.Unlock()
+	if n.wal, err = openStoreLog(filepath.Join(n.cfg.Storage, walFile), aead); err != nil {
+		return err
+	}
+	n.log.Info("loaded records", "count", loaded)
+	return n.checkpoint()
+}
+
+func (n *Node) loadStoreLog(path string, aead cipher.AEAD) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	loaded := 0
+	for lineNo := 1; ; lineNo++ {
+		data, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(data)) > 0 {
+				n.log.Warn("ignoring torn last record", "file", path)
+			}
+			return loaded, nil
+		}
+		if err != nil {
+			return loaded, err
+		}
+		line, err := decodeLogLine(data, aead)
+		if err != nil {
+			return loaded, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if err := n.importRecord(line, line.Publisher == n.self.id); err != nil {
+			n.log.Debug("skipping logged record", "key", line.Key, "err", err)
+			continue
+		}
+		loaded++
+	}
+}
+
+// checkpoint writes the whole store to the checkpoint file and empties the
+// log. Stores logged meanwhile wait, so none falls between the two.
+func (n *Node) checkpoint() error {
+	if n.wal == nil {
+		return nil
+	}
+	n.wal.mu.Lock()
+	defer n.wal.mu.Unlock()
+	n.mu.Lock()
+	keys := n.store.keys()
+	n.mu.Unlock()
+
+	path := filepath.Join(n.cfg.Storage, checkpointFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		line, ok := n.snapshotRecord(key)
+		if !ok {
+			continue
+		}
+		data, err := encodeLogLine(line, n.wal.aead)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(n.cfg.Storage); err != nil {
+		return err
+	}
+	if err := n.wal.f.Truncate(0); err != nil {
+		return err
+	}
+	return n.wal.f.Sync()
+}
@@ -0,0 +1,44 @@
+package dht
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Redamancylll/2020131047/dhtsim"
+)
+
+func TestStoreLoggedBeforeApplied(t *testing.T) {
+	cfg := fuzzConfig()
+	cfg.Storage = t.TempDir()
+	open := func() *Node {
+		node := NewNode(cfg, newMemTransport(dhtsim.NewNetwork()))
+		if err := node.openStoreLog(); err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	store := func(node *Node, key string) error {
+		return node.storeRemote(&message{Type: msgStore, From: contact{ID: testID}, Key: key, Value: []byte("v"), Version: 1})
+	}
+
+	node := open()
+	if err := store(node, "logged"); err != nil {
+		t.Fatal(err)
+	}
+	// A store the log cannot take is refused and not applied.
+	node.wal.f.Close()
+	if err := store(node, "unlogged"); !errors.Is(err, errLog) {
+		t.Fatalf("store with the log closed: %v, want %v", err, errLog)
+	}
+	if node.store.has("unlogged") {
+		t.Error("record applied though logging it failed")
+	}
+
+	again := open()
+	if !again.store.has("logged") {
+		t.Error("logged record not loaded back")
+	}
+	if again.store.has("unlogged") {
+		t.Error("unlogged record loaded back")
+	}
+}
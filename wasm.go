@@ -0,0 +1,259 @@
+//go:build js && wasm
+
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall/js"
+)
+
+// jsTransport sends packets over browser WebSockets, one per URL, in the
+// framing wsTransport uses. Nodes may send requests back over them.
+type jsTransport struct {
+	mu      sync.Mutex
+	pending pendingCalls
+	conns   map[string]*jsSocket
+	handler func(from string, req *message) *message
+	closed  bool
+
+	sent, received int64
+}
+
+// jsSocket is one browser WebSocket. ready is closed once it has opened or
+// failed to, err telling which.
+type jsSocket struct {
+	ws    js.Value
+	ready chan struct{}
+	once  sync.Once
+	err   error
+	funcs []js.Func
+	done  sync.Once
+}
+
+// NewBrowserTransport returns the transport of a node in a web page. It
+// cannot open sockets, so it dials the ws:// and wss:// listeners of
+// ordinary nodes through the browser's WebSocket API and listens on
+// nothing, which keeps the node out of everyone's routing table.
+func NewBrowserTransport() Transport {
+	return newJSTransport()
+}
+
+func newJSTransport() *jsTransport {
+	return &jsTransport{pending: make(pendingCalls), conns: make(map[string]*jsSocket)}
+}
+
+func (t *jsTransport) Addr() string           { return "" }
+func (t *jsTransport) Addrs() []string        { return nil }
+func (t *jsTransport) dials(m multiaddr) bool { return m.ws != "" }
+
+func (t *jsTransport) Serve(handler func(from string, req *message) *message) {
+	t.mu.Lock()
+	t.handler = handler
+	t.mu.Unlock()
+}
+
+// dial opens a WebSocket to addr and waits for it to open.
+func (t *jsTransport) dial(ctx context.Context, addr string) (s *jsSocket, err error) {
+	defer func() {
+		// The constructor throws on malformed URLs.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrUnreachable, addr, r)
+		}
+	}()
+	s = &jsSocket{ws: js.Global().Get("WebSocket").New(addr), ready: make(chan struct{})}
+	s.ws.Set("binaryType", "arraybuffer")
+	settle := func(err error) {
+		s.once.Do(func() {
+			s.err = err
+			close(s.ready)
+		})
+	}
+	on := func(event string, f func(js.Value)) {
+		fn := js.FuncOf(func(this js.Value, args []js.Value) any {
+			f(args[0])
+			return nil
+		})
+		s.funcs = append(s.funcs, fn)
+		s.ws.Set(event, fn)
+	}
+	on("onopen", func(js.Value) { settle(nil) })
+	on("onerror", func(js.Value) { settle(fmt.Errorf("%w: %s", ErrUnreachable, addr)) })
+	on("onclose", func(js.Value) {
+		settle(fmt.Errorf("%w: %s", ErrUnreachable, addr))
+		t.forget(addr, s)
+		s.close()
+	})
+	on("onmessage", func(event js.Value) {
+		var data []byte
+		if v := event.Get("data"); v.Type() == js.TypeString {
+			data = []byte(v.String())
+		} else {
+			array := js.Global().Get("Uint8Array").New(v)
+			data = make([]byte, array.Length())
+			js.CopyBytesToGo(data, array)
+		}
+		t.receive(addr, s, data)
+	})
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		s.close()
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		s.close()
+		return nil, s.err
+	}
+	return s, nil
+}
+
+func (s *jsSocket) close() {
+	s.done.Do(func() {
+		s.ws.Call("close")
+		for _, fn := range s.funcs {
+			fn.Release()
+		}
+	})
+}
+
+// forget drops s once the browser has closed it.
+func (t *jsTransport) forget(addr string, s *jsSocket) {
+	t.mu.Lock()
+	if t.conns[addr] == s {
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+}
+
+func (t *jsTransport) connection(ctx context.Context, addr string) (*jsSocket, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s, ok := t.conns[addr]
+	t.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	if m, err := toMultiaddr(addr); err != nil || m.ws == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, addr)
+	}
+	s, err := t.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if existing, ok := t.conns[addr]; ok || t.closed {
+		t.mu.Unlock()
+		s.close()
+		if !ok {
+			return nil, ErrClosed
+		}
+		return existing, nil
+	}
+	t.conns[addr] = s
+	t.mu.Unlock()
+	return s, nil
+}
+
+func (t *jsTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	s, err := t.connection(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	var ch chan *message
+	req.RPCID, ch = t.pending.add(addr)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.RPCID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(s, req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, replyError(resp)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *jsTransport) write(s *jsSocket, m *message) error {
+	buf, err := encodePacket(m)
+	if err != nil {
+		return err
+	}
+	defer releasePacket(buf)
+	s.ws.Call("send", buf.String())
+	t.mu.Lock()
+	t.sent += int64(buf.Len())
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *jsTransport) receive(addr string, s *jsSocket, data []byte) {
+	if len(data) > maxPacketSize {
+		return
+	}
+	t.mu.Lock()
+	t.received += int64(len(data))
+	t.mu.Unlock()
+	msgs, err := decodePacket(data)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Reply {
+			t.deliver(addr, msg)
+			continue
+		}
+		go t.handle(addr, s, msg)
+	}
+}
+
+func (t *jsTransport) deliver(from string, resp *message) {
+	t.mu.Lock()
+	t.pending.deliver(from, resp)
+	t.mu.Unlock()
+}
+
+func (t *jsTransport) handle(from string, s *jsSocket, req *message) {
+	t.mu.Lock()
+	handler := t.handler
+	t.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	resp := handler(from, req)
+	if resp == nil {
+		return
+	}
+	resp.RPCID = req.RPCID
+	resp.Reply = true
+	t.write(s, resp)
+}
+
+func (t *jsTransport) traffic() (sent, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent, t.received
+}
+
+func (t *jsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = make(map[string]*jsSocket)
+	t.mu.Unlock()
+	for _, s := range conns {
+		s.close()
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package dht
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket transport lets browsers, which cannot send UDP, talk to
+// the DHT. A node listens on it with a ws:// listen address and dials
+// ws:// and wss:// addresses. Every WebSocket message, text or binary,
+// carries one packet exactly as the UDP transport would send it: a JSON
+// message or an array of them, matched to replies by rpc_id. Either side
+// may send requests over a connection, whichever side opened it.
+// Connections we accepted are known by their remote address under the
+// wsc: prefix, which only reaches the peer while it stays connected. A
+// peer that lists a WebSocket listener of its own among its addresses is
+// taken into the routing table at that listener; others, such as
+// browsers, are answered but not taken in. Only the parts of RFC 6455
+// needed for this are implemented: no extensions or subprotocols, and
+// messages of at most maxPacketSize bytes.
+const (
+	wsGUID             = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsClientPrefix     = "wsc:"
+	wsHandshakeTimeout = 10 * time.Second
+	maxWSConns         = 1024
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var errBadFrame = errors.New("bad websocket frame")
+
+// wsConn is one WebSocket connection. client is set on the side that
+// dialed, whose frames must be masked.
+type wsConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	client bool
+	wmu    sync.Mutex
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | op
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	if c.client {
+		header[1] |= 0x80
+		var key [4]byte
+		rand.Read(key[:])
+		header = append(header, key[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ key[i%4]
+		}
+		payload = masked
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readMessage returns the next data message, joining fragments and
+// answering pings on the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var data []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return nil, err
+		}
+		fin, op, masked := head[0]&0x80 != 0, head[0]&0x0f, head[1]&0x80 != 0
+		size := uint64(head[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		if size > maxPacketSize || uint64(len(data))+size > maxPacketSize {
+			return nil, errBadFrame
+		}
+		var key [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.r, key[:]); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= key[i%4]
+			}
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if data != nil {
+				return nil, errBadFrame
+			}
+			data = payload
+		case wsContinuation:
+			if data == nil {
+				return nil, errBadFrame
+			}
+			data = append(data, payload...)
+		default:
+			return nil, errBadFrame
+		}
+		if fin {
+			return data, nil
+		}
+	}
+}
+
+// contactAddr returns the address to record for the sender c of a
+// request that arrived from from, or "" if it cannot be called back.
+func (n *Node) contactAddr(from string, c contact) string {
+	remote, ok := strings.CutPrefix(from, wsClientPrefix)
+	if !ok {
+		return from
+	}
+	host, _, _ := net.SplitHostPort(remote)
+	for _, s := range c.Addrs {
+		m, err := parseMultiaddr(s)
+		if err != nil || m.ws == "" || m.circuit {
+			continue
+		}
+		if ip := net.ParseIP(m.host); ip != nil && ip.IsUnspecified() {
+			// Listening on every interface: the one it connected from.
+			if m, err = toMultiaddr(m.ws + "://" + net.JoinHostPort(host, m.port)); err != nil {
+				continue
+			}
+		}
+		if n.canReach(m) {
+			return m.dialAddr()
+		}
+	}
+	return ""
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type wsTransport struct {
+	ln      net.Listener
+	server  *http.Server
+	mu      sync.Mutex
+	pending pendingCalls
+	conns   map[string]*wsConn // dialed by URL, accepted by wsc: address
+	handler func(from string, req *message) *message
+	closed  bool
+
+	sent, received int64
+}
+
+// listenWS listens for WebSocket connections on addr, a ws://host:port
+// URL.
+func listenWS(addr string) (*wsTransport, error) {
+	hostport, ok := strings.CutPrefix(addr, "ws://")
+	if !ok {
+		return nil, fmt.Errorf("%q is not a ws:// address", addr)
+	}
+	ln, err := net.Listen("tcp", strings.TrimSuffix(hostport, "/"))
+	if err != nil {
+		return nil, err
+	}
+	t := &wsTransport{ln: ln, pending: make(pendingCalls), conns: make(map[string]*wsConn)}
+	t.server = &http.Server{Handler: t, ReadHeaderTimeout: wsHandshakeTimeout}
+	go t.server.Serve(ln)
+	return t, nil
+}
+
+func (t *wsTransport) Addr() string {
+	return "ws://" + t.ln.Addr().String()
+}
+
+func (t *wsTransport) Addrs() []string {
+	return []string{t.Addr()}
+}
+
+func (t *wsTransport) Serve(handler func(from string, req *message) *message) {
+	t.mu.Lock()
+	t.handler = handler
+	t.mu.Unlock()
+}
+
+// ServeHTTP upgrades a request to a WebSocket connection.
+func (t *wsTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	addr := wsClientPrefix + conn.RemoteAddr().String()
+	c := &wsConn{conn: conn, r: rw.Reader}
+	t.mu.Lock()
+	if t.closed || len(t.conns) >= maxWSConns {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[addr] = c
+	t.mu.Unlock()
+	go t.readLoop(addr, c)
+}
+
+// dial opens a connection to a ws:// or wss:// URL.
+func (t *wsTransport) dial(ctx context.Context, addr string) (*wsConn, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, addr)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	ctx, cancel := context.WithTimeout(ctx, wsHandshakeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	path := u.RequestURI()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, u.Host, key)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s failed: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, r: r, client: true}, nil
+}
+
+// connection returns the open connection to addr, dialing it if it is a
+// URL.
+func (t *wsTransport) connection(ctx context.Context, addr string) (*wsConn, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c, ok := t.conns[addr]
+	t.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+	if strings.HasPrefix(addr, wsClientPrefix) {
+		return nil, ErrUnreachable
+	}
+	c, err := t.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if existing, ok := t.conns[addr]; ok || t.closed {
+		t.mu.Unlock()
+		c.conn.Close()
+		if !ok {
+			return nil, ErrClosed
+		}
+		return existing, nil
+	}
+	t.conns[addr] = c
+	t.mu.Unlock()
+	go t.readLoop(addr, c)
+	return c, nil
+}
+
+func (t *wsTransport) Call(ctx context.Context, addr string, req *message) (*message, error) {
+	c, err := t.connection(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	var ch chan *message
+	req.RPCID, ch = t.pending.add(addr)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.RPCID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(c, req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, replyError(resp)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *wsTransport) write(c *wsConn, m *message) error {
+	buf, err := encodePacket(m)
+	if err != nil {
+		return err
+	}
+	defer releasePacket(buf)
+	if err := c.writeFrame(wsText, buf.Bytes()); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.sent += int64(buf.Len())
+	t.mu.Unlock()
+	return nil
+}
+
+// readLoop reads messages from c until it fails, then forgets it.
+func (t *wsTransport) readLoop(addr string, c *wsConn) {
+	defer func() {
+		t.mu.Lock()
+		if t.conns[addr] == c {
+			delete(t.conns, addr)
+		}
+		t.mu.Unlock()
+		c.conn.Close()
+	}()
+	for {
+		data, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		t.received += int64(len(data))
+		t.mu.Unlock()
+		msgs, err := decodePacket(data)
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Reply {
+				t.deliver(addr, msg)
+				continue
+			}
+			go t.handle(addr, c, msg)
+		}
+	}
+}
+
+func (t *wsTransport) deliver(from string, resp *message) {
+	t.mu.Lock()
+	t.pending.deliver(from, resp)
+	t.mu.Unlock()
+}
+
+func (t *wsTransport) handle(from string, c *wsConn, req *message) {
+	t.mu.Lock()
+	handler := t.handler
+	t.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	resp := handler(from, req)
+	if resp == nil {
+		return
+	}
+	resp.RPCID = req.RPCID
+	resp.Reply = true
+	t.write(c, resp)
+}
+
+func (t *wsTransport) traffic() (sent, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent, t.received
+}
+
+func (t *wsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = make(map[string]*wsConn)
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+	return t.server.Close()
+}